@@ -0,0 +1,336 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samertm/githubstreaks/db"
+	"github.com/samertm/githubstreaks/debug"
+)
+
+// Achievement is a badge users earn for their commits.
+type Achievement struct {
+	Key         string
+	Name        string
+	Description string
+}
+
+// achievementRule decides when an achievement was earned.
+type achievementRule struct {
+	Achievement
+	// earned returns when the user earned the achievement, given
+	// their commits sorted oldest first, and false if they haven't
+	// earned it. Days are in loc.
+	earned func(commits []Commit, loc *time.Location) (time.Time, bool)
+}
+
+// streakRule is earned by the first commit on the nth day of the
+// user's first n day streak.
+func streakRule(n int) achievementRule {
+	return achievementRule{
+		Achievement: Achievement{
+			Key:         "streak:" + strconv.Itoa(n),
+			Name:        strconv.Itoa(n) + " day streak",
+			Description: "Commit " + strconv.Itoa(n) + " days in a row",
+		},
+		earned: func(commits []Commit, loc *time.Location) (time.Time, bool) {
+			// DayCommitGroups sorts its commits newest first,
+			// and the other rules need them oldest first.
+			dcgs := DayCommitGroups(append([]Commit(nil), commits...), loc)
+			streak := 0
+			for i := len(dcgs) - 1; i >= 0; i-- {
+				if i < len(dcgs)-1 && nextDay(dcgs[i+1].Day).Equal(dcgs[i].Day) {
+					streak++
+				} else {
+					streak = 1
+				}
+				if streak == n {
+					// The day's commits are newest first.
+					return dcgs[i].Commits[len(dcgs[i].Commits)-1].AuthorDate, true
+				}
+			}
+			return time.Time{}, false
+		},
+	}
+}
+
+// commitsRule is earned by the nth commit.
+func commitsRule(n int) achievementRule {
+	return achievementRule{
+		Achievement: Achievement{
+			Key:         "commits:" + strconv.Itoa(n),
+			Name:        strconv.Itoa(n) + " commits",
+			Description: "Make " + strconv.Itoa(n) + " commits",
+		},
+		earned: func(commits []Commit, loc *time.Location) (time.Time, bool) {
+			if len(commits) < n {
+				return time.Time{}, false
+			}
+			return commits[n-1].AuthorDate, true
+		},
+	}
+}
+
+// reposRule is earned by the first commit in the nth repo.
+func reposRule(n int) achievementRule {
+	return achievementRule{
+		Achievement: Achievement{
+			Key:         "repos:" + strconv.Itoa(n),
+			Name:        strconv.Itoa(n) + " repos",
+			Description: "Commit to " + strconv.Itoa(n) + " different repos",
+		},
+		earned: func(commits []Commit, loc *time.Location) (time.Time, bool) {
+			seen := make(map[string]bool)
+			for _, c := range commits {
+				seen[c.RepoID()] = true
+				if len(seen) == n {
+					return c.AuthorDate, true
+				}
+			}
+			return time.Time{}, false
+		},
+	}
+}
+
+// nightOwlRule is earned by a commit between midnight and 4am.
+var nightOwlRule = achievementRule{
+	Achievement: Achievement{
+		Key:         "night-owl",
+		Name:        "Night owl",
+		Description: "Commit between midnight and 4am",
+	},
+	earned: func(commits []Commit, loc *time.Location) (time.Time, bool) {
+		for _, c := range commits {
+			if c.AuthorDate.In(loc).Hour() < 4 {
+				return c.AuthorDate, true
+			}
+		}
+		return time.Time{}, false
+	},
+}
+
+// achievementRules are the achievements that can be earned, besides
+// the language achievements.
+var achievementRules = []achievementRule{
+	streakRule(7),
+	streakRule(30),
+	streakRule(100),
+	streakRule(365),
+	commitsRule(100),
+	commitsRule(1000),
+	reposRule(10),
+	nightOwlRule,
+}
+
+// languageAchievementPrefix starts the keys of the achievements for
+// a first commit in a language.
+const languageAchievementPrefix = "language:"
+
+// LanguageAchievement returns the achievement for a first commit in
+// language.
+func LanguageAchievement(language string) Achievement {
+	return Achievement{
+		Key:         languageAchievementPrefix + language,
+		Name:        "First " + language + " commit",
+		Description: "Commit " + language + " code for the first time",
+	}
+}
+
+// LookupAchievement returns the achievement with key.
+func LookupAchievement(key string) (Achievement, bool) {
+	if strings.HasPrefix(key, languageAchievementPrefix) {
+		return LanguageAchievement(strings.TrimPrefix(key, languageAchievementPrefix)), true
+	}
+	for _, r := range achievementRules {
+		if r.Key == key {
+			return r.Achievement, true
+		}
+	}
+	return Achievement{}, false
+}
+
+// EarnedAchievements returns when each achievement was earned, by
+// key, given a user's commits, the first time they committed in each
+// language and their timezone.
+func EarnedAchievements(commits []Commit, firstLanguages map[string]time.Time, loc *time.Location) map[string]time.Time {
+	asc := append([]Commit(nil), commits...)
+	sort.Sort(sort.Reverse(SortableCommits(asc)))
+	earned := make(map[string]time.Time)
+	for _, r := range achievementRules {
+		if t, ok := r.earned(asc, loc); ok {
+			earned[r.Key] = t
+		}
+	}
+	for l, t := range firstLanguages {
+		earned[LanguageAchievement(l).Key] = t
+	}
+	return earned
+}
+
+// UserAchievement is an achievement a user earned.
+type UserAchievement struct {
+	UID      int       `db:"uid"`
+	Key      string    `db:"key"`
+	EarnedOn time.Time `db:"earned_on"`
+	// Name and Description are from the achievement with Key.
+	Name        string `db:"-"`
+	Description string `db:"-"`
+}
+
+var userAchievementSchema = `
+CREATE TABLE IF NOT EXISTS user_achievement (
+  uid integer REFERENCES "user" (uid) NOT NULL,
+  key text NOT NULL,
+  earned_on timestamp NOT NULL,
+  PRIMARY KEY (uid, key)
+)`
+
+type sortableUserAchievements []UserAchievement
+
+func (s sortableUserAchievements) Len() int      { return len(s) }
+func (s sortableUserAchievements) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortableUserAchievements) Less(i, j int) bool {
+	if !s[i].EarnedOn.Equal(s[j].EarnedOn) {
+		return s[i].EarnedOn.After(s[j].EarnedOn)
+	}
+	return s[i].Key < s[j].Key
+}
+
+// describeAchievements fills in the names and descriptions of uas.
+func describeAchievements(uas []UserAchievement) {
+	for i := range uas {
+		if a, ok := LookupAchievement(uas[i].Key); ok {
+			uas[i].Name, uas[i].Description = a.Name, a.Description
+		} else {
+			uas[i].Name = uas[i].Key
+		}
+	}
+}
+
+// GetUserAchievements returns u's achievements, newest first.
+func GetUserAchievements(u User) ([]UserAchievement, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM user_achievement WHERE uid = ` + b.Bind(u.UID) + ` ORDER BY earned_on DESC, key ASC`
+	var uas []UserAchievement
+	if err := db.DB.Select(&uas, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	describeAchievements(uas)
+	return uas, nil
+}
+
+// firstLanguageCommits returns when u first committed in each
+// language.
+func firstLanguageCommits(u User) (map[string]time.Time, error) {
+	b := &db.Binder{}
+	query := `
+SELECT commit_file.language, min(commit.author_date) AS first_on
+FROM commit_file JOIN commit ON commit.sha = commit_file.commit_sha
+WHERE (` + userCommitCond(b, u) + `) AND commit_file.language <> ''
+GROUP BY commit_file.language`
+	var rows []struct {
+		Language string    `db:"language"`
+		FirstOn  time.Time `db:"first_on"`
+	}
+	if err := db.DB.Select(&rows, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	ls := make(map[string]time.Time)
+	for _, r := range rows {
+		ls[r.Language] = r.FirstOn
+	}
+	return ls, nil
+}
+
+// userLocation returns u's timezone. Users who haven't set one get
+// the timezone of their first group, or UTC.
+func userLocation(u User) (*time.Location, error) {
+	if u.Timezone != "" {
+		loc, err := time.LoadLocation(u.Timezone)
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		return loc, nil
+	}
+	gs, err := GetGroups(u)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if len(gs) == 0 {
+		return time.UTC, nil
+	}
+	return GetGroupLocation(gs[0])
+}
+
+// achievementNotifyWindow is how recently an achievement must have
+// been earned for its groups to be notified. Achievements for old
+// commits, e.g. from a backfill, are saved quietly.
+const achievementNotifyWindow = 48 * time.Hour
+
+// EvaluateAchievements saves the achievements u has earned, and
+// notifies u's groups about the new ones earned recently as of now.
+// It returns the new achievements. Achievements are never taken
+// away.
+func EvaluateAchievements(u User, now time.Time) ([]UserAchievement, error) {
+	cs, err := GetUserCommits(u, time.Time{})
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	ls, err := firstLanguageCommits(u)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	loc, err := userLocation(u)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	earned := EarnedAchievements(cs, ls, loc)
+	if len(earned) == 0 {
+		return nil, nil
+	}
+	b := &db.Binder{}
+	var values []string
+	for key, t := range earned {
+		values = append(values, `(`+b.Bind(u.UID, key, t.UTC())+`)`)
+	}
+	query := `INSERT INTO user_achievement(uid, key, earned_on) VALUES ` + strings.Join(values, ", ") + `
+ON CONFLICT DO NOTHING RETURNING *`
+	var uas []UserAchievement
+	if err := db.DB.Select(&uas, query, b.Items...); err != nil {
+		return nil, wrapErrorf(err, "error saving achievements for user %d", u.UID)
+	}
+	describeAchievements(uas)
+	sort.Sort(sortableUserAchievements(uas))
+	var recent []UserAchievement
+	for _, ua := range uas {
+		if now.Sub(ua.EarnedOn) <= achievementNotifyWindow {
+			recent = append(recent, ua)
+		}
+	}
+	if len(recent) == 0 {
+		return uas, nil
+	}
+	gs, err := GetGroups(u)
+	if err != nil {
+		return uas, wrapError(err)
+	}
+	for _, g := range gs {
+		for i := range recent {
+			e := GroupEvent{Kind: EventAchievementEarned, Group: g, User: u, Achievement: &recent[i]}
+			if err := PublishGroupEvent(e); err != nil {
+				return uas, wrapError(err)
+			}
+		}
+	}
+	return uas, nil
+}
+
+// evaluateAchievements is EvaluateAchievements for after commits are
+// ingested, where failing to evaluate shouldn't fail the ingest.
+func evaluateAchievements(u User) {
+	if _, err := EvaluateAchievements(u, time.Now()); err != nil {
+		debug.Println(err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEarnedAchievements(t *testing.T) {
+	at := func(d, h int) time.Time { return time.Date(2015, 8, d, h, 0, 0, 0, time.UTC) }
+	var cs []Commit
+	// Seven days in a row in 10 repos, the last at 2am.
+	for d := 1; d <= 7; d++ {
+		cs = append(cs, Commit{RepoName: "samertm/repo" + strconv.Itoa(d), AuthorDate: at(d, 12)})
+	}
+	cs = append(cs,
+		Commit{RepoName: "samertm/repo8", AuthorDate: at(7, 13)},
+		Commit{RepoName: "samertm/repo9", AuthorDate: at(7, 14)},
+		Commit{RepoName: "samertm/repo1", Provider: "gitlab", AuthorDate: at(8, 2)},
+	)
+	got := EarnedAchievements(cs, map[string]time.Time{"Go": at(3, 12)}, time.UTC)
+	want := map[string]time.Time{
+		"streak:7":    at(7, 12),
+		"repos:10":    at(8, 2),
+		"night-owl":   at(8, 2),
+		"language:Go": at(3, 12),
+	}
+	if len(got) != len(want) {
+		t.Errorf("Got achievements %v, want %v", got, want)
+	}
+	for k, w := range want {
+		if g, ok := got[k]; !ok || !g.Equal(w) {
+			t.Errorf("Got %s earned at %s, want %s", k, g, w)
+		}
+	}
+	// Night owl is judged in the user's timezone.
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := EarnedAchievements(cs, nil, la)["night-owl"]; ok {
+		t.Error("Got night owl for a 7pm commit")
+	}
+}
+
+func TestLookupAchievement(t *testing.T) {
+	for key, name := range map[string]string{
+		"streak:30":   "30 day streak",
+		"commits:100": "100 commits",
+		"language:Go": "First Go commit",
+	} {
+		if a, ok := LookupAchievement(key); !ok || a.Name != name {
+			t.Errorf("LookupAchievement(%q) = %+v, %t, want %q", key, a, ok, name)
+		}
+	}
+	if _, ok := LookupAchievement("streak:3"); ok {
+		t.Error("Got an achievement for an unknown key")
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/flosch/pongo2"
+	"github.com/zenazn/goji/web"
+)
+
+var adminTemplate = pongo2.Must(pongo2.FromFile("templates/admin.html"))
+
+type adminTemplateVars struct {
+	RateLimits []RateLimit
+}
+
+func serveAdmin(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if err := a.Admin(r); err != nil {
+		return err
+	}
+	return RenderTemplate(adminTemplate, w, adminTemplateVars{
+		RateLimits: GitHubRateLimits(),
+	})
+}
@@ -4,7 +4,9 @@ import (
 	"net/http"
 	"net/url"
 
+	"github.com/go-errors/errors"
 	"github.com/gorilla/sessions"
+	"github.com/samertm/githubstreaks/conf"
 	"github.com/zenazn/goji/web"
 )
 
@@ -44,3 +46,21 @@ func (a App) Authed(r *http.Request) *HTTPRedirect {
 	}
 	return nil
 }
+
+// Admin returns nil if the user is an admin, otherwise it returns an
+// error that redirects them to log in or forbids the request. Admins
+// are listed by login in the Admins config and must log in with the
+// default GitHub host.
+func (a App) Admin(r *http.Request) error {
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	if a.User.Provider == GitHubProvider {
+		for _, login := range conf.Config.Admins {
+			if login == a.User.Login {
+				return nil
+			}
+		}
+	}
+	return &HTTPError{Err: errors.New("you are not an admin"), Code: http.StatusForbidden}
+}
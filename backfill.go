@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/conf"
+	"github.com/zenazn/goji/web"
+)
+
+// BackfillJob is the kind of job that backfills a user's commits
+// from before the window covered by ListRecentPushes.
+const BackfillJob = "backfill"
+
+func init() {
+	jobHandlers[BackfillJob] = runBackfillJob
+}
+
+// BackfillArgs are the arguments for a backfill job. Only the
+// account for Provider and Login is backfilled.
+type BackfillArgs struct {
+	Provider string
+	Login    string
+	Since    time.Time
+	Until    time.Time
+}
+
+// BackfillCursor is where a backfill left off.
+type BackfillCursor struct {
+	// Repos is the list of repos to walk. It is saved so that a
+	// resumed backfill walks the same repos in the same order.
+	// It is nil until the repos have been listed.
+	Repos []string
+	// Next is the index in Repos of the next repo to walk.
+	Next int
+	// Saved is the number of new commits saved so far.
+	Saved int
+}
+
+// Progress describes how far along the backfill is.
+func (c BackfillCursor) Progress() string {
+	if c.Repos == nil {
+		return "Listing repos"
+	}
+	return fmt.Sprintf("Walked %d of %d repos, found %d new commits", c.Next, len(c.Repos), c.Saved)
+}
+
+// Backfill walks an account's repos on a HistorySource and saves the
+// commits that the account authored in a date range.
+type Backfill struct {
+	Source  HistorySource
+	Account Account
+	Since   time.Time
+	Until   time.Time
+	// Exists reports whether a commit has already been saved. If
+	// it is nil, CommitExists is used.
+	Exists func(sha string) (bool, error)
+	// Save saves a new commit. If it is nil, CreateCommit is used.
+	Save func(a Account, c SourceCommit) error
+}
+
+// Run walks the repos starting from cur, calling checkpoint after the
+// repos are listed and after every repo is walked. If checkpoint
+// returns an error, Run stops and returns it.
+func (b *Backfill) Run(cur BackfillCursor, checkpoint func(BackfillCursor) error) error {
+	exists, save := b.Exists, b.Save
+	if exists == nil {
+		exists = CommitExists
+	}
+	if save == nil {
+		save = CreateCommit
+	}
+	if cur.Repos == nil {
+		repos, err := b.Source.ListRepos(b.Account.Login)
+		if err != nil {
+			return wrapError(err)
+		}
+		cur.Repos = append([]string{}, repos...)
+		if err := checkpoint(cur); err != nil {
+			return err
+		}
+	}
+	for ; cur.Next < len(cur.Repos); cur.Next++ {
+		repo := cur.Repos[cur.Next]
+		shas, err := b.Source.ListAuthoredCommits(repo, b.Account.Login, b.Since, b.Until)
+		if err != nil {
+			return wrapError(err)
+		}
+		for _, sha := range shas {
+			ok, err := exists(sha)
+			if err != nil {
+				return wrapError(err)
+			}
+			if ok {
+				continue
+			}
+			c, err := b.Source.GetCommit(repo, sha)
+			if err != nil {
+				return wrapError(err)
+			}
+			if err := save(b.Account, c); err != nil {
+				return wrapError(err)
+			}
+			cur.Saved++
+		}
+		next := cur
+		next.Next++
+		if err := checkpoint(next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runBackfillJob(j *Job) error {
+	var args BackfillArgs
+	if err := j.DecodeArgs(&args); err != nil {
+		return err
+	}
+	a := Account{UID: j.UID, Provider: args.Provider, Login: args.Login}
+	src, err := AccountSource(a)
+	if err != nil {
+		return wrapError(err)
+	}
+	hs, ok := src.(HistorySource)
+	if !ok {
+		return errors.Errorf("provider %q does not support backfilling", a.Provider)
+	}
+	if gs, ok := hs.(*GitHubSource); ok {
+		gs.Reserve = conf.Config.GitHubRateLimitReserve
+	}
+	var cur BackfillCursor
+	if j.Cursor != "" {
+		if err := json.Unmarshal([]byte(j.Cursor), &cur); err != nil {
+			return wrapErrorf(err, "error decoding cursor for job %d", j.JID)
+		}
+	}
+	b := &Backfill{Source: hs, Account: a, Since: args.Since, Until: args.Until}
+	err = b.Run(cur, func(cur BackfillCursor) error {
+		bs, err := json.Marshal(cur)
+		if err != nil {
+			return wrapError(err)
+		}
+		return j.Checkpoint(string(bs), cur.Progress())
+	})
+	if err != nil {
+		return err
+	}
+	u, err := GetUser(UserSpec{UID: j.UID})
+	if err != nil {
+		return wrapError(err)
+	}
+	evaluateAchievements(u)
+	return nil
+}
+
+// EnqueueBackfill queues backfill jobs for u's commits between since
+// and until, one for each of u's accounts that supports backfilling.
+// Nothing is queued if u already has a backfill in progress.
+func EnqueueBackfill(u User, since, until time.Time) error {
+	active, err := HasActiveJob(u, BackfillJob)
+	if err != nil {
+		return wrapError(err)
+	}
+	if active {
+		return nil
+	}
+	as, err := GetUserAccounts(u)
+	if err != nil {
+		return wrapError(err)
+	}
+	for _, a := range as {
+		src, err := AccountSource(a)
+		if err != nil {
+			// Skip accounts on providers that are no longer
+			// configured.
+			continue
+		}
+		if _, ok := src.(HistorySource); !ok {
+			continue
+		}
+		args := BackfillArgs{Provider: a.Provider, Login: a.Login, Since: since, Until: until}
+		if _, err := EnqueueJob(u, BackfillJob, args); err != nil {
+			return wrapError(err)
+		}
+	}
+	return nil
+}
+
+type backfillForm struct {
+	// Since is a date in the form "2006-01-02".
+	Since string `schema:"since"`
+}
+
+func serveBackfill(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form backfillForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	since, err := time.Parse("2006-01-02", form.Since)
+	if err != nil {
+		return &HTTPError{Err: wrapError(err), Code: http.StatusBadRequest}
+	}
+	if err := EnqueueBackfill(*a.User, since, time.Now()); err != nil {
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: "/", Code: http.StatusSeeOther}
+}
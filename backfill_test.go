@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/samertm/githubstreaks/conf"
+)
+
+func TestBackfill(t *testing.T) {
+	sha := func(i int) string { return fmt.Sprintf("%040d", i) }
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.RequestURI() {
+		case "/users/someone/repos?per_page=100&type=all":
+			w.Header().Set("Link", `<`+srv.URL+`/users/someone/repos?page=2&per_page=100&type=all>; rel="next"`)
+			fmt.Fprint(w, `[{"full_name": "someone/a"}]`)
+		case "/users/someone/repos?page=2&per_page=100&type=all":
+			fmt.Fprint(w, `[{"full_name": "org/b"}]`)
+		case "/repos/someone/a/commits?author=someone&per_page=100&since=2015-01-01T00%3A00%3A00Z&until=2015-06-01T00%3A00%3A00Z":
+			fmt.Fprintf(w, `[{"sha": "%s"}, {"sha": "%s"}]`, sha(1), sha(2))
+		case "/repos/org/b/commits?author=someone&per_page=100&since=2015-01-01T00%3A00%3A00Z&until=2015-06-01T00%3A00%3A00Z":
+			fmt.Fprintf(w, `[{"sha": "%s"}]`, sha(3))
+		case "/repos/someone/a/commits/" + sha(2), "/repos/org/b/commits/" + sha(3):
+			fmt.Fprintf(w, `{"sha": "%s", "author": {"login": "someone"},
+"commit": {"message": "Old work", "author": {"date": "2015-02-01T12:00:00Z"}}}`, r.URL.Path[len(r.URL.Path)-40:])
+		default:
+			t.Errorf("Unexpected request %s", r.URL.RequestURI())
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	host, err := newGitHubHost("ghe", conf.GitHubHost{WebURL: srv.URL, APIURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha(1) was already fetched from the user's recent pushes.
+	saved := map[string]bool{sha(1): true}
+	b := &Backfill{
+		Source:  &GitHubSource{Host: host},
+		Account: Account{UID: 1, Provider: "ghe", Login: "someone"},
+		Since:   time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:   time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC),
+		Exists:  func(sha string) (bool, error) { return saved[sha], nil },
+		Save: func(a Account, c SourceCommit) error {
+			if saved[c.SHA] {
+				t.Errorf("Saved %s twice", c.SHA)
+			}
+			saved[c.SHA] = true
+			return nil
+		},
+	}
+	// Interrupt the backfill after the first repo.
+	interrupted := errors.New("interrupted")
+	var last BackfillCursor
+	err = b.Run(BackfillCursor{}, func(cur BackfillCursor) error {
+		last = cur
+		if cur.Next == 1 {
+			return interrupted
+		}
+		return nil
+	})
+	if err != interrupted {
+		t.Fatalf("Run returned %v, wanted it to be interrupted", err)
+	}
+	if want := "Walked 1 of 2 repos, found 1 new commits"; last.Progress() != want {
+		t.Errorf("Got progress %q, wanted %q", last.Progress(), want)
+	}
+	// Resume from the last checkpoint.
+	if err := b.Run(last, func(cur BackfillCursor) error {
+		last = cur
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if last.Next != 2 || last.Saved != 2 {
+		t.Errorf("Got cursor %+v, wanted to walk 2 repos and save 2 commits", last)
+	}
+	if len(saved) != 3 {
+		t.Errorf("Got %d commits, wanted 3", len(saved))
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jmoiron/sqlx"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/samertm/githubstreaks/debug"
+	"github.com/zenazn/goji/web"
+)
+
+// Chat hook formats.
+const (
+	ChatSlack      = "slack"
+	ChatDiscord    = "discord"
+	ChatMattermost = "mattermost"
+)
+
+// ValidChatFormat returns true if f is a chat hook format.
+func ValidChatFormat(f string) bool {
+	return f == ChatSlack || f == ChatDiscord || f == ChatMattermost
+}
+
+// ChatHook is an incoming webhook in a Slack, Discord or Mattermost
+// channel that gets a group's events.
+type ChatHook struct {
+	HID       int       `db:"hid"`
+	GID       int       `db:"gid"`
+	URL       string    `db:"url"`
+	Format    string    `db:"format"`
+	CreatedOn time.Time `db:"created_on"`
+}
+
+// Host returns the host of h's URL. The rest of the URL is a secret.
+func (h ChatHook) Host() string {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+var chatHookSchema = `
+CREATE TABLE IF NOT EXISTS chat_hook (
+  hid serial PRIMARY KEY,
+  gid integer NOT NULL REFERENCES "group" (gid),
+  url text NOT NULL,
+  format text NOT NULL,
+  created_on timestamp NOT NULL
+)`
+
+// groupDailySchema records the days that groups' daily events were
+// sent for, so that they are only sent once.
+var groupDailySchema = `
+CREATE TABLE IF NOT EXISTS group_daily (
+  gid integer NOT NULL REFERENCES "group" (gid),
+  day date NOT NULL,
+  PRIMARY KEY (gid, day)
+)`
+
+// chatHookKind is the Delivery.HookKind for chat hooks.
+const chatHookKind = "chat"
+
+// GetChatHooks returns g's chat hooks, oldest first.
+func GetChatHooks(g Group) ([]ChatHook, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM chat_hook WHERE gid = ` + b.Bind(g.GID) + ` ORDER BY hid ASC`
+	var hs []ChatHook
+	if err := db.DB.Select(&hs, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	return hs, nil
+}
+
+// AddChatHook adds a chat hook with url and format to g.
+func AddChatHook(g Group, url, format string) error {
+	if !ValidChatFormat(format) {
+		return errors.Errorf("unknown chat format %q", format)
+	}
+	if err := ValidWebhookURL(url); err != nil {
+		return err
+	}
+	b := &db.Binder{}
+	query := `INSERT INTO chat_hook(gid, url, format, created_on) VALUES (` +
+		b.Bind(g.GID, url, format) + `, current_timestamp)`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error adding chat hook to group %d", g.GID)
+	}
+	return nil
+}
+
+// DeleteChatHook deletes g's chat hook with hid, along with the
+// deliveries to it that haven't been sent.
+func DeleteChatHook(g Group, hid int) error {
+	b := &db.Binder{}
+	query := `
+WITH h AS (
+  DELETE FROM chat_hook WHERE hid = ` + b.Bind(hid) + ` AND gid = ` + b.Bind(g.GID) + ` RETURNING hid
+)
+DELETE FROM delivery WHERE hook_kind = ` + b.Bind(chatHookKind) + ` AND state = ` + b.Bind(DeliveryPending) + `
+  AND hook_id IN (SELECT hid FROM h)`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error deleting chat hook %d", hid)
+	}
+	return nil
+}
+
+// Group event kinds.
+const (
+	EventMemberJoined    = "member.joined"
+	EventStreakMilestone = "streak.milestone"
+	EventStreakBroken    = "streak.broken"
+	EventDailySummary    = "summary.daily"
+	// EventAchievementEarned is also sent to webhooks.
+	EventAchievementEarned = "achievement.earned"
+)
+
+// GroupEvent is something that happened in a group, for posting to
+// its chat hooks.
+type GroupEvent struct {
+	Kind  string
+	Group Group
+	// User is who the event is about. It isn't set for daily
+	// summaries.
+	User User
+	// Streak is the length of User's streak: the milestone it
+	// reached, or how long it was before it broke.
+	Streak int
+	// Day is the day the event is for, except for
+	// member.joined.
+	Day time.Time
+	// Summary has a line per user for daily summaries. Commits
+	// are the commits on Day.
+	Summary []DigestEntry
+	// Commit is the commit for commit.ingested.
+	Commit *Commit
+	// Achievement is the achievement for achievement.earned.
+	Achievement *UserAchievement
+}
+
+// Title is a one-line description of e.
+func (e GroupEvent) Title() string {
+	switch e.Kind {
+	case EventMemberJoined:
+		return fmt.Sprintf("%s joined group %d", e.User.Login, e.Group.GID)
+	case EventStreakMilestone:
+		return fmt.Sprintf("%s is on a %d day streak!", e.User.Login, e.Streak)
+	case EventStreakBroken:
+		return fmt.Sprintf("%s's %d day streak ended", e.User.Login, e.Streak)
+	case EventDailySummary:
+		return fmt.Sprintf("Group %d on %s", e.Group.GID, e.Day.Format("Monday, January 2"))
+	case EventAchievementEarned:
+		return fmt.Sprintf("%s earned %s: %s", e.User.Login, e.Achievement.Name, e.Achievement.Description)
+	}
+	return e.Kind
+}
+
+// Lines are the rest of e's description, if any.
+func (e GroupEvent) Lines() []string {
+	if e.Kind != EventDailySummary {
+		return nil
+	}
+	var ls []string
+	for _, de := range e.Summary {
+		ls = append(ls, fmt.Sprintf("%s: %d commit%s, %d day streak",
+			de.User.Login, de.Commits, plural(de.Commits), de.Streaks.Current))
+	}
+	return ls
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+// slackEscaper escapes the characters that Slack treats as markup.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// discordGreen is the color of the bar next to Discord embeds.
+const discordGreen = 0x2ea44f
+
+// ChatPayload returns the JSON value to post to a format chat hook
+// for e.
+func ChatPayload(format string, e GroupEvent) interface{} {
+	link := AbsoluteURL(GroupURL(e.Group))
+	switch format {
+	case ChatSlack:
+		text := "*" + slackEscaper.Replace(e.Title()) + "*"
+		for _, l := range e.Lines() {
+			text += "\n" + slackEscaper.Replace(l)
+		}
+		text += "\n<" + link + "|View the group>"
+		return map[string]interface{}{
+			// text is the fallback for notifications.
+			"text": e.Title(),
+			"blocks": []interface{}{
+				map[string]interface{}{
+					"type": "section",
+					"text": map[string]string{"type": "mrkdwn", "text": text},
+				},
+			},
+		}
+	case ChatDiscord:
+		return map[string]interface{}{
+			"embeds": []interface{}{
+				map[string]interface{}{
+					"title":       e.Title(),
+					"description": strings.Join(e.Lines(), "\n"),
+					"url":         link,
+					"color":       discordGreen,
+				},
+			},
+		}
+	}
+	// Mattermost takes Markdown.
+	text := "**" + e.Title() + "**"
+	for _, l := range e.Lines() {
+		text += "\n" + l
+	}
+	text += "\n[View the group](" + link + ")"
+	return map[string]string{"text": text}
+}
+
+// chatEvents are the event kinds posted to chat hooks.
+var chatEvents = map[string]bool{
+	EventMemberJoined:      true,
+	EventStreakMilestone:   true,
+	EventStreakBroken:      true,
+	EventDailySummary:      true,
+	EventAchievementEarned: true,
+}
+
+// NotifyGroup queues e for all of its group's chat hooks with ex.
+func NotifyGroup(ex sqlx.Execer, e GroupEvent) error {
+	if !chatEvents[e.Kind] {
+		return nil
+	}
+	hs, err := GetChatHooks(e.Group)
+	if err != nil {
+		return wrapError(err)
+	}
+	for _, h := range hs {
+		if err := EnqueueDelivery(ex, chatHookKind, h.HID, h.URL, ChatPayload(h.Format, e)); err != nil {
+			return wrapError(err)
+		}
+	}
+	return nil
+}
+
+// streakMilestones are the streak lengths that are announced.
+var streakMilestones = []int{7, 14, 30, 50, 100, 200, 365, 500, 1000}
+
+// brokenStreakMin is the shortest streak whose end is announced.
+const brokenStreakMin = 3
+
+func isStreakMilestone(n int) bool {
+	for _, m := range streakMilestones {
+		if n == m {
+			return true
+		}
+	}
+	return false
+}
+
+// DailyEvents returns the events for g on day, given the commits of
+// each of g's users.
+func DailyEvents(g Group, us []User, commits map[int][]Commit, loc *time.Location, day time.Time) []GroupEvent {
+	var es []GroupEvent
+	summary := GroupEvent{Kind: EventDailySummary, Group: g, Day: day}
+	for _, u := range us {
+		cs := commits[u.UID]
+		streak := StreakOn(cs, loc, day)
+		if streak > 0 {
+			es = append(es, GroupEvent{Kind: EventStreakExtended, Group: g, User: u, Streak: streak, Day: day})
+		}
+		if isStreakMilestone(streak) {
+			es = append(es, GroupEvent{Kind: EventStreakMilestone, Group: g, User: u, Streak: streak, Day: day})
+		}
+		if prev := StreakOn(cs, loc, day.AddDate(0, 0, -1)); streak == 0 && prev >= brokenStreakMin {
+			es = append(es, GroupEvent{Kind: EventStreakBroken, Group: g, User: u, Streak: prev, Day: day})
+		}
+		de := DigestEntry{User: u, Streaks: Streaks{Current: streak}}
+		for _, c := range cs {
+			if BeginningOfDay(c.AuthorDate.In(loc)).Equal(day) {
+				de.Commits++
+			}
+		}
+		summary.Summary = append(summary.Summary, de)
+	}
+	sort.Sort(sortableDigestEntries(summary.Summary))
+	return append(es, summary)
+}
+
+// groupDailySent returns true if the daily events for g on day have
+// been sent.
+func groupDailySent(g Group, day time.Time) (bool, error) {
+	b := &db.Binder{}
+	query := `SELECT count(*) FROM group_daily WHERE gid = ` + b.Bind(g.GID) +
+		` AND day = ` + b.Bind(day.Format("2006-01-02"))
+	var n int
+	if err := db.DB.Get(&n, query, b.Items...); err != nil {
+		return false, wrapError(err)
+	}
+	return n > 0, nil
+}
+
+// claimGroupDaily returns true if the daily events for g on day
+// haven't been sent yet, and records in tx that they have been. Other
+// claims for the day wait until tx is done.
+func claimGroupDaily(tx *sqlx.Tx, g Group, day time.Time) (bool, error) {
+	b := &db.Binder{}
+	query := `INSERT INTO group_daily(gid, day) VALUES (` + b.Bind(g.GID, day.Format("2006-01-02")) +
+		`) ON CONFLICT DO NOTHING`
+	res, err := tx.Exec(query, b.Items...)
+	if err != nil {
+		return false, wrapError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, wrapError(err)
+	}
+	return n > 0, nil
+}
+
+// NotifyDaily queues the daily events for yesterday, in each group's
+// timezone, for the groups with chat hooks or webhooks.
+func NotifyDaily(now time.Time) error {
+	query := `SELECT gid FROM chat_hook UNION SELECT gid FROM group_webhook WHERE enabled ORDER BY gid ASC`
+	var gids []int
+	if err := db.DB.Select(&gids, query); err != nil {
+		return wrapError(err)
+	}
+	for _, gid := range gids {
+		if err := notifyGroupDaily(gid, now); err != nil {
+			debug.Printf("Error sending daily events for group %d: %s", gid, err)
+		}
+	}
+	return nil
+}
+
+func notifyGroupDaily(gid int, now time.Time) error {
+	g, err := GetGroup(gid)
+	if err != nil {
+		return wrapError(err)
+	}
+	loc, err := GetGroupLocation(g)
+	if err != nil {
+		return wrapError(err)
+	}
+	day := BeginningOfDay(now.In(loc)).AddDate(0, 0, -1)
+	if sent, err := groupDailySent(g, day); err != nil || sent {
+		return err
+	}
+	us, err := GetGroupUsers(g)
+	if err != nil {
+		return wrapError(err)
+	}
+	commits := make(map[int][]Commit)
+	for _, u := range us {
+		// Make sure we've seen the day's last commits. Rate limits
+		// leave the day unsent, and it is tried again later.
+		if err := UpdateUserCommits(u); err != nil {
+			if _, ok := RateLimitedUntil(err); ok {
+				return wrapError(err)
+			}
+			debug.Printf("Error updating commits for user %d: %s", u.UID, err)
+		}
+		if commits[u.UID], err = GetUserCommits(u, time.Time{}); err != nil {
+			return wrapError(err)
+		}
+	}
+	// The day is claimed in the same transaction that queues its
+	// events, so that it stays unsent if queueing fails.
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return wrapError(err)
+	}
+	ok, err := claimGroupDaily(tx, g, day)
+	if err != nil || !ok {
+		tx.Rollback()
+		return err
+	}
+	for _, e := range DailyEvents(g, us, commits, loc, day) {
+		if err := publishGroupEvent(tx, e); err != nil {
+			tx.Rollback()
+			return wrapError(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// RunDailyNotifications queues groups' daily events, checking every
+// interval for groups whose day has ended. It never returns.
+func RunDailyNotifications(interval time.Duration) {
+	for {
+		if err := NotifyDaily(time.Now()); err != nil {
+			debug.Println(err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// memberGroup returns the group in c's group_id, checking that u is
+// in it.
+func memberGroup(u User, c web.C) (Group, error) {
+	gid, err := getParamInt(c, "group_id")
+	if err != nil {
+		return Group{}, wrapError(err)
+	}
+	g, err := GetGroup(gid)
+	if err != nil {
+		return Group{}, wrapError(err)
+	}
+	ok, err := UserInGroup(u, g)
+	if err != nil {
+		return Group{}, wrapError(err)
+	}
+	if !ok {
+		return Group{}, &HTTPError{Err: errors.Errorf("you aren't in group %d", g.GID), Code: http.StatusForbidden}
+	}
+	return g, nil
+}
+
+type chatHookForm struct {
+	URL    string `schema:"url"`
+	Format string `schema:"format"`
+}
+
+func serveAddChatHook(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	g, err := memberGroup(*a.User, c)
+	if err != nil {
+		return err
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form chatHookForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	if err := AddChatHook(g, strings.TrimSpace(form.URL), form.Format); err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	return &HTTPRedirect{To: GroupURL(g) + "#chat-hooks", Code: http.StatusSeeOther}
+}
+
+type deleteChatHookForm struct {
+	HID int `schema:"hid"`
+}
+
+func serveDeleteChatHook(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	g, err := memberGroup(*a.User, c)
+	if err != nil {
+		return err
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form deleteChatHookForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	if err := DeleteChatHook(g, form.HID); err != nil {
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: GroupURL(g) + "#chat-hooks", Code: http.StatusSeeOther}
+}
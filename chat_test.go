@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatPayload(t *testing.T) {
+	e := GroupEvent{Kind: EventStreakMilestone, Group: Group{GID: 3}, User: User{Login: "samertm"}, Streak: 30}
+	for _, tt := range []struct {
+		format string
+		want   []string
+	}{
+		{ChatSlack, []string{`"text":"samertm is on a 30 day streak!"`, `"type":"mrkdwn"`, `*samertm is on a 30 day streak!*`, `|View the group`}},
+		{ChatDiscord, []string{`"embeds":[`, `"title":"samertm is on a 30 day streak!"`, `"color":3056719`, `/group/3"`}},
+		{ChatMattermost, []string{`"text":"**samertm is on a 30 day streak!**`, `[View the group](`}},
+	} {
+		bs, err := json.Marshal(ChatPayload(tt.format, e))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(string(bs), w) {
+				t.Errorf("%s payload %s doesn't contain %s", tt.format, bs, w)
+			}
+		}
+	}
+}
+
+func TestDailyEvents(t *testing.T) {
+	day := func(d int) Commit {
+		return Commit{AuthorDate: time.Date(2015, 8, d, 12, 0, 0, 0, time.UTC)}
+	}
+	var week []Commit
+	for d := 14; d <= 20; d++ {
+		week = append(week, day(d))
+	}
+	us := []User{{UID: 1, Login: "samertm"}, {UID: 2, Login: "broken"}, {UID: 3, Login: "idle"}}
+	commits := map[int][]Commit{
+		1: week,
+		2: []Commit{day(17), day(18), day(19)},
+	}
+	es := DailyEvents(Group{GID: 3}, us, commits, time.UTC, time.Date(2015, 8, 20, 0, 0, 0, 0, time.UTC))
+	var chat []string
+	for _, e := range es {
+		if chatEvents[e.Kind] {
+			chat = append(chat, e.Title())
+		}
+	}
+	want := []string{
+		"samertm is on a 7 day streak!",
+		"broken's 3 day streak ended",
+		"Group 3 on Thursday, August 20",
+	}
+	if strings.Join(chat, "|") != strings.Join(want, "|") {
+		t.Fatalf("Got chat events %q, want %q", chat, want)
+	}
+	lines := es[len(es)-1].Lines()
+	if len(lines) != 3 || lines[0] != "samertm: 1 commit, 7 day streak" || lines[2] != "idle: 0 commits, 0 day streak" {
+		t.Errorf("Got summary %q", lines)
+	}
+}
+
+func TestPostDelivery(t *testing.T) {
+	defer allowLoopbackWebhooks()()
+	bodies := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Got Content-Type %q", ct)
+		}
+		bs, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		bodies <- string(bs)
+	}))
+	defer ts.Close()
+
+	e := GroupEvent{Kind: EventMemberJoined, Group: Group{GID: 3}, User: User{Login: "samertm"}}
+	bs, err := json.Marshal(ChatPayload(ChatMattermost, e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := postDelivery(Delivery{URL: ts.URL, Body: string(bs)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-bodies; got != string(bs) {
+		t.Errorf("Got body %s, want %s", got, bs)
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/samertm/githubstreaks/debug"
+)
+
+// Exit codes of the githubstreaks binary.
+const (
+	exitOK = 0
+	// exitError means the command failed.
+	exitError = 1
+	// exitUsage means the command was called with bad arguments,
+	// and nothing was done.
+	exitUsage = 2
+)
+
+// command is a subcommand of the githubstreaks binary. Every command
+// shares the configuration and database connection set up by the
+// conf and db packages.
+type command struct {
+	// Usage is the command's arguments, as shown after its name.
+	Usage string
+	// Summary describes the command in one line.
+	Summary string
+	Run     func(args []string) error
+}
+
+// commands holds the subcommands, keyed by name. It is filled in by
+// init to avoid an initialization loop through the help output.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve": {
+			Summary: "Run the web server. This is the default command.",
+			Run:     serveCommand,
+		},
+		"migrate": {
+			Summary: "Create and migrate the database tables, then exit.",
+			Run:     migrateCommand,
+		},
+		"refresh-user": {
+			Usage:   "[host:]<login>",
+			Summary: "Fetch a user's recent commits.",
+			Run:     refreshUserCommand,
+		},
+		"refresh-group": {
+			Usage:   "<gid>",
+			Summary: "Fetch the recent commits of every user in a group.",
+			Run:     refreshGroupCommand,
+		},
+		"backfill": {
+			Usage:   "-since <YYYY-MM-DD> [-until <YYYY-MM-DD>] [host:]<login>",
+			Summary: "Queue a backfill of a user's commit history for the server's worker.",
+			Run:     backfillCommand,
+		},
+		"list-users": {
+			Summary: "List users.",
+			Run:     listUsersCommand,
+		},
+		"list-groups": {
+			Summary: "List groups.",
+			Run:     listGroupsCommand,
+		},
+		"merge-users": {
+			Usage:   "[host:]<from login> [host:]<into login>",
+			Summary: "Move a user's commits, groups and accounts to another user and delete them.",
+			Run:     mergeUsersCommand,
+		},
+		"recompute-streaks": {
+			Usage:   "[[host:]<login>...]",
+			Summary: "Reapply repo filters and reevaluate achievements, for everyone by default.",
+			Run:     recomputeStreaksCommand,
+		},
+		"export": {
+			Usage:   "[-o <file>] ([host:]<login> | -group <gid> [-format csv|json] [-by commit|day])",
+			Summary: "Write a user's data export zip, or a group's commits.",
+			Run:     exportCommand,
+		},
+		"import-git": {
+			Usage:   "-login <login> [-host <host>] [-repo <owner/name>] <repo dir or bundle>",
+			Summary: "Import commits from a local repository or git bundle.",
+			Run:     importGitCommand,
+		},
+		"import-export": {
+			Usage:   "[-login <login>] [-host <host>] <export.zip>",
+			Summary: "Import a data export zip into a user's account.",
+			Run:     importExportCommand,
+		},
+	}
+}
+
+// usageError is returned by commands that were called with bad
+// arguments.
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// parseFlags parses args with fs, returning a usageError if they
+// are bad.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return &usageError{msg: err.Error()}
+	}
+	return nil
+}
+
+// printUsage writes the list of commands to w.
+func printUsage(w io.Writer) {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "usage: githubstreaks [command] [arguments]")
+	fmt.Fprintln(w, "\nCommands:")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, commands[name].Summary)
+	}
+	tw.Flush()
+}
+
+// runCommand runs the command named by args[0] with the rest of args,
+// and returns the exit code. With no command, it serves the app.
+func runCommand(args []string) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printUsage(os.Stdout)
+		return exitOK
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "githubstreaks: unknown command %q\n\n", name)
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+	err := cmd.Run(args)
+	if err == nil || err == flag.ErrHelp {
+		return exitOK
+	}
+	if _, ok := err.(*usageError); ok {
+		fmt.Fprintf(os.Stderr, "githubstreaks %s: %s\n", name, err)
+		fmt.Fprintf(os.Stderr, "usage: githubstreaks %s %s\n", name, cmd.Usage)
+		return exitUsage
+	}
+	debug.Println(err)
+	return exitError
+}
+
+// parseUserArg parses a user given as "login" or "host:login".
+func parseUserArg(s string) (UserSpec, error) {
+	us, err := ParseUserSpec(s)
+	if err != nil {
+		return UserSpec{}, usageErrorf("bad user %q", s)
+	}
+	return us, nil
+}
+
+// getUserArg gets the user given by s, which parseUserArg must have
+// accepted.
+func getUserArg(s string) (User, error) {
+	us, err := parseUserArg(s)
+	if err != nil {
+		return User{}, err
+	}
+	u, err := GetUser(us)
+	if err != nil {
+		return User{}, wrapErrorf(err, "error getting user %s", s)
+	}
+	return u, nil
+}
+
+func migrateCommand(args []string) error {
+	if len(args) != 0 {
+		return usageErrorf("unexpected arguments")
+	}
+	if err := MigrateSchemas(); err != nil {
+		return wrapError(err)
+	}
+	if err := MigrateCommitFiles(); err != nil {
+		return wrapError(err)
+	}
+	os.Stdout.WriteString("Migrated " + strconv.Itoa(len(schemas)) + " schemas.\n")
+	return nil
+}
+
+func refreshUserCommand(args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("expected one user")
+	}
+	if _, err := parseUserArg(args[0]); err != nil {
+		return err
+	}
+	u, err := getUserArg(args[0])
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := UpdateUserCommits(u); err != nil {
+		return wrapError(err)
+	}
+	os.Stdout.WriteString("Refreshed " + u.Login + ".\n")
+	return nil
+}
+
+func refreshGroupCommand(args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("expected one group id")
+	}
+	gid, err := strconv.Atoi(args[0])
+	if err != nil {
+		return usageErrorf("bad group id %q", args[0])
+	}
+	g, err := GetGroup(gid)
+	if err != nil {
+		return wrapErrorf(err, "error getting group %d", gid)
+	}
+	if err := UpdateGroupCommits(g); err != nil {
+		return wrapError(err)
+	}
+	os.Stdout.WriteString("Refreshed group " + strconv.Itoa(gid) + ".\n")
+	return nil
+}
+
+func backfillCommand(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	sinceFlag := fs.String("since", "", "Day to backfill from, YYYY-MM-DD.")
+	untilFlag := fs.String("until", "", "Day to backfill until, YYYY-MM-DD (default now).")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("expected one user")
+	}
+	if _, err := parseUserArg(fs.Arg(0)); err != nil {
+		return err
+	}
+	since, err := time.Parse("2006-01-02", *sinceFlag)
+	if err != nil {
+		return usageErrorf("bad -since %q", *sinceFlag)
+	}
+	until := time.Now()
+	if *untilFlag != "" {
+		if until, err = time.Parse("2006-01-02", *untilFlag); err != nil {
+			return usageErrorf("bad -until %q", *untilFlag)
+		}
+	}
+	u, err := getUserArg(fs.Arg(0))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := EnqueueBackfill(u, since, until); err != nil {
+		return wrapError(err)
+	}
+	os.Stdout.WriteString("Queued a backfill for " + u.Login + ".\n")
+	return nil
+}
+
+// userListing is a row of list-users.
+type userListing struct {
+	User
+	Groups int `db:"groups"`
+}
+
+func listUsersCommand(args []string) error {
+	if len(args) != 0 {
+		return usageErrorf("unexpected arguments")
+	}
+	query := `
+SELECT "user".*, (SELECT count(*) FROM user_group WHERE uid = "user".uid) AS groups
+FROM "user" ORDER BY uid ASC`
+	var us []userListing
+	if err := db.DB.Select(&us, query); err != nil {
+		return wrapError(err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "UID\tPROVIDER\tLOGIN\tEMAIL\tGROUPS\tLAST UPDATED")
+	for _, u := range us {
+		updated := "never"
+		if u.CommitsLastUpdatedOn != nil {
+			updated = u.CommitsLastUpdatedOn.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%s\n", u.UID, u.Provider, u.Login, u.Email.String, u.Groups, updated)
+	}
+	return tw.Flush()
+}
+
+// groupListing is a row of list-groups.
+type groupListing struct {
+	Group
+	Members int `db:"members"`
+}
+
+func listGroupsCommand(args []string) error {
+	if len(args) != 0 {
+		return usageErrorf("unexpected arguments")
+	}
+	query := `
+SELECT "group".*, (SELECT count(*) FROM user_group WHERE gid = "group".gid) AS members
+FROM "group" ORDER BY gid ASC`
+	var gs []groupListing
+	if err := db.DB.Select(&gs, query); err != nil {
+		return wrapError(err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "GID\tCREATED\tTIMEZONE\tMEMBERS")
+	for _, g := range gs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\n", g.GID, g.CreatedOn.Format("2006-01-02"), g.Timezone, g.Members)
+	}
+	return tw.Flush()
+}
+
+// mergeUsersQueries returns the queries that move everything the
+// user with uid $1 owns to the user with uid $2, in order. Settings
+// that $2 already has are kept, and $1's are left to be deleted.
+func mergeUsersQueries() []string {
+	return []string{
+		`UPDATE commit SET uid = $2 WHERE uid = $1`,
+		// Drop credits that $2 already has, either as a co-author
+		// or because they now own the commit.
+		`DELETE FROM commit_author ca WHERE ca.uid = $1 AND (
+  EXISTS (SELECT 1 FROM commit WHERE sha = ca.sha AND uid = $2) OR
+  EXISTS (SELECT 1 FROM commit_author WHERE sha = ca.sha AND uid = $2))`,
+		`UPDATE commit_author SET uid = $2 WHERE uid = $1`,
+		`DELETE FROM commit_author WHERE uid = $2 AND sha IN (SELECT sha FROM commit WHERE uid = $2)`,
+		`INSERT INTO user_group(uid, gid, joined_on)
+  SELECT $2, gid, joined_on FROM user_group WHERE uid = $1 ON CONFLICT DO NOTHING`,
+		`UPDATE digest_subscription SET uid = $2
+  WHERE uid = $1 AND gid NOT IN (SELECT gid FROM digest_subscription WHERE uid = $2)`,
+		`UPDATE user_email SET uid = $2
+  WHERE uid = $1 AND email NOT IN (SELECT email FROM user_email WHERE uid = $2)`,
+		`UPDATE account SET uid = $2 WHERE uid = $1`,
+		`UPDATE user_achievement SET uid = $2
+  WHERE uid = $1 AND key NOT IN (SELECT key FROM user_achievement WHERE uid = $2)`,
+		`INSERT INTO repo_filter(uid, include, exclude, exclude_forks, exclude_archived)
+  SELECT $2, include, exclude, exclude_forks, exclude_archived FROM repo_filter WHERE uid = $1
+  ON CONFLICT DO NOTHING`,
+		`INSERT INTO reminder_setting(uid, enabled, gid, local_time, email, webhook_url)
+  SELECT $2, enabled, gid, local_time, email, webhook_url FROM reminder_setting WHERE uid = $1
+  ON CONFLICT DO NOTHING`,
+		// Tokens are unique, so $1's token can't be copied before
+		// it is deleted.
+		`UPDATE feed_token SET uid = $2
+  WHERE uid = $1 AND NOT EXISTS (SELECT 1 FROM feed_token WHERE uid = $2)`,
+	}
+}
+
+// MergeUsers moves from's commits, credits, groups, digests, emails,
+// accounts, achievements, repo filter, reminder setting and feed token
+// to into, links from's login to into, and deletes from. It runs in a
+// single transaction.
+func MergeUsers(from, into User) error {
+	if from.UID == into.UID {
+		return errors.New("can't merge a user into themselves")
+	}
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return wrapError(err)
+	}
+	for _, query := range mergeUsersQueries() {
+		if _, err := tx.Exec(query, from.UID, into.UID); err != nil {
+			tx.Rollback()
+			return wrapErrorf(err, "error merging user %d into %d", from.UID, into.UID)
+		}
+	}
+	// from owns nothing now, so this only clears what into
+	// didn't take.
+	for _, query := range accountDeletionQueries(DeleteCommits) {
+		if _, err := tx.Exec(query, from.UID); err != nil {
+			tx.Rollback()
+			return wrapErrorf(err, "error deleting user %d", from.UID)
+		}
+	}
+	if from.Provider != deletedProvider {
+		// Keep new commits from from's login coming to into.
+		query := `INSERT INTO account(uid, provider, login) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+		if _, err := tx.Exec(query, into.UID, from.Provider, from.Login); err != nil {
+			tx.Rollback()
+			return wrapErrorf(err, "error linking %s account %s to user %d", from.Provider, from.Login, into.UID)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+func mergeUsersCommand(args []string) error {
+	if len(args) != 2 {
+		return usageErrorf("expected two users")
+	}
+	for _, arg := range args {
+		if _, err := parseUserArg(arg); err != nil {
+			return err
+		}
+	}
+	from, err := getUserArg(args[0])
+	if err != nil {
+		return wrapError(err)
+	}
+	into, err := getUserArg(args[1])
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := MergeUsers(from, into); err != nil {
+		return wrapError(err)
+	}
+	// The merged commits may be in repos into filters out.
+	if err := ApplyRepoFilter(into); err != nil {
+		return wrapError(err)
+	}
+	if _, err := EvaluateAchievements(into, time.Now()); err != nil {
+		return wrapError(err)
+	}
+	os.Stdout.WriteString("Merged " + from.Login + " into " + into.Login + ".\n")
+	return nil
+}
+
+// recomputeStreaksCommand reapplies repo filters and reevaluates
+// achievements, which depend on which commits count, and prints the
+// resulting streaks. Streaks themselves aren't stored.
+func recomputeStreaksCommand(args []string) error {
+	for _, arg := range args {
+		if _, err := parseUserArg(arg); err != nil {
+			return err
+		}
+	}
+	var us []User
+	if len(args) == 0 {
+		if err := db.DB.Select(&us, `SELECT * FROM "user" WHERE provider != $1 ORDER BY uid ASC`, deletedProvider); err != nil {
+			return wrapError(err)
+		}
+	}
+	for _, arg := range args {
+		u, err := getUserArg(arg)
+		if err != nil {
+			return wrapError(err)
+		}
+		us = append(us, u)
+	}
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "UID\tLOGIN\tCURRENT\tLONGEST\tNEW ACHIEVEMENTS")
+	for _, u := range us {
+		if err := ApplyRepoFilter(u); err != nil {
+			return wrapErrorf(err, "error filtering %s's repos", u.Login)
+		}
+		uas, err := EvaluateAchievements(u, now)
+		if err != nil {
+			return wrapErrorf(err, "error evaluating %s's achievements", u.Login)
+		}
+		loc, err := userLocation(u)
+		if err != nil {
+			return wrapError(err)
+		}
+		s, err := GetUserStreaks(u, loc, now)
+		if err != nil {
+			return wrapError(err)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%d\n", u.UID, u.Login, s.Current, s.Longest, len(uas))
+	}
+	return tw.Flush()
+}
+
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := fs.String("o", "", "File to write to (default stdout).")
+	gid := fs.Int("group", 0, "Group to export the commits of, instead of a user.")
+	format := fs.String("format", "csv", "Group export format, csv or json.")
+	by := fs.String("by", "commit", "Group export rows, commit or day.")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *gid != 0 {
+		if fs.NArg() != 0 {
+			return usageErrorf("expected a user or -group, not both")
+		}
+		if *format != "csv" && *format != "json" {
+			return usageErrorf("bad -format %q", *format)
+		}
+	} else if fs.NArg() != 1 {
+		return usageErrorf("expected one user")
+	} else if _, err := parseUserArg(fs.Arg(0)); err != nil {
+		return err
+	}
+	geq, err := ParseGroupExportQuery(url.Values{"by": {*by}}, time.UTC)
+	if err != nil {
+		return usageErrorf("%s", err)
+	}
+
+	write := func(w io.Writer) error {
+		if *gid == 0 {
+			return writeUserExport(w, fs.Arg(0))
+		}
+		return writeGroupExport(w, *gid, geq, *format)
+	}
+	if *out == "" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// writeUserExport writes the data export zip of the user given by
+// arg to w.
+func writeUserExport(w io.Writer, arg string) error {
+	u, err := getUserArg(arg)
+	if err != nil {
+		return wrapError(err)
+	}
+	e, err := BuildExport(u, time.Now())
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := e.WriteZip(w); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// writeGroupExport writes all of the commits of the group with gid
+// to w in format, with times in the group's timezone.
+func writeGroupExport(w io.Writer, gid int, geq GroupExportQuery, format string) error {
+	g, err := GetGroup(gid)
+	if err != nil {
+		return wrapErrorf(err, "error getting group %d", gid)
+	}
+	loc, err := GetGroupLocation(g)
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := WriteGroupExport(w, g, geq, loc, format); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunCommandUsage(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected int
+	}{
+		{[]string{"help"}, exitOK},
+		{[]string{"frobnicate"}, exitUsage},
+		{[]string{"serve", "extra"}, exitUsage},
+		{[]string{"migrate", "extra"}, exitUsage},
+		{[]string{"refresh-user"}, exitUsage},
+		{[]string{"refresh-user", "github:"}, exitUsage},
+		{[]string{"refresh-group", "one"}, exitUsage},
+		{[]string{"backfill", "samertm"}, exitUsage},
+		{[]string{"backfill", "-since", "2015-08-01", "-until", "yesterday", "samertm"}, exitUsage},
+		{[]string{"list-users", "extra"}, exitUsage},
+		{[]string{"merge-users", "samertm"}, exitUsage},
+		{[]string{"export"}, exitUsage},
+		{[]string{"export", "-group", "1", "samertm"}, exitUsage},
+		{[]string{"export", "-group", "1", "-format", "xml"}, exitUsage},
+		{[]string{"export", "-by", "week", "samertm"}, exitUsage},
+		{[]string{"import-git", "-bogus"}, exitUsage},
+		{[]string{"import-export"}, exitUsage},
+	}
+	for _, test := range tests {
+		if code := runCommand(test.args); code != test.expected {
+			t.Errorf("%q: got exit code %d, expected %d", test.args, code, test.expected)
+		}
+	}
+}
+
+func TestParseUserArg(t *testing.T) {
+	tests := []struct {
+		arg      string
+		expected UserSpec
+		err      bool
+	}{
+		{"samertm", UserSpec{Login: "samertm"}, false},
+		{"gitlab:samertm", UserSpec{Provider: "gitlab", Login: "samertm"}, false},
+		{"gitlab:", UserSpec{}, true},
+		{"", UserSpec{}, true},
+	}
+	for _, test := range tests {
+		us, err := parseUserArg(test.arg)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v, expected error: %t", test.arg, err, test.err)
+		}
+		if us != test.expected {
+			t.Errorf("%q: got %+v, expected %+v", test.arg, us, test.expected)
+		}
+	}
+}
+
+// TestMergeUsersQueries checks that merging users moves the settings
+// that deleting the merged user would otherwise clear.
+func TestMergeUsersQueries(t *testing.T) {
+	qs := strings.Join(mergeUsersQueries(), "\n")
+	for _, table := range []string{
+		"user_group", "digest_subscription", "user_email", "account",
+		"user_achievement", "repo_filter", "reminder_setting", "feed_token",
+	} {
+		if !strings.Contains(qs, "INSERT INTO "+table+"(") && !strings.Contains(qs, "UPDATE "+table+" SET uid = $2") {
+			t.Errorf("%s isn't moved", table)
+		}
+	}
+}
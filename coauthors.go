@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/samertm/githubstreaks/db"
+)
+
+// CoAuthor is an author listed in a "Co-authored-by" trailer.
+type CoAuthor struct {
+	Name  string
+	Email string
+}
+
+// coAuthorTrailer is the trailer that lists co-authors. It is matched
+// case-insensitively.
+const coAuthorTrailer = "co-authored-by:"
+
+// ParseCoAuthors returns the co-authors listed in the commit message
+// m, in order. Trailers with malformed addresses are ignored. Emails
+// are lowercase.
+func ParseCoAuthors(m string) []CoAuthor {
+	var cas []CoAuthor
+	for _, line := range strings.Split(m, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(strings.ToLower(line), coAuthorTrailer) {
+			continue
+		}
+		a, err := mail.ParseAddress(strings.TrimSpace(line[len(coAuthorTrailer):]))
+		if err != nil {
+			continue
+		}
+		cas = append(cas, CoAuthor{Name: a.Name, Email: strings.ToLower(a.Address)})
+	}
+	return cas
+}
+
+// gitHubNoreplyDomain is the domain of the private emails GitHub
+// hands out, e.g. "123+login@users.noreply.github.com".
+const gitHubNoreplyDomain = "@users.noreply.github.com"
+
+// GitHubNoreplyLogin returns the GitHub login for the private email
+// address email, or "" if email isn't one.
+func GitHubNoreplyLogin(email string) string {
+	if !strings.HasSuffix(email, gitHubNoreplyDomain) {
+		return ""
+	}
+	login := strings.TrimSuffix(email, gitHubNoreplyDomain)
+	if i := strings.Index(login, "+"); i != -1 {
+		login = login[i+1:]
+	}
+	return login
+}
+
+// CoAuthorUID returns the uid of the user that ca refers to, or 0 if
+// ca isn't a user. Co-authors are matched by their verified author
+// email, then by the login in a GitHub private email, and then by
+// their verified account email.
+func CoAuthorUID(ca CoAuthor) (int, error) {
+	uid, err := GetVerifiedEmailUID(ca.Email)
+	if err != nil || uid != 0 {
+		return uid, err
+	}
+	if login := GitHubNoreplyLogin(ca.Email); login != "" {
+		return FindAccountUID(GitHubProvider, login)
+	}
+	b := &db.Binder{}
+	query := `SELECT uid FROM "user" WHERE lower(email) = ` + b.Bind(ca.Email) + ` AND email_verified`
+	var uids []int
+	if err := db.DB.Select(&uids, query, b.Items...); err != nil {
+		return 0, wrapError(err)
+	}
+	if len(uids) == 0 {
+		return 0, nil
+	}
+	return uids[0], nil
+}
+
+// CommitCoAuthorUIDs returns the uids of the users listed as
+// co-authors in the commit message m, excluding the commit's owner.
+func CommitCoAuthorUIDs(owner int, m string) ([]int, error) {
+	seen := map[int]bool{owner: true, 0: true}
+	var uids []int
+	for _, ca := range ParseCoAuthors(m) {
+		uid, err := CoAuthorUID(ca)
+		if err != nil {
+			return nil, wrapErrorf(err, "error resolving co-author %s", ca.Email)
+		}
+		if !seen[uid] {
+			seen[uid] = true
+			uids = append(uids, uid)
+		}
+	}
+	return uids, nil
+}
+
+// commit_author lists the co-authors of commits. The commit's owner,
+// commit.uid, is not included.
+var commitAuthorSchema = `
+CREATE TABLE IF NOT EXISTS commit_author (
+  sha text REFERENCES "commit" (sha) NOT NULL,
+  uid integer REFERENCES "user" (uid) NOT NULL,
+  PRIMARY KEY (sha, uid)
+)`
+
+// GetCommitAuthors returns the users credited for c. The commit's
+// owner is first, followed by its co-authors.
+func GetCommitAuthors(c Commit) ([]User, error) {
+	owner, err := GetUser(UserSpec{UID: c.UID})
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	b := &db.Binder{}
+	query := `
+SELECT "user".* FROM "user" JOIN commit_author ON commit_author.uid = "user".uid
+WHERE commit_author.sha = ` + b.Bind(c.SHA) + `
+ORDER BY "user".login ASC`
+	var us []User
+	if err := db.DB.Select(&us, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	return append([]User{owner}, us...), nil
+}
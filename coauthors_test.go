@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCoAuthors(t *testing.T) {
+	m := `Pair on the parser
+
+Co-authored-by: Ada Lovelace <Ada@Example.com>
+co-authored-by: grace <123+grace@users.noreply.github.com>
+Co-authored-by: not an address
+Signed-off-by: Someone Else <else@example.com>`
+	want := []CoAuthor{
+		{Name: "Ada Lovelace", Email: "ada@example.com"},
+		{Name: "grace", Email: "123+grace@users.noreply.github.com"},
+	}
+	if got := ParseCoAuthors(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseCoAuthors = %+v, want %+v", got, want)
+	}
+	if got := ParseCoAuthors("No trailers here"); got != nil {
+		t.Errorf("ParseCoAuthors = %+v, want nil", got)
+	}
+}
+
+func TestGitHubNoreplyLogin(t *testing.T) {
+	for email, want := range map[string]string{
+		"123+grace@users.noreply.github.com": "grace",
+		"grace@users.noreply.github.com":     "grace",
+		"grace@example.com":                  "",
+	} {
+		if got := GitHubNoreplyLogin(email); got != want {
+			t.Errorf("GitHubNoreplyLogin(%q) = %q, want %q", email, got, want)
+		}
+	}
+}
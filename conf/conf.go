@@ -12,14 +12,75 @@ import (
 )
 
 type ConfigVars struct {
-	GitHubID           string
-	GitHubSecret       string
+	GitHubID     string
+	GitHubSecret string
+	// GitHubWebURL, GitHubAPIURL and GitHubUploadURL point the
+	// default GitHub host at a GitHub Enterprise Server instance.
+	// They default to github.com.
+	GitHubWebURL       string
+	GitHubAPIURL       string
+	GitHubUploadURL    string
 	BaseURL            string
 	PostgresDataSource string
 	SessionKey         string
 	OAuthStateString   string
 	Debug              string
 	LogglyToken        string
+	// GitLabURL and GiteaURL enable the GitLab and Gitea commit
+	// sources. The tokens are optional and are used to read
+	// non-public activity.
+	GitLabURL   string
+	GitLabToken string
+	GiteaURL    string
+	GiteaToken  string
+	// GitHubHosts are additional GitHub hosts, usually GitHub
+	// Enterprise Server instances, that users can log in with
+	// alongside the default host.
+	GitHubHosts []GitHubHost
+	// SMTPAddr is the "host:port" of the SMTP server used to send
+	// mail. If it is empty, mail is logged instead of sent.
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+	// MergeCommitPolicy is "count" (the default) to count merge
+	// commits toward streaks, or "skip" to ignore them.
+	MergeCommitPolicy string
+	// ForeignCommitPolicy decides who gets credit for commits in a
+	// user's pushes that were authored by someone else: "skip" (the
+	// default) ignores them, "author" credits the author if they
+	// are a githubstreaks user, and "pusher" credits the pusher.
+	ForeignCommitPolicy string
+	// GitHubRateLimitMaxWait is the longest, in seconds, that a
+	// GitHub request pauses for an exhausted rate limit before the
+	// work is deferred. It defaults to 60.
+	GitHubRateLimitMaxWait int
+	// GitHubRateLimitReserve is the number of requests that
+	// background jobs leave in each rate limit budget for users.
+	GitHubRateLimitReserve int
+	// PatchPolicy decides how much of each file's patch is stored:
+	// "full" (the default), "truncate" to keep the first
+	// PatchTruncateBytes bytes, or "none".
+	PatchPolicy        string
+	PatchTruncateBytes int
+	// HTTPCache is where conditional request responses are
+	// cached: "postgres" (the default) or "memory".
+	HTTPCache string
+	// Admins are the logins of the users on the default GitHub host
+	// that can see the admin pages.
+	Admins []string
+}
+
+// GitHubHost configures a GitHub host.
+type GitHubHost struct {
+	// Name identifies the host. It is stored with the host's
+	// users and commits, so it must not change.
+	Name         string
+	WebURL       string
+	APIURL       string
+	UploadURL    string
+	ClientID     string
+	ClientSecret string
 }
 
 var Config ConfigVars
@@ -32,9 +32,9 @@ func init() {
 
 var logglyClient *loggly.Client
 
-// flush flushes the logger. No-op if we are not logging to Loggly.
+// Flush flushes the logger. No-op if we are not logging to Loggly.
 // Must be called before the program exits abruptly while logging.
-func flush() {
+func Flush() {
 	if logglyClient != nil {
 		logglyClient.Flush()
 	}
@@ -45,14 +45,14 @@ var Logger *log.Logger
 // Fatal is equivalent to Print() followed by a call to os.Exit(1).
 func Fatal(v ...interface{}) {
 	Print(v...)
-	flush()
+	Flush()
 	os.Exit(1)
 }
 
 // Fatalf is equivalent to Printf() followed by a call to os.Exit(1).
 func Fatalf(format string, v ...interface{}) {
 	Printf(format, v)
-	flush()
+	Flush()
 	os.Exit(1)
 }
 
@@ -60,7 +60,7 @@ func Fatalf(format string, v ...interface{}) {
 // os.Exit(1).
 func Fatalln(v ...interface{}) {
 	Println(v...)
-	flush()
+	Flush()
 	os.Exit(1)
 }
 
@@ -68,7 +68,7 @@ func Fatalln(v ...interface{}) {
 func Panic(v ...interface{}) {
 	s := fmt.Sprint(v...)
 	Print(v...)
-	flush()
+	Flush()
 	panic(s)
 }
 
@@ -76,7 +76,7 @@ func Panic(v ...interface{}) {
 func Panicf(format string, v ...interface{}) {
 	s := fmt.Sprintf(format, v...)
 	Printf(format, v...)
-	flush()
+	Flush()
 	panic(s)
 }
 
@@ -84,7 +84,7 @@ func Panicf(format string, v ...interface{}) {
 func Panicln(v ...interface{}) {
 	s := fmt.Sprintln(v...)
 	Println(v...)
-	flush()
+	Flush()
 	panic(s)
 }
 
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/samertm/githubstreaks/debug"
+	"github.com/zenazn/goji/web"
+)
+
+// Digest frequencies.
+const (
+	DigestWeekly  = "weekly"
+	DigestMonthly = "monthly"
+	DigestOff     = "off"
+)
+
+// defaultDigestFrequency is the frequency for users who haven't
+// chosen one for a group.
+const defaultDigestFrequency = DigestWeekly
+
+// DigestSubscription is how often a user gets a digest for a group.
+type DigestSubscription struct {
+	UID       int    `db:"uid"`
+	GID       int    `db:"gid"`
+	Frequency string `db:"frequency"`
+	// LastSentOn is when the last digest was sent, or nil if none
+	// has been.
+	LastSentOn *time.Time `db:"last_sent_on"`
+}
+
+var digestSubscriptionSchema = `
+CREATE TABLE IF NOT EXISTS digest_subscription (
+  uid integer REFERENCES "user" (uid) NOT NULL,
+  gid integer REFERENCES "group" (gid) NOT NULL,
+  frequency text NOT NULL,
+  last_sent_on timestamp,
+  PRIMARY KEY (uid, gid)
+)`
+
+// ValidDigestFrequency returns true if f is a digest frequency.
+func ValidDigestFrequency(f string) bool {
+	return f == DigestWeekly || f == DigestMonthly || f == DigestOff
+}
+
+// GetDigestSubscription returns the digest subscription of the user
+// with uid for the group with gid.
+func GetDigestSubscription(uid, gid int) (DigestSubscription, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM digest_subscription WHERE uid = ` + b.Bind(uid) + ` AND gid = ` + b.Bind(gid)
+	var ds DigestSubscription
+	if err := db.DB.Get(&ds, query, b.Items...); err != nil {
+		if strings.Contains(err.Error(), sqlNotFound) {
+			return DigestSubscription{UID: uid, GID: gid, Frequency: defaultDigestFrequency}, nil
+		}
+		return DigestSubscription{}, wrapError(err)
+	}
+	return ds, nil
+}
+
+// SetDigestFrequency sets how often the user with uid gets digests for
+// the group with gid.
+func SetDigestFrequency(uid, gid int, frequency string) error {
+	if !ValidDigestFrequency(frequency) {
+		return errors.Errorf("unknown digest frequency %q", frequency)
+	}
+	b := &db.Binder{}
+	query := `
+INSERT INTO digest_subscription(uid, gid, frequency) VALUES (` + b.Bind(uid, gid, frequency) + `)
+ON CONFLICT (uid, gid) DO UPDATE SET frequency = excluded.frequency`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error setting digest frequency for user %d in group %d", uid, gid)
+	}
+	return nil
+}
+
+// markDigestSent records that ds's digest was sent at t.
+func markDigestSent(ds DigestSubscription, t time.Time) error {
+	b := &db.Binder{}
+	query := `
+INSERT INTO digest_subscription(uid, gid, frequency, last_sent_on)
+  VALUES (` + b.Bind(ds.UID, ds.GID, ds.Frequency, t) + `)
+ON CONFLICT (uid, gid) DO UPDATE SET last_sent_on = excluded.last_sent_on`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// DigestPeriod returns the period covered by the latest digest of
+// frequency as of now: the previous seven days for weekly digests,
+// and the previous calendar month for monthly digests. Periods start
+// at the beginning of a day in now's location.
+func DigestPeriod(frequency string, now time.Time) (since, until time.Time) {
+	if frequency == DigestMonthly {
+		until = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		return until.AddDate(0, -1, 0), until
+	}
+	until = BeginningOfDay(now)
+	return until.AddDate(0, 0, -7), until
+}
+
+// digestDue returns true if ds's digest for the period ending at
+// until has not been sent. Weekly digests are sent at most once every
+// seven days.
+func digestDue(ds DigestSubscription, until time.Time) bool {
+	if ds.Frequency == DigestOff {
+		return false
+	}
+	if ds.LastSentOn == nil {
+		return true
+	}
+	if ds.Frequency == DigestWeekly {
+		// Due if the last digest went out on the day seven days
+		// ago or earlier, whatever time it was sent.
+		return ds.LastSentOn.Before(until.AddDate(0, 0, -6))
+	}
+	return ds.LastSentOn.Before(until)
+}
+
+// DigestEntry is a user's line on a digest's leaderboard.
+type DigestEntry struct {
+	User User
+	// Commits is the number of commits in the digest's period.
+	Commits int
+	Streaks Streaks
+}
+
+type sortableDigestEntries []DigestEntry
+
+func (s sortableDigestEntries) Len() int      { return len(s) }
+func (s sortableDigestEntries) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortableDigestEntries) Less(i, j int) bool {
+	if s[i].Commits != s[j].Commits {
+		return s[i].Commits > s[j].Commits
+	}
+	if s[i].Streaks.Current != s[j].Streaks.Current {
+		return s[i].Streaks.Current > s[j].Streaks.Current
+	}
+	return s[i].User.Login < s[j].User.Login
+}
+
+// Digest is a summary of a group's activity, sent to one of its
+// users.
+type Digest struct {
+	User      User
+	Group     Group
+	Frequency string
+	// Since and Until are the period the digest covers.
+	Since time.Time
+	Until time.Time
+	// Streaks are User's streaks.
+	Streaks Streaks
+	// Leaderboard ranks the group's users by their commits in the
+	// period.
+	Leaderboard []DigestEntry
+	TopRepos    []RepoSummary
+	// NewMembers are the users who joined the group in the period.
+	NewMembers     []User
+	GroupURL       string
+	UnsubscribeURL string
+	SettingsURL    string
+}
+
+// digestTopRepos is the number of repos in Digest.TopRepos.
+const digestTopRepos = 5
+
+// GetGroupNewMembers returns the users who joined g between since and
+// until.
+func GetGroupNewMembers(g Group, since, until time.Time) ([]User, error) {
+	b := &db.Binder{}
+	query := `SELECT "user".* FROM "user" JOIN user_group USING (uid)
+WHERE user_group.gid = ` + b.Bind(g.GID) + ` AND user_group.joined_on >= ` + b.Bind(since) +
+		` AND user_group.joined_on < ` + b.Bind(until) + `
+ORDER BY user_group.joined_on ASC`
+	var us []User
+	if err := db.DB.Select(&us, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	return us, nil
+}
+
+// BuildDigest builds u's digest of frequency for g as of now.
+func BuildDigest(u User, g Group, frequency string, now time.Time) (Digest, error) {
+	loc, err := GetGroupLocation(g)
+	if err != nil {
+		return Digest{}, wrapError(err)
+	}
+	d := Digest{
+		User:           u,
+		Group:          g,
+		Frequency:      frequency,
+		GroupURL:       AbsoluteURL(GroupURL(g)),
+		UnsubscribeURL: DigestUnsubscribeURL(u.UID, g.GID),
+		SettingsURL:    AbsoluteURL(GroupURL(g) + "#digest"),
+	}
+	d.Since, d.Until = DigestPeriod(frequency, now.In(loc))
+	us, err := GetGroupUsers(g)
+	if err != nil {
+		return Digest{}, wrapError(err)
+	}
+	for _, gu := range us {
+		cs, err := GetUserCommits(gu, time.Time{})
+		if err != nil {
+			return Digest{}, wrapError(err)
+		}
+		e := DigestEntry{User: gu}
+		for _, c := range cs {
+			if !c.AuthorDate.Before(d.Since) && c.AuthorDate.Before(d.Until) {
+				e.Commits++
+			}
+		}
+		e.Streaks = ComputeStreaks(cs, loc, now)
+		if gu.UID == u.UID {
+			d.Streaks = e.Streaks
+		}
+		d.Leaderboard = append(d.Leaderboard, e)
+	}
+	sort.Sort(sortableDigestEntries(d.Leaderboard))
+	if d.TopRepos, err = GetGroupTopRepos(g, d.Since, digestTopRepos); err != nil {
+		return Digest{}, wrapError(err)
+	}
+	if d.NewMembers, err = GetGroupNewMembers(g, d.Since, d.Until); err != nil {
+		return Digest{}, wrapError(err)
+	}
+	return d, nil
+}
+
+var (
+	digestHTMLTemplate = pongo2.Must(pongo2.FromFile("templates/digest.html"))
+	digestTextTemplate = pongo2.Must(pongo2.FromFile("templates/digest.txt"))
+)
+
+// Mail renders d as an email to its user.
+func (d Digest) Mail() (Mail, error) {
+	m := Mail{
+		To:      d.User.Email.String,
+		Subject: "Your " + d.Frequency + " GitHub Streaks digest for group " + strconv.Itoa(d.Group.GID),
+	}
+	for _, t := range []struct {
+		tpl  *pongo2.Template
+		body *string
+	}{{digestTextTemplate, &m.Text}, {digestHTMLTemplate, &m.HTML}} {
+		buf := &bytes.Buffer{}
+		if err := RenderTemplate(t.tpl, buf, d); err != nil {
+			return Mail{}, wrapError(err)
+		}
+		*t.body = buf.String()
+	}
+	return m, nil
+}
+
+// digestUnsubscribeTTL is how long unsubscribe links work for. They
+// should outlive the mail client's interest in the email.
+var digestUnsubscribeTTL = 365 * 24 * time.Hour
+
+// DigestUnsubscribeURL returns the link that turns off digests for
+// the user with uid in the group with gid.
+func DigestUnsubscribeURL(uid, gid int) string {
+	v := url.Values{}
+	v.Set("uid", strconv.Itoa(uid))
+	v.Set("gid", strconv.Itoa(gid))
+	return AbsoluteURL("/digest/unsubscribe?" + SignQuery(SignDigestUnsubscribe, v, time.Now().Add(digestUnsubscribeTTL)))
+}
+
+// dueDigest is a digest subscription with its user's email.
+type dueDigest struct {
+	DigestSubscription
+	Email string `db:"email"`
+}
+
+// SendDueDigests sends every digest that is due as of now. Users
+// without a verified email don't get digests. It returns the number of
+// digests sent; a digest that fails is logged and retried next time.
+func SendDueDigests(now time.Time) (int, error) {
+	b := &db.Binder{}
+	freq := `coalesce(ds.frequency, ` + b.Bind(defaultDigestFrequency) + `)`
+	query := `
+SELECT ug.uid, ug.gid, ` + freq + ` AS frequency, ds.last_sent_on, u.email
+FROM user_group ug JOIN "user" u ON u.uid = ug.uid
+LEFT JOIN digest_subscription ds ON ds.uid = ug.uid AND ds.gid = ug.gid
+WHERE u.email IS NOT NULL AND u.email <> '' AND u.email_verified AND ` + freq + ` <> ` + b.Bind(DigestOff)
+	var dds []dueDigest
+	if err := db.DB.Select(&dds, query, b.Items...); err != nil {
+		return 0, wrapError(err)
+	}
+	var sent int
+	for _, dd := range dds {
+		if err := sendDigest(dd.DigestSubscription, now); err != nil {
+			debug.Printf("Error sending digest to user %d for group %d: %s", dd.UID, dd.GID, err)
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// sendDigest sends ds's digest if it is due.
+func sendDigest(ds DigestSubscription, now time.Time) error {
+	g, err := GetGroup(ds.GID)
+	if err != nil {
+		return wrapError(err)
+	}
+	loc, err := GetGroupLocation(g)
+	if err != nil {
+		return wrapError(err)
+	}
+	if _, until := DigestPeriod(ds.Frequency, now.In(loc)); !digestDue(ds, until) {
+		return nil
+	}
+	u, err := GetUser(UserSpec{UID: ds.UID})
+	if err != nil {
+		return wrapError(err)
+	}
+	d, err := BuildDigest(u, g, ds.Frequency, now)
+	if err != nil {
+		return wrapError(err)
+	}
+	m, err := d.Mail()
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := SendMail(m); err != nil {
+		return wrapError(err)
+	}
+	return markDigestSent(ds, now)
+}
+
+// RunDigests sends due digests every interval. It never returns. Only
+// one server should run it.
+func RunDigests(interval time.Duration) {
+	for {
+		n, err := SendDueDigests(time.Now())
+		if err != nil {
+			debug.Println(err)
+		} else if n > 0 {
+			debug.Printf("Sent %d digests", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+var messageTemplate = pongo2.Must(pongo2.FromFile("templates/message.html"))
+
+type messageTemplateVars struct {
+	Message string
+}
+
+func serveDigestUnsubscribe(c web.C, w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	if err := VerifySignedQuery(SignDigestUnsubscribe, q, time.Now()); err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	uid, err := strconv.Atoi(q.Get("uid"))
+	if err != nil {
+		return &HTTPError{Err: wrapError(err), Code: http.StatusBadRequest}
+	}
+	gid, err := strconv.Atoi(q.Get("gid"))
+	if err != nil {
+		return &HTTPError{Err: wrapError(err), Code: http.StatusBadRequest}
+	}
+	if err := SetDigestFrequency(uid, gid, DigestOff); err != nil {
+		return wrapError(err)
+	}
+	return RenderTemplate(messageTemplate, w, messageTemplateVars{
+		Message: "You won't get digests for group " + strconv.Itoa(gid) + " anymore.",
+	})
+}
+
+type digestForm struct {
+	Frequency string `schema:"frequency"`
+	// Settings is set by the settings page, to return there.
+	Settings bool `schema:"settings"`
+}
+
+func serveGroupDigest(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	g, err := memberGroup(*a.User, c)
+	if err != nil {
+		return err
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form digestForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	if !ValidDigestFrequency(form.Frequency) {
+		return &HTTPError{Err: errors.Errorf("unknown digest frequency %q", form.Frequency), Code: http.StatusBadRequest}
+	}
+	if err := SetDigestFrequency(a.User.UID, g.GID, form.Frequency); err != nil {
+		return wrapError(err)
+	}
+	if form.Settings {
+		return &HTTPRedirect{To: "/settings", Code: http.StatusSeeOther}
+	}
+	return &HTTPRedirect{To: GroupURL(g), Code: http.StatusSeeOther}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDigestPeriod(t *testing.T) {
+	now := time.Date(2015, 9, 3, 15, 4, 5, 0, time.UTC)
+	for _, tt := range []struct {
+		frequency    string
+		since, until time.Time
+	}{
+		{DigestWeekly, time.Date(2015, 8, 27, 0, 0, 0, 0, time.UTC), time.Date(2015, 9, 3, 0, 0, 0, 0, time.UTC)},
+		{DigestMonthly, time.Date(2015, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2015, 9, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		since, until := DigestPeriod(tt.frequency, now)
+		if !since.Equal(tt.since) || !until.Equal(tt.until) {
+			t.Errorf("DigestPeriod(%q) = %s, %s, want %s, %s", tt.frequency, since, until, tt.since, tt.until)
+		}
+	}
+}
+
+func TestDigestDue(t *testing.T) {
+	until := time.Date(2015, 9, 1, 0, 0, 0, 0, time.UTC)
+	at := func(t time.Time) *time.Time { return &t }
+	for _, tt := range []struct {
+		ds   DigestSubscription
+		want bool
+	}{
+		{DigestSubscription{Frequency: DigestWeekly}, true},
+		{DigestSubscription{Frequency: DigestOff}, false},
+		{DigestSubscription{Frequency: DigestWeekly, LastSentOn: at(until.AddDate(0, 0, -7).Add(time.Hour))}, true},
+		{DigestSubscription{Frequency: DigestWeekly, LastSentOn: at(until.AddDate(0, 0, -3))}, false},
+		{DigestSubscription{Frequency: DigestMonthly, LastSentOn: at(until.AddDate(0, 0, -3))}, true},
+		{DigestSubscription{Frequency: DigestMonthly, LastSentOn: at(until.Add(time.Hour))}, false},
+	} {
+		if got := digestDue(tt.ds, until); got != tt.want {
+			t.Errorf("digestDue(%+v) = %t, want %t", tt.ds, got, tt.want)
+		}
+	}
+}
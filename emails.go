@@ -0,0 +1,296 @@
+package main
+
+import (
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/google/go-github/github"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/zenazn/goji/web"
+)
+
+// UserEmail is an author email registered by a user. Commits whose
+// author email matches a verified UserEmail are credited to the user,
+// even if the email isn't linked to their account on the commit's
+// source.
+type UserEmail struct {
+	UID int `db:"uid"`
+	// Email is always lowercase.
+	Email     string    `db:"email"`
+	Verified  bool      `db:"verified"`
+	CreatedOn time.Time `db:"created_on"`
+}
+
+// Several users may add the same email, but only one of them can
+// verify it.
+var userEmailSchema = `
+CREATE TABLE IF NOT EXISTS user_email (
+  uid integer REFERENCES "user" (uid) NOT NULL,
+  email text NOT NULL,
+  verified boolean NOT NULL DEFAULT false,
+  created_on timestamp NOT NULL,
+  CONSTRAINT uid_email UNIQUE(uid, email)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS user_email_verified ON user_email (email) WHERE verified`
+
+// ParseEmail validates email and returns its lowercase bare address.
+func ParseEmail(email string) (string, error) {
+	a, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil {
+		return "", errors.Errorf("%q is not a valid email address", email)
+	}
+	if a.Name != "" {
+		return "", errors.Errorf("%q must be a bare email address", email)
+	}
+	return strings.ToLower(a.Address), nil
+}
+
+// AddUserEmail adds the unverified author email to u.
+func AddUserEmail(u User, email string) error {
+	b := &db.Binder{}
+	query := `INSERT INTO user_email(uid, email, created_on) VALUES (` +
+		b.Bind(u.UID, email) + `, current_timestamp)`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error adding email %s to user %d", email, u.UID)
+	}
+	return nil
+}
+
+// GetUserEmails returns all of u's author emails.
+func GetUserEmails(u User) ([]UserEmail, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM user_email WHERE uid = ` + b.Bind(u.UID) + ` ORDER BY email ASC`
+	var es []UserEmail
+	if err := db.DB.Select(&es, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	return es, nil
+}
+
+// UserAuthorEmails returns u's verified author emails. All of the
+// emails are lowercase.
+func UserAuthorEmails(u User) ([]string, error) {
+	b := &db.Binder{}
+	query := `SELECT email FROM user_email WHERE uid = ` + b.Bind(u.UID) + ` AND verified`
+	var emails []string
+	if err := db.DB.Select(&emails, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	return emails, nil
+}
+
+// SaveGitHubEmails saves the emails in es that GitHub has verified as
+// u's verified author emails. Emails that another user has already
+// verified are skipped.
+func SaveGitHubEmails(u User, es []github.UserEmail) error {
+	for _, e := range es {
+		if e.Email == nil || e.Verified == nil || !*e.Verified {
+			continue
+		}
+		b := &db.Binder{}
+		query := `
+INSERT INTO user_email(uid, email, verified, created_on)
+  SELECT ` + b.Bind(u.UID, strings.ToLower(*e.Email)) + `, true, current_timestamp
+  WHERE NOT EXISTS (SELECT 1 FROM user_email WHERE email = $2 AND verified)
+ON CONFLICT (uid, email) DO UPDATE SET verified = true`
+		if _, err := db.DB.Exec(query, b.Items...); err != nil {
+			return wrapErrorf(err, "error saving email %s for user %d", *e.Email, u.UID)
+		}
+	}
+	return nil
+}
+
+// VerifyUserEmail marks email as verified for the user with uid.
+func VerifyUserEmail(uid int, email string) error {
+	b := &db.Binder{}
+	query := `UPDATE user_email SET verified = true WHERE uid = ` + b.Bind(uid) +
+		` AND email = ` + b.Bind(email)
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error verifying email %s for user %d", email, uid)
+	}
+	return nil
+}
+
+// DeleteUserEmail removes email from u's author emails.
+func DeleteUserEmail(u User, email string) error {
+	b := &db.Binder{}
+	query := `DELETE FROM user_email WHERE uid = ` + b.Bind(u.UID) + ` AND email = ` + b.Bind(email)
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// GetVerifiedEmailUID returns the uid of the user that verified
+// email, or 0 if nobody has.
+func GetVerifiedEmailUID(email string) (int, error) {
+	b := &db.Binder{}
+	query := `SELECT uid FROM user_email WHERE email = ` + b.Bind(strings.ToLower(email)) + ` AND verified`
+	var uids []int
+	if err := db.DB.Select(&uids, query, b.Items...); err != nil {
+		return 0, wrapError(err)
+	}
+	if len(uids) == 0 {
+		return 0, nil
+	}
+	return uids[0], nil
+}
+
+// emailVerificationTTL is how long email verification links are
+// valid for.
+var emailVerificationTTL = 7 * 24 * time.Hour
+
+// UserEmailVerificationURL returns the link that verifies email for
+// the user with uid.
+func UserEmailVerificationURL(uid int, email string) string {
+	v := url.Values{}
+	v.Set("uid", strconv.Itoa(uid))
+	v.Set("email", email)
+	return AbsoluteURL("/user/emails/verify?" + SignQuery(SignUserEmailVerify, v, time.Now().Add(emailVerificationTTL)))
+}
+
+// SendUserEmailVerification mails the verification link for email to
+// email.
+func SendUserEmailVerification(u User, email string) error {
+	return SendMail(Mail{
+		To:      email,
+		Subject: "Verify your author email for GitHub Streaks",
+		Text: "Hi " + u.Login + ",\n\n" +
+			"Open this link to count commits authored by " + email + " toward your streaks:\n\n" +
+			UserEmailVerificationURL(u.UID, email) + "\n\n" +
+			"If you didn't add this email, you can ignore this message.\n",
+	})
+}
+
+type userEmailForm struct {
+	Email string `schema:"email"`
+}
+
+func serveAddUserEmail(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form userEmailForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	email, err := ParseEmail(form.Email)
+	if err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	if err := AddUserEmail(*a.User, email); err != nil {
+		return wrapError(err)
+	}
+	if err := SendUserEmailVerification(*a.User, email); err != nil {
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: "/settings", Code: http.StatusSeeOther}
+}
+
+func serveVerifyUserEmail(c web.C, w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	if err := VerifySignedQuery(SignUserEmailVerify, q, time.Now()); err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	uid, err := strconv.Atoi(q.Get("uid"))
+	if err != nil {
+		return &HTTPError{Err: wrapError(err), Code: http.StatusBadRequest}
+	}
+	if err := VerifyUserEmail(uid, q.Get("email")); err != nil {
+		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+			return &HTTPError{
+				Err:  errors.Errorf("%s was already verified by another user", q.Get("email")),
+				Code: http.StatusConflict,
+			}
+		}
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: "/settings", Code: http.StatusSeeOther}
+}
+
+func serveDeleteUserEmail(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form userEmailForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	if err := DeleteUserEmail(*a.User, strings.ToLower(form.Email)); err != nil {
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: "/settings", Code: http.StatusSeeOther}
+}
+
+// VerifyAccountEmail marks the email of the user with uid as verified,
+// as long as it is still email.
+func VerifyAccountEmail(uid int, email string) error {
+	b := &db.Binder{}
+	query := `UPDATE "user" SET email_verified = true WHERE uid = ` + b.Bind(uid) +
+		` AND email = ` + b.Bind(email)
+	res, err := db.DB.Exec(query, b.Items...)
+	if err != nil {
+		return wrapErrorf(err, "error verifying email %s for user %d", email, uid)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(err)
+	}
+	if n == 0 {
+		return errors.Errorf("user %d's email is no longer %s", uid, email)
+	}
+	return nil
+}
+
+// AccountEmailVerificationURL returns the link that verifies email as
+// the email of the user with uid.
+func AccountEmailVerificationURL(uid int, email string) string {
+	v := url.Values{}
+	v.Set("uid", strconv.Itoa(uid))
+	v.Set("email", email)
+	return AbsoluteURL("/email/verify?" + SignQuery(SignAccountEmailVerify, v, time.Now().Add(emailVerificationTTL)))
+}
+
+// SendAccountEmailVerification mails the verification link for email,
+// u's new email, to email.
+func SendAccountEmailVerification(u User, email string) error {
+	return SendMail(Mail{
+		To:      email,
+		Subject: "Verify your email for GitHub Streaks",
+		Text: "Hi " + u.Login + ",\n\n" +
+			"Open this link to get GitHub Streaks digests and reminders at " + email + ":\n\n" +
+			AccountEmailVerificationURL(u.UID, email) + "\n\n" +
+			"If you didn't sign up for GitHub Streaks, you can ignore this message.\n",
+	})
+}
+
+func serveVerifyAccountEmail(c web.C, w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	if err := VerifySignedQuery(SignAccountEmailVerify, q, time.Now()); err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	uid, err := strconv.Atoi(q.Get("uid"))
+	if err != nil {
+		return &HTTPError{Err: wrapError(err), Code: http.StatusBadRequest}
+	}
+	if err := VerifyAccountEmail(uid, q.Get("email")); err != nil {
+		if strings.Contains(err.Error(), "is no longer") {
+			return &HTTPError{Err: err, Code: http.StatusConflict}
+		}
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: "/", Code: http.StatusSeeOther}
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/zenazn/goji/web"
+)
+
+// exportVersion is the version of the export format. Imports refuse
+// exports from newer versions.
+const exportVersion = 1
+
+// ExportProfile is the user's profile in an export.
+type ExportProfile struct {
+	Login          string `json:"login"`
+	Provider       string `json:"provider"`
+	Email          string `json:"email,omitempty"`
+	EmailVerified  bool   `json:"email_verified"`
+	Timezone       string `json:"timezone,omitempty"`
+	ProfilePrivate bool   `json:"profile_private"`
+}
+
+// ExportSettings are the user's settings in an export.
+type ExportSettings struct {
+	RepoFilter   ExportRepoFilter `json:"repo_filter"`
+	Reminder     ExportReminder   `json:"reminder"`
+	Digests      []ExportDigest   `json:"digests"`
+	AuthorEmails []ExportEmail    `json:"author_emails"`
+	Accounts     []ExportAccount  `json:"accounts"`
+}
+
+type ExportRepoFilter struct {
+	Include         string `json:"include"`
+	Exclude         string `json:"exclude"`
+	ExcludeForks    bool   `json:"exclude_forks"`
+	ExcludeArchived bool   `json:"exclude_archived"`
+}
+
+type ExportReminder struct {
+	Enabled    bool   `json:"enabled"`
+	GID        int    `json:"group_id,omitempty"`
+	LocalTime  string `json:"local_time,omitempty"`
+	Email      bool   `json:"email"`
+	WebhookURL string `json:"webhook_url,omitempty"`
+}
+
+type ExportDigest struct {
+	GID       int    `json:"group_id"`
+	Frequency string `json:"frequency"`
+}
+
+type ExportEmail struct {
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
+}
+
+type ExportAccount struct {
+	Provider string `json:"provider"`
+	Login    string `json:"login"`
+}
+
+// ExportGroup is a group the user is in.
+type ExportGroup struct {
+	GID       int        `json:"group_id" db:"gid"`
+	Timezone  string     `json:"timezone" db:"timezone"`
+	CreatedOn time.Time  `json:"created_on" db:"created_on"`
+	JoinedOn  *time.Time `json:"joined_on,omitempty" db:"joined_on"`
+}
+
+// ExportCommit is a commit the user owns or co-authored.
+type ExportCommit struct {
+	SHA        string    `json:"sha" db:"sha"`
+	Provider   string    `json:"provider" db:"provider"`
+	RepoName   string    `json:"repo_name" db:"repo_name"`
+	AuthorDate time.Time `json:"author_date" db:"author_date"`
+	Message    string    `json:"message" db:"message"`
+	Additions  int       `json:"additions" db:"additions"`
+	Deletions  int       `json:"deletions" db:"deletions"`
+	Excluded   bool      `json:"excluded" db:"excluded"`
+	// Coauthored is true for commits owned by someone else.
+	Coauthored bool `json:"coauthored" db:"coauthored"`
+}
+
+type ExportCommitFile struct {
+	CommitSHA string `json:"commit_sha" db:"commit_sha"`
+	Filename  string `json:"filename" db:"filename"`
+	Status    string `json:"status" db:"status"`
+	Additions int    `json:"additions" db:"additions"`
+	Deletions int    `json:"deletions" db:"deletions"`
+	Language  string `json:"language,omitempty" db:"language"`
+	Patch     string `json:"patch" db:"patch"`
+}
+
+type ExportAchievement struct {
+	Key      string    `json:"key"`
+	Name     string    `json:"name"`
+	EarnedOn time.Time `json:"earned_on"`
+}
+
+// exportManifest describes an export. It is manifest.json in the
+// zip.
+type exportManifest struct {
+	Version    int       `json:"version"`
+	ExportedOn time.Time `json:"exported_on"`
+	// Source is the base URL of the instance that made the export.
+	Source string `json:"source"`
+}
+
+// Export is everything githubstreaks stores about a user.
+type Export struct {
+	ExportedOn   time.Time
+	Source       string
+	Profile      ExportProfile
+	Settings     ExportSettings
+	Groups       []ExportGroup
+	Commits      []ExportCommit
+	CommitFiles  []ExportCommitFile
+	Achievements []ExportAchievement
+}
+
+// exportTime formats times in CSV files.
+func exportTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// exportFile is a file in an export's zip.
+type exportFile struct {
+	name string
+	// v is written as JSON if rows is nil, and as CSV otherwise.
+	v    interface{}
+	rows [][]string
+}
+
+// files returns the files in e's zip, in order. Every list is
+// written as JSON, which imports read, and as CSV, for spreadsheets.
+func (e Export) files() []exportFile {
+	groups := [][]string{{"group_id", "timezone", "created_on", "joined_on"}}
+	for _, g := range e.Groups {
+		joined := ""
+		if g.JoinedOn != nil {
+			joined = exportTime(*g.JoinedOn)
+		}
+		groups = append(groups, []string{strconv.Itoa(g.GID), g.Timezone, exportTime(g.CreatedOn), joined})
+	}
+	commits := [][]string{{"sha", "provider", "repo_name", "author_date", "message", "additions", "deletions", "excluded", "coauthored"}}
+	for _, c := range e.Commits {
+		commits = append(commits, []string{c.SHA, c.Provider, c.RepoName, exportTime(c.AuthorDate), c.Message,
+			strconv.Itoa(c.Additions), strconv.Itoa(c.Deletions), strconv.FormatBool(c.Excluded), strconv.FormatBool(c.Coauthored)})
+	}
+	// Patches are left out of the CSV; they are in the JSON.
+	files := [][]string{{"commit_sha", "filename", "status", "additions", "deletions", "language"}}
+	for _, f := range e.CommitFiles {
+		files = append(files, []string{f.CommitSHA, f.Filename, f.Status,
+			strconv.Itoa(f.Additions), strconv.Itoa(f.Deletions), f.Language})
+	}
+	achievements := [][]string{{"key", "name", "earned_on"}}
+	for _, a := range e.Achievements {
+		achievements = append(achievements, []string{a.Key, a.Name, exportTime(a.EarnedOn)})
+	}
+	return []exportFile{
+		{name: "manifest.json", v: exportManifest{Version: exportVersion, ExportedOn: e.ExportedOn, Source: e.Source}},
+		{name: "profile.json", v: e.Profile},
+		{name: "settings.json", v: e.Settings},
+		{name: "groups.json", v: e.Groups},
+		{name: "groups.csv", rows: groups},
+		{name: "commits.json", v: e.Commits},
+		{name: "commits.csv", rows: commits},
+		{name: "commit_files.json", v: e.CommitFiles},
+		{name: "commit_files.csv", rows: files},
+		{name: "achievements.json", v: e.Achievements},
+		{name: "achievements.csv", rows: achievements},
+	}
+}
+
+// WriteZip writes e to w as a zip of JSON and CSV files.
+func (e Export) WriteZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	for _, f := range e.files() {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate})
+		if err != nil {
+			return wrapError(err)
+		}
+		if f.rows != nil {
+			cw := csv.NewWriter(fw)
+			cw.WriteAll(f.rows)
+			if err := cw.Error(); err != nil {
+				return wrapErrorf(err, "error writing %s", f.name)
+			}
+			continue
+		}
+		bs, err := json.MarshalIndent(f.v, "", "  ")
+		if err != nil {
+			return wrapErrorf(err, "error encoding %s", f.name)
+		}
+		if _, err := fw.Write(bs); err != nil {
+			return wrapError(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// ReadExport reads an export written by WriteZip from r, which is
+// size bytes long. Only the JSON files are read.
+func ReadExport(r io.ReaderAt, size int64) (Export, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return Export{}, wrapErrorf(err, "error reading export")
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	decode := func(name string, v interface{}) error {
+		f, ok := files[name]
+		if !ok {
+			return errors.Errorf("export is missing %s", name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return wrapError(err)
+		}
+		defer rc.Close()
+		if err := json.NewDecoder(rc).Decode(v); err != nil {
+			return wrapErrorf(err, "error decoding %s", name)
+		}
+		return nil
+	}
+	var m exportManifest
+	if err := decode("manifest.json", &m); err != nil {
+		return Export{}, err
+	}
+	if m.Version < 1 || m.Version > exportVersion {
+		return Export{}, errors.Errorf("unsupported export version %d", m.Version)
+	}
+	e := Export{ExportedOn: m.ExportedOn, Source: m.Source}
+	for name, v := range map[string]interface{}{
+		"profile.json":      &e.Profile,
+		"settings.json":     &e.Settings,
+		"groups.json":       &e.Groups,
+		"commits.json":      &e.Commits,
+		"commit_files.json": &e.CommitFiles,
+		"achievements.json": &e.Achievements,
+	} {
+		if err := decode(name, v); err != nil {
+			return Export{}, err
+		}
+	}
+	return e, nil
+}
+
+// exportCommitsCond matches the commits u owns or co-authored,
+// including excluded ones. Its parameters are bound in b.
+func exportCommitsCond(b *db.Binder, u User) string {
+	uid := b.Bind(u.UID)
+	return `commit.uid = ` + uid + ` OR commit.sha IN (SELECT sha FROM commit_author WHERE uid = ` + uid + `)`
+}
+
+// BuildExport collects everything stored about u as of now.
+func BuildExport(u User, now time.Time) (Export, error) {
+	e := Export{
+		ExportedOn: now.UTC(),
+		Source:     AbsoluteURL("/"),
+		Profile: ExportProfile{
+			Login:          u.Login,
+			Provider:       u.Provider,
+			Email:          u.Email.String,
+			EmailVerified:  u.EmailVerified,
+			Timezone:       u.Timezone,
+			ProfilePrivate: u.ProfilePrivate,
+		},
+	}
+	f, err := GetRepoFilter(u.UID)
+	if err != nil {
+		return Export{}, wrapError(err)
+	}
+	e.Settings.RepoFilter = ExportRepoFilter{f.Include, f.Exclude, f.ExcludeForks, f.ExcludeArchived}
+	rs, err := GetReminderSetting(u.UID)
+	if err != nil {
+		return Export{}, wrapError(err)
+	}
+	e.Settings.Reminder = ExportReminder{rs.Enabled, rs.GID, rs.LocalTime, rs.Email, rs.WebhookURL}
+	es, err := GetUserEmails(u)
+	if err != nil {
+		return Export{}, wrapError(err)
+	}
+	for _, ue := range es {
+		e.Settings.AuthorEmails = append(e.Settings.AuthorEmails, ExportEmail{ue.Email, ue.Verified})
+	}
+	as, err := GetUserAccounts(u)
+	if err != nil {
+		return Export{}, wrapError(err)
+	}
+	for _, a := range as {
+		e.Settings.Accounts = append(e.Settings.Accounts, ExportAccount{a.Provider, a.Login})
+	}
+
+	b := &db.Binder{}
+	query := `
+SELECT "group".gid, "group".timezone, "group".created_on, user_group.joined_on
+FROM "group" JOIN user_group USING (gid)
+WHERE user_group.uid = ` + b.Bind(u.UID) + `
+ORDER BY "group".gid ASC`
+	if err := db.DB.Select(&e.Groups, query, b.Items...); err != nil {
+		return Export{}, wrapError(err)
+	}
+	for _, g := range e.Groups {
+		ds, err := GetDigestSubscription(u.UID, g.GID)
+		if err != nil {
+			return Export{}, wrapError(err)
+		}
+		e.Settings.Digests = append(e.Settings.Digests, ExportDigest{g.GID, ds.Frequency})
+	}
+
+	b = &db.Binder{}
+	query = `
+SELECT sha, provider, repo_name, author_date, message, additions, deletions, excluded,
+  commit.uid <> ` + b.Bind(u.UID) + ` AS coauthored
+FROM commit WHERE ` + exportCommitsCond(b, u) + `
+ORDER BY author_date ASC, sha ASC`
+	if err := db.DB.Select(&e.Commits, query, b.Items...); err != nil {
+		return Export{}, wrapError(err)
+	}
+	b = &db.Binder{}
+	query = `
+SELECT commit_sha, filename, status, additions, deletions, coalesce(language, '') AS language, patch
+FROM commit_file WHERE commit_sha IN (SELECT sha FROM commit WHERE ` + exportCommitsCond(b, u) + `)
+ORDER BY commit_sha ASC, filename ASC`
+	if err := db.DB.Select(&e.CommitFiles, query, b.Items...); err != nil {
+		return Export{}, wrapError(err)
+	}
+
+	uas, err := GetUserAchievements(u)
+	if err != nil {
+		return Export{}, wrapError(err)
+	}
+	for _, ua := range uas {
+		e.Achievements = append(e.Achievements, ExportAchievement{ua.Key, ua.Name, ua.EarnedOn})
+	}
+	return e, nil
+}
+
+// DataExport is a user's export, built by an export job.
+type DataExport struct {
+	EID       int       `db:"eid"`
+	UID       int       `db:"uid"`
+	CreatedOn time.Time `db:"created_on"`
+	// Size is the size of the zip in bytes.
+	Size int `db:"size"`
+}
+
+// KB returns e's size in kilobytes, rounded up.
+func (e DataExport) KB() int {
+	return (e.Size + 1023) / 1024
+}
+
+// Only a user's latest export is kept.
+var dataExportSchema = `
+CREATE TABLE IF NOT EXISTS data_export (
+  eid serial PRIMARY KEY,
+  uid integer REFERENCES "user" (uid) NOT NULL,
+  data bytea NOT NULL,
+  created_on timestamp NOT NULL
+)`
+
+func init() {
+	jobHandlers[ExportJob] = runExportJob
+}
+
+// saveDataExport saves data as u's export, replacing their older
+// exports.
+func saveDataExport(u User, data []byte) (DataExport, error) {
+	b := &db.Binder{}
+	query := `
+WITH old AS (
+  DELETE FROM data_export WHERE uid = ` + b.Bind(u.UID) + `
+)
+INSERT INTO data_export(uid, data, created_on)
+  VALUES (` + b.Bind(u.UID, data) + `, current_timestamp)
+  RETURNING eid, uid, created_on, length(data) AS size`
+	var e DataExport
+	if err := db.DB.Get(&e, query, b.Items...); err != nil {
+		return DataExport{}, wrapErrorf(err, "error saving export for user %d", u.UID)
+	}
+	return e, nil
+}
+
+// GetDataExport returns u's latest export, or nil if they don't have
+// one.
+func GetDataExport(u User) (*DataExport, error) {
+	b := &db.Binder{}
+	query := `SELECT eid, uid, created_on, length(data) AS size FROM data_export
+WHERE uid = ` + b.Bind(u.UID) + ` ORDER BY eid DESC LIMIT 1`
+	var e DataExport
+	if err := db.DB.Get(&e, query, b.Items...); err != nil {
+		if strings.Contains(err.Error(), sqlNotFound) {
+			return nil, nil
+		}
+		return nil, wrapError(err)
+	}
+	return &e, nil
+}
+
+// exportLinkTTL is how long export download links work.
+const exportLinkTTL = 7 * 24 * time.Hour
+
+// DataExportURL returns the signed download link for e.
+func DataExportURL(e DataExport) string {
+	q := SignQuery(SignExportDownload, url.Values{"eid": {strconv.Itoa(e.EID)}}, e.CreatedOn.Add(exportLinkTTL))
+	return AbsoluteURL("/export/download?" + q)
+}
+
+// ExportJob is the kind of job that builds a user's export.
+const ExportJob = "export"
+
+func runExportJob(j *Job) error {
+	u, err := GetUser(UserSpec{UID: j.UID})
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := j.Checkpoint("", "Collecting your data"); err != nil {
+		return wrapError(err)
+	}
+	e, err := BuildExport(u, time.Now())
+	if err != nil {
+		return wrapError(err)
+	}
+	var buf bytes.Buffer
+	if err := e.WriteZip(&buf); err != nil {
+		return wrapError(err)
+	}
+	de, err := saveDataExport(u, buf.Bytes())
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := j.Checkpoint("", "Your export is ready on the settings page"); err != nil {
+		return wrapError(err)
+	}
+	if u.Email.Valid && u.EmailVerified {
+		return SendMail(Mail{
+			To:      u.Email.String,
+			Subject: "Your GitHub Streaks export is ready",
+			Text: "Hi " + u.Login + ",\n\n" +
+				"Download everything GitHub Streaks stores about you from this link. It works for a week:\n\n" +
+				DataExportURL(de) + "\n",
+		})
+	}
+	return nil
+}
+
+func serveRequestExport(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	active, err := HasActiveJob(*a.User, ExportJob)
+	if err != nil {
+		return wrapError(err)
+	}
+	if !active {
+		if _, err := EnqueueJob(*a.User, ExportJob, struct{}{}); err != nil {
+			return wrapError(err)
+		}
+	}
+	return &HTTPRedirect{To: "/settings", Code: http.StatusSeeOther}
+}
+
+// serveDownloadExport serves an export from a signed link, so that
+// the link in the email works without logging in.
+func serveDownloadExport(c web.C, w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	if err := VerifySignedQuery(SignExportDownload, q, time.Now()); err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	eid, err := strconv.Atoi(q.Get("eid"))
+	if err != nil {
+		return &HTTPError{Err: wrapError(err), Code: http.StatusBadRequest}
+	}
+	b := &db.Binder{}
+	query := `SELECT data_export.data, "user".login FROM data_export JOIN "user" USING (uid)
+WHERE eid = ` + b.Bind(eid)
+	var row struct {
+		Data  []byte `db:"data"`
+		Login string `db:"login"`
+	}
+	if err := db.DB.Get(&row, query, b.Items...); err != nil {
+		if strings.Contains(err.Error(), sqlNotFound) {
+			return &HTTPError{Err: errors.New("this export was replaced by a newer one"), Code: http.StatusNotFound}
+		}
+		return wrapError(err)
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="githubstreaks-`+row.Login+`.zip"`)
+	_, err = w.Write(row.Data)
+	return err
+}
+
+// ImportResult counts what ImportExport imported.
+type ImportResult struct {
+	Commits      int
+	Skipped      int
+	Achievements int
+}
+
+// ImportExport imports e into u's account. It imports u's settings
+// that don't depend on groups, the commits u owns with their files,
+// and achievements. Groups are specific to the instance the export
+// came from, so they, and the group settings, are not imported.
+// Co-authored commits belong to other users and are skipped, as are
+// commits that already exist. Author emails must be verified again.
+func ImportExport(u User, e Export) (ImportResult, error) {
+	var res ImportResult
+	if tz, err := ParseTimezone(e.Profile.Timezone); err == nil {
+		if err := SetUserTimezone(u, tz); err != nil {
+			return res, wrapError(err)
+		}
+	}
+	if err := SetProfilePrivate(u, e.Profile.ProfilePrivate); err != nil {
+		return res, wrapError(err)
+	}
+	if !u.Email.Valid && e.Profile.Email != "" {
+		if err := SetEmail(u, e.Profile.Email); err != nil {
+			return res, wrapError(err)
+		}
+	}
+	for _, ue := range e.Settings.AuthorEmails {
+		if err := AddUserEmail(u, ue.Email); err != nil &&
+			!strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+			return res, wrapError(err)
+		}
+	}
+	rf := e.Settings.RepoFilter
+	f := RepoFilter{
+		UID:             u.UID,
+		Include:         rf.Include,
+		Exclude:         rf.Exclude,
+		ExcludeForks:    rf.ExcludeForks,
+		ExcludeArchived: rf.ExcludeArchived,
+	}
+	if err := SetRepoFilter(f); err != nil {
+		return res, wrapError(err)
+	}
+
+	files := make(map[string][]CommitFile)
+	for _, f := range e.CommitFiles {
+		files[f.CommitSHA] = append(files[f.CommitSHA], CommitFile{
+			CommitSHA: f.CommitSHA,
+			Filename:  f.Filename,
+			Status:    f.Status,
+			Additions: f.Additions,
+			Deletions: f.Deletions,
+			Patch:     f.Patch,
+		})
+	}
+	for _, ec := range e.Commits {
+		if ec.Coauthored {
+			res.Skipped++
+			continue
+		}
+		c := Commit{
+			SHA:        ec.SHA,
+			UID:        u.UID,
+			AuthorDate: ec.AuthorDate.UTC(),
+			RepoName:   ec.RepoName,
+			Message:    ec.Message,
+			Additions:  ec.Additions,
+			Deletions:  ec.Deletions,
+			Provider:   ec.Provider,
+		}
+		created, err := saveCommit(c, files[c.SHA], nil)
+		if err != nil {
+			return res, wrapError(err)
+		}
+		if created {
+			res.Commits++
+		} else {
+			res.Skipped++
+		}
+	}
+	// The filter decides which of the imported commits are
+	// excluded here.
+	if err := ApplyRepoFilter(u); err != nil {
+		return res, wrapError(err)
+	}
+
+	for _, a := range e.Achievements {
+		b := &db.Binder{}
+		query := `INSERT INTO user_achievement(uid, key, earned_on) VALUES (` +
+			b.Bind(u.UID, a.Key, a.EarnedOn.UTC()) + `) ON CONFLICT DO NOTHING`
+		r, err := db.DB.Exec(query, b.Items...)
+		if err != nil {
+			return res, wrapError(err)
+		}
+		if n, err := r.RowsAffected(); err == nil {
+			res.Achievements += int(n)
+		}
+	}
+	return res, nil
+}
+
+// importExportCommand imports an export zip into a user's account.
+// The user is created if they don't exist.
+func importExportCommand(args []string) error {
+	fs := flag.NewFlagSet("import-export", flag.ContinueOnError)
+	login := fs.String("login", "", "Login of the user to import into (default the export's login).")
+	host := fs.String("host", "", "GitHub host of the user (default the export's host).")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("expected one export zip")
+	}
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return wrapError(err)
+	}
+	e, err := ReadExport(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return wrapError(err)
+	}
+	if *login == "" {
+		*login = e.Profile.Login
+	}
+	if *host == "" {
+		*host = e.Profile.Provider
+	}
+	if _, err := GetGitHubHost(*host); err != nil {
+		return wrapErrorf(err, "unknown host %q; pass -host", *host)
+	}
+	u, err := GetCreateUser(*host, *login)
+	if err != nil {
+		return wrapErrorf(err, "error getting user %s", *login)
+	}
+	res, err := ImportExport(u, e)
+	if err != nil {
+		return wrapError(err)
+	}
+	evaluateAchievements(u)
+	os.Stdout.WriteString("Imported " + strconv.Itoa(res.Commits) + " commits (skipped " +
+		strconv.Itoa(res.Skipped) + ") and " + strconv.Itoa(res.Achievements) + " achievements into " +
+		u.Login + ".\n")
+	return nil
+}
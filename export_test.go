@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testExport() Export {
+	joined := time.Date(2015, 8, 2, 0, 0, 0, 0, time.UTC)
+	return Export{
+		ExportedOn: time.Date(2015, 8, 21, 8, 0, 0, 0, time.UTC),
+		Source:     "https://streaks.example.com/",
+		Profile:    ExportProfile{Login: "samertm", Provider: GitHubProvider, Email: "samer@example.com", EmailVerified: true, Timezone: "America/New_York"},
+		Settings: ExportSettings{
+			RepoFilter:   ExportRepoFilter{Exclude: "samertm/dotfiles", ExcludeForks: true},
+			Reminder:     ExportReminder{Enabled: true, GID: 1, LocalTime: "20:00", Email: true},
+			Digests:      []ExportDigest{{GID: 1, Frequency: "weekly"}},
+			AuthorEmails: []ExportEmail{{Email: "samer@work.example.com", Verified: true}},
+			Accounts:     []ExportAccount{{Provider: GitHubProvider, Login: "samertm"}},
+		},
+		Groups: []ExportGroup{{GID: 1, Timezone: "America/Los_Angeles", CreatedOn: time.Date(2015, 8, 1, 0, 0, 0, 0, time.UTC), JoinedOn: &joined}},
+		Commits: []ExportCommit{
+			{SHA: "a1", Provider: GitHubProvider, RepoName: "samertm/githubstreaks", AuthorDate: time.Date(2015, 8, 20, 9, 0, 0, 0, time.UTC),
+				Message: "Fix \"quotes\", commas\nand lines", Additions: 3, Deletions: 1},
+			{SHA: "b2", Provider: GitHubProvider, RepoName: "ada/engine", AuthorDate: time.Date(2015, 8, 20, 10, 0, 0, 0, time.UTC),
+				Message: "Pair on the engine", Coauthored: true},
+		},
+		CommitFiles:  []ExportCommitFile{{CommitSHA: "a1", Filename: "main.go", Status: "modified", Additions: 3, Deletions: 1, Language: "Go", Patch: "@@ -1 +1 @@"}},
+		Achievements: []ExportAchievement{{Key: "language:Go", Name: "First Go commit", EarnedOn: time.Date(2015, 8, 20, 9, 0, 0, 0, time.UTC)}},
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	e := testExport()
+	var buf bytes.Buffer
+	if err := e.WriteZip(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadExport(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, e) {
+		t.Errorf("got %+v, expected %+v", got, e)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testExport().WriteZip(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var commits string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.Name != "commits.csv" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits = string(bs)
+	}
+	expectedNames := []string{"manifest.json", "profile.json", "settings.json", "groups.json", "groups.csv",
+		"commits.json", "commits.csv", "commit_files.json", "commit_files.csv", "achievements.json", "achievements.csv"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("got files %v, expected %v", names, expectedNames)
+	}
+	expected := `sha,provider,repo_name,author_date,message,additions,deletions,excluded,coauthored
+a1,github,samertm/githubstreaks,2015-08-20T09:00:00Z,"Fix ""quotes"", commas
+and lines",3,1,false,false
+b2,github,ada/engine,2015-08-20T10:00:00Z,Pair on the engine,0,0,false,true
+`
+	if commits != expected {
+		t.Errorf("got commits.csv:\n%s\nexpected:\n%s", commits, expected)
+	}
+}
+
+func TestReadExportVersion(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("manifest.json")
+	w.Write([]byte(`{"version": 2}`))
+	zw.Close()
+	if _, err := ReadExport(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err == nil {
+		t.Error("expected an error for a newer export version")
+	}
+}
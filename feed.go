@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/zenazn/goji/web"
+)
+
+// FeedToken authenticates a user's feed reader, which can't log in.
+type FeedToken struct {
+	UID       int       `db:"uid"`
+	Token     string    `db:"token"`
+	CreatedOn time.Time `db:"created_on"`
+}
+
+var feedTokenSchema = `
+CREATE TABLE IF NOT EXISTS feed_token (
+  uid integer PRIMARY KEY REFERENCES "user" (uid),
+  token text NOT NULL UNIQUE,
+  created_on timestamp NOT NULL
+)`
+
+func newFeedToken() (string, error) {
+	bs := make([]byte, 20)
+	if _, err := rand.Read(bs); err != nil {
+		return "", wrapError(err)
+	}
+	return hex.EncodeToString(bs), nil
+}
+
+// GetFeedToken returns u's feed token, creating it if u doesn't have
+// one yet.
+func GetFeedToken(u User) (string, error) {
+	token, err := newFeedToken()
+	if err != nil {
+		return "", wrapError(err)
+	}
+	b := &db.Binder{}
+	query := `
+WITH i AS (
+  INSERT INTO feed_token(uid, token, created_on) VALUES (` + b.Bind(u.UID, token) + `, current_timestamp)
+  ON CONFLICT (uid) DO NOTHING RETURNING token
+)
+SELECT token FROM i UNION ALL SELECT token FROM feed_token WHERE uid = ` + b.Bind(u.UID)
+	var tokens []string
+	if err := db.DB.Select(&tokens, query, b.Items...); err != nil {
+		return "", wrapErrorf(err, "error getting feed token for user %d", u.UID)
+	}
+	if len(tokens) == 0 {
+		return "", errors.Errorf("no feed token for user %d", u.UID)
+	}
+	return tokens[0], nil
+}
+
+// ResetFeedToken gives u a new feed token, so that feed URLs with the
+// old one stop working.
+func ResetFeedToken(u User) error {
+	token, err := newFeedToken()
+	if err != nil {
+		return wrapError(err)
+	}
+	b := &db.Binder{}
+	query := `
+INSERT INTO feed_token(uid, token, created_on) VALUES (` + b.Bind(u.UID, token) + `, current_timestamp)
+ON CONFLICT (uid) DO UPDATE SET token = excluded.token, created_on = excluded.created_on`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error resetting feed token for user %d", u.UID)
+	}
+	return nil
+}
+
+// GetFeedTokenUser returns the user with token.
+func GetFeedTokenUser(token string) (User, error) {
+	b := &db.Binder{}
+	query := `SELECT uid FROM feed_token WHERE token = ` + b.Bind(token)
+	var uid int
+	if err := db.DB.Get(&uid, query, b.Items...); err != nil {
+		return User{}, wrapError(err)
+	}
+	return GetUser(UserSpec{UID: uid})
+}
+
+// GroupFeedURL returns the URL of g's feed in format, "atom" or
+// "rss", authenticated by token.
+func GroupFeedURL(g Group, token, format string) string {
+	return AbsoluteURL(GroupURL(g) + "/feed." + format + "?token=" + token)
+}
+
+// FeedEntry is an entry in a feed. Content is HTML.
+type FeedEntry struct {
+	ID      string
+	Title   string
+	Link    string
+	Author  string
+	Updated time.Time
+	Content string
+}
+
+type sortableFeedEntries []FeedEntry
+
+func (s sortableFeedEntries) Len() int      { return len(s) }
+func (s sortableFeedEntries) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortableFeedEntries) Less(i, j int) bool {
+	if !s[i].Updated.Equal(s[j].Updated) {
+		return s[i].Updated.After(s[j].Updated)
+	}
+	return s[i].ID < s[j].ID
+}
+
+// Feed is a group's activity, for feed readers.
+type Feed struct {
+	ID      string
+	Title   string
+	Link    string
+	Updated time.Time
+	Entries []FeedEntry
+}
+
+// feedDays is the number of days of activity in a feed, and
+// feedMaxEntries is the most entries it has.
+const (
+	feedDays       = 30
+	feedMaxEntries = 100
+)
+
+// feedEntryID returns a stable ID for a feed entry.
+func feedEntryID(g Group, u User, kind string, day time.Time) string {
+	return "urn:githubstreaks:group:" + strconv.Itoa(g.GID) + ":user:" + strconv.Itoa(u.UID) +
+		":" + kind + ":" + day.Format("2006-01-02")
+}
+
+// dayEntryContent summarizes commits as HTML, by repo.
+func dayEntryContent(commits []Commit) string {
+	buf := &bytes.Buffer{}
+	for _, cg := range CommitGroups(commits) {
+		fmt.Fprintf(buf, "<p><strong>%s</strong> (%d commit%s)</p>\n<ul>\n",
+			html.EscapeString(cg.RepoID), len(cg.Commits), plural(len(cg.Commits)))
+		for _, c := range cg.Commits {
+			fmt.Fprintf(buf, "<li>%s</li>\n", html.EscapeString(CommitMessageTitle(c.Message)))
+		}
+		buf.WriteString("</ul>\n")
+	}
+	return buf.String()
+}
+
+// BuildGroupFeed builds g's feed as of now, given the commits of each
+// of g's users. Each user gets an entry per day with commits, and an
+// entry for each streak milestone they reached.
+func BuildGroupFeed(g Group, us []User, commits map[int][]Commit, loc *time.Location, now time.Time) Feed {
+	link := AbsoluteURL(GroupURL(g))
+	f := Feed{
+		ID:      "urn:githubstreaks:group:" + strconv.Itoa(g.GID),
+		Title:   "GitHub Streaks group " + strconv.Itoa(g.GID),
+		Link:    link,
+		Updated: g.CreatedOn,
+	}
+	since := BeginningOfDay(now.In(loc)).AddDate(0, 0, -feedDays)
+	if created := BeginningOfDay(g.CreatedOn.In(loc)); created.After(since) {
+		since = created
+	}
+	for _, u := range us {
+		dcgs := DayCommitGroups(commits[u.UID], loc)
+		streak := 0
+		// Walk the days oldest first to count streaks.
+		for i := len(dcgs) - 1; i >= 0; i-- {
+			dcg := dcgs[i]
+			if i < len(dcgs)-1 && nextDay(dcgs[i+1].Day).Equal(dcg.Day) {
+				streak++
+			} else {
+				streak = 1
+			}
+			if dcg.Day.Before(since) {
+				continue
+			}
+			n := len(dcg.Commits)
+			f.Entries = append(f.Entries, FeedEntry{
+				ID:      feedEntryID(g, u, "day", dcg.Day),
+				Title:   fmt.Sprintf("%s made %d commit%s on %s", u.Login, n, plural(n), dcg.Day.Format("Monday, January 2")),
+				Link:    link,
+				Author:  u.Login,
+				Updated: dcg.Commits[0].AuthorDate,
+				Content: dayEntryContent(dcg.Commits),
+			})
+			if isStreakMilestone(streak) {
+				f.Entries = append(f.Entries, FeedEntry{
+					ID:     feedEntryID(g, u, "streak", dcg.Day),
+					Title:  fmt.Sprintf("%s reached a %d day streak!", u.Login, streak),
+					Link:   link,
+					Author: u.Login,
+					// The day's first commit reached the
+					// milestone.
+					Updated: dcg.Commits[n-1].AuthorDate,
+					Content: "<p>" + html.EscapeString(u.Login) + " has committed every day since " +
+						dcg.Day.AddDate(0, 0, 1-streak).Format("Monday, January 2") + ".</p>",
+				})
+			}
+		}
+	}
+	sort.Sort(sortableFeedEntries(f.Entries))
+	if len(f.Entries) > feedMaxEntries {
+		f.Entries = f.Entries[:feedMaxEntries]
+	}
+	if len(f.Entries) > 0 {
+		f.Updated = f.Entries[0].Updated
+	}
+	return f
+}
+
+// GetGroupFeed returns g's feed as of now.
+func GetGroupFeed(g Group, now time.Time) (Feed, error) {
+	loc, err := GetGroupLocation(g)
+	if err != nil {
+		return Feed{}, wrapError(err)
+	}
+	us, err := GetGroupUsers(g)
+	if err != nil {
+		return Feed{}, wrapError(err)
+	}
+	commits := make(map[int][]Commit)
+	for _, u := range us {
+		// Streaks need every commit, not just the feed's.
+		if commits[u.UID], err = GetUserCommits(u, time.Time{}); err != nil {
+			return Feed{}, wrapError(err)
+		}
+	}
+	return BuildGroupFeed(g, us, commits, loc, now), nil
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Author  atomAuthor `xml:"author"`
+	Link    atomLink   `xml:"link"`
+	Content atomText   `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// WriteAtom writes f to w as an Atom feed whose URL is self.
+func (f Feed) WriteAtom(w io.Writer, self string) error {
+	af := atomFeed{
+		ID:      f.ID,
+		Title:   f.Title,
+		Updated: f.Updated.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "alternate", Href: f.Link}, {Rel: "self", Href: self}},
+	}
+	for _, e := range f.Entries {
+		af.Entries = append(af.Entries, atomEntry{
+			ID:      e.ID,
+			Title:   e.Title,
+			Updated: e.Updated.UTC().Format(time.RFC3339),
+			Author:  atomAuthor{Name: e.Author},
+			Link:    atomLink{Rel: "alternate", Href: e.Link},
+			Content: atomText{Type: "html", Body: e.Content},
+		})
+	}
+	return writeXML(w, af)
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+// WriteRSS writes f to w as an RSS 2.0 feed.
+func (f Feed) WriteRSS(w io.Writer) error {
+	rf := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          f.Link,
+			Description:   "Daily commits and streak milestones in " + f.Title,
+			LastBuildDate: f.Updated.UTC().Format(time.RFC1123Z),
+		},
+	}
+	for _, e := range f.Entries {
+		rf.Channel.Items = append(rf.Channel.Items, rssItem{
+			Title:       e.Title,
+			Link:        e.Link,
+			GUID:        rssGUID{Value: e.ID},
+			PubDate:     e.Updated.UTC().Format(time.RFC1123Z),
+			Description: e.Content,
+		})
+	}
+	return writeXML(w, rf)
+}
+
+func writeXML(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return wrapError(err)
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	if err := e.Encode(v); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+type feedQuery struct {
+	Token string `schema:"token"`
+}
+
+// feedTokenGroup returns the group in c, checking that the request's
+// feed token belongs to a user in the group.
+func feedTokenGroup(c web.C, r *http.Request) (Group, error) {
+	var q feedQuery
+	if err := SchemaDecoder.Decode(&q, r.URL.Query()); err != nil {
+		return Group{}, wrapError(err)
+	}
+	if q.Token == "" {
+		return Group{}, &HTTPError{Err: errors.New("feeds need a token"), Code: http.StatusUnauthorized}
+	}
+	u, err := GetFeedTokenUser(q.Token)
+	if err != nil {
+		if strings.Contains(err.Error(), sqlNotFound) {
+			return Group{}, &HTTPError{Err: errors.New("unknown feed token"), Code: http.StatusForbidden}
+		}
+		return Group{}, wrapError(err)
+	}
+	return memberGroup(u, c)
+}
+
+func serveGroupFeedAtom(c web.C, w http.ResponseWriter, r *http.Request) error {
+	g, err := feedTokenGroup(c, r)
+	if err != nil {
+		return err
+	}
+	f, err := GetGroupFeed(g, time.Now())
+	if err != nil {
+		return wrapError(err)
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	return f.WriteAtom(w, AbsoluteURL(r.URL.RequestURI()))
+}
+
+func serveGroupFeedRSS(c web.C, w http.ResponseWriter, r *http.Request) error {
+	g, err := feedTokenGroup(c, r)
+	if err != nil {
+		return err
+	}
+	f, err := GetGroupFeed(g, time.Now())
+	if err != nil {
+		return wrapError(err)
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	return f.WriteRSS(w)
+}
+
+func serveResetFeedToken(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	g, err := memberGroup(*a.User, c)
+	if err != nil {
+		return err
+	}
+	if err := ResetFeedToken(*a.User); err != nil {
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: GroupURL(g) + "#feeds", Code: http.StatusSeeOther}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func feedTestGroup() (Group, []User, map[int][]Commit, time.Time) {
+	g := Group{GID: 3, CreatedOn: time.Date(2015, 8, 1, 0, 0, 0, 0, time.UTC)}
+	us := []User{{UID: 1, Login: "samertm"}, {UID: 2, Login: "ada"}}
+	commits := map[int][]Commit{}
+	for d := 14; d <= 20; d++ {
+		commits[1] = append(commits[1], Commit{
+			SHA: "s" + strconv.Itoa(d), RepoName: "samertm/githubstreaks", Provider: GitHubProvider,
+			Message: "Fix day " + strconv.Itoa(d) + "\n\nDetails.", AuthorDate: time.Date(2015, 8, d, 10, 0, 0, 0, time.UTC),
+		})
+	}
+	commits[2] = []Commit{{SHA: "a1", RepoName: "ada/engine", Provider: GitHubProvider,
+		Message: "Add <notes>", AuthorDate: time.Date(2015, 8, 20, 9, 0, 0, 0, time.UTC)}}
+	return g, us, commits, time.Date(2015, 8, 21, 8, 0, 0, 0, time.UTC)
+}
+
+func TestBuildGroupFeed(t *testing.T) {
+	g, us, commits, now := feedTestGroup()
+	f := BuildGroupFeed(g, us, commits, time.UTC, now)
+	if len(f.Entries) != 9 {
+		t.Fatalf("Got %d entries, want 9", len(f.Entries))
+	}
+	for i, want := range []string{
+		"samertm made 1 commit on Thursday, August 20",
+		"samertm reached a 7 day streak!",
+		"ada made 1 commit on Thursday, August 20",
+		"samertm made 1 commit on Wednesday, August 19",
+	} {
+		if f.Entries[i].Title != want {
+			t.Errorf("Entry %d is %q, want %q", i, f.Entries[i].Title, want)
+		}
+	}
+	if c := f.Entries[2].Content; !strings.Contains(c, "<strong>ada/engine</strong>") ||
+		!strings.Contains(c, "<li>Add &lt;notes&gt;</li>") {
+		t.Errorf("Got content %q", c)
+	}
+	if !f.Updated.Equal(f.Entries[0].Updated) {
+		t.Errorf("Got feed updated %s, want %s", f.Updated, f.Entries[0].Updated)
+	}
+}
+
+func TestFeedWriteAtom(t *testing.T) {
+	g, us, commits, now := feedTestGroup()
+	f := BuildGroupFeed(g, us, commits, time.UTC, now)
+	buf := &bytes.Buffer{}
+	if err := f.WriteAtom(buf, "/group/3/feed.atom?token=x"); err != nil {
+		t.Fatal(err)
+	}
+	var got atomFeed
+	if err := xml.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Entries) != len(f.Entries) || got.Entries[0].Title != f.Entries[0].Title ||
+		got.Entries[0].Updated != "2015-08-20T10:00:00Z" || got.Entries[0].Content.Type != "html" {
+		t.Errorf("Got feed %+v", got)
+	}
+}
+
+func TestFeedWriteRSS(t *testing.T) {
+	g, us, commits, now := feedTestGroup()
+	f := BuildGroupFeed(g, us, commits, time.UTC, now)
+	buf := &bytes.Buffer{}
+	if err := f.WriteRSS(buf); err != nil {
+		t.Fatal(err)
+	}
+	var got rssFeed
+	if err := xml.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	items := got.Channel.Items
+	if got.Version != "2.0" || len(items) != len(f.Entries) || items[1].Title != "samertm reached a 7 day streak!" ||
+		items[0].PubDate != "Thu, 20 Aug 2015 10:00:00 +0000" || items[0].GUID.IsPermaLink {
+		t.Errorf("Got feed %+v", got)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/google/go-github/github"
+	"github.com/samertm/githubstreaks/conf"
+	"github.com/samertm/githubstreaks/debug"
+	"golang.org/x/oauth2"
+	githuboauth "golang.org/x/oauth2/github"
+)
+
+// GitHubHost is a GitHub instance that users log in with, either
+// github.com or a GitHub Enterprise Server.
+type GitHubHost struct {
+	// Provider is stored with the host's users, accounts and
+	// commits. The default host's provider is GitHubProvider.
+	Provider string
+	// Name is the host's name, as shown to users.
+	Name string
+	// WebURL is the URL of the host's website, without a
+	// trailing slash.
+	WebURL string
+	OAuth  oauth2.Config
+	// APIURL and UploadURL are nil for github.com, which uses
+	// go-github's defaults.
+	APIURL    *url.URL
+	UploadURL *url.URL
+}
+
+const defaultGitHubWebURL = "https://github.com"
+
+// githubHosts holds all of the configured GitHub hosts, keyed by
+// provider.
+var githubHosts = make(map[string]*GitHubHost)
+
+// defaultGitHubHost is the host configured by the top-level GitHub
+// options. It is github.com unless GitHubWebURL is set.
+var defaultGitHubHost *GitHubHost
+
+func init() {
+	h, err := newGitHubHost(GitHubProvider, conf.GitHubHost{
+		Name:         "GitHub",
+		WebURL:       conf.Config.GitHubWebURL,
+		APIURL:       conf.Config.GitHubAPIURL,
+		UploadURL:    conf.Config.GitHubUploadURL,
+		ClientID:     conf.Config.GitHubID,
+		ClientSecret: conf.Config.GitHubSecret,
+	})
+	if err != nil {
+		debug.Fatalf("Error configuring GitHub: %s", err)
+	}
+	defaultGitHubHost = h
+	githubHosts[h.Provider] = h
+	for _, c := range conf.Config.GitHubHosts {
+		switch c.Name {
+		case "", GitHubProvider, GitLabProvider, GiteaProvider, LocalProvider:
+			debug.Fatalf("Invalid GitHub host name %q", c.Name)
+		}
+		if _, ok := githubHosts[c.Name]; ok {
+			debug.Fatalf("Duplicate GitHub host name %q", c.Name)
+		}
+		h, err := newGitHubHost(c.Name, c)
+		if err != nil {
+			debug.Fatalf("Error configuring GitHub host %s: %s", c.Name, err)
+		}
+		githubHosts[h.Provider] = h
+	}
+}
+
+// newGitHubHost creates the host for provider from c. If c.WebURL is
+// not github.com, the API and upload URLs default to the GitHub
+// Enterprise Server paths under c.WebURL.
+func newGitHubHost(provider string, c conf.GitHubHost) (*GitHubHost, error) {
+	h := &GitHubHost{
+		Provider: provider,
+		Name:     c.Name,
+		WebURL:   strings.TrimSuffix(c.WebURL, "/"),
+		OAuth: oauth2.Config{
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			Scopes:       []string{"user:email"},
+			Endpoint:     githuboauth.Endpoint,
+		},
+	}
+	if h.WebURL == "" {
+		h.WebURL = defaultGitHubWebURL
+	}
+	if h.Name == "" {
+		h.Name = provider
+	}
+	if h.WebURL != defaultGitHubWebURL {
+		h.OAuth.Endpoint = oauth2.Endpoint{
+			AuthURL:  h.WebURL + "/login/oauth/authorize",
+			TokenURL: h.WebURL + "/login/oauth/access_token",
+		}
+		if c.APIURL == "" {
+			c.APIURL = h.WebURL + "/api/v3/"
+		}
+		if c.UploadURL == "" {
+			c.UploadURL = h.WebURL + "/api/uploads/"
+		}
+	}
+	if provider != GitHubProvider {
+		// The callback needs to know which host the user
+		// logged in with.
+		h.OAuth.RedirectURL = AbsoluteURL("/github_callback?host=" + url.QueryEscape(provider))
+	}
+	var err error
+	if h.APIURL, err = parseBaseURL(c.APIURL); err != nil {
+		return nil, err
+	}
+	if h.UploadURL, err = parseBaseURL(c.UploadURL); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// parseBaseURL parses a go-github base URL, which must end with a
+// slash. It returns nil if s is empty.
+func parseBaseURL(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.HasSuffix(s, "/") {
+		s += "/"
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, wrapErrorf(err, "error parsing URL %q", s)
+	}
+	return u, nil
+}
+
+// GetGitHubHost returns the host for provider. The empty string is
+// the default host.
+func GetGitHubHost(provider string) (*GitHubHost, error) {
+	if provider == "" {
+		return defaultGitHubHost, nil
+	}
+	h, ok := githubHosts[provider]
+	if !ok {
+		return nil, errors.Errorf("GitHub host %q is not configured", provider)
+	}
+	return h, nil
+}
+
+// OtherGitHubHosts returns the configured hosts other than the
+// default host, sorted by name.
+func OtherGitHubHosts() []*GitHubHost {
+	var hs []*GitHubHost
+	for _, h := range githubHosts {
+		if h != defaultGitHubHost {
+			hs = append(hs, h)
+		}
+	}
+	sort.Sort(sortableGitHubHosts(hs))
+	return hs
+}
+
+type sortableGitHubHosts []*GitHubHost
+
+func (s sortableGitHubHosts) Len() int           { return len(s) }
+func (s sortableGitHubHosts) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sortableGitHubHosts) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// LoginURL returns the url for logging in with h.
+func (h *GitHubHost) LoginURL() string {
+	if h.Provider == GitHubProvider {
+		return "/login"
+	}
+	return "/login?host=" + url.QueryEscape(h.Provider)
+}
+
+// Client returns a go-github client for h that makes requests with
+// httpClient.
+func (h *GitHubHost) Client(httpClient *http.Client) *github.Client {
+	client := github.NewClient(httpClient)
+	if h.APIURL != nil {
+		client.BaseURL = h.APIURL
+	}
+	if h.UploadURL != nil {
+		client.UploadURL = h.UploadURL
+	}
+	return client
+}
+
+// TokenClient returns a client for h that makes requests with a
+// user's token.
+func (h *GitHubHost) TokenClient(token *oauth2.Token) *github.Client {
+	return h.Client(&http.Client{
+		Transport: &oauth2.Transport{
+			Source: oauth2.StaticTokenSource(token),
+			Base:   &RateLimitTransport{Key: TokenRateLimitKey(h, token.AccessToken)},
+		},
+	})
+}
+
+// UnauthedGitHubClient returns a client for h that authenticates
+// with h's OAuth application instead of a user's token. Requests
+// keep reserve requests in the application's rate limit budget. Pass
+// nil for transport to use the default transport.
+func UnauthedGitHubClient(h *GitHubHost, transport http.RoundTripper, reserve int) *github.Client {
+	t := github.UnauthenticatedRateLimitedTransport{
+		ClientID:     h.OAuth.ClientID,
+		ClientSecret: h.OAuth.ClientSecret,
+		Transport: &RateLimitTransport{
+			Key:       AppRateLimitKey(h),
+			Reserve:   reserve,
+			Transport: transport,
+		},
+	}
+	return h.Client(t.Client())
+}
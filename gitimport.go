@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/debug"
+	"github.com/zenazn/goji/web"
+)
+
+// LocalCommit is a commit read from a git repository on disk, as
+// opposed to one fetched from GitHub.
+type LocalCommit struct {
+	SHA         string
+	AuthorName  string
+	AuthorEmail string
+	// AuthorDate is stored as UTC.
+	AuthorDate time.Time
+	// Parents holds the SHAs of the commit's parents. Merge
+	// commits have more than one parent.
+	Parents []string
+	Message string
+	// Files holds the per-file stats from "git log --numstat".
+	// Binary files have zero additions and deletions.
+	Files []CommitFile
+}
+
+// Additions returns the total number of additions in c.
+func (c LocalCommit) Additions() int {
+	var n int
+	for _, f := range c.Files {
+		n += f.Additions
+	}
+	return n
+}
+
+// Deletions returns the total number of deletions in c.
+func (c LocalCommit) Deletions() int {
+	var n int
+	for _, f := range c.Files {
+		n += f.Deletions
+	}
+	return n
+}
+
+const (
+	gitRecordSep = "\x1e"
+	gitFieldSep  = "\x1f"
+)
+
+// gitLogFormat is passed to "git log --format". Every commit starts
+// with gitRecordSep and its fields are separated by gitFieldSep. The
+// --numstat lines follow the last field.
+var gitLogFormat = gitRecordSep + strings.Join([]string{
+	"%H", "%an", "%ae", "%at", "%P", "%B",
+}, gitFieldSep) + gitFieldSep
+
+// ParseGitLog parses the output of "git log --numstat" run with
+// gitLogFormat.
+func ParseGitLog(r io.Reader) ([]LocalCommit, error) {
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	var cs []LocalCommit
+	for _, record := range strings.Split(string(out), gitRecordSep) {
+		if strings.TrimSpace(record) == "" {
+			continue
+		}
+		fields := strings.Split(record, gitFieldSep)
+		if len(fields) != 7 {
+			return nil, errors.Errorf("malformed git log record: %q", record)
+		}
+		at, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, wrapErrorf(err, "error parsing author date for %s", fields[0])
+		}
+		c := LocalCommit{
+			SHA:         fields[0],
+			AuthorName:  fields[1],
+			AuthorEmail: fields[2],
+			AuthorDate:  time.Unix(at, 0).UTC(),
+			Parents:     strings.Fields(fields[4]),
+			Message:     strings.TrimSpace(fields[5]),
+		}
+		for _, line := range strings.Split(fields[6], "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			f, err := parseNumstatLine(c.SHA, line)
+			if err != nil {
+				return nil, err
+			}
+			c.Files = append(c.Files, f)
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// parseNumstatLine parses a single "additions\tdeletions\tfilename"
+// line. Binary files are reported by git as "-\t-\tfilename".
+func parseNumstatLine(sha, line string) (CommitFile, error) {
+	parts := strings.SplitN(line, "\t", 3)
+	if len(parts) != 3 {
+		return CommitFile{}, errors.Errorf("malformed numstat line for %s: %q", sha, line)
+	}
+	f := CommitFile{
+		CommitSHA: sha,
+		Filename:  parts[2],
+		Status:    "modified",
+	}
+	if parts[0] != "-" {
+		n, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return CommitFile{}, wrapErrorf(err, "error parsing additions for %s", sha)
+		}
+		f.Additions = n
+	}
+	if parts[1] != "-" {
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return CommitFile{}, wrapErrorf(err, "error parsing deletions for %s", sha)
+		}
+		f.Deletions = n
+	}
+	return f, nil
+}
+
+// runGit runs git with args in dir and returns its stdout.
+func runGit(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Errorf("git %s failed: %s: %s",
+			strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// ReadLocalRepo reads every commit reachable from any ref in the git
+// repository at dir.
+func ReadLocalRepo(dir string) ([]LocalCommit, error) {
+	out, err := runGit(dir, "-c", "core.quotepath=off", "log", "--all",
+		"--numstat", "--no-renames", "--format="+gitLogFormat)
+	if err != nil {
+		// Repositories without any commits have nothing to
+		// import.
+		if strings.Contains(err.Error(), "does not have any commits") {
+			return nil, nil
+		}
+		return nil, wrapError(err)
+	}
+	return ParseGitLog(bytes.NewReader(out))
+}
+
+// ReadGitBundle reads every commit in the git bundle at path. The
+// bundle is cloned into a temporary directory, which is removed
+// before ReadGitBundle returns.
+func ReadGitBundle(path string) ([]LocalCommit, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	dir, err := ioutil.TempDir("", "githubstreaks-bundle")
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := runGit(dir, "clone", "--quiet", "--bare", path, "repo.git"); err != nil {
+		return nil, wrapError(err)
+	}
+	return ReadLocalRepo(filepath.Join(dir, "repo.git"))
+}
+
+// FilterLocalCommits returns the commits in cs whose author email is
+// in emails. The comparison is case-insensitive.
+func FilterLocalCommits(cs []LocalCommit, emails []string) []LocalCommit {
+	set := make(map[string]bool, len(emails))
+	for _, e := range emails {
+		set[strings.ToLower(e)] = true
+	}
+	var filtered []LocalCommit
+	for _, c := range cs {
+		if set[strings.ToLower(c.AuthorEmail)] {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+// ImportLocalCommits saves the commits in cs that were authored by
+// u under repoName. It returns the number of commits that matched
+// u's verified author emails.
+func ImportLocalCommits(u User, repoName string, cs []LocalCommit) (int, error) {
+	emails, err := UserAuthorEmails(u)
+	if err != nil {
+		return 0, wrapError(err)
+	}
+	matched := FilterLocalCommits(cs, emails)
+	for _, lc := range matched {
+		if !countsMergeCommit(len(lc.Parents)) {
+			continue
+		}
+		c := Commit{
+			SHA:        lc.SHA,
+			UID:        u.UID,
+			AuthorDate: lc.AuthorDate,
+			RepoName:   repoName,
+			Message:    lc.Message,
+			Additions:  lc.Additions(),
+			Deletions:  lc.Deletions(),
+			Provider:   LocalProvider,
+		}
+		coauthors, err := CommitCoAuthorUIDs(u.UID, lc.Message)
+		if err != nil {
+			return 0, wrapError(err)
+		}
+		cas, err := markExcluded(&c, coauthors)
+		if err != nil {
+			return 0, wrapError(err)
+		}
+		created, err := saveCommit(c, lc.Files, cas)
+		if err != nil {
+			return 0, wrapErrorf(err, "error importing commit %s", lc.SHA)
+		}
+		if !created {
+			continue
+		}
+		if err := PublishCommit(c, cas); err != nil {
+			// The commit is saved, so don't fail the import.
+			debug.Println(err)
+		}
+	}
+	return len(matched), nil
+}
+
+// LocalRepoName returns the repo name that commits imported from the
+// repository at path are stored under when no name is given. It is in
+// the form "local/repo" so that it doesn't collide with GitHub repos.
+func LocalRepoName(path string) string {
+	base := filepath.Base(filepath.Clean(path))
+	base = strings.TrimSuffix(base, ".git")
+	base = strings.TrimSuffix(base, ".bundle")
+	return "local/" + base
+}
+
+// importGitCommand implements "githubstreaks import-git". It imports
+// commits from a local repository or a git bundle for a user.
+func importGitCommand(args []string) error {
+	fs := flag.NewFlagSet("import-git", flag.ContinueOnError)
+	login := fs.String("login", "", "Login of the user to import commits for.")
+	host := fs.String("host", "", "GitHub host of the user (default host if empty).")
+	repo := fs.String("repo", "", `Repo name to store commits under (default "local/<dir>").`)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *login == "" || fs.NArg() != 1 {
+		return usageErrorf("expected -login and one repo dir or bundle")
+	}
+	path := fs.Arg(0)
+	u, err := GetUser(UserSpec{Provider: *host, Login: *login})
+	if err != nil {
+		return wrapErrorf(err, "error getting user %s", *login)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return wrapError(err)
+	}
+	var cs []LocalCommit
+	if fi.IsDir() {
+		cs, err = ReadLocalRepo(path)
+	} else {
+		cs, err = ReadGitBundle(path)
+	}
+	if err != nil {
+		return wrapError(err)
+	}
+	if *repo == "" {
+		*repo = LocalRepoName(path)
+	}
+	if !ValidRepoName(*repo) {
+		return usageErrorf("repo name %q must be in the form owner/name", *repo)
+	}
+	n, err := ImportLocalCommits(u, *repo, cs)
+	if err != nil {
+		return wrapError(err)
+	}
+	evaluateAchievements(u)
+	os.Stdout.WriteString("Imported " + strconv.Itoa(n) + " of " +
+		strconv.Itoa(len(cs)) + " commits into " + *repo + ".\n")
+	return nil
+}
+
+// maxBundleSize is the largest upload, including the git bundle, that
+// can be imported.
+const maxBundleSize = 64 << 20
+
+func serveImportGit(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBundleSize)
+	if err := r.ParseMultipartForm(maxBundleSize); err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			return &HTTPError{
+				Err:  errors.Errorf("bundles can't be larger than %d MB", maxBundleSize>>20),
+				Code: http.StatusRequestEntityTooLarge,
+			}
+		}
+		return &HTTPError{Err: wrapErrorf(err, "error parsing upload"), Code: http.StatusBadRequest}
+	}
+	file, header, err := r.FormFile("bundle")
+	if err != nil {
+		return &HTTPError{Err: wrapErrorf(err, "missing bundle"), Code: http.StatusBadRequest}
+	}
+	defer file.Close()
+	repo := strings.TrimSpace(r.FormValue("repo"))
+	if repo == "" {
+		repo = LocalRepoName(header.Filename)
+	}
+	if !ValidRepoName(repo) {
+		return &HTTPError{
+			Err:  errors.Errorf("repo name %q must be in the form owner/name", repo),
+			Code: http.StatusBadRequest,
+		}
+	}
+	tmp, err := ioutil.TempFile("", "githubstreaks-upload")
+	if err != nil {
+		return wrapError(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, file); err != nil {
+		tmp.Close()
+		return wrapError(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return wrapError(err)
+	}
+	cs, err := ReadGitBundle(tmp.Name())
+	if err != nil {
+		return &HTTPError{Err: wrapErrorf(err, "error reading bundle"), Code: http.StatusBadRequest}
+	}
+	if _, err := ImportLocalCommits(*a.User, repo, cs); err != nil {
+		return wrapError(err)
+	}
+	evaluateAchievements(*a.User)
+	return &HTTPRedirect{To: "/", Code: http.StatusSeeOther}
+}
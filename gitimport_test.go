@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// gitForTest runs git in dir with a fixed committer, and the author
+// identified by name and email.
+func gitForTest(t *testing.T, dir, name, email string, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME="+name, "GIT_AUTHOR_EMAIL="+email,
+		"GIT_AUTHOR_DATE=2015-06-01T12:00:00Z",
+		"GIT_COMMITTER_NAME=Committer", "GIT_COMMITTER_EMAIL=committer@example.com",
+		"GIT_COMMITTER_DATE=2015-06-01T12:00:00Z")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %s: %s", args, err, out)
+	}
+}
+
+// newRepoForTest creates a throwaway repo with two commits by
+// me@example.com and one by someone else.
+func newRepoForTest(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "githubstreaks-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitForTest(t, dir, "Me", "me@example.com", "init", "--quiet")
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.go", "package a\n\nfunc A() {}\n")
+	gitForTest(t, dir, "Me", "me@example.com", "add", "a.go")
+	gitForTest(t, dir, "Me", "me@example.com", "commit", "--quiet", "-m", "Add a.go\n\nWith a body.")
+	write("b.txt", "one\ntwo\n")
+	write("bin.dat", "\x00\x01\x02")
+	gitForTest(t, dir, "Someone Else", "else@example.com", "add", "b.txt", "bin.dat")
+	gitForTest(t, dir, "Someone Else", "else@example.com", "commit", "--quiet", "-m", "Add b.txt")
+	write("a.go", "package a\n")
+	gitForTest(t, dir, "Me", "ME@example.com", "commit", "--quiet", "-a", "-m", "Shrink a.go")
+	return dir
+}
+
+func TestReadLocalRepo(t *testing.T) {
+	dir := newRepoForTest(t)
+	defer os.RemoveAll(dir)
+	cs, err := ReadLocalRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 3; len(cs) != want {
+		t.Fatalf("Got %d commits, wanted %d", len(cs), want)
+	}
+	// git log lists the newest commit first.
+	shrink, add := cs[0], cs[2]
+	if want := "Shrink a.go"; shrink.Message != want {
+		t.Errorf("Got message %q, wanted %q", shrink.Message, want)
+	}
+	if shrink.Additions() != 0 || shrink.Deletions() != 2 {
+		t.Errorf("Got +%d/-%d, wanted +0/-2", shrink.Additions(), shrink.Deletions())
+	}
+	if len(shrink.Parents) != 1 || shrink.Parents[0] != cs[1].SHA {
+		t.Errorf("Got parents %v, wanted [%s]", shrink.Parents, cs[1].SHA)
+	}
+	if want := "Add a.go\n\nWith a body."; add.Message != want {
+		t.Errorf("Got message %q, wanted %q", add.Message, want)
+	}
+	if len(add.Files) != 1 || add.Files[0].Filename != "a.go" || add.Files[0].Additions != 3 {
+		t.Errorf("Got files %+v, wanted a.go with 3 additions", add.Files)
+	}
+	if want := int64(1433160000); add.AuthorDate.Unix() != want {
+		t.Errorf("Got author date %s, wanted unix time %d", add.AuthorDate, want)
+	}
+	for _, f := range cs[1].Files {
+		if f.Filename == "bin.dat" && (f.Additions != 0 || f.Deletions != 0) {
+			t.Errorf("Got +%d/-%d for binary file, wanted +0/-0", f.Additions, f.Deletions)
+		}
+	}
+}
+
+func TestFilterLocalCommits(t *testing.T) {
+	dir := newRepoForTest(t)
+	defer os.RemoveAll(dir)
+	cs, err := ReadLocalRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mine := FilterLocalCommits(cs, []string{"Me@Example.com"})
+	if want := 2; len(mine) != want {
+		t.Fatalf("Got %d commits, wanted %d", len(mine), want)
+	}
+	for _, c := range mine {
+		if c.AuthorName != "Me" {
+			t.Errorf("Got commit by %s, wanted Me", c.AuthorName)
+		}
+	}
+	if got := FilterLocalCommits(cs, nil); len(got) != 0 {
+		t.Errorf("Got %d commits with no emails, wanted 0", len(got))
+	}
+}
+
+func TestReadGitBundle(t *testing.T) {
+	dir := newRepoForTest(t)
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "repo.bundle")
+	gitForTest(t, dir, "Me", "me@example.com", "bundle", "create", "--quiet", bundle, "--all")
+	cs, err := ReadGitBundle(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 3; len(cs) != want {
+		t.Errorf("Got %d commits, wanted %d", len(cs), want)
+	}
+	if want := "local/repo"; LocalRepoName(bundle) != want {
+		t.Errorf("Got repo name %s, wanted %s", LocalRepoName(bundle), want)
+	}
+}
+
+func TestValidRepoName(t *testing.T) {
+	for s, want := range map[string]bool{
+		"samertm/githubstreaks": true,
+		"local/repo":            true,
+		"group/sub/repo":        true,
+		"foo":                   false,
+		"":                      false,
+		"/repo":                 false,
+		"local/":                false,
+	} {
+		if got := ValidRepoName(s); got != want {
+			t.Errorf("ValidRepoName(%q) = %t, want %t", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/samertm/githubstreaks/debug"
+	"github.com/zenazn/goji/web"
+)
+
+// GroupExportQuery filters a group export.
+type GroupExportQuery struct {
+	// From and Until bound the commits' author dates. Until is
+	// exclusive. Either may be zero for no bound.
+	From  time.Time
+	Until time.Time
+	// Members are the members to include, or empty for everyone.
+	Members []UserSpec
+	// ByDay exports one row per member per day instead of one row
+	// per commit.
+	ByDay bool
+}
+
+// ParseGroupExportQuery parses a group export's query string. "from"
+// and "to" are inclusive dates in the form "2006-01-02", in loc.
+// "member" is a login or "provider:login", and may be repeated. "by"
+// is "commit", the default, or "day".
+func ParseGroupExportQuery(q url.Values, loc *time.Location) (GroupExportQuery, error) {
+	var geq GroupExportQuery
+	if s := q.Get("from"); s != "" {
+		from, err := time.ParseInLocation("2006-01-02", s, loc)
+		if err != nil {
+			return GroupExportQuery{}, errors.Errorf("invalid from date %q", s)
+		}
+		geq.From = from
+	}
+	if s := q.Get("to"); s != "" {
+		to, err := time.ParseInLocation("2006-01-02", s, loc)
+		if err != nil {
+			return GroupExportQuery{}, errors.Errorf("invalid to date %q", s)
+		}
+		geq.Until = nextDay(to)
+	}
+	if !geq.From.IsZero() && !geq.Until.IsZero() && !geq.From.Before(geq.Until) {
+		return GroupExportQuery{}, errors.New("from must not be after to")
+	}
+	for _, m := range q["member"] {
+		if m = strings.TrimSpace(m); m == "" {
+			continue
+		}
+		us, err := ParseUserSpec(m)
+		if err != nil {
+			return GroupExportQuery{}, errors.Errorf("invalid member %q", m)
+		}
+		if us.Provider == "" {
+			us.Provider = GitHubProvider
+		}
+		geq.Members = append(geq.Members, us)
+	}
+	switch q.Get("by") {
+	case "", "commit":
+	case "day":
+		geq.ByDay = true
+	default:
+		return GroupExportQuery{}, errors.Errorf("unknown by %q, expected commit or day", q.Get("by"))
+	}
+	return geq, nil
+}
+
+// GroupExportCommit is a row of a group export by commit.
+type GroupExportCommit struct {
+	SHA   string `json:"sha"`
+	Login string `json:"login"`
+	// AuthorDate is in the group's timezone, formatted as RFC
+	// 3339.
+	AuthorDate string `json:"author_date"`
+	Repo       string `json:"repo"`
+	Title      string `json:"title"`
+	Additions  int    `json:"additions"`
+	Deletions  int    `json:"deletions"`
+}
+
+var groupExportCommitHeader = []string{"sha", "login", "author_date", "repo", "title", "additions", "deletions"}
+
+func (c GroupExportCommit) record() []string {
+	return []string{
+		c.SHA, csvText(c.Login), c.AuthorDate, csvText(c.Repo), csvText(c.Title),
+		strconv.Itoa(c.Additions), strconv.Itoa(c.Deletions),
+	}
+}
+
+// GroupExportDay is a row of a group export by day: a member's
+// commits on a day.
+type GroupExportDay struct {
+	Login string `json:"login"`
+	// Day is in the group's timezone, in the form "2006-01-02".
+	Day       string `json:"day"`
+	Commits   int    `json:"commits"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+var groupExportDayHeader = []string{"login", "day", "commits", "additions", "deletions"}
+
+func (d GroupExportDay) record() []string {
+	return []string{csvText(d.Login), d.Day, strconv.Itoa(d.Commits), strconv.Itoa(d.Additions), strconv.Itoa(d.Deletions)}
+}
+
+// csvText returns s as a CSV cell that spreadsheets show as text.
+// Cells that start like a formula are prefixed with "'", so that
+// commit titles can't run formulas in the reader's spreadsheet.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// groupExportRow is a GroupExportCommit or a GroupExportDay.
+type groupExportRow interface {
+	record() []string
+}
+
+// groupExportFlushRows is how many rows are written between flushes,
+// so that large exports stream to the client.
+const groupExportFlushRows = 500
+
+// groupExportEncoder writes rows as CSV, with a header, or as a JSON
+// array, without holding them in memory.
+type groupExportEncoder struct {
+	w    io.Writer
+	json bool
+	csv  *csv.Writer
+	rows int
+}
+
+// newGroupExportEncoder returns an encoder that writes to w in format,
+// "csv" or "json". header is the CSV header.
+func newGroupExportEncoder(w io.Writer, format string, header []string) (*groupExportEncoder, error) {
+	e := &groupExportEncoder{w: w}
+	switch format {
+	case "csv":
+		e.csv = csv.NewWriter(w)
+		if err := e.csv.Write(header); err != nil {
+			return nil, wrapError(err)
+		}
+	case "json":
+		e.json = true
+		if _, err := io.WriteString(w, "["); err != nil {
+			return nil, wrapError(err)
+		}
+	default:
+		return nil, errors.Errorf("unknown export format %q", format)
+	}
+	return e, nil
+}
+
+// flush flushes buffered rows to the client, if w can be flushed.
+func (e *groupExportEncoder) flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return wrapError(err)
+		}
+	}
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// Encode writes row.
+func (e *groupExportEncoder) Encode(row groupExportRow) error {
+	if e.json {
+		bs, err := json.Marshal(row)
+		if err != nil {
+			return wrapError(err)
+		}
+		sep := ",\n"
+		if e.rows == 0 {
+			sep = "\n"
+		}
+		if _, err := io.WriteString(e.w, sep+string(bs)); err != nil {
+			return wrapError(err)
+		}
+	} else if err := e.csv.Write(row.record()); err != nil {
+		return wrapError(err)
+	}
+	e.rows++
+	if e.rows%groupExportFlushRows == 0 {
+		return e.flush()
+	}
+	return nil
+}
+
+// Close finishes the export.
+func (e *groupExportEncoder) Close() error {
+	if e.json {
+		if _, err := io.WriteString(e.w, "\n]\n"); err != nil {
+			return wrapError(err)
+		}
+	}
+	return e.flush()
+}
+
+// groupExportCredit is a member's credit for a commit, as read from
+// the database.
+type groupExportCredit struct {
+	SHA        string    `db:"sha"`
+	Login      string    `db:"login"`
+	AuthorDate time.Time `db:"author_date"`
+	Provider   string    `db:"provider"`
+	RepoName   string    `db:"repo_name"`
+	Message    string    `db:"message"`
+	Additions  int       `db:"additions"`
+	Deletions  int       `db:"deletions"`
+}
+
+// groupExportQuery returns the query for the credits in g's export,
+// with its parameters bound in b. By commit, there is one row per
+// commit, credited to its owner if they are a member, and otherwise
+// to a co-author who is. By day, there is a row for each member
+// credited with each commit, ordered by member and author date.
+func groupExportQuery(b *db.Binder, g Group, geq GroupExportQuery) string {
+	members := `SELECT "user".uid, "user".login FROM "user" JOIN user_group USING (uid)
+    WHERE user_group.gid = ` + b.Bind(g.GID)
+	if len(geq.Members) != 0 {
+		var ps []string
+		for _, m := range geq.Members {
+			ps = append(ps, `("user".provider = `+b.Bind(m.Provider)+` AND "user".login = `+b.Bind(m.Login)+`)`)
+		}
+		members += ` AND (` + strings.Join(ps, " OR ") + `)`
+	}
+	var conds []string
+	if !geq.From.IsZero() {
+		conds = append(conds, `commit.author_date >= `+b.Bind(geq.From.UTC()))
+	}
+	if !geq.Until.IsZero() {
+		conds = append(conds, `commit.author_date < `+b.Bind(geq.Until.UTC()))
+	}
+	where := ""
+	if len(conds) != 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+	query := `
+WITH members AS (
+  ` + members + `
+), credits AS (
+  SELECT sha, uid, true AS owner FROM commit
+    WHERE uid IN (SELECT uid FROM members) AND NOT excluded
+  UNION ALL
+  SELECT sha, uid, false AS owner FROM commit_author
+    WHERE uid IN (SELECT uid FROM members) AND NOT excluded
+)
+SELECT `
+	if !geq.ByDay {
+		query += `DISTINCT ON (commit.author_date, commit.sha) `
+	}
+	query += `commit.sha, members.login, commit.author_date, commit.provider,
+  commit.repo_name, commit.message, commit.additions, commit.deletions
+FROM credits JOIN commit USING (sha) JOIN members ON members.uid = credits.uid
+` + where
+	if geq.ByDay {
+		return query + `
+ORDER BY members.login ASC, commit.author_date ASC`
+	}
+	return query + `
+ORDER BY commit.author_date ASC, commit.sha ASC, credits.owner DESC, members.login ASC`
+}
+
+// groupExportDays sums credits into days, in loc. Credits must be
+// ordered by login and author date; each day is written to emit as
+// soon as it is complete.
+type groupExportDays struct {
+	loc  *time.Location
+	day  *GroupExportDay
+	emit func(GroupExportDay) error
+}
+
+// Add adds c to its member's day.
+func (d *groupExportDays) Add(c groupExportCredit) error {
+	day := c.AuthorDate.In(d.loc).Format("2006-01-02")
+	if d.day != nil && (d.day.Login != c.Login || d.day.Day != day) {
+		if err := d.Close(); err != nil {
+			return err
+		}
+	}
+	if d.day == nil {
+		d.day = &GroupExportDay{Login: c.Login, Day: day}
+	}
+	d.day.Commits++
+	d.day.Additions += c.Additions
+	d.day.Deletions += c.Deletions
+	return nil
+}
+
+// Close emits the last day.
+func (d *groupExportDays) Close() error {
+	if d.day == nil {
+		return nil
+	}
+	day := *d.day
+	d.day = nil
+	return d.emit(day)
+}
+
+// WriteGroupExport streams g's export, filtered by geq, to w in
+// format, "csv" or "json". Times are in loc.
+func WriteGroupExport(w io.Writer, g Group, geq GroupExportQuery, loc *time.Location, format string) error {
+	header := groupExportCommitHeader
+	if geq.ByDay {
+		header = groupExportDayHeader
+	}
+	enc, err := newGroupExportEncoder(w, format, header)
+	if err != nil {
+		return wrapError(err)
+	}
+	days := &groupExportDays{loc: loc, emit: func(d GroupExportDay) error { return enc.Encode(d) }}
+	b := &db.Binder{}
+	rows, err := db.DB.Queryx(groupExportQuery(b, g, geq), b.Items...)
+	if err != nil {
+		return wrapError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c groupExportCredit
+		if err := rows.StructScan(&c); err != nil {
+			return wrapError(err)
+		}
+		if geq.ByDay {
+			err = days.Add(c)
+		} else {
+			err = enc.Encode(GroupExportCommit{
+				SHA:        c.SHA,
+				Login:      c.Login,
+				AuthorDate: c.AuthorDate.In(loc).Format(time.RFC3339),
+				Repo:       Commit{RepoName: c.RepoName, Provider: c.Provider}.RepoID(),
+				Title:      CommitMessageTitle(c.Message),
+				Additions:  c.Additions,
+				Deletions:  c.Deletions,
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return wrapError(err)
+	}
+	if err := days.Close(); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// serveGroupExport serves the group's export in format.
+func serveGroupExport(c web.C, w http.ResponseWriter, r *http.Request, format string) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	g, err := memberGroup(*a.User, c)
+	if err != nil {
+		return err
+	}
+	loc, err := GetGroupLocation(g)
+	if err != nil {
+		return wrapError(err)
+	}
+	geq, err := ParseGroupExportQuery(r.URL.Query(), loc)
+	if err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="group-`+strconv.Itoa(g.GID)+`.`+format+`"`)
+	if err := WriteGroupExport(w, g, geq, loc, format); err != nil {
+		// The response has started, so the error can't be
+		// reported to the client; the export is cut short.
+		debug.Printf("Error exporting group %d: %s", g.GID, err)
+	}
+	return nil
+}
+
+func serveGroupExportCSV(c web.C, w http.ResponseWriter, r *http.Request) error {
+	return serveGroupExport(c, w, r, "csv")
+}
+
+func serveGroupExportJSON(c web.C, w http.ResponseWriter, r *http.Request) error {
+	return serveGroupExport(c, w, r, "json")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseGroupExportQuery(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := url.Values{"from": {"2015-08-01"}, "to": {"2015-08-31"}, "member": {"samertm", " ", "gitlab:ada"}, "by": {"day"}}
+	geq, err := ParseGroupExportQuery(q, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Date(2015, 8, 1, 0, 0, 0, 0, loc); !geq.From.Equal(expected) {
+		t.Errorf("got from %s, expected %s", geq.From, expected)
+	}
+	if expected := time.Date(2015, 9, 1, 0, 0, 0, 0, loc); !geq.Until.Equal(expected) {
+		t.Errorf("got until %s, expected %s", geq.Until, expected)
+	}
+	expectedMembers := []UserSpec{{Provider: GitHubProvider, Login: "samertm"}, {Provider: GitLabProvider, Login: "ada"}}
+	if !reflect.DeepEqual(geq.Members, expectedMembers) {
+		t.Errorf("got members %v, expected %v", geq.Members, expectedMembers)
+	}
+	if !geq.ByDay {
+		t.Error("expected by day")
+	}
+	for _, bad := range []url.Values{
+		{"from": {"08/01/2015"}},
+		{"from": {"2015-08-02"}, "to": {"2015-08-01"}},
+		{"by": {"week"}},
+		{"member": {"gitlab:"}},
+	} {
+		if _, err := ParseGroupExportQuery(bad, loc); err == nil {
+			t.Errorf("%v: expected an error", bad)
+		}
+	}
+}
+
+func TestGroupExportEncoder(t *testing.T) {
+	rows := []groupExportRow{
+		GroupExportCommit{SHA: "a1", Login: "samertm", AuthorDate: "2015-08-20T02:00:00-07:00", Repo: "samertm/githubstreaks", Title: "Fix, \"quoted\"", Additions: 3, Deletions: 1},
+		GroupExportCommit{SHA: "b2", Login: "ada", AuthorDate: "2015-08-20T03:00:00-07:00", Repo: "gitlab:ada/engine", Title: "Start", Additions: 10},
+		GroupExportCommit{SHA: "c3", Login: "ada", AuthorDate: "2015-08-20T04:00:00-07:00", Repo: "gitlab:ada/engine", Title: "=HYPERLINK(\"x\")"},
+	}
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"csv", `sha,login,author_date,repo,title,additions,deletions
+a1,samertm,2015-08-20T02:00:00-07:00,samertm/githubstreaks,"Fix, ""quoted""",3,1
+b2,ada,2015-08-20T03:00:00-07:00,gitlab:ada/engine,Start,10,0
+c3,ada,2015-08-20T04:00:00-07:00,gitlab:ada/engine,"'=HYPERLINK(""x"")",0,0
+`},
+		{"json", `[
+{"sha":"a1","login":"samertm","author_date":"2015-08-20T02:00:00-07:00","repo":"samertm/githubstreaks","title":"Fix, \"quoted\"","additions":3,"deletions":1},
+{"sha":"b2","login":"ada","author_date":"2015-08-20T03:00:00-07:00","repo":"gitlab:ada/engine","title":"Start","additions":10,"deletions":0},
+{"sha":"c3","login":"ada","author_date":"2015-08-20T04:00:00-07:00","repo":"gitlab:ada/engine","title":"=HYPERLINK(\"x\")","additions":0,"deletions":0}
+]
+`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		enc, err := newGroupExportEncoder(&buf, test.format, groupExportCommitHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			if err := enc.Encode(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.format, buf.String(), test.expected)
+		}
+	}
+	var buf bytes.Buffer
+	enc, err := newGroupExportEncoder(&buf, "json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Close()
+	if buf.String() != "[\n]\n" {
+		t.Errorf("got empty JSON export %q", buf.String())
+	}
+}
+
+func TestGroupExportDays(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	credits := []groupExportCredit{
+		// Aug 19 in Los Angeles.
+		{Login: "ada", AuthorDate: time.Date(2015, 8, 20, 6, 0, 0, 0, time.UTC), Additions: 1},
+		{Login: "ada", AuthorDate: time.Date(2015, 8, 20, 8, 0, 0, 0, time.UTC), Additions: 2, Deletions: 1},
+		{Login: "ada", AuthorDate: time.Date(2015, 8, 20, 20, 0, 0, 0, time.UTC), Additions: 4},
+		{Login: "samertm", AuthorDate: time.Date(2015, 8, 21, 9, 0, 0, 0, time.UTC), Deletions: 5},
+	}
+	var got []GroupExportDay
+	days := &groupExportDays{loc: loc, emit: func(d GroupExportDay) error {
+		got = append(got, d)
+		return nil
+	}}
+	for _, c := range credits {
+		if err := days.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := days.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []GroupExportDay{
+		{Login: "ada", Day: "2015-08-19", Commits: 1, Additions: 1},
+		{Login: "ada", Day: "2015-08-20", Commits: 2, Additions: 6, Deletions: 1},
+		{Login: "samertm", Day: "2015-08-21", Commits: 1, Deletions: 5},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("got %+v, expected %+v", got, expected)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("%d: got %+v, expected %+v", i, got[i], expected[i])
+		}
+	}
+}
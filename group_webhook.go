@@ -0,0 +1,507 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/go-errors/errors"
+	"github.com/jmoiron/sqlx"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/zenazn/goji/web"
+)
+
+// GroupWebhook is an endpoint that gets a group's events as signed
+// JSON payloads, for people's own automation.
+type GroupWebhook struct {
+	WID int    `db:"wid"`
+	GID int    `db:"gid"`
+	URL string `db:"url"`
+	// Secret is the key that payloads are signed with.
+	Secret  string `db:"secret"`
+	Enabled bool   `db:"enabled"`
+	// Failures is the number of deliveries in a row that failed
+	// for good. The webhook is disabled when it reaches
+	// webhookMaxFailures.
+	Failures int `db:"failures"`
+	// DisabledReason is why the webhook was disabled, if it was
+	// disabled automatically.
+	DisabledReason string    `db:"disabled_reason"`
+	CreatedOn      time.Time `db:"created_on"`
+}
+
+var groupWebhookSchema = `
+CREATE TABLE IF NOT EXISTS group_webhook (
+  wid serial PRIMARY KEY,
+  gid integer NOT NULL REFERENCES "group" (gid),
+  url text NOT NULL,
+  secret text NOT NULL,
+  enabled boolean NOT NULL DEFAULT true,
+  failures integer NOT NULL DEFAULT 0,
+  disabled_reason text NOT NULL DEFAULT '',
+  created_on timestamp NOT NULL
+)`
+
+func init() {
+	deliveryKinds[webhookHookKind] = deliveryKind{
+		Header:   webhookHeader,
+		Finished: webhookFinished,
+	}
+}
+
+// webhookHookKind is the Delivery.HookKind for group webhooks.
+const webhookHookKind = "webhook"
+
+// webhookMaxFailures is the number of deliveries in a row that can
+// fail before a webhook is disabled.
+const webhookMaxFailures = 5
+
+// Group webhook event kinds, on top of EventMemberJoined and
+// EventStreakBroken.
+const (
+	EventCommitIngested = "commit.ingested"
+	EventStreakExtended = "streak.extended"
+	EventMemberLeft     = "member.left"
+)
+
+// webhookEvents are the event kinds sent to group webhooks.
+var webhookEvents = map[string]bool{
+	EventCommitIngested:    true,
+	EventStreakExtended:    true,
+	EventStreakBroken:      true,
+	EventMemberJoined:      true,
+	EventMemberLeft:        true,
+	EventAchievementEarned: true,
+}
+
+// newWebhookSecret returns a random secret for signing payloads.
+func newWebhookSecret() (string, error) {
+	bs := make([]byte, 20)
+	if _, err := rand.Read(bs); err != nil {
+		return "", wrapError(err)
+	}
+	return hex.EncodeToString(bs), nil
+}
+
+// SignWebhookBody returns the X-Streaks-Signature header for body:
+// "sha256=" and the hex HMAC-SHA256 of body keyed by secret.
+func SignWebhookBody(secret string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(body)
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+// AddGroupWebhook adds a webhook with url to g, with a new secret.
+func AddGroupWebhook(g Group, url string) error {
+	if err := ValidWebhookURL(url); err != nil {
+		return err
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return wrapError(err)
+	}
+	b := &db.Binder{}
+	query := `INSERT INTO group_webhook(gid, url, secret, created_on) VALUES (` +
+		b.Bind(g.GID, url, secret) + `, current_timestamp)`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error adding webhook to group %d", g.GID)
+	}
+	return nil
+}
+
+// GetGroupWebhooks returns g's webhooks, oldest first.
+func GetGroupWebhooks(g Group) ([]GroupWebhook, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM group_webhook WHERE gid = ` + b.Bind(g.GID) + ` ORDER BY wid ASC`
+	var ws []GroupWebhook
+	if err := db.DB.Select(&ws, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	return ws, nil
+}
+
+// GetGroupWebhook returns g's webhook with wid.
+func GetGroupWebhook(g Group, wid int) (GroupWebhook, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM group_webhook WHERE wid = ` + b.Bind(wid) + ` AND gid = ` + b.Bind(g.GID)
+	var w GroupWebhook
+	if err := db.DB.Get(&w, query, b.Items...); err != nil {
+		return GroupWebhook{}, wrapErrorf(err, "error getting webhook %d for group %d", wid, g.GID)
+	}
+	return w, nil
+}
+
+// DeleteGroupWebhook deletes g's webhook with wid, along with the
+// deliveries to it that haven't been sent.
+func DeleteGroupWebhook(g Group, wid int) error {
+	b := &db.Binder{}
+	query := `
+WITH w AS (
+  DELETE FROM group_webhook WHERE wid = ` + b.Bind(wid) + ` AND gid = ` + b.Bind(g.GID) + ` RETURNING wid
+)
+DELETE FROM delivery WHERE hook_kind = ` + b.Bind(webhookHookKind) + ` AND state = ` + b.Bind(DeliveryPending) + `
+  AND hook_id IN (SELECT wid FROM w)`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error deleting webhook %d", wid)
+	}
+	return nil
+}
+
+// EnableGroupWebhook turns g's webhook with wid back on and forgets
+// its failures.
+func EnableGroupWebhook(g Group, wid int) error {
+	b := &db.Binder{}
+	query := `UPDATE group_webhook SET enabled = true, failures = 0, disabled_reason = ''
+WHERE wid = ` + b.Bind(wid) + ` AND gid = ` + b.Bind(g.GID)
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error enabling webhook %d", wid)
+	}
+	return nil
+}
+
+// WebhookUser is a user in a webhook payload.
+type WebhookUser struct {
+	UID      int    `json:"uid"`
+	Login    string `json:"login"`
+	Provider string `json:"provider"`
+}
+
+// WebhookCommit is a commit in a webhook payload.
+type WebhookCommit struct {
+	SHA        string    `json:"sha"`
+	Provider   string    `json:"provider"`
+	RepoName   string    `json:"repo_name"`
+	Message    string    `json:"message"`
+	AuthorDate time.Time `json:"author_date"`
+	Additions  int       `json:"additions"`
+	Deletions  int       `json:"deletions"`
+}
+
+// WebhookAchievement is an achievement in a webhook payload.
+type WebhookAchievement struct {
+	Key         string    `json:"key"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	EarnedOn    time.Time `json:"earned_on"`
+}
+
+// WebhookPayload is the JSON posted to group webhooks.
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	GroupID   int       `json:"group_id"`
+	CreatedAt time.Time `json:"created_at"`
+	// User is who the event is about.
+	User *WebhookUser `json:"user,omitempty"`
+	// Commit is set for commit.ingested.
+	Commit *WebhookCommit `json:"commit,omitempty"`
+	// Achievement is set for achievement.earned.
+	Achievement *WebhookAchievement `json:"achievement,omitempty"`
+	// Streak and Day are set for streak events. Streak is the
+	// extended streak's length, or the broken streak's length
+	// before it broke. Day is the group-local day the streak was
+	// extended or broken on.
+	Streak int    `json:"streak,omitempty"`
+	Day    string `json:"day,omitempty"`
+}
+
+// NewWebhookPayload returns the payload for e.
+func NewWebhookPayload(e GroupEvent, now time.Time) WebhookPayload {
+	p := WebhookPayload{Event: e.Kind, GroupID: e.Group.GID, CreatedAt: now.UTC(), Streak: e.Streak}
+	if e.User.UID != 0 {
+		p.User = &WebhookUser{UID: e.User.UID, Login: e.User.Login, Provider: e.User.Provider}
+	}
+	if e.Commit != nil {
+		p.Commit = &WebhookCommit{
+			SHA:        e.Commit.SHA,
+			Provider:   e.Commit.Provider,
+			RepoName:   e.Commit.RepoName,
+			Message:    e.Commit.Message,
+			AuthorDate: e.Commit.AuthorDate.UTC(),
+			Additions:  e.Commit.Additions,
+			Deletions:  e.Commit.Deletions,
+		}
+	}
+	if e.Achievement != nil {
+		p.Achievement = &WebhookAchievement{
+			Key:         e.Achievement.Key,
+			Name:        e.Achievement.Name,
+			Description: e.Achievement.Description,
+			EarnedOn:    e.Achievement.EarnedOn.UTC(),
+		}
+	}
+	if !e.Day.IsZero() {
+		p.Day = e.Day.Format("2006-01-02")
+	}
+	return p
+}
+
+// notifyGroupWebhooks queues e for its group's enabled webhooks with
+// ex.
+func notifyGroupWebhooks(ex sqlx.Execer, e GroupEvent) error {
+	if !webhookEvents[e.Kind] {
+		return nil
+	}
+	b := &db.Binder{}
+	query := `SELECT * FROM group_webhook WHERE enabled AND gid = ` + b.Bind(e.Group.GID) + ` ORDER BY wid ASC`
+	var ws []GroupWebhook
+	if err := db.DB.Select(&ws, query, b.Items...); err != nil {
+		return wrapError(err)
+	}
+	p := NewWebhookPayload(e, time.Now())
+	for _, w := range ws {
+		if err := EnqueueDelivery(ex, webhookHookKind, w.WID, w.URL, p); err != nil {
+			return wrapError(err)
+		}
+	}
+	return nil
+}
+
+// PublishGroupEvent queues e for its group's chat hooks and webhooks.
+func PublishGroupEvent(e GroupEvent) error {
+	return publishGroupEvent(db.DB, e)
+}
+
+// publishGroupEvent is PublishGroupEvent, queueing the deliveries with
+// ex, which may be a transaction.
+func publishGroupEvent(ex sqlx.Execer, e GroupEvent) error {
+	if err := NotifyGroup(ex, e); err != nil {
+		return wrapError(err)
+	}
+	return notifyGroupWebhooks(ex, e)
+}
+
+// PublishCommit queues commit.ingested events for c in the groups of
+// the users credited for it. It does nothing for excluded commits.
+func PublishCommit(c Commit, coauthors []commitAuthor) error {
+	if c.Excluded {
+		return nil
+	}
+	b := &db.Binder{}
+	uids := []string{b.Bind(c.UID)}
+	for _, ca := range coauthors {
+		if !ca.Excluded {
+			uids = append(uids, b.Bind(ca.UID))
+		}
+	}
+	query := `SELECT DISTINCT gid FROM group_webhook WHERE enabled AND gid IN
+  (SELECT gid FROM user_group WHERE uid IN (` + strings.Join(uids, ", ") + `))
+ORDER BY gid ASC`
+	var gids []int
+	if err := db.DB.Select(&gids, query, b.Items...); err != nil {
+		return wrapError(err)
+	}
+	if len(gids) == 0 {
+		return nil
+	}
+	u, err := GetUser(UserSpec{UID: c.UID})
+	if err != nil {
+		return wrapError(err)
+	}
+	for _, gid := range gids {
+		e := GroupEvent{Kind: EventCommitIngested, Group: Group{GID: gid}, User: u, Commit: &c}
+		if err := notifyGroupWebhooks(db.DB, e); err != nil {
+			return wrapError(err)
+		}
+	}
+	return nil
+}
+
+// webhookHeader signs d with its webhook's secret. Deliveries to
+// webhooks that were deleted or disabled fail.
+func webhookHeader(d Delivery) (http.Header, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM group_webhook WHERE wid = ` + b.Bind(d.HookID)
+	var w GroupWebhook
+	if err := db.DB.Get(&w, query, b.Items...); err != nil {
+		if strings.Contains(err.Error(), sqlNotFound) {
+			return nil, errors.Errorf("webhook %d was deleted", d.HookID)
+		}
+		return nil, wrapError(err)
+	}
+	if !w.Enabled {
+		return nil, errors.Errorf("webhook %d is disabled", w.WID)
+	}
+	var p struct {
+		Event string `json:"event"`
+	}
+	if err := json.Unmarshal([]byte(d.Body), &p); err != nil {
+		return nil, wrapError(err)
+	}
+	h := http.Header{}
+	h.Set("X-Streaks-Event", p.Event)
+	h.Set("X-Streaks-Delivery", strconv.Itoa(d.DID))
+	h.Set("X-Streaks-Signature", SignWebhookBody(w.Secret, []byte(d.Body)))
+	return h, nil
+}
+
+// webhookFinished counts d's webhook's failures, and disables it once
+// webhookMaxFailures deliveries in a row have failed. Deliveries that
+// fail because the webhook is already disabled don't count.
+func webhookFinished(d Delivery) error {
+	b := &db.Binder{}
+	var query string
+	if d.State == DeliveryDelivered {
+		query = `UPDATE group_webhook SET failures = 0 WHERE wid = ` + b.Bind(d.HookID)
+	} else {
+		reason := "disabled after " + strconv.Itoa(webhookMaxFailures) + " failed deliveries, the last one: " + d.Error
+		query = `UPDATE group_webhook SET failures = failures + 1,
+  enabled = failures + 1 < ` + b.Bind(webhookMaxFailures) + `,
+  disabled_reason = CASE WHEN failures + 1 >= ` + b.Bind(webhookMaxFailures) + ` THEN ` + b.Bind(reason) + ` ELSE '' END
+WHERE enabled AND wid = ` + b.Bind(d.HookID)
+	}
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error counting failures for webhook %d", d.HookID)
+	}
+	return nil
+}
+
+var groupWebhookTemplate = pongo2.Must(pongo2.FromFile("templates/webhook.html"))
+
+type groupWebhookTemplateVars struct {
+	Group   Group
+	Webhook GroupWebhook
+	// Deliveries are the webhook's recent deliveries.
+	Deliveries []DeliveryLog
+}
+
+// groupWebhookDeliveries is the number of deliveries shown on a
+// webhook's page.
+const groupWebhookDeliveries = 30
+
+// GroupWebhookURL returns the url of w's page.
+func GroupWebhookURL(w GroupWebhook) string {
+	return GroupURL(Group{GID: w.GID}) + "/webhooks/" + strconv.Itoa(w.WID)
+}
+
+// memberGroupWebhook returns the webhook in c's webhook_id, checking
+// that u is in its group.
+func memberGroupWebhook(u User, c web.C) (Group, GroupWebhook, error) {
+	g, err := memberGroup(u, c)
+	if err != nil {
+		return Group{}, GroupWebhook{}, err
+	}
+	wid, err := getParamInt(c, "webhook_id")
+	if err != nil {
+		return Group{}, GroupWebhook{}, wrapError(err)
+	}
+	w, err := GetGroupWebhook(g, wid)
+	if err != nil {
+		if strings.Contains(err.Error(), sqlNotFound) {
+			return Group{}, GroupWebhook{}, &HTTPError{Err: err, Code: http.StatusNotFound}
+		}
+		return Group{}, GroupWebhook{}, wrapError(err)
+	}
+	return g, w, nil
+}
+
+func serveGroupWebhook(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	g, gw, err := memberGroupWebhook(*a.User, c)
+	if err != nil {
+		return err
+	}
+	ls, err := GetDeliveryLogs(webhookHookKind, gw.WID, groupWebhookDeliveries)
+	if err != nil {
+		return wrapError(err)
+	}
+	return RenderTemplate(groupWebhookTemplate, w, groupWebhookTemplateVars{
+		Group:      g,
+		Webhook:    gw,
+		Deliveries: ls,
+	})
+}
+
+type groupWebhookForm struct {
+	URL string `schema:"url"`
+}
+
+func serveAddGroupWebhook(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	g, err := memberGroup(*a.User, c)
+	if err != nil {
+		return err
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form groupWebhookForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	if err := AddGroupWebhook(g, strings.TrimSpace(form.URL)); err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	return &HTTPRedirect{To: GroupURL(g) + "#webhooks", Code: http.StatusSeeOther}
+}
+
+func serveDeleteGroupWebhook(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	g, gw, err := memberGroupWebhook(*a.User, c)
+	if err != nil {
+		return err
+	}
+	if err := DeleteGroupWebhook(g, gw.WID); err != nil {
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: GroupURL(g) + "#webhooks", Code: http.StatusSeeOther}
+}
+
+func serveEnableGroupWebhook(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	g, gw, err := memberGroupWebhook(*a.User, c)
+	if err != nil {
+		return err
+	}
+	if err := EnableGroupWebhook(g, gw.WID); err != nil {
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: GroupWebhookURL(gw), Code: http.StatusSeeOther}
+}
+
+type redeliverForm struct {
+	DID int `schema:"did"`
+}
+
+func serveRedeliverGroupWebhook(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	_, gw, err := memberGroupWebhook(*a.User, c)
+	if err != nil {
+		return err
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form redeliverForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	if _, err := Redeliver(webhookHookKind, gw.WID, form.DID); err != nil {
+		if strings.Contains(err.Error(), "no delivery") {
+			return &HTTPError{Err: err, Code: http.StatusNotFound}
+		}
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: GroupWebhookURL(gw), Code: http.StatusSeeOther}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignWebhookBody(t *testing.T) {
+	got := SignWebhookBody("It's a Secret to Everybody", []byte("Hello, World!"))
+	want := "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"
+	if got != want {
+		t.Errorf("Got signature %s, want %s", got, want)
+	}
+}
+
+func TestNewWebhookPayload(t *testing.T) {
+	now := time.Date(2015, 8, 21, 0, 5, 0, 0, time.UTC)
+	u := User{UID: 1, Login: "samertm", Provider: GitHubProvider}
+	c := Commit{SHA: "abc123", UID: 1, RepoName: "samertm/githubstreaks", Provider: GitHubProvider,
+		AuthorDate: time.Date(2015, 8, 20, 12, 0, 0, 0, time.UTC), Additions: 3}
+	for _, tt := range []struct {
+		e    GroupEvent
+		want string
+	}{
+		{
+			GroupEvent{Kind: EventCommitIngested, Group: Group{GID: 3}, User: u, Commit: &c},
+			`{"event":"commit.ingested","group_id":3,"created_at":"2015-08-21T00:05:00Z",` +
+				`"user":{"uid":1,"login":"samertm","provider":"github"},` +
+				`"commit":{"sha":"abc123","provider":"github","repo_name":"samertm/githubstreaks","message":"",` +
+				`"author_date":"2015-08-20T12:00:00Z","additions":3,"deletions":0}}`,
+		},
+		{
+			GroupEvent{Kind: EventStreakBroken, Group: Group{GID: 3}, User: u, Streak: 4,
+				Day: time.Date(2015, 8, 20, 0, 0, 0, 0, time.UTC)},
+			`{"event":"streak.broken","group_id":3,"created_at":"2015-08-21T00:05:00Z",` +
+				`"user":{"uid":1,"login":"samertm","provider":"github"},"streak":4,"day":"2015-08-20"}`,
+		},
+	} {
+		bs, err := json.Marshal(NewWebhookPayload(tt.e, now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bs) != tt.want {
+			t.Errorf("Got payload\n%s\nwant\n%s", bs, tt.want)
+		}
+	}
+}
+
+func TestSignedDelivery(t *testing.T) {
+	defer allowLoopbackWebhooks()()
+	secret := "shh"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get("X-Streaks-Signature") != SignWebhookBody(secret, body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	d := Delivery{DID: 7, URL: ts.URL, Body: `{"event":"member.joined","group_id":3}`}
+	h := http.Header{}
+	h.Set("X-Streaks-Signature", SignWebhookBody(secret, []byte(d.Body)))
+	if err := postDelivery(d, h); err != nil {
+		t.Error(err)
+	}
+	h.Set("X-Streaks-Signature", SignWebhookBody("wrong", []byte(d.Body)))
+	if err := postDelivery(d, h); err == nil {
+		t.Error("Got no error for a rejected delivery")
+	}
+}
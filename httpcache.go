@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samertm/githubstreaks/conf"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/samertm/githubstreaks/debug"
+)
+
+// CachedResponse is a response saved by CachingTransport.
+type CachedResponse struct {
+	// Key identifies the request, see cacheKey.
+	Key          string `db:"key"`
+	ETag         string `db:"etag"`
+	LastModified string `db:"last_modified"`
+	// Response is the full response in wire format, as written by
+	// http.Response.Write.
+	Response  []byte    `db:"response"`
+	UpdatedOn time.Time `db:"updated_on"`
+}
+
+// ResponseCache stores responses for CachingTransport.
+type ResponseCache interface {
+	// Get returns the response for key, or nil if there is none.
+	Get(key string) (*CachedResponse, error)
+	// Set saves r, replacing the response for r.Key.
+	Set(r CachedResponse) error
+	// Expire deletes the responses last saved before t, and returns
+	// how many were deleted.
+	Expire(t time.Time) (int, error)
+}
+
+// MemoryResponseCache is a ResponseCache that keeps responses in
+// memory. It is safe for concurrent use.
+type MemoryResponseCache struct {
+	mu sync.Mutex
+	m  map[string]CachedResponse
+}
+
+func NewMemoryResponseCache() *MemoryResponseCache {
+	return &MemoryResponseCache{m: make(map[string]CachedResponse)}
+}
+
+func (c *MemoryResponseCache) Get(key string) (*CachedResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.m[key]
+	if !ok {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+func (c *MemoryResponseCache) Set(r CachedResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r.UpdatedOn = time.Now()
+	c.m[r.Key] = r
+	return nil
+}
+
+func (c *MemoryResponseCache) Expire(t time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k, r := range c.m {
+		if r.UpdatedOn.Before(t) {
+			delete(c.m, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+var httpCacheSchema = `
+CREATE TABLE IF NOT EXISTS http_cache (
+  key text PRIMARY KEY,
+  etag text NOT NULL,
+  last_modified text NOT NULL,
+  response bytea NOT NULL,
+  updated_on timestamp NOT NULL
+)`
+
+// PostgresResponseCache is a ResponseCache that keeps responses in the
+// http_cache table, so they are shared between servers and survive
+// restarts.
+type PostgresResponseCache struct{}
+
+func (PostgresResponseCache) Get(key string) (*CachedResponse, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM http_cache WHERE key = ` + b.Bind(key)
+	var r CachedResponse
+	if err := db.DB.Get(&r, query, b.Items...); err != nil {
+		if strings.Contains(err.Error(), sqlNotFound) {
+			return nil, nil
+		}
+		return nil, wrapError(err)
+	}
+	return &r, nil
+}
+
+func (PostgresResponseCache) Set(r CachedResponse) error {
+	b := &db.Binder{}
+	query := `
+INSERT INTO http_cache(key, etag, last_modified, response, updated_on)
+  VALUES (` + b.Bind(r.Key, r.ETag, r.LastModified, r.Response) + `, current_timestamp)
+ON CONFLICT (key) DO UPDATE SET
+  etag = excluded.etag, last_modified = excluded.last_modified,
+  response = excluded.response, updated_on = excluded.updated_on`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+func (PostgresResponseCache) Expire(t time.Time) (int, error) {
+	b := &db.Binder{}
+	// Timestamps are stored without a time zone.
+	query := `DELETE FROM http_cache WHERE updated_on < ` + b.Bind(t.UTC())
+	r, err := db.DB.Exec(query, b.Items...)
+	if err != nil {
+		return 0, wrapError(err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, wrapError(err)
+	}
+	return int(n), nil
+}
+
+// httpResponseCache is the cache shared by the commit sources. It is
+// chosen by the HTTPCache config.
+var httpResponseCache = newResponseCache(conf.Config.HTTPCache)
+
+func newResponseCache(kind string) ResponseCache {
+	switch kind {
+	case "memory":
+		return NewMemoryResponseCache()
+	case "", "postgres":
+		return PostgresResponseCache{}
+	}
+	debug.Fatalf("Unknown HTTPCache %q, must be \"memory\" or \"postgres\"", kind)
+	return nil
+}
+
+// CachingTransport makes conditional GET requests for responses it
+// has seen before. When the server replies 304 Not Modified, the
+// cached response is returned in its place, so callers always see
+// the full body.
+type CachingTransport struct {
+	Cache ResponseCache
+	// Transport makes the requests. If it is nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+func (t *CachingTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+// cacheKey returns the key for req's response. Responses depend on
+// who is asking, so the credentials are part of the key. The key is
+// hashed to keep credentials out of the cache.
+func cacheKey(req *http.Request) string {
+	h := sha256.New()
+	h.Write([]byte(req.URL.String()))
+	h.Write([]byte{0})
+	h.Write([]byte(req.Header.Get("Authorization")))
+	h.Write([]byte{0})
+	h.Write([]byte(req.Header.Get("PRIVATE-TOKEN")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// notModifiedHeaders are the headers of a 304 response that replace
+// the cached ones. Rate limits have to be current for
+// RateLimitTransport.
+var notModifiedHeaders = []string{
+	"Date", "ETag", "Last-Modified", "Cache-Control",
+	"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset",
+}
+
+// cachedPathSuffixes are the endpoints whose responses are cached:
+// event feeds and lists, which are polled and usually unchanged.
+// Single commits never change once fetched, so conditional requests
+// don't save anything, and their patches would fill the cache.
+var cachedPathSuffixes = []string{
+	"/events", "/events/public", "/activities/feeds", "/commits", "/repos",
+}
+
+// cacheable returns true if req's response should be cached.
+func cacheable(req *http.Request) bool {
+	if req.Method != "GET" || req.Header.Get("Range") != "" {
+		return false
+	}
+	for _, suffix := range cachedPathSuffixes {
+		if strings.HasSuffix(req.URL.Path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *CachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !cacheable(req) {
+		return t.transport().RoundTrip(req)
+	}
+	key := cacheKey(req)
+	cached, err := t.Cache.Get(key)
+	if err != nil {
+		// The cache is an optimization, so carry on without
+		// it.
+		debug.Printf("Error reading cached response for %s: %s", req.URL.Path, err)
+		cached = nil
+	}
+	if cached != nil {
+		req = cloneRequest(req)
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := t.transport().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		cr, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(cached.Response)), req)
+		if err != nil {
+			// Our copy is broken; the 304 is all we have.
+			debug.Printf("Error reading cached response for %s: %s", req.URL.Path, err)
+			return resp, nil
+		}
+		resp.Body.Close()
+		for _, h := range notModifiedHeaders {
+			if v := resp.Header.Get(h); v != "" {
+				cr.Header.Set(h, v)
+			}
+		}
+		return cr, nil
+	}
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || (etag == "" && lastModified == "") {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if err := t.save(key, etag, lastModified, resp, body); err != nil {
+		debug.Printf("Error caching response for %s: %s", req.URL.Path, err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// save caches resp, whose body has already been read into body.
+func (t *CachingTransport) save(key, etag, lastModified string, resp *http.Response, body []byte) error {
+	buf := &bytes.Buffer{}
+	// Write consumes resp.Body and uses ContentLength; the body
+	// was already decompressed by the transport.
+	saved := *resp
+	saved.Body = ioutil.NopCloser(bytes.NewReader(body))
+	saved.ContentLength = int64(len(body))
+	saved.TransferEncoding = nil
+	saved.Header = cloneHeader(resp.Header)
+	saved.Header.Del("Content-Encoding")
+	saved.Header.Del("Transfer-Encoding")
+	if err := saved.Write(buf); err != nil {
+		return wrapError(err)
+	}
+	return t.Cache.Set(CachedResponse{
+		Key:          key,
+		ETag:         etag,
+		LastModified: lastModified,
+		Response:     buf.Bytes(),
+	})
+}
+
+// httpCacheTTL is how long cached responses are kept after they were
+// last fetched in full. Responses that were revalidated since are
+// fetched again once they expire, which costs one request.
+var httpCacheTTL = 30 * 24 * time.Hour
+
+// RunHTTPCacheSweeps deletes expired responses from the shared
+// response cache every interval.
+func RunHTTPCacheSweeps(interval time.Duration) {
+	for {
+		n, err := httpResponseCache.Expire(time.Now().Add(-httpCacheTTL))
+		if err != nil {
+			debug.Println(err)
+		} else if n > 0 {
+			debug.Printf("Expired %d cached responses", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// CachedTransport returns a CachingTransport that uses the shared
+// response cache.
+func CachedTransport() http.RoundTripper {
+	return &CachingTransport{Cache: httpResponseCache}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, vs := range h {
+		h2[k] = append([]string(nil), vs...)
+	}
+	return h2
+}
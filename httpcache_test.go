@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCachingTransport(t *testing.T) {
+	var requests, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("X-RateLimit-Remaining", fmt.Sprint(100-requests))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprintf(w, `[{"page": %s}]`, r.URL.Query().Get("page"))
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: &CachingTransport{Cache: NewMemoryResponseCache()}}
+	get := func(url string) (string, *http.Response) {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body), resp
+	}
+	for i := 0; i < 2; i++ {
+		// Every page is cached separately.
+		for _, page := range []string{"1", "2"} {
+			body, resp := get(srv.URL + "/events?page=" + page)
+			if want := `[{"page": ` + page + `}]`; body != want {
+				t.Errorf("Got body %s for page %s, wanted %s", body, page, want)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Got status %d, wanted %d", resp.StatusCode, http.StatusOK)
+			}
+			if got, want := resp.Header.Get("X-RateLimit-Remaining"), fmt.Sprint(100-requests); got != want {
+				t.Errorf("Got X-RateLimit-Remaining %s, wanted the current value %s", got, want)
+			}
+		}
+	}
+	if requests != 4 || notModified != 2 {
+		t.Errorf("Got %d requests and %d not modified, wanted 4 and 2", requests, notModified)
+	}
+}
+
+func TestCachingTransportNetworkError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+	client := &http.Client{Transport: &CachingTransport{Cache: NewMemoryResponseCache()}}
+	if _, err := client.Get(url); err == nil {
+		t.Error("Got no error from a closed server")
+	}
+}
+
+func TestCachingTransportCacheable(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") != "" {
+			t.Errorf("Got a conditional request for %s", r.URL.Path)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, `{}`)
+	}))
+	defer srv.Close()
+	cache := NewMemoryResponseCache()
+	client := &http.Client{Transport: &CachingTransport{Cache: cache}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL + "/repos/o/r/commits/ffff")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if requests != 2 || len(cache.m) != 0 {
+		t.Errorf("Got %d requests and %d cached responses, wanted 2 and 0", requests, len(cache.m))
+	}
+}
+
+func TestMemoryResponseCacheExpire(t *testing.T) {
+	cache := NewMemoryResponseCache()
+	cache.Set(CachedResponse{Key: "old"})
+	cutoff := time.Now().Add(time.Second)
+	if n, err := cache.Expire(cutoff); err != nil || n != 1 {
+		t.Errorf("Expire() = %d, %v, wanted 1, nil", n, err)
+	}
+	if r, _ := cache.Get("old"); r != nil {
+		t.Error("Got an expired response")
+	}
+}
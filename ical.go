@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zenazn/goji/web"
+)
+
+// CalendarEvent is an all-day event.
+type CalendarEvent struct {
+	UID         string
+	Day         time.Time
+	Summary     string
+	Description string
+}
+
+type sortableCalendarEvents []CalendarEvent
+
+func (s sortableCalendarEvents) Len() int      { return len(s) }
+func (s sortableCalendarEvents) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortableCalendarEvents) Less(i, j int) bool {
+	if !s[i].Day.Equal(s[j].Day) {
+		return s[i].Day.Before(s[j].Day)
+	}
+	return s[i].UID < s[j].UID
+}
+
+// Calendar is a set of all-day events, written as iCalendar (RFC
+// 5545) by WriteICS.
+type Calendar struct {
+	Name string
+	// Timezone is the IANA name of the timezone the days are in.
+	// All-day events don't have a timezone, so it is only a hint
+	// for calendar apps.
+	Timezone string
+	Events   []CalendarEvent
+}
+
+// icsLineLen is the longest a content line can be, in octets, before
+// it must be folded.
+const icsLineLen = 75
+
+// icsTextEscaper escapes TEXT values.
+var icsTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// icsWriter writes iCalendar content lines. It remembers the first
+// error, so callers can check once at the end.
+type icsWriter struct {
+	w   io.Writer
+	err error
+}
+
+// line writes the content line name:value, folded so that no line
+// is longer than icsLineLen octets. Folds don't split UTF-8
+// characters.
+func (iw *icsWriter) line(name, value string) {
+	if iw.err != nil {
+		return
+	}
+	l := name + ":" + value
+	max := icsLineLen
+	for len(l) > max {
+		i := max
+		for i > 0 && !utf8.RuneStart(l[i]) {
+			i--
+		}
+		if _, iw.err = io.WriteString(iw.w, l[:i]+"\r\n "); iw.err != nil {
+			return
+		}
+		// Continuation lines start with a space, which
+		// counts towards their length.
+		l, max = l[i:], icsLineLen-1
+	}
+	_, iw.err = io.WriteString(iw.w, l+"\r\n")
+}
+
+// text writes a content line with a TEXT value.
+func (iw *icsWriter) text(name, value string) {
+	iw.line(name, icsTextEscaper.Replace(value))
+}
+
+// WriteICS writes cal to w as an iCalendar object, with now as every
+// event's DTSTAMP.
+func (cal Calendar) WriteICS(w io.Writer, now time.Time) error {
+	iw := &icsWriter{w: w}
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", "-//GitHub Streaks//Group Calendar//EN")
+	iw.line("CALSCALE", "GREGORIAN")
+	iw.line("METHOD", "PUBLISH")
+	iw.text("X-WR-CALNAME", cal.Name)
+	if cal.Timezone != "" {
+		iw.text("X-WR-TIMEZONE", cal.Timezone)
+	}
+	stamp := now.UTC().Format("20060102T150405Z")
+	for _, e := range cal.Events {
+		iw.line("BEGIN", "VEVENT")
+		iw.text("UID", e.UID)
+		iw.line("DTSTAMP", stamp)
+		iw.line("DTSTART;VALUE=DATE", e.Day.Format("20060102"))
+		iw.line("DTEND;VALUE=DATE", nextDay(e.Day).Format("20060102"))
+		iw.text("SUMMARY", e.Summary)
+		if e.Description != "" {
+			iw.text("DESCRIPTION", e.Description)
+		}
+		iw.line("TRANSP", "TRANSPARENT")
+		iw.line("END", "VEVENT")
+	}
+	iw.line("END", "VCALENDAR")
+	if iw.err != nil {
+		return wrapError(iw.err)
+	}
+	return nil
+}
+
+// calendarUID returns a globally unique, stable UID for an event.
+func calendarUID(g Group, kind string, uid int, day time.Time) string {
+	return fmt.Sprintf("%s-%d-%d-%s@githubstreaks", kind, g.GID, uid, day.Format("20060102"))
+}
+
+// BuildGroupCalendar builds g's calendar, given the commits of each
+// of g's users. It has the days the group starts and ends, if it
+// ends, and each user's days with commits since it started, in loc.
+func BuildGroupCalendar(g Group, us []User, commits map[int][]Commit, loc *time.Location) Calendar {
+	start := BeginningOfDay(g.CreatedOn.In(loc))
+	cal := Calendar{
+		Name:     "GitHub Streaks group " + strconv.Itoa(g.GID),
+		Timezone: loc.String(),
+		Events: []CalendarEvent{{
+			UID:         calendarUID(g, "start", 0, start),
+			Day:         start,
+			Summary:     "Group " + strconv.Itoa(g.GID) + " started",
+			Description: AbsoluteURL(GroupURL(g)),
+		}},
+	}
+	if end := GroupEndDay(g, loc); !end.IsZero() {
+		cal.Events = append(cal.Events, CalendarEvent{
+			UID:         calendarUID(g, "end", 0, end),
+			Day:         end,
+			Summary:     "Group " + strconv.Itoa(g.GID) + " ends",
+			Description: AbsoluteURL(GroupURL(g)),
+		})
+	}
+	for _, u := range us {
+		for _, dcg := range DayCommitGroups(commits[u.UID], loc) {
+			if dcg.Day.Before(start) {
+				break
+			}
+			n := len(dcg.Commits)
+			var repos []string
+			for _, cg := range CommitGroups(dcg.Commits) {
+				repos = append(repos, fmt.Sprintf("%s (%d)", cg.RepoID, len(cg.Commits)))
+			}
+			cal.Events = append(cal.Events, CalendarEvent{
+				UID:         calendarUID(g, "active", u.UID, dcg.Day),
+				Day:         dcg.Day,
+				Summary:     fmt.Sprintf("%s: %d commit%s", u.Login, n, plural(n)),
+				Description: strings.Join(repos, "\n"),
+			})
+		}
+	}
+	sort.Sort(sortableCalendarEvents(cal.Events))
+	return cal
+}
+
+// GetGroupCalendar returns g's calendar.
+func GetGroupCalendar(g Group) (Calendar, error) {
+	loc, err := GetGroupLocation(g)
+	if err != nil {
+		return Calendar{}, wrapError(err)
+	}
+	us, err := GetGroupUsers(g)
+	if err != nil {
+		return Calendar{}, wrapError(err)
+	}
+	commits := make(map[int][]Commit)
+	for _, u := range us {
+		if commits[u.UID], err = GetUserCommits(u, BeginningOfDay(g.CreatedOn)); err != nil {
+			return Calendar{}, wrapError(err)
+		}
+	}
+	return BuildGroupCalendar(g, us, commits, loc), nil
+}
+
+// GroupCalendarURL returns the URL of g's calendar, authenticated by
+// the feed token.
+func GroupCalendarURL(g Group, token string) string {
+	return AbsoluteURL(GroupURL(g) + "/calendar.ics?token=" + token)
+}
+
+// serveGroupCalendar serves the group's calendar. Calendar apps can't
+// log in, so it is authenticated by the user's feed token.
+func serveGroupCalendar(c web.C, w http.ResponseWriter, r *http.Request) error {
+	g, err := feedTokenGroup(c, r)
+	if err != nil {
+		return err
+	}
+	cal, err := GetGroupCalendar(g)
+	if err != nil {
+		return wrapError(err)
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	return cal.WriteICS(w, time.Now())
+}
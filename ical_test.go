@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalendarWriteICS(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endsOn := time.Date(2015, 8, 31, 0, 0, 0, 0, time.UTC)
+	g := Group{GID: 3, CreatedOn: time.Date(2015, 8, 19, 16, 0, 0, 0, time.UTC), EndsOn: &endsOn}
+	us := []User{{UID: 1, Login: "samertm"}}
+	commits := map[int][]Commit{1: {
+		// 2015-08-20 in Los Angeles, but 2015-08-21 in UTC.
+		{RepoName: "samertm/githubstreaks", AuthorDate: time.Date(2015, 8, 21, 2, 0, 0, 0, time.UTC)},
+		{RepoName: "samertm/githubstreaks", AuthorDate: time.Date(2015, 8, 20, 18, 0, 0, 0, time.UTC)},
+		{RepoName: "samertm/dotfiles", AuthorDate: time.Date(2015, 8, 20, 17, 0, 0, 0, time.UTC)},
+		// Before the group started.
+		{RepoName: "samertm/dotfiles", AuthorDate: time.Date(2015, 8, 18, 17, 0, 0, 0, time.UTC)},
+	}}
+	cal := BuildGroupCalendar(g, us, commits, la)
+	buf := &bytes.Buffer{}
+	if err := cal.WriteICS(buf, time.Date(2015, 8, 22, 1, 2, 3, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//GitHub Streaks//Group Calendar//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:GitHub Streaks group 3",
+		"X-WR-TIMEZONE:America/Los_Angeles",
+		"BEGIN:VEVENT",
+		"UID:start-3-0-20150819@githubstreaks",
+		"DTSTAMP:20150822T010203Z",
+		"DTSTART;VALUE=DATE:20150819",
+		"DTEND;VALUE=DATE:20150820",
+		"SUMMARY:Group 3 started",
+		"DESCRIPTION:/group/3",
+		"TRANSP:TRANSPARENT",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:active-3-1-20150820@githubstreaks",
+		"DTSTAMP:20150822T010203Z",
+		"DTSTART;VALUE=DATE:20150820",
+		"DTEND;VALUE=DATE:20150821",
+		"SUMMARY:samertm: 3 commits",
+		`DESCRIPTION:samertm/githubstreaks (2)\nsamertm/dotfiles (1)`,
+		"TRANSP:TRANSPARENT",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:end-3-0-20150831@githubstreaks",
+		"DTSTAMP:20150822T010203Z",
+		"DTSTART;VALUE=DATE:20150831",
+		"DTEND;VALUE=DATE:20150901",
+		"SUMMARY:Group 3 ends",
+		"DESCRIPTION:/group/3",
+		"TRANSP:TRANSPARENT",
+		"END:VEVENT",
+		"END:VCALENDAR",
+		"",
+	}, "\r\n")
+	if got := buf.String(); got != want {
+		t.Errorf("Got calendar\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestICSWriterLine(t *testing.T) {
+	for _, tt := range []struct {
+		name, value string
+		text        bool
+		want        string
+	}{
+		{"SUMMARY", "a, b; c\\d\ne", true, `SUMMARY:a\, b\; c\\d\ne` + "\r\n"},
+		{
+			"DESCRIPTION", strings.Repeat("x", 100), false,
+			"DESCRIPTION:" + strings.Repeat("x", 63) + "\r\n " + strings.Repeat("x", 37) + "\r\n",
+		},
+		// Folds don't split the 3 octet "€".
+		{
+			"SUMMARY", strings.Repeat("x", 65) + "€", false,
+			"SUMMARY:" + strings.Repeat("x", 65) + "\r\n €\r\n",
+		},
+	} {
+		buf := &bytes.Buffer{}
+		iw := &icsWriter{w: buf}
+		if tt.text {
+			iw.text(tt.name, tt.value)
+		} else {
+			iw.line(tt.name, tt.value)
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("Got line %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestParseGroupEndsOn(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2015-08-19 in Los Angeles, but 2015-08-20 in UTC.
+	g := Group{GID: 3, CreatedOn: time.Date(2015, 8, 20, 2, 0, 0, 0, time.UTC)}
+	for _, tt := range []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{s: "", want: ""},
+		{s: " 2015-08-31 ", want: "2015-08-31"},
+		{s: "2015-08-19", want: "2015-08-19"},
+		{s: "2015-08-18", wantErr: true},
+		{s: "08/31/2015", wantErr: true},
+	} {
+		day, err := ParseGroupEndsOn(g, tt.s, la)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseGroupEndsOn(%q) got error %v, want error %t", tt.s, err, tt.wantErr)
+			continue
+		}
+		got := ""
+		if day != nil {
+			got = day.Format("2006-01-02")
+		}
+		if got != tt.want {
+			t.Errorf("ParseGroupEndsOn(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/samertm/githubstreaks/debug"
+)
+
+// Job states.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is a unit of work run by the background worker, like
+// backfilling a user's commits. Jobs that are interrupted are
+// restarted from their last checkpoint.
+type Job struct {
+	JID  int    `db:"jid"`
+	Kind string `db:"kind"`
+	// UID is the user the job was started for.
+	UID int `db:"uid"`
+	// Args is the JSON-encoded arguments for the job's handler.
+	Args  string `db:"args"`
+	State string `db:"state"`
+	// Cursor is where the job left off, as saved by Checkpoint.
+	// Its format is up to the job's handler.
+	Cursor string `db:"cursor"`
+	// Progress is a human readable description of the job's
+	// progress.
+	Progress  string    `db:"progress"`
+	Error     string    `db:"error"`
+	CreatedOn time.Time `db:"created_on"`
+	UpdatedOn time.Time `db:"updated_on"`
+	// RunAfter is when a deferred job may run again.
+	RunAfter *time.Time `db:"run_after"`
+}
+
+var jobSchema = `
+CREATE TABLE IF NOT EXISTS job (
+  jid serial PRIMARY KEY,
+  kind text NOT NULL,
+  uid integer REFERENCES "user" (uid) NOT NULL,
+  args text NOT NULL,
+  state text NOT NULL DEFAULT 'queued',
+  cursor text NOT NULL DEFAULT '',
+  progress text NOT NULL DEFAULT '',
+  error text NOT NULL DEFAULT '',
+  created_on timestamp NOT NULL,
+  updated_on timestamp NOT NULL
+)`
+
+// jobRunAfterSchema adds run_after to databases created before jobs
+// could be deferred.
+var jobRunAfterSchema = `
+ALTER TABLE job ADD COLUMN IF NOT EXISTS run_after timestamp`
+
+// jobHandlers maps job kinds to the functions that run them. A
+// handler should call Checkpoint as it makes progress, and pick up
+// from j.Cursor when it starts.
+var jobHandlers = make(map[string]func(j *Job) error)
+
+// EnqueueJob queues a job of kind for u. args is encoded as JSON.
+func EnqueueJob(u User, kind string, args interface{}) (Job, error) {
+	return enqueueJob(u, kind, args, nil)
+}
+
+// EnqueueJobAt queues a job of kind for u that runs no earlier than
+// runAfter.
+func EnqueueJobAt(u User, kind string, args interface{}, runAfter time.Time) (Job, error) {
+	// Timestamps are stored without a time zone.
+	runAfter = runAfter.UTC()
+	return enqueueJob(u, kind, args, &runAfter)
+}
+
+func enqueueJob(u User, kind string, args interface{}, runAfter *time.Time) (Job, error) {
+	if _, ok := jobHandlers[kind]; !ok {
+		return Job{}, errors.Errorf("unknown job kind %q", kind)
+	}
+	bs, err := json.Marshal(args)
+	if err != nil {
+		return Job{}, wrapError(err)
+	}
+	b := &db.Binder{}
+	query := `
+INSERT INTO job(kind, uid, args, run_after, created_on, updated_on)
+  VALUES (` + b.Bind(kind, u.UID, string(bs), runAfter) + `, current_timestamp, current_timestamp)
+  RETURNING *`
+	var j Job
+	if err := db.DB.Get(&j, query, b.Items...); err != nil {
+		return Job{}, wrapErrorf(err, "error queueing %s job for user %d", kind, u.UID)
+	}
+	return j, nil
+}
+
+// GetUserJobs returns u's unfinished jobs and jobs that finished in
+// the last day, newest first.
+func GetUserJobs(u User) ([]Job, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM job WHERE uid = ` + b.Bind(u.UID) + `
+  AND (state IN ('queued', 'running') OR updated_on > current_timestamp - interval '1 day')
+ORDER BY jid DESC`
+	var js []Job
+	if err := db.DB.Select(&js, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	return js, nil
+}
+
+// HasActiveJob returns true if u has a queued or running job of kind.
+func HasActiveJob(u User, kind string) (bool, error) {
+	b := &db.Binder{}
+	query := `SELECT count(*) FROM job WHERE uid = ` + b.Bind(u.UID) +
+		` AND kind = ` + b.Bind(kind) + ` AND state IN ('queued', 'running')`
+	var n int
+	if err := db.DB.Get(&n, query, b.Items...); err != nil {
+		return false, wrapError(err)
+	}
+	return n > 0, nil
+}
+
+// HasQueuedJob returns true if u has a job of kind waiting to run.
+// Unlike HasActiveJob, it ignores running jobs, so a job can use it
+// to check for a job it queued for later.
+func HasQueuedJob(u User, kind string) (bool, error) {
+	b := &db.Binder{}
+	query := `SELECT count(*) FROM job WHERE uid = ` + b.Bind(u.UID) +
+		` AND kind = ` + b.Bind(kind) + ` AND state = 'queued'`
+	var n int
+	if err := db.DB.Get(&n, query, b.Items...); err != nil {
+		return false, wrapError(err)
+	}
+	return n > 0, nil
+}
+
+// CancelQueuedJobs deletes u's jobs of kind that haven't started.
+func CancelQueuedJobs(u User, kind string) error {
+	b := &db.Binder{}
+	query := `DELETE FROM job WHERE uid = ` + b.Bind(u.UID) +
+		` AND kind = ` + b.Bind(kind) + ` AND state = 'queued'`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error cancelling %s jobs for user %d", kind, u.UID)
+	}
+	return nil
+}
+
+// DecodeArgs decodes j's arguments into v.
+func (j *Job) DecodeArgs(v interface{}) error {
+	if err := json.Unmarshal([]byte(j.Args), v); err != nil {
+		return wrapErrorf(err, "error decoding args for job %d", j.JID)
+	}
+	return nil
+}
+
+// Checkpoint saves j's cursor and progress, so that the job can be
+// resumed from cursor if it is interrupted.
+func (j *Job) Checkpoint(cursor, progress string) error {
+	j.Cursor, j.Progress = cursor, progress
+	b := &db.Binder{}
+	query := `UPDATE job SET cursor = ` + b.Bind(cursor) + `, progress = ` + b.Bind(progress) +
+		`, updated_on = current_timestamp WHERE jid = ` + b.Bind(j.JID)
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error saving checkpoint for job %d", j.JID)
+	}
+	return nil
+}
+
+// finishJob marks j as done, or as failed if jobErr is not nil.
+func finishJob(j Job, jobErr error) error {
+	state, msg := JobDone, ""
+	if jobErr != nil {
+		state, msg = JobFailed, jobErr.Error()
+	}
+	b := &db.Binder{}
+	query := `UPDATE job SET state = ` + b.Bind(state) + `, error = ` + b.Bind(msg) +
+		`, updated_on = current_timestamp WHERE jid = ` + b.Bind(j.JID)
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error finishing job %d", j.JID)
+	}
+	return nil
+}
+
+// claimJob marks the oldest queued job as running and returns it. It
+// returns nil if there are no queued jobs.
+func claimJob() (*Job, error) {
+	query := `
+UPDATE job SET state = 'running', updated_on = current_timestamp
+WHERE jid = (
+  SELECT jid FROM job
+  WHERE state = 'queued' AND (run_after IS NULL OR run_after <= current_timestamp)
+  ORDER BY jid ASC LIMIT 1 FOR UPDATE SKIP LOCKED
+) RETURNING *`
+	var j Job
+	if err := db.DB.Get(&j, query); err != nil {
+		if strings.Contains(err.Error(), sqlNotFound) {
+			return nil, nil
+		}
+		return nil, wrapError(err)
+	}
+	return &j, nil
+}
+
+// deferJob queues j to run again after t. It resumes from its last
+// checkpoint.
+func deferJob(j Job, t time.Time) error {
+	b := &db.Binder{}
+	query := `UPDATE job SET state = 'queued', run_after = ` + b.Bind(t) +
+		`, updated_on = current_timestamp WHERE jid = ` + b.Bind(j.JID)
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error deferring job %d", j.JID)
+	}
+	return nil
+}
+
+// requeueInterruptedJobs queues jobs that were running when the
+// server last stopped. They resume from their last checkpoint.
+func requeueInterruptedJobs() error {
+	if _, err := db.DB.Exec(`UPDATE job SET state = 'queued' WHERE state = 'running'`); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// runJob runs j with its handler, recovering from panics so that one
+// bad job doesn't take down the worker.
+func runJob(j *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("job %d panicked: %v", j.JID, r)
+		}
+	}()
+	h, ok := jobHandlers[j.Kind]
+	if !ok {
+		return errors.Errorf("unknown job kind %q", j.Kind)
+	}
+	return h(j)
+}
+
+// RunWorker runs queued jobs one at a time, checking for new jobs
+// every poll. It never returns. Only one worker should run per
+// database.
+func RunWorker(poll time.Duration) {
+	if err := requeueInterruptedJobs(); err != nil {
+		debug.Println(err)
+	}
+	for {
+		j, err := claimJob()
+		if err != nil {
+			debug.Println(err)
+		}
+		if j == nil {
+			time.Sleep(poll)
+			continue
+		}
+		debug.Printf("Running %s job %d for user %d", j.Kind, j.JID, j.UID)
+		jobErr := runJob(j)
+		if until, ok := RateLimitedUntil(jobErr); ok {
+			debug.Printf("Job %d is rate limited, deferring it until %s", j.JID, until)
+			if err := deferJob(*j, until); err != nil {
+				debug.Println(err)
+			}
+			continue
+		}
+		if jobErr != nil {
+			debug.Printf("Job %d failed: %s", j.JID, jobErr)
+		}
+		if err := finishJob(*j, jobErr); err != nil {
+			debug.Println(err)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/samertm/githubstreaks/conf"
+	"github.com/samertm/githubstreaks/db"
+)
+
+// languageFilenames maps whole filenames to their language, for files
+// that are recognized by name rather than extension.
+var languageFilenames = map[string]string{
+	"Dockerfile":     "Dockerfile",
+	"Makefile":       "Makefile",
+	"GNUmakefile":    "Makefile",
+	"makefile":       "Makefile",
+	"CMakeLists.txt": "CMake",
+	"Rakefile":       "Ruby",
+	"Gemfile":        "Ruby",
+	"Vagrantfile":    "Ruby",
+	"Jenkinsfile":    "Groovy",
+	"BUILD":          "Starlark",
+	"WORKSPACE":      "Starlark",
+	"go.mod":         "Go Module",
+	"go.sum":         "Go Checksums",
+}
+
+// languageExtensions maps file extensions, including the dot, to their
+// language. It follows the names used by GitHub's linguist.
+var languageExtensions = map[string]string{
+	".go":         "Go",
+	".c":          "C",
+	".h":          "C",
+	".cc":         "C++",
+	".cpp":        "C++",
+	".cxx":        "C++",
+	".hh":         "C++",
+	".hpp":        "C++",
+	".cs":         "C#",
+	".java":       "Java",
+	".kt":         "Kotlin",
+	".kts":        "Kotlin",
+	".scala":      "Scala",
+	".clj":        "Clojure",
+	".cljs":       "Clojure",
+	".groovy":     "Groovy",
+	".js":         "JavaScript",
+	".jsx":        "JavaScript",
+	".mjs":        "JavaScript",
+	".ts":         "TypeScript",
+	".tsx":        "TypeScript",
+	".coffee":     "CoffeeScript",
+	".py":         "Python",
+	".rb":         "Ruby",
+	".erb":        "HTML+ERB",
+	".php":        "PHP",
+	".pl":         "Perl",
+	".pm":         "Perl",
+	".rs":         "Rust",
+	".swift":      "Swift",
+	".m":          "Objective-C",
+	".mm":         "Objective-C++",
+	".hs":         "Haskell",
+	".ml":         "OCaml",
+	".mli":        "OCaml",
+	".ex":         "Elixir",
+	".exs":        "Elixir",
+	".erl":        "Erlang",
+	".elm":        "Elm",
+	".lua":        "Lua",
+	".r":          "R",
+	".jl":         "Julia",
+	".dart":       "Dart",
+	".el":         "Emacs Lisp",
+	".lisp":       "Common Lisp",
+	".scm":        "Scheme",
+	".rkt":        "Racket",
+	".vim":        "Vim script",
+	".sh":         "Shell",
+	".bash":       "Shell",
+	".zsh":        "Shell",
+	".fish":       "fish",
+	".ps1":        "PowerShell",
+	".sql":        "SQL",
+	".html":       "HTML",
+	".htm":        "HTML",
+	".css":        "CSS",
+	".scss":       "SCSS",
+	".sass":       "Sass",
+	".less":       "Less",
+	".vue":        "Vue",
+	".svelte":     "Svelte",
+	".md":         "Markdown",
+	".markdown":   "Markdown",
+	".rst":        "reStructuredText",
+	".tex":        "TeX",
+	".json":       "JSON",
+	".yml":        "YAML",
+	".yaml":       "YAML",
+	".toml":       "TOML",
+	".xml":        "XML",
+	".proto":      "Protocol Buffer",
+	".tf":         "HCL",
+	".nix":        "Nix",
+	".zig":        "Zig",
+	".nim":        "Nim",
+	".v":          "Verilog",
+	".vhd":        "VHDL",
+	".asm":        "Assembly",
+	".s":          "Assembly",
+	".ipynb":      "Jupyter Notebook",
+	".dockerfile": "Dockerfile",
+}
+
+// DetectLanguage returns the language of the file at filename, judged
+// by its name and extension. It returns "" if the language is not
+// known.
+func DetectLanguage(filename string) string {
+	base := path.Base(filename)
+	if l, ok := languageFilenames[base]; ok {
+		return l
+	}
+	return languageExtensions[strings.ToLower(path.Ext(base))]
+}
+
+// Patch storage policies for PatchPolicy.
+const (
+	PatchesFull     = "full"
+	PatchesTruncate = "truncate"
+	PatchesNone     = "none"
+)
+
+// defaultPatchTruncateBytes is used when PatchTruncateBytes is not
+// configured.
+const defaultPatchTruncateBytes = 4096
+
+func patchTruncateBytes() int {
+	if n := conf.Config.PatchTruncateBytes; n > 0 {
+		return n
+	}
+	return defaultPatchTruncateBytes
+}
+
+// StoredPatch returns the part of patch that is stored, according to
+// the patch policy.
+func StoredPatch(patch string) string {
+	switch conf.Config.PatchPolicy {
+	case PatchesNone:
+		return ""
+	case PatchesTruncate:
+		return TruncatePatch(patch, patchTruncateBytes())
+	}
+	return patch
+}
+
+// TruncatePatch shortens patch to at most n bytes. It cuts after the
+// last whole line that fits, or at a character boundary if the first
+// line is too long.
+func TruncatePatch(patch string, n int) string {
+	if len(patch) <= n {
+		return patch
+	}
+	if i := strings.LastIndex(patch[:n], "\n"); i != -1 {
+		return patch[:i+1]
+	}
+	for n > 0 && !utf8.RuneStart(patch[n]) {
+		n--
+	}
+	return patch[:n]
+}
+
+// MigrateCommitFiles brings commit_file rows saved by older versions
+// up to date: it detects languages for rows without one, and applies
+// the patch policy to stored patches.
+func MigrateCommitFiles() error {
+	var filenames []string
+	query := `SELECT DISTINCT filename FROM commit_file WHERE language IS NULL`
+	if err := db.DB.Select(&filenames, query); err != nil {
+		return wrapError(err)
+	}
+	for _, f := range filenames {
+		b := &db.Binder{}
+		query := `UPDATE commit_file SET language = ` + b.Bind(DetectLanguage(f)) +
+			` WHERE filename = ` + b.Bind(f) + ` AND language IS NULL`
+		if _, err := db.DB.Exec(query, b.Items...); err != nil {
+			return wrapErrorf(err, "error setting language for %s", f)
+		}
+	}
+	switch conf.Config.PatchPolicy {
+	case PatchesNone:
+		if _, err := db.DB.Exec(`UPDATE commit_file SET patch = '' WHERE patch <> ''`); err != nil {
+			return wrapError(err)
+		}
+	case PatchesTruncate:
+		if err := truncateStoredPatches(patchTruncateBytes()); err != nil {
+			return wrapError(err)
+		}
+	}
+	return nil
+}
+
+// truncateStoredPatches cuts stored patches longer than n bytes with
+// TruncatePatch, a batch at a time. Postgres only truncates text by
+// characters, which leaves non-ASCII patches too long.
+func truncateStoredPatches(n int) error {
+	for {
+		var fs []CommitFile
+		query := `
+SELECT commit_sha, filename, patch FROM commit_file
+WHERE commit_sha IS NOT NULL AND octet_length(patch) > $1 LIMIT 500`
+		if err := db.DB.Select(&fs, query, n); err != nil {
+			return wrapError(err)
+		}
+		if len(fs) == 0 {
+			return nil
+		}
+		for _, f := range fs {
+			query := `
+UPDATE commit_file SET patch = $1 WHERE commit_sha = $2 AND filename = $3 AND octet_length(patch) > $4`
+			if _, err := db.DB.Exec(query, TruncatePatch(f.Patch, n), f.CommitSHA, f.Filename, n); err != nil {
+				return wrapErrorf(err, "error truncating patch of %s in %s", f.Filename, f.CommitSHA)
+			}
+		}
+	}
+}
+
+// LanguageStat is the amount of work in a language.
+type LanguageStat struct {
+	Language  string `db:"language"`
+	Commits   int    `db:"commits"`
+	Additions int    `db:"additions"`
+	Deletions int    `db:"deletions"`
+}
+
+// languageStats sums the files in commits matching cond by language,
+// most changed first. cond is a condition on commit; its parameters
+// are bound in b.
+func languageStats(b *db.Binder, cond string, since time.Time) ([]LanguageStat, error) {
+	query := `
+SELECT commit_file.language, count(DISTINCT commit.sha) AS commits,
+  sum(commit_file.additions) AS additions, sum(commit_file.deletions) AS deletions
+FROM commit_file JOIN commit ON commit.sha = commit_file.commit_sha
+WHERE (` + cond + `) AND commit.author_date > ` + b.Bind(since) + `
+  AND commit_file.language <> ''
+GROUP BY commit_file.language
+ORDER BY sum(commit_file.additions + commit_file.deletions) DESC`
+	var ls []LanguageStat
+	if err := db.DB.Select(&ls, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	return ls, nil
+}
+
+// GetUserLanguageStats returns the languages of the commits u owns
+// or co-authored since since.
+func GetUserLanguageStats(u User, since time.Time) ([]LanguageStat, error) {
+	b := &db.Binder{}
+	return languageStats(b, userCommitCond(b, u), since)
+}
+
+// GetGroupLanguageStats returns the languages of the commits made by
+// g's users since since.
+func GetGroupLanguageStats(g Group, since time.Time) ([]LanguageStat, error) {
+	b := &db.Binder{}
+	return languageStats(b, groupCommitCond(b, g), since)
+}
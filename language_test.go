@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestDetectLanguage(t *testing.T) {
+	for filename, want := range map[string]string{
+		"main.go":             "Go",
+		"src/App.TSX":         "TypeScript",
+		"build/Dockerfile":    "Dockerfile",
+		"Makefile":            "Makefile",
+		"docs/README.md":      "Markdown",
+		"LICENSE":             "",
+		"some file name":      "",
+		"archive.tar.gz":      "",
+		"scripts/deploy.bash": "Shell",
+	} {
+		if got := DetectLanguage(filename); got != want {
+			t.Errorf("DetectLanguage(%q) = %q, want %q", filename, got, want)
+		}
+	}
+}
+
+func TestTruncatePatch(t *testing.T) {
+	patch := "@@ -1 +1,2 @@\n-old\n+new\n"
+	for _, tt := range []struct {
+		n    int
+		want string
+	}{
+		{100, patch},
+		{len(patch), patch},
+		{20, "@@ -1 +1,2 @@\n-old\n"},
+		{5, "@@ -1"},
+	} {
+		if got := TruncatePatch(patch, tt.n); got != tt.want {
+			t.Errorf("TruncatePatch(%q, %d) = %q, want %q", patch, tt.n, got, tt.want)
+		}
+	}
+	// Don't cut characters in half.
+	if got := TruncatePatch("+héllo", 3); got != "+h" {
+		t.Errorf("TruncatePatch = %q, want %q", got, "+h")
+	}
+}
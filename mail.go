@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/samertm/githubstreaks/conf"
+	"github.com/samertm/githubstreaks/debug"
+)
+
+// Mail is an email sent by githubstreaks.
+type Mail struct {
+	To      string
+	Subject string
+	// Text is the plain text body.
+	Text string
+	// HTML is the HTML body. If it is set, the mail is sent with
+	// both bodies as alternatives.
+	HTML string
+}
+
+// crlf converts the line endings in s to CRLF, as mail requires.
+func crlf(s string) string {
+	return strings.Replace(strings.Replace(s, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+// Bytes returns the message for m, including headers.
+func (m Mail) Bytes(from string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	if m.HTML == "" {
+		buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+		buf.WriteString("\r\n")
+		buf.WriteString(crlf(m.Text))
+		return buf.Bytes()
+	}
+	mw := multipart.NewWriter(buf)
+	fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%s\r\n", mw.Boundary())
+	buf.WriteString("\r\n")
+	// Clients show the last alternative they understand, so the
+	// HTML goes last. Writes to buf can't fail.
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", m.Text},
+		{"text/html; charset=UTF-8", m.HTML},
+	} {
+		w, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		w.Write([]byte(crlf(part.body)))
+	}
+	mw.Close()
+	return buf.Bytes()
+}
+
+// SendMail sends m over SMTP. If SMTPAddr is not configured, the
+// mail is logged instead, which is handy during development.
+func SendMail(m Mail) error {
+	c := conf.Config
+	if c.SMTPAddr == "" {
+		debug.Printf("Not sending mail, SMTPAddr is not set:\n%s", m.Bytes(c.MailFrom))
+		return nil
+	}
+	var auth smtp.Auth
+	if c.SMTPUsername != "" {
+		host, _, err := net.SplitHostPort(c.SMTPAddr)
+		if err != nil {
+			return wrapError(err)
+		}
+		auth = smtp.PlainAuth("", c.SMTPUsername, c.SMTPPassword, host)
+	}
+	if err := smtp.SendMail(c.SMTPAddr, auth, c.MailFrom, []string{m.To}, m.Bytes(c.MailFrom)); err != nil {
+		return wrapErrorf(err, "error sending mail to %s", m.To)
+	}
+	return nil
+}
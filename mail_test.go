@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/samertm/githubstreaks/conf"
+)
+
+// fakeSMTPServer accepts one SMTP session on a local port and sends
+// the message it receives on the returned channel.
+func fakeSMTPServer(t *testing.T) (addr string, msgs chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs = make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		tc := textproto.NewConn(conn)
+		tc.PrintfLine("220 localhost fake SMTP")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+				tc.PrintfLine("250 OK")
+			case "DATA":
+				tc.PrintfLine("354 Go ahead")
+				lines, err := tc.ReadDotLines()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				msgs <- strings.Join(lines, "\n")
+				tc.PrintfLine("250 OK")
+			case "QUIT":
+				tc.PrintfLine("221 Bye")
+				return
+			default:
+				tc.PrintfLine("502 %s not implemented", cmd)
+			}
+		}
+	}()
+	return l.Addr().String(), msgs
+}
+
+func TestSendMailHTML(t *testing.T) {
+	addr, msgs := fakeSMTPServer(t)
+	saved := conf.Config
+	defer func() { conf.Config = saved }()
+	conf.Config.SMTPAddr = addr
+	conf.Config.SMTPUsername = ""
+	conf.Config.MailFrom = "streaks@localhost"
+
+	err := SendMail(Mail{
+		To:      "samer@example.com",
+		Subject: "Your weekly digest",
+		Text:    "Hi samertm,\nYou're on a 3 day streak.\n",
+		HTML:    "<p>You're on a <strong>3 day streak</strong>.</p>\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(strings.NewReader(<-msgs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Header.Get("To"); got != "samer@example.com" {
+		t.Errorf("Got To %q", got)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Got Content-Type %q, %v", m.Header.Get("Content-Type"), err)
+	}
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", "You're on a 3 day streak."},
+		{"text/html; charset=UTF-8", "<strong>3 day streak</strong>"},
+	} {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Header.Get("Content-Type"); got != want.contentType {
+			t.Errorf("Got part Content-Type %q, want %q", got, want.contentType)
+		}
+		body, err := ioutil.ReadAll(bufio.NewReader(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), want.body) {
+			t.Errorf("Part %q doesn't contain %q:\n%s", want.contentType, want.body, body)
+		}
+	}
+}
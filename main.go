@@ -1,21 +1,23 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/flosch/pongo2"
 	"github.com/go-errors/errors"
-	"github.com/google/go-github/github"
 	"github.com/gorilla/context"
 	"github.com/samertm/githubstreaks/conf"
 	"github.com/samertm/githubstreaks/debug"
 	"github.com/zenazn/goji"
 	"github.com/zenazn/goji/web"
 	"golang.org/x/oauth2"
-	githuboauth "golang.org/x/oauth2/github"
 )
 
 var _ = pongo2.Must(pongo2.FromFile("templates/base.html"))
@@ -33,6 +35,17 @@ var baseContext = pongo2.Context{
 	"AbsoluteURL":        AbsoluteURL,
 	"CommitGroups":       CommitGroups,
 	"CommitMessageTitle": CommitMessageTitle,
+	"DataExportURL": func(e *DataExport) string {
+		return DataExportURL(*e)
+	},
+	"GetCommitAuthors": func(c Commit) []User {
+		us, _ := GetCommitAuthors(c)
+		return us
+	},
+	"GetUserAchievements": func(u User) []UserAchievement {
+		uas, _ := GetUserAchievements(u)
+		return uas
+	},
 	"GetGroupUsers": func(g Group) []User {
 		us, _ := GetGroupUsers(g)
 		return us
@@ -41,9 +54,18 @@ var baseContext = pongo2.Context{
 		u, _ := GetUser(UserSpec{UID: uid})
 		return u
 	},
-	"GroupShareURL": GroupShareURL,
-	"GroupURL":      GroupURL,
-	"ShortSHA":      ShortSHA,
+	"GroupCalendarURL":      GroupCalendarURL,
+	"GroupFeedURL":          GroupFeedURL,
+	"GroupPunchcardURL":     GroupPunchcardURL,
+	"GroupRepoURL":          GroupRepoURL,
+	"GroupShareURL":         GroupShareURL,
+	"GroupURL":              GroupURL,
+	"GroupUserPunchcardURL": GroupUserPunchcardURL,
+	"GroupWebhookURL":       GroupWebhookURL,
+	"OtherGitHubHosts":      OtherGitHubHosts,
+	"ShortSHA":              ShortSHA,
+	"UserHeatmapURL":        UserHeatmapURL,
+	"UserURL":               UserURL,
 }
 
 func RenderTemplate(t *pongo2.Template, w io.Writer, data interface{}) error {
@@ -53,9 +75,19 @@ func RenderTemplate(t *pongo2.Template, w io.Writer, data interface{}) error {
 var indexTemplate = pongo2.Must(pongo2.FromFile("templates/index.html"))
 
 type indexTemplateVars struct {
-	Login  string
-	Email  string
-	Groups []Group
+	// User is the logged in user, if any.
+	User          User
+	Login         string
+	Email         string
+	EmailVerified bool
+	Groups        []Group
+	// Jobs are the user's recent background jobs.
+	Jobs []Job
+	// Languages is the user's language breakdown for the last
+	// week.
+	Languages []LanguageStat
+	// Achievements are the user's achievements, newest first.
+	Achievements []UserAchievement
 
 	NeedEmail bool
 }
@@ -64,24 +96,43 @@ func serveIndex(c web.C, w http.ResponseWriter, r *http.Request) error {
 	a := NewApp(c)
 	v := indexTemplateVars{}
 	if a.User != nil {
+		v.User = *a.User
 		v.Login = a.User.Login
 		// Check whether we need to ask for their email.
 		if !a.User.Email.Valid {
 			v.NeedEmail = true
 		} else {
 			v.Email = a.User.Email.String
+			v.EmailVerified = a.User.EmailVerified
 		}
 		gs, err := GetGroups(*a.User)
 		if err != nil {
 			return wrapErrorf(err, "error getting groups for User %d", a.User.UID)
 		}
 		v.Groups = gs
+		js, err := GetUserJobs(*a.User)
+		if err != nil {
+			return wrapErrorf(err, "error getting jobs for User %d", a.User.UID)
+		}
+		v.Jobs = js
+		ls, err := GetUserLanguageStats(*a.User, WeekStart(time.Now()))
+		if err != nil {
+			return wrapErrorf(err, "error getting languages for User %d", a.User.UID)
+		}
+		v.Languages = ls
+		v.Achievements, err = GetUserAchievements(*a.User)
+		if err != nil {
+			return wrapErrorf(err, "error getting achievements for User %d", a.User.UID)
+		}
 	}
 	return RenderTemplate(indexTemplate, w, v)
 }
 
 type redirectQuery struct {
 	Redirect string `schema:"redirect"`
+	// Host is the provider of the GitHub host to log in with. It
+	// is empty for the default host.
+	Host string `schema:"host"`
 }
 
 func serveLogin(c web.C, w http.ResponseWriter, r *http.Request) error {
@@ -89,9 +140,17 @@ func serveLogin(c web.C, w http.ResponseWriter, r *http.Request) error {
 	if err := SchemaDecoder.Decode(&q, r.URL.Query()); err != nil {
 		return wrapError(err)
 	}
-	oauth := oauthConf // Copy oauthConf so we don't modify it.
+	host, err := GetGitHubHost(q.Host)
+	if err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	oauth := host.OAuth // Copy host.OAuth so we don't modify it.
 	if q.Redirect != "" {
-		oauth.RedirectURL = AbsoluteURL("/github_callback?redirect=" + q.Redirect)
+		if oauth.RedirectURL == "" {
+			oauth.RedirectURL = AbsoluteURL("/github_callback?redirect=" + q.Redirect)
+		} else {
+			oauth.RedirectURL += "&redirect=" + q.Redirect
+		}
 	}
 	u := oauth.AuthCodeURL(oauthStateString, oauth2.AccessTypeOnline)
 	return &HTTPRedirect{To: u, Code: http.StatusSeeOther}
@@ -103,33 +162,43 @@ func serveGitHubCallback(c web.C, w http.ResponseWriter, r *http.Request) error
 	if state != oauthStateString {
 		return errors.Errorf("invalid oauth state, expected '%s', got '%s'\n", oauthStateString, state)
 	}
+	var q redirectQuery
+	if err := SchemaDecoder.Decode(&q, r.URL.Query()); err != nil {
+		return wrapError(err)
+	}
+	host, err := GetGitHubHost(q.Host)
+	if err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
 
 	code := r.FormValue("code")
-	token, err := oauthConf.Exchange(oauth2.NoContext, code)
+	token, err := host.OAuth.Exchange(oauth2.NoContext, code)
 	if err != nil {
-		return wrapErrorf(err, "oauthConf.Exchange() failed")
+		return wrapErrorf(err, "host.OAuth.Exchange() failed for %s", host.Name)
 	}
 
-	oauthClient := oauthConf.Client(oauth2.NoContext, token)
-	client := github.NewClient(oauthClient)
+	client := host.TokenClient(token)
 	ghUser, _, err := client.Users.Get("")
 	if err != nil {
 		return wrapErrorf(err, "client.Users.Get() failed")
 	}
-	debug.Printf("Logged in as GitHub user: %s\n", *ghUser.Login)
+	debug.Printf("Logged in as %s user: %s\n", host.Name, *ghUser.Login)
 	// Save user to DB.
-	user, err := GetCreateUser(*ghUser.Login)
+	user, err := GetCreateUser(host.Provider, *ghUser.Login)
 	if err != nil {
 		return wrapErrorf(err, "error saving user to the database")
 	}
+	es, _, err := client.Users.ListEmails(nil)
+	if err != nil {
+		return wrapErrorf(err, "client.Users.ListEmails() failed")
+	}
+	if err := SaveGitHubEmails(user, es); err != nil {
+		return wrapError(err)
+	}
 	a.Session.Values[UIDSessionKey] = user.UID
 	if err := a.Session.Save(r, w); err != nil {
 		return wrapErrorf(err, "error saving session")
 	}
-	var q redirectQuery
-	if err := SchemaDecoder.Decode(&q, r.URL.Query()); err != nil {
-		return wrapError(err)
-	}
 	if q.Redirect != "" {
 		u, err := url.QueryUnescape(q.Redirect)
 		if err != nil {
@@ -157,20 +226,42 @@ func serveSaveEmail(c web.C, w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return wrapErrorf(err, "error decoding form")
 	}
-	if err := SetEmail(*a.User, form.Email); err != nil {
+	email, err := ParseEmail(form.Email)
+	if err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	if err := SetEmail(*a.User, email); err != nil {
 		return wrapErrorf(err, "error setting email")
 	}
+	u, err := GetUser(UserSpec{UID: a.User.UID})
+	if err != nil {
+		return wrapError(err)
+	}
+	// Saving the same verified email again doesn't need a new
+	// link; saving an unverified one resends it.
+	if !u.EmailVerified {
+		if err := SendAccountEmailVerification(u, email); err != nil {
+			return wrapError(err)
+		}
+	}
+	// Only the first email is saved from the index page; changes
+	// come from the settings page.
+	if a.User.Email.Valid {
+		return &HTTPRedirect{To: "/settings", Code: http.StatusSeeOther}
+	}
 	return &HTTPRedirect{To: "/", Code: http.StatusSeeOther}
 }
 
+// serveUserStatsSVG serves the streak of one of the group's users.
+// Only the group's members can see it, like the group page.
 func serveUserStatsSVG(c web.C, w http.ResponseWriter, r *http.Request) error {
-	gid, err := getParamInt(c, "group_id")
-	if err != nil {
-		return wrapError(err)
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
 	}
-	g, err := GetGroup(gid)
+	g, err := memberGroup(*a.User, c)
 	if err != nil {
-		return wrapError(err)
+		return err
 	}
 	uid, err := getParamInt(c, "user_id")
 	if err != nil {
@@ -180,6 +271,13 @@ func serveUserStatsSVG(c web.C, w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return wrapError(err)
 	}
+	ok, err := UserInGroup(u, g)
+	if err != nil {
+		return wrapError(err)
+	}
+	if !ok {
+		return &HTTPError{Err: errors.Errorf("user %d isn't in group %d", u.UID, g.GID), Code: http.StatusNotFound}
+	}
 	w.Header().Set("Content-Type", "image/svg+xml")
 	if err := CreateStreakSVG(u, g, w); err != nil {
 		return wrapError(err)
@@ -205,6 +303,19 @@ type groupTemplateVars struct {
 	Login           string
 	Group           Group
 	DayCommitGroups []DayCommitGroup
+	// Languages is the group's language breakdown for the last
+	// week.
+	Languages []LanguageStat
+	// TopRepos are the group's most active repos in the last week.
+	TopRepos []RepoSummary
+	// Digest is the user's digest subscription for the group.
+	Digest DigestSubscription
+	// ChatHooks are the group's chat hooks.
+	ChatHooks []ChatHook
+	// Webhooks are the group's webhooks.
+	Webhooks []GroupWebhook
+	// FeedToken is the user's token for the group's feeds.
+	FeedToken string
 }
 
 func serveGroup(c web.C, w http.ResponseWriter, r *http.Request) error {
@@ -212,27 +323,53 @@ func serveGroup(c web.C, w http.ResponseWriter, r *http.Request) error {
 	if redirect := a.Authed(r); redirect != nil {
 		return redirect
 	}
-	gid, err := getParamInt(c, "group_id")
+	g, err := memberGroup(*a.User, c)
+	if err != nil {
+		return err
+	}
+	cs, err := GetGroupAllCommits(g)
 	if err != nil {
 		return wrapError(err)
 	}
-	g, err := GetGroup(gid)
+	loc, err := GetGroupLocation(g)
 	if err != nil {
 		return wrapError(err)
 	}
-	cs, err := GetGroupAllCommits(g)
+	weekStart := WeekStart(time.Now().In(loc))
+	ls, err := GetGroupLanguageStats(g, weekStart)
 	if err != nil {
 		return wrapError(err)
 	}
-	loc, err := GetGroupLocation(g)
+	trs, err := GetGroupTopRepos(g, weekStart, 5)
+	if err != nil {
+		return wrapError(err)
+	}
+	ds, err := GetDigestSubscription(a.User.UID, g.GID)
+	if err != nil {
+		return wrapError(err)
+	}
+	hs, err := GetChatHooks(g)
+	if err != nil {
+		return wrapError(err)
+	}
+	whs, err := GetGroupWebhooks(g)
+	if err != nil {
+		return wrapError(err)
+	}
+	ft, err := GetFeedToken(*a.User)
 	if err != nil {
 		return wrapError(err)
 	}
-	// TODO(samertm): Check that the user is in the group.
 	return RenderTemplate(groupTemplate, w, groupTemplateVars{
 		Login:           a.User.Login,
 		Group:           g,
 		DayCommitGroups: DayCommitGroups(cs, loc),
+		Languages:       ls,
+		TopRepos:        trs,
+		Digest:          ds,
+		ChatHooks:       hs,
+		Webhooks:        whs,
+		FeedToken:       ft,
 	})
 }
 
@@ -247,11 +384,54 @@ func serveGroupRefresh(c web.C, w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 	if err := UpdateGroupCommits(g); err != nil {
+		if until, ok := RateLimitedUntil(err); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(until.Sub(time.Now()).Seconds())+1))
+			return &HTTPError{
+				Err:  errors.Errorf("GitHub is rate limiting us, try again after %s", until.Format(time.Kitchen)),
+				Code: http.StatusServiceUnavailable,
+			}
+		}
 		return err
 	}
 	return nil
 }
 
+type groupEndsOnForm struct {
+	EndsOn string `schema:"ends_on"`
+}
+
+// serveSaveGroupEndsOn sets or clears the last day of the group's
+// challenge.
+func serveSaveGroupEndsOn(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	g, err := memberGroup(*a.User, c)
+	if err != nil {
+		return err
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form groupEndsOnForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	loc, err := GetGroupLocation(g)
+	if err != nil {
+		return wrapError(err)
+	}
+	day, err := ParseGroupEndsOn(g, form.EndsOn, loc)
+	if err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	if err := SetGroupEndsOn(g, day); err != nil {
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: GroupURL(g), Code: http.StatusSeeOther}
+}
+
 type groupJoinQuery struct {
 	Key string `schema:"key"`
 }
@@ -280,32 +460,72 @@ func serveGroupJoin(c web.C, w http.ResponseWriter, r *http.Request) error {
 	if err := GroupAddUser(g, *a.User); err != nil {
 		return wrapError(err)
 	}
+	if err := PublishGroupEvent(GroupEvent{Kind: EventMemberJoined, Group: g, User: *a.User}); err != nil {
+		// The user still joined.
+		debug.Println(err)
+	}
+	// The group shows commits since it was created, which may be
+	// older than what we fetch from recent pushes.
+	if err := EnqueueBackfill(*a.User, BeginningOfDay(g.CreatedOn), time.Now()); err != nil {
+		return wrapError(err)
+	}
 	return &HTTPRedirect{To: GroupURL(g), Code: http.StatusSeeOther}
 }
 
-var (
-	oauthConf = oauth2.Config{
-		ClientID:     conf.Config.GitHubID,
-		ClientSecret: conf.Config.GitHubSecret,
-		Scopes:       []string{"user:email"},
-		Endpoint:     githuboauth.Endpoint,
+func serveGroupLeave(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
 	}
-	oauthStateString = conf.Config.OAuthStateString
-)
-
-// Pass nil for transport.
-func UnauthedGitHubClient(transport http.RoundTripper) *github.Client {
-	t := github.UnauthenticatedRateLimitedTransport{
-		ClientID:     oauthConf.ClientID,
-		ClientSecret: oauthConf.ClientSecret,
-		Transport:    transport,
+	g, err := memberGroup(*a.User, c)
+	if err != nil {
+		return err
+	}
+	if err := GroupRemoveUser(g, *a.User); err != nil {
+		return wrapError(err)
 	}
-	return github.NewClient(t.Client())
+	if err := PublishGroupEvent(GroupEvent{Kind: EventMemberLeft, Group: g, User: *a.User}); err != nil {
+		// The user still left.
+		debug.Println(err)
+	}
+	return &HTTPRedirect{To: "/", Code: http.StatusSeeOther}
 }
 
+var oauthStateString = conf.Config.OAuthStateString
+
 func main() {
+	code := runCommand(os.Args[1:])
+	debug.Flush()
+	os.Exit(code)
+}
+
+// serveCommand implements "githubstreaks serve". It runs the web
+// server and background workers until the server stops.
+func serveCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageErrorf("unexpected arguments")
+	}
 	// Initalize database.
 	ExecuteSchemas()
+	go func() {
+		if err := MigrateCommitFiles(); err != nil {
+			debug.Println(err)
+		}
+	}()
+	go func() {
+		if err := ScheduleReminders(); err != nil {
+			debug.Println(err)
+		}
+	}()
+	go RunWorker(5 * time.Second)
+	go RunDigests(time.Hour)
+	go RunDeliveries(5 * time.Second)
+	go RunDailyNotifications(15 * time.Minute)
+	go RunHTTPCacheSweeps(time.Hour)
 	// Serve static files.
 	staticDirs := []string{"bower_components", "res"}
 	for _, d := range staticDirs {
@@ -323,12 +543,56 @@ func main() {
 	goji.Get("/github_callback", handler(serveGitHubCallback))
 	// TODO(samertm): Make this POST /user/email.
 	goji.Post("/save_email", handler(serveSaveEmail))
+	goji.Get("/email/verify", handler(serveVerifyAccountEmail))
+	goji.Post("/import/git", handler(serveImportGit))
+	goji.Post("/account/link", handler(serveLinkAccount))
+	goji.Post("/user/emails", handler(serveAddUserEmail))
+	goji.Get("/user/emails/verify", handler(serveVerifyUserEmail))
+	goji.Post("/user/emails/delete", handler(serveDeleteUserEmail))
+	goji.Post("/user/backfill", handler(serveBackfill))
+	goji.Post("/user/repo_filter", handler(serveSaveRepoFilter))
+	goji.Post("/user/reminder", handler(serveSaveReminder))
+	goji.Post("/user/profile_privacy", handler(serveSaveProfilePrivacy))
+	goji.Post("/user/timezone", handler(serveSaveTimezone))
+	goji.Get("/settings", handler(serveSettings))
+	goji.Get("/settings/delete", handler(serveDeleteAccountConfirm))
+	goji.Post("/settings/delete", handler(serveDeleteAccount))
+	goji.Post("/settings/export", handler(serveRequestExport))
+	goji.Get("/export/download", handler(serveDownloadExport))
+	goji.Get("/user/:login/heatmap.svg", handler(serveProfileHeatmap))
+	goji.Get("/user/:login", handler(serveProfile))
+
+	goji.Get("/admin", handler(serveAdmin))
 
 	goji.Post("/group/create", handler(serveGroupCreate))
 	goji.Post("/group/:group_id/refresh", handler(serveGroupRefresh))
+	goji.Post("/group/:group_id/ends_on", handler(serveSaveGroupEndsOn))
 	goji.Get("/group/:group_id/join", handler(serveGroupJoin))
+	goji.Post("/group/:group_id/leave", handler(serveGroupLeave))
 	goji.Get("/group/:group_id", handler(serveGroup))
 	goji.Get("/group/:group_id/user/:user_id/stats.svg", handler(serveUserStatsSVG))
+	goji.Get("/group/:group_id/user/:user_id/punchcard.svg", handler(servePunchcardSVG))
+	goji.Get("/group/:group_id/user/:user_id/punchcard.json", handler(servePunchcardJSON))
+	goji.Get("/group/:group_id/punchcard.svg", handler(servePunchcardSVG))
+	goji.Get("/group/:group_id/punchcard.json", handler(servePunchcardJSON))
+	goji.Get("/group/:group_id/repo/:owner/:name", handler(serveGroupRepo))
+	goji.Get("/group/:group_id/repo/:owner/:name/stats.json", handler(serveGroupRepoStats))
+	goji.Post("/group/:group_id/digest", handler(serveGroupDigest))
+	goji.Get("/digest/unsubscribe", handler(serveDigestUnsubscribe))
+	goji.Post("/group/:group_id/chat_hooks", handler(serveAddChatHook))
+	goji.Post("/group/:group_id/chat_hooks/delete", handler(serveDeleteChatHook))
+	goji.Get("/group/:group_id/feed.atom", handler(serveGroupFeedAtom))
+	goji.Get("/group/:group_id/feed.rss", handler(serveGroupFeedRSS))
+	goji.Get("/group/:group_id/calendar.ics", handler(serveGroupCalendar))
+	goji.Get("/group/:group_id/export.csv", handler(serveGroupExportCSV))
+	goji.Get("/group/:group_id/export.json", handler(serveGroupExportJSON))
+	goji.Post("/group/:group_id/feed_token/reset", handler(serveResetFeedToken))
+	goji.Post("/group/:group_id/webhooks", handler(serveAddGroupWebhook))
+	goji.Get("/group/:group_id/webhooks/:webhook_id", handler(serveGroupWebhook))
+	goji.Post("/group/:group_id/webhooks/:webhook_id/delete", handler(serveDeleteGroupWebhook))
+	goji.Post("/group/:group_id/webhooks/:webhook_id/enable", handler(serveEnableGroupWebhook))
+	goji.Post("/group/:group_id/webhooks/:webhook_id/redeliver", handler(serveRedeliverGroupWebhook))
 
 	goji.Serve()
+	return nil
 }
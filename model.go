@@ -4,30 +4,74 @@ import (
 	"crypto/md5"
 	"database/sql"
 	"encoding/hex"
-	"fmt"
-	"net/http"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-errors/errors"
-	"github.com/google/go-github/github"
+	"github.com/samertm/githubstreaks/conf"
 	"github.com/samertm/githubstreaks/db"
 	"github.com/samertm/githubstreaks/debug"
 )
 
-// schemas is a list of all of the database schemas. All of the
-// schemas must be executed before the app starts. Each new database
-// schema should be added to schemas.
-var schemas []string
+// schemas is a list of all of the database schemas, in the order they
+// are executed. All of the schemas must be executed before the app
+// starts. Each new database schema should be added to schemas after
+// the schemas of the tables it references or alters.
+var schemas = []string{
+	userSchema,
+	userProviderSchema,
+	userEmailVerifiedSchema,
+	userProfilePrivateSchema,
+	userTimezoneSchema,
+	groupSchema,
+	groupEndsOnSchema,
+	userGroupSchema,
+	userGroupJoinedOnSchema,
+	commitSchema,
+	commitFileSchema,
+	commitProviderSchema,
+	commitFileLanguageSchema,
+	accountSchema,
+	userEmailSchema,
+	commitAuthorSchema,
+	jobSchema,
+	jobRunAfterSchema,
+	httpCacheSchema,
+	repoFilterSchema,
+	repoInfoSchema,
+	excludedSchema,
+	digestSubscriptionSchema,
+	reminderSettingSchema,
+	reminderSchema,
+	chatHookSchema,
+	groupDailySchema,
+	groupWebhookSchema,
+	deliverySchema,
+	deliveryAttemptSchema,
+	feedTokenSchema,
+	userAchievementSchema,
+	dataExportSchema,
+}
 
 // ExecuteSchemas executes all of the schemas defined for the models.
 // It must be called before starting the app.
 func ExecuteSchemas() {
+	if err := MigrateSchemas(); err != nil {
+		panic(err)
+	}
+}
+
+// MigrateSchemas executes all of the schemas defined for the models,
+// stopping at the first one that fails.
+func MigrateSchemas() error {
 	for _, s := range schemas {
-		db.DB.MustExec(s)
+		if _, err := db.DB.Exec(s); err != nil {
+			return wrapErrorf(err, "error executing schema %s", s)
+		}
 	}
+	return nil
 }
 
 // User represents a user on githubstreaks.
@@ -36,45 +80,89 @@ type User struct {
 	// valid UID.
 	UID int `db:"uid"`
 	// Login is the user's username. It is the same as their
-	// GitHub login.
+	// login on their GitHub host.
 	Login string         `db:"login"`
 	Email sql.NullString `db:"email"`
+	// EmailVerified is true if the user opened the verification
+	// link for Email. Notifications are only sent to verified
+	// emails.
+	EmailVerified bool `db:"email_verified"`
 	// CommitsLastUpdatedOn is the date that the user's commits
 	// were last updated. It is never used, and should probably be
 	// removed.
 	CommitsLastUpdatedOn *time.Time `db:"commits_last_updated_on"`
-	// ETag is the etag retrieved from the last request for the
-	// user's events from GitHub.
+	// ETag is no longer used. Conditional requests are cached
+	// per URL by CachingTransport.
 	ETag sql.NullString `db:"etag"`
+	// Provider is the GitHub host that the user logged in with.
+	// Logins are only unique within a host.
+	Provider string `db:"provider"`
+	// ProfilePrivate hides the user's profile from people who
+	// aren't in any of their groups.
+	ProfilePrivate bool `db:"profile_private"`
+	// Timezone is the IANA name of the user's timezone, or empty
+	// if they haven't set one.
+	Timezone string `db:"timezone"`
 }
 
 var userSchema = `
 CREATE TABLE IF NOT EXISTS "user" (
   uid SERIAL PRIMARY KEY,
-  login text NOT NULL UNIQUE,
+  login text NOT NULL,
   email text,
   commits_last_updated_on timestamp,
   etag text
 )
 `
 
-func init() {
-	schemas = append(schemas, userSchema)
-}
+// userProviderSchema keys users by their GitHub host and login
+// instead of only their login, which may collide across hosts.
+var userProviderSchema = `
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS provider text NOT NULL DEFAULT 'github';
+ALTER TABLE "user" DROP CONSTRAINT IF EXISTS user_login_key;
+CREATE UNIQUE INDEX IF NOT EXISTS user_provider_login ON "user" (provider, login)`
+
+// userEmailVerifiedSchema adds the email_verified column to databases
+// created before emails were verified.
+var userEmailVerifiedSchema = `
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS email_verified boolean NOT NULL DEFAULT false`
+
+// userProfilePrivateSchema adds the profile privacy setting.
+var userProfilePrivateSchema = `
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS profile_private boolean NOT NULL DEFAULT false`
+
+// userTimezoneSchema adds the user's timezone setting.
+var userTimezoneSchema = `
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS timezone text NOT NULL DEFAULT ''`
 
 // UserSpec represents a unique identifier for a user. Either UID or
 // Login must not be their type's zero value (0 and "", respectively)
-// when UserSpec is used.
+// when UserSpec is used. Logins are looked up on Provider, or on the
+// default GitHub host if Provider is empty.
 type UserSpec struct {
-	UID   int
-	Login string
+	UID      int
+	Provider string
+	Login    string
+}
+
+// ParseUserSpec parses s, a login or "provider:login", into a
+// UserSpec. Logins without a provider are on GitHub.
+func ParseUserSpec(s string) (UserSpec, error) {
+	us := UserSpec{Login: s}
+	if i := strings.Index(s, ":"); i != -1 {
+		us.Provider, us.Login = s[:i], s[i+1:]
+	}
+	if us.Login == "" {
+		return UserSpec{}, errors.Errorf("bad user %q", s)
+	}
+	return us, nil
 }
 
-// GetCreateUser gets the user for login, or creates them if they do
-// not exist.
-func GetCreateUser(login string) (User, error) {
+// GetCreateUser gets the user for login on provider, or creates them
+// if they do not exist.
+func GetCreateUser(provider, login string) (User, error) {
 	// Try to get the user once.
-	u, err := GetUser(UserSpec{Login: login})
+	u, err := GetUser(UserSpec{Provider: provider, Login: login})
 	if err == nil {
 		// User exists, return them.
 		return u, nil
@@ -83,21 +171,21 @@ func GetCreateUser(login string) (User, error) {
 	// and log & abort otherwise (hit a bug related to this.)
 
 	// Create the user and then get them.
-	if err := CreateUser(login); err != nil {
+	if err := CreateUser(provider, login); err != nil {
 		return User{}, wrapError(err)
 	}
 	// Get the user one last time.
-	u, err = GetUser(UserSpec{Login: login})
+	u, err = GetUser(UserSpec{Provider: provider, Login: login})
 	if err != nil {
 		return User{}, wrapError(err)
 	}
 	return u, nil
 }
 
-// CreateUser creates a user for login.
-func CreateUser(login string) error {
-	query := `INSERT INTO "user"(login) VALUES ($1)`
-	if _, err := db.DB.Exec(query, login); err != nil {
+// CreateUser creates a user for login on provider.
+func CreateUser(provider, login string) error {
+	query := `INSERT INTO "user"(login, provider) VALUES ($1, $2)`
+	if _, err := db.DB.Exec(query, login, provider); err != nil {
 		return wrapError(err)
 	}
 	return nil
@@ -106,32 +194,32 @@ func CreateUser(login string) error {
 // GetUser gets a user identified by us.
 func GetUser(us UserSpec) (User, error) {
 	u := User{}
-	where := struct {
-		col string
-		val string
-	}{}
+	var err error
 	if us.UID != 0 {
-		where.col = "uid"
-		where.val = strconv.Itoa(us.UID)
+		err = db.DB.Get(&u, `SELECT * from "user" WHERE uid=$1`, us.UID)
 	} else if us.Login != "" {
-		where.col = "login"
-		where.val = us.Login
+		provider := us.Provider
+		if provider == "" {
+			provider = GitHubProvider
+		}
+		err = db.DB.Get(&u, `SELECT * from "user" WHERE login=$1 AND provider=$2`, us.Login, provider)
 	} else {
 		return User{}, errors.New("Empty user spec")
 	}
-
-	err := db.DB.Get(&u, fmt.Sprintf(`SELECT * from "user" WHERE %s=$1`, where.col), where.val)
 	if err != nil {
 		return User{}, wrapError(err)
 	}
 	return u, nil
 }
 
-// GetUserCommits gets u's commits made after after.
+// GetUserCommits gets the commits u owns or co-authored made after
+// after. Commits excluded by u's repo filter are left out.
 func GetUserCommits(u User, after time.Time) ([]Commit, error) {
 	b := &db.Binder{}
 	query := `SELECT * FROM commit
-WHERE uid = ` + b.Bind(u.UID) + ` AND author_date > ` + b.Bind(after)
+WHERE ((uid = ` + b.Bind(u.UID) + ` AND NOT excluded) OR
+       sha IN (SELECT sha FROM commit_author WHERE uid = ` + b.Bind(u.UID) + ` AND NOT excluded))
+  AND author_date > ` + b.Bind(after)
 	var commits []Commit
 	if err := db.DB.Select(&commits, query, b.Items...); err != nil {
 		return nil, wrapError(err)
@@ -139,10 +227,12 @@ WHERE uid = ` + b.Bind(u.UID) + ` AND author_date > ` + b.Bind(after)
 	return commits, nil
 }
 
-// SetEmail sets u's email to email in the database.
+// SetEmail sets u's email to email in the database. The email has to
+// be verified again if it changed.
 func SetEmail(u User, email string) error {
 	b := &db.Binder{}
-	query := `UPDATE "user" SET email = ` + b.Bind(email) + " " +
+	query := `UPDATE "user" SET email = ` + b.Bind(email) + ", " +
+		"email_verified = (email_verified AND email IS NOT DISTINCT FROM " + b.Bind(email) + ") " +
 		"WHERE uid = " + b.Bind(u.UID)
 	if _, err := db.DB.Exec(query, b.Items...); err != nil {
 		return wrapError(err)
@@ -196,15 +286,10 @@ func BeginningOfDay(t time.Time) time.Time {
 	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
 }
 
-// SetETag sets u's etag to etag in the database.
-func SetETag(u User, etag string) error {
-	b := &db.Binder{}
-	query := `UPDATE "user" SET etag = ` + b.Bind(etag) + ` ` +
-		`WHERE uid = ` + b.Bind(u.UID)
-	if _, err := db.DB.Exec(query, b.Items...); err != nil {
-		return wrapError(err)
-	}
-	return nil
+// WeekStart returns the beginning of the day six days before t, so
+// that the week ending on t's day is seven days long.
+func WeekStart(t time.Time) time.Time {
+	return BeginningOfDay(t.AddDate(0, 0, -6))
 }
 
 // Group represents a collaborative GitHub projects group.
@@ -212,6 +297,9 @@ type Group struct {
 	GID       int       `db:"gid"`
 	CreatedOn time.Time `db:"created_on"`
 	Timezone  string    `db:"timezone"`
+	// EndsOn is the last day of the group's challenge, as a date in
+	// the group's timezone, or nil if it doesn't end.
+	EndsOn *time.Time `db:"ends_on"`
 }
 
 var groupSchema = `
@@ -221,9 +309,9 @@ CREATE TABLE IF NOT EXISTS "group" (
   timezone text NOT NULL
 )`
 
-func init() {
-	schemas = append(schemas, groupSchema)
-}
+// groupEndsOnSchema adds challenge end dates to groups.
+var groupEndsOnSchema = `
+ALTER TABLE "group" ADD COLUMN IF NOT EXISTS ends_on date`
 
 // UserGroup represents a many-to-many relation between users and
 // groups. This type exists solely for interfacing with the database.
@@ -239,23 +327,30 @@ CREATE TABLE IF NOT EXISTS user_group (
   CONSTRAINT uid_gid UNIQUE(uid, gid)
 )`
 
-func init() {
-	schemas = append(schemas, userGroupSchema)
-}
+// userGroupJoinedOnSchema records when users join groups. It is NULL
+// for users who joined before it was added.
+var userGroupJoinedOnSchema = `
+ALTER TABLE user_group ADD COLUMN IF NOT EXISTS joined_on timestamp`
 
-// CreateGroup creates a group and adds u as its first user.
+// defaultTimezone is the timezone of groups created by users who
+// haven't set one.
+const defaultTimezone = "America/Los_Angeles"
+
+// CreateGroup creates a group and adds u as its first user. The group
+// is in u's timezone.
 func CreateGroup(u User) (Group, error) {
-	// TODO(samertm): Use the user's timezone instead of always
-	// stored "America/Los_Angeles".
-	tz := "America/Los_Angeles"
+	tz := u.Timezone
+	if tz == "" {
+		tz = defaultTimezone
+	}
 	b := &db.Binder{}
 	query := `
 WITH g AS (
   INSERT INTO "group"(gid, created_on, timezone)
     VALUES (DEFAULT, current_timestamp, ` + b.Bind(tz) + `) RETURNING *
 ), i AS (
-  INSERT INTO user_group(uid, gid)
-    SELECT ` + b.Bind(u.UID) + `, gid FROM g
+  INSERT INTO user_group(uid, gid, joined_on)
+    SELECT ` + b.Bind(u.UID) + `, gid, current_timestamp FROM g
 )
 SELECT gid FROM g`
 	var g Group
@@ -269,13 +364,49 @@ SELECT gid FROM g`
 func GroupAddUser(g Group, u User) error {
 	b := &db.Binder{}
 	query := `
-INSERT INTO user_group(uid, gid) VALUES (` + b.Bind(u.UID, g.GID) + `)`
+INSERT INTO user_group(uid, gid, joined_on) VALUES (` + b.Bind(u.UID, g.GID) + `, current_timestamp)`
 	if _, err := db.DB.Exec(query, b.Items...); err != nil {
 		return wrapErrorf(err, "error adding user %d to group %d", u.UID, g.GID)
 	}
 	return nil
 }
 
+// GroupRemoveUser removes u from group g, along with u's digest
+// subscription for g. If u's reminders use g, they move to another of
+// u's groups, or are turned off if u is in no other group, since they
+// need a group to decide what counts as today.
+func GroupRemoveUser(g Group, u User) error {
+	b := &db.Binder{}
+	uid, gid := b.Bind(u.UID), b.Bind(g.GID)
+	otherGroups := `SELECT gid FROM user_group WHERE uid = ` + uid + ` AND gid != ` + gid
+	query := `
+WITH d AS (
+  DELETE FROM digest_subscription WHERE uid = ` + uid + ` AND gid = ` + gid + `
+), r AS (
+  UPDATE reminder_setting SET gid = (` + otherGroups + ` ORDER BY gid ASC LIMIT 1)
+  WHERE uid = ` + uid + ` AND gid = ` + gid + ` AND EXISTS (` + otherGroups + `)
+), rd AS (
+  DELETE FROM reminder_setting
+  WHERE uid = ` + uid + ` AND gid = ` + gid + ` AND NOT EXISTS (` + otherGroups + `)
+)
+DELETE FROM user_group WHERE uid = ` + uid + ` AND gid = ` + gid
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error removing user %d from group %d", u.UID, g.GID)
+	}
+	return nil
+}
+
+// UserInGroup returns true if u is in g.
+func UserInGroup(u User, g Group) (bool, error) {
+	b := &db.Binder{}
+	query := `SELECT count(*) FROM user_group WHERE uid = ` + b.Bind(u.UID) + ` AND gid = ` + b.Bind(g.GID)
+	var n int
+	if err := db.DB.Get(&n, query, b.Items...); err != nil {
+		return false, wrapError(err)
+	}
+	return n > 0, nil
+}
+
 // GroupURL returns a url for navigating to g.
 func GroupURL(g Group) string {
 	return "/group/" + strconv.Itoa(g.GID)
@@ -342,21 +473,28 @@ func GetGroupUsers(g Group) ([]User, error) {
 	return us, nil
 }
 
-// GetGroupAllCommits gets the commits in g.
+// GetGroupAllCommits gets the commits in g. Commits co-authored by
+// several users in g are only included once.
 func GetGroupAllCommits(g Group) ([]Commit, error) {
 	us, err := GetGroupUsers(g)
 	if err != nil {
 		return nil, wrapError(err)
 	}
 	var cs []Commit
+	seen := make(map[string]bool)
 	for _, u := range us {
 		// TODO(samertm): Convert CreatedOn to the correct
 		// timezone. Also, give every group a timezone.
-		c, err := GetUserCommits(u, BeginningOfDay(g.CreatedOn))
+		ucs, err := GetUserCommits(u, BeginningOfDay(g.CreatedOn))
 		if err != nil {
 			return nil, wrapError(err)
 		}
-		cs = append(cs, c...)
+		for _, c := range ucs {
+			if !seen[c.SHA] {
+				seen[c.SHA] = true
+				cs = append(cs, c)
+			}
+		}
 	}
 	return cs, nil
 }
@@ -378,6 +516,49 @@ func UpdateGroupCommits(g Group) error {
 	return nil
 }
 
+// ParseGroupEndsOn parses s, a date in the form "2006-01-02", as the
+// last day of g's challenge in loc. An empty s means g doesn't end.
+// The end can't be before the day g started.
+func ParseGroupEndsOn(g Group, s string, loc *time.Location) (*time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", s, loc)
+	if err != nil {
+		return nil, errors.Errorf("%q is not a date like 2015-08-31", s)
+	}
+	if day.Before(BeginningOfDay(g.CreatedOn.In(loc))) {
+		return nil, errors.New("the group can't end before it started")
+	}
+	return &day, nil
+}
+
+// SetGroupEndsOn sets the last day of g's challenge to day, or
+// removes it if day is nil.
+func SetGroupEndsOn(g Group, day *time.Time) error {
+	var endsOn interface{}
+	if day != nil {
+		endsOn = day.Format("2006-01-02")
+	}
+	b := &db.Binder{}
+	query := `UPDATE "group" SET ends_on = ` + b.Bind(endsOn) + ` WHERE gid = ` + b.Bind(g.GID)
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error setting the end of group %d", g.GID)
+	}
+	return nil
+}
+
+// GroupEndDay returns the last day of g's challenge in loc, or the
+// zero time if it doesn't end.
+func GroupEndDay(g Group, loc *time.Location) time.Time {
+	if g.EndsOn == nil {
+		return time.Time{}
+	}
+	// Dates come back from the database at midnight UTC.
+	return time.Date(g.EndsOn.Year(), g.EndsOn.Month(), g.EndsOn.Day(), 0, 0, 0, 0, loc)
+}
+
 func GetGroupLocation(g Group) (*time.Location, error) {
 	if g.Timezone == "" {
 		return nil, errors.Errorf("group %d has no timezone", g.GID)
@@ -412,6 +593,22 @@ type Commit struct {
 	Additions int `db:"additions"`
 	// Deletions is the number of deletions.
 	Deletions int `db:"deletions"`
+	// Provider is the CommitSource that the commit was fetched
+	// from, e.g. "github". Repo names are only unique within a
+	// provider.
+	Provider string `db:"provider"`
+	// Excluded is true if the owner's repo filter excludes the
+	// commit's repo. Excluded commits don't count for the owner.
+	Excluded bool `db:"excluded"`
+}
+
+// RepoID returns a name for c's repo that is unique across
+// providers. GitHub repos keep their plain "user/repo" name.
+func (c Commit) RepoID() string {
+	if c.Provider == "" || c.Provider == GitHubProvider {
+		return c.RepoName
+	}
+	return c.Provider + ":" + c.RepoName
 }
 
 type CommitFile struct {
@@ -422,8 +619,13 @@ type CommitFile struct {
 	Status    string `db:"status"`
 	Additions int    `db:"additions"`
 	Deletions int    `db:"deletions"`
-	// Patch is the full patch for this commit.
+	// Patch is the patch for this file. It may be truncated or
+	// empty, depending on the patch policy; see StoredPatch.
 	Patch string `db:"patch"`
+	// Language is the file's language, or "" if it isn't known.
+	// It is only NULL for rows that MigrateCommitFiles hasn't
+	// gotten to yet.
+	Language sql.NullString `db:"language"`
 }
 
 var (
@@ -449,10 +651,15 @@ CREATE TABLE IF NOT EXISTS "commit_file" (
 )`
 )
 
-func init() {
-	schemas = append(schemas, commitSchema)
-	schemas = append(schemas, commitFileSchema)
-}
+// commitProviderSchema adds the provider column to databases created
+// before commits could come from sources other than GitHub.
+var commitProviderSchema = `
+ALTER TABLE "commit" ADD COLUMN IF NOT EXISTS provider text NOT NULL DEFAULT 'github'`
+
+// commitFileLanguageSchema adds the language column to databases
+// created before languages were detected.
+var commitFileLanguageSchema = `
+ALTER TABLE commit_file ADD COLUMN IF NOT EXISTS language text`
 
 // GetCommits gets the commits for sha.
 func GetCommit(sha string) (Commit, error) {
@@ -499,9 +706,12 @@ func (s SortableCommits) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s SortableCommits) Less(i, j int) bool { return s[i].AuthorDate.After(s[j].AuthorDate) }
 
 // CommitGroup represents a set of commits grouped by Repo. All of the
-// commits should have the same repo name.
+// commits should have the same repo name and provider.
 type CommitGroup struct {
+	// RepoID is the RepoID of all of the commits in the group.
+	RepoID    string
 	RepoName  string
+	Provider  string
 	Additions int
 	Deletions int
 	// Commits is the list of commits associated with the repo.
@@ -523,13 +733,16 @@ func CommitGroups(commits []Commit) []CommitGroup {
 	// First, sort commits into CommitGroups by repo.
 	cgm := make(map[string]CommitGroup)
 	for _, c := range commits {
-		cg := cgm[c.RepoName]
-		// This is essentially a no-op if cg.RepoName is not empty.
+		id := c.RepoID()
+		cg := cgm[id]
+		// This is essentially a no-op if cg.RepoID is not empty.
+		cg.RepoID = id
 		cg.RepoName = c.RepoName
+		cg.Provider = c.Provider
 		cg.Additions += c.Additions
 		cg.Deletions += c.Deletions
 		cg.Commits = append(cg.Commits, c)
-		cgm[c.RepoName] = cg
+		cgm[id] = cg
 	}
 	// Now, we sort each of the commit arrays by time and stuff
 	// them into a slice.
@@ -596,136 +809,220 @@ func DayCommitGroups(commits []Commit, loc *time.Location) []DayCommitGroup {
 	return dcgs
 }
 
-// GitHubCommitRepo associates a RepositoryCommit with a RepoName.
-type GitHubCommitRepo struct {
-	github.RepositoryCommit
-	RepoName string
+// ValidRepoName returns true if fullRepoName has the form
+// owner/name.
+func ValidRepoName(fullRepoName string) bool {
+	i := strings.Index(fullRepoName, "/")
+	return i > 0 && i < len(fullRepoName)-1
 }
 
-// FetchRecentCommits fetches the commits for u from GitHub. If
-// transport is nil, the default transport is used. Pass in an
-// ETagTransport to keep track of u's etag.
-func FetchRecentCommits(u User, transport http.RoundTripper) ([]GitHubCommitRepo, error) {
-	client := UnauthedGitHubClient(transport)
-	es, resp, err := client.Activity.ListEventsPerformedByUser(u.Login, true, nil)
-	// If the response was not modified, then there are no new
-	// events (es is nil).
-	if resp.StatusCode != http.StatusNotModified && err != nil {
+// SplitRepoName splits fullRepoName into the userName and the
+// repoName. It panics if fullRepoName does not contain a "/".
+func SplitRepoName(fullRepoName string) (userName, repoName string) {
+	s := strings.SplitN(fullRepoName, "/", 2)
+	return s[0], s[1]
+}
+
+// FetchRecentCommits fetches the commits recently pushed by login
+// from src. Commits that are already in the database are skipped.
+func FetchRecentCommits(src CommitSource, login string) ([]SourceCommit, error) {
+	ps, err := src.ListRecentPushes(login)
+	if err != nil {
 		return nil, wrapError(err)
 	}
-	var cs []GitHubCommitRepo
-	for _, e := range es {
-		if *e.Type != "PushEvent" {
+	var cs []SourceCommit
+	for _, p := range ps {
+		// Don't fetch the commit if we already have a copy of
+		// it in the database.
+		exists, err := CommitExists(p.SHA)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
 			continue
 		}
-		repoUser, repoName := SplitRepoName(*e.Repo.Name)
-		PushEventCommits := e.Payload().(*github.PushEvent).Commits
-		for _, pec := range PushEventCommits {
-			// Don't fetch the commit if we already have a
-			// copy of it in the database.
-			exists, err := CommitExists(*pec.SHA)
-			if err != nil {
-				return nil, err
-			}
-			if exists {
-				continue
-			}
-			c, _, err := client.Repositories.GetCommit(repoUser, repoName, *pec.SHA)
-			if err != nil {
-				return nil, wrapError(err)
+		c, err := src.GetCommit(p.RepoName, p.SHA)
+		if err != nil {
+			if _, ok := RateLimitedUntil(err); ok {
+				// Return what we have so that it can be
+				// saved, the rest is fetched next time.
+				return cs, wrapError(err)
 			}
-			cs = append(cs, GitHubCommitRepo{
-				RepositoryCommit: *c,
-				RepoName:         *e.Repo.Name,
-			})
+			return nil, wrapError(err)
 		}
+		cs = append(cs, c)
 	}
 	return cs, nil
 }
 
-// SplitRepoName splits fullRepoName into the userName and the
-// repoName. It panics if fullRepoName does not contain a "/".
-func SplitRepoName(fullRepoName string) (userName, repoName string) {
-	s := strings.Split(fullRepoName, "/")
-	return s[0], s[1]
-}
-
-// UpdateUserCommits updates u's commits by fetching them from GitHub
-// and saving them in the database.
+// UpdateUserCommits updates u's commits by fetching them from each of
+// u's accounts and saving them in the database.
 func UpdateUserCommits(u User) error {
 	// TODO(samertm): Range over results based on UpdateTime.
-	t := NewETagTransport(u.ETag.String)
-	var functionFinishedSuccessfully bool // Set this before returning success.
-	defer func() {
-		etag := t.GetNewETag()
-		if functionFinishedSuccessfully {
-			if err := SetETag(u, etag); err != nil {
-				debug.Println(err)
-			}
-		}
-	}()
-	cs, err := FetchRecentCommits(u, t)
+	as, err := GetUserAccounts(u)
 	if err != nil {
 		return wrapError(err)
 	}
-	for _, c := range cs {
-		if err := CreateCommit(u, c); err != nil {
+	for _, a := range as {
+		src, err := AccountSource(a)
+		if err != nil {
 			return wrapError(err)
 		}
+		cs, fetchErr := FetchRecentCommits(src, a.Login)
+		// Save the commits that were fetched before hitting the
+		// rate limit, if any.
+		for _, c := range cs {
+			if err := CreateCommit(a, c); err != nil {
+				return wrapError(err)
+			}
+		}
+		if fetchErr != nil {
+			return wrapErrorf(fetchErr, "error fetching commits for %s on %s", a.Login, a.Provider)
+		}
 	}
 	if err := SetCommitsLastUpdatedOn(u, time.Now()); err != nil {
 		return wrapError(err)
 	}
-	functionFinishedSuccessfully = true
+	evaluateAchievements(u)
 	return nil
 }
 
-// CreateCommit creates a commit c for u in the database.
-func CreateCommit(u User, c GitHubCommitRepo) error {
-	debug.Printf("Creating commit %v for user %s", c, u.Login)
-	if c.Author == nil || u.Login != *c.Author.Login {
-		// Ignore the commit if the commit has no GitHub
-		// author, or the author does not match u.
+// Policies for MergeCommitPolicy and ForeignCommitPolicy.
+const (
+	MergeCommitsCount    = "count"
+	MergeCommitsSkip     = "skip"
+	ForeignCommitsSkip   = "skip"
+	ForeignCommitsAuthor = "author"
+	ForeignCommitsPusher = "pusher"
+)
+
+// countsMergeCommit returns false if commits with parents parents
+// should be ignored because of the merge commit policy.
+func countsMergeCommit(parents int) bool {
+	return parents < 2 || conf.Config.MergeCommitPolicy != MergeCommitsSkip
+}
+
+// CommitOwner returns the uid of the user credited for c, which was
+// pushed by a. The author is matched by their login on a's provider,
+// and then by their verified author email. Commits authored by
+// someone else are credited according to the foreign commit policy,
+// and so are commits from sources that don't link commits to
+// accounts, like GitLab, unless their author email is verified.
+// CommitOwner returns 0 if nobody should be credited.
+func CommitOwner(a Account, c SourceCommit) (int, error) {
+	if c.AuthorLogin != "" && c.AuthorLogin == a.Login {
+		return a.UID, nil
+	}
+	var authorUID int
+	if c.AuthorEmail != "" {
+		uid, err := GetVerifiedEmailUID(c.AuthorEmail)
+		if err != nil {
+			return 0, wrapError(err)
+		}
+		if uid == a.UID {
+			return a.UID, nil
+		}
+		authorUID = uid
+	}
+	switch conf.Config.ForeignCommitPolicy {
+	case ForeignCommitsPusher:
+		return a.UID, nil
+	case ForeignCommitsAuthor:
+		if authorUID != 0 || c.AuthorLogin == "" {
+			return authorUID, nil
+		}
+		return FindAccountUID(a.Provider, c.AuthorLogin)
+	}
+	return 0, nil
+}
+
+// CreateCommit creates a commit c, pushed by a, in the database. The
+// commit is credited to the user returned by CommitOwner and to the
+// users listed in its Co-authored-by trailers.
+func CreateCommit(a Account, c SourceCommit) error {
+	debug.Printf("Creating commit %s for user %s on %s", c.SHA, a.Login, a.Provider)
+	if !countsMergeCommit(c.ParentCount) {
 		return nil
 	}
-	tx, err := db.DB.Beginx()
+	uid, err := CommitOwner(a, c)
+	if err != nil {
+		return wrapError(err)
+	}
+	coauthors, err := CommitCoAuthorUIDs(uid, c.Message)
+	if err != nil {
+		return wrapError(err)
+	}
+	if uid == 0 {
+		if len(coauthors) == 0 {
+			// Ignore the commit if nobody gets credit for it.
+			return nil
+		}
+		// The commit needs an owner, so promote the first
+		// co-author.
+		uid, coauthors = coauthors[0], coauthors[1:]
+	}
+	c.UID = uid
+	c.Provider = a.Provider
+	cas, err := markExcluded(&c.Commit, coauthors)
 	if err != nil {
 		return wrapError(err)
 	}
-	if c.Message == nil {
-		c.Message = github.String("")
+	created, err := saveCommit(c.Commit, c.Files, cas)
+	if err != nil || !created {
+		return err
+	}
+	if err := PublishCommit(c.Commit, cas); err != nil {
+		// The commit is saved, so don't fail the update.
+		debug.Println(err)
+	}
+	return nil
+}
+
+// saveCommit inserts c, its files and its co-authors into the
+// database in a single transaction. It returns false if the commit
+// already exists, which is not an error.
+func saveCommit(c Commit, files []CommitFile, coauthors []commitAuthor) (bool, error) {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return false, wrapError(err)
 	}
 	b := &db.Binder{}
 	query := `
-INSERT INTO commit(sha, uid, author_date, repo_name, message, additions, deletions)
+INSERT INTO commit(sha, uid, author_date, repo_name, message, additions, deletions, provider, excluded)
   VALUES (` +
-		b.Bind(*c.SHA, u.UID, *c.Commit.Author.Date,
-			c.RepoName, *c.Commit.Message, *c.Stats.Additions, *c.Stats.Deletions) +
+		b.Bind(c.SHA, c.UID, c.AuthorDate, c.RepoName, c.Message, c.Additions, c.Deletions, c.Provider, c.Excluded) +
 		`)`
 	if _, err := tx.Exec(query, b.Items...); err != nil {
+		tx.Rollback()
 		// Ignore if we've seen this commit.
 		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
-			return nil
+			return false, nil
 		}
-		return wrapError(err)
+		return false, wrapError(err)
 	}
-	for _, f := range c.Files {
+	for _, f := range files {
 		b := &db.Binder{}
-		// For empty files, Patch is nil.
-		if f.Patch == nil {
-			f.Patch = github.String("")
-		}
 		query := `
-INSERT INTO commit_file(commit_sha, filename, status, additions, deletions, patch)
+INSERT INTO commit_file(commit_sha, filename, status, additions, deletions, patch, language)
   VALUES (` +
-			b.Bind(*c.SHA, *f.Filename, *f.Status, *f.Additions, *f.Deletions, *f.Patch) +
+			b.Bind(c.SHA, f.Filename, f.Status, f.Additions, f.Deletions,
+				StoredPatch(f.Patch), DetectLanguage(f.Filename)) +
 			`)`
 		if _, err := tx.Exec(query, b.Items...); err != nil {
-			return wrapError(err)
+			tx.Rollback()
+			return false, wrapError(err)
+		}
+	}
+	for _, ca := range coauthors {
+		b := &db.Binder{}
+		query := `INSERT INTO commit_author(sha, uid, excluded) VALUES (` + b.Bind(c.SHA, ca.UID, ca.Excluded) + `)`
+		if _, err := tx.Exec(query, b.Items...); err != nil {
+			tx.Rollback()
+			return false, wrapError(err)
 		}
 	}
 	if err := tx.Commit(); err != nil {
-		return wrapError(err)
+		return false, wrapError(err)
 	}
-	return nil
+	return true, nil
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"regexp"
 	"strconv"
 	"testing"
 	"time"
@@ -58,9 +59,9 @@ func TestCreateUser(t *testing.T) {
 	mdb := db.GetSetMock()
 	login := "strange-login"
 	sqlmock.ExpectExec(`INSERT INTO "user".*`).
-		WithArgs(login).
+		WithArgs(login, GitHubProvider).
 		WillReturnResult(sqlmock.NewResult(0, 1)) // 1 affected row.
-	if err := CreateUser(login); err != nil {
+	if err := CreateUser(GitHubProvider, login); err != nil {
 		t.Error(err)
 	}
 	if err := mdb.Close(); err != nil {
@@ -72,17 +73,17 @@ func TestGetCreateUser(t *testing.T) {
 	mdb := db.GetSetMock()
 	login := "strange-login"
 	sqlmock.ExpectQuery(`SELECT \* from "user" WHERE login.*`).
-		WithArgs(login).
+		WithArgs(login, GitHubProvider).
 		WillReturnError(fmt.Errorf("user not found"))
 	sqlmock.ExpectExec(`INSERT INTO "user".*`).
-		WithArgs(login).
+		WithArgs(login, GitHubProvider).
 		WillReturnResult(sqlmock.NewResult(0, 1)) // 1 affected row.
 	sqlmock.ExpectQuery(`SELECT \* from "user" WHERE login.*`).
-		WithArgs(login).
+		WithArgs(login, GitHubProvider).
 		WillReturnRows(
 		sqlmock.NewRows([]string{"uid", "login"}).
 			AddRow(1, login))
-	u, err := GetCreateUser(login)
+	u, err := GetCreateUser(GitHubProvider, login)
 	if err != nil {
 		t.Error(err)
 	}
@@ -99,7 +100,7 @@ func TestSetEmail(t *testing.T) {
 	email := "something@something.com"
 	uid := 1
 	sqlmock.ExpectExec(`UPDATE "user" SET email = .* WHERE uid = .*`).
-		WithArgs(email, uid).
+		WithArgs(email, email, uid).
 		WillReturnResult(sqlmock.NewResult(0, 1)) // 1 affected row.
 	if err := SetEmail(User{UID: 1}, email); err != nil {
 		t.Error(err)
@@ -145,17 +146,24 @@ func TestCreateCommit(t *testing.T) {
 	mdb := db.GetSetMock()
 	u := User{UID: 1, Login: "strange-login"}
 	c := GetGitHubCommitRepoForTest(u.Login)
+	sqlmock.ExpectQuery("SELECT .* FROM repo_filter.*").
+		WithArgs(u.UID).
+		WillReturnRows(
+		sqlmock.NewRows([]string{"uid", "include", "exclude", "exclude_forks", "exclude_archived"}))
 	sqlmock.ExpectBegin()
 	sqlmock.ExpectExec("INSERT INTO commit.*").
 		WithArgs(*c.SHA, u.UID, *c.Commit.Author.Date, c.RepoName,
-		*c.Commit.Message, *c.Stats.Additions, *c.Stats.Deletions).
+		*c.Commit.Message, *c.Stats.Additions, *c.Stats.Deletions, GitHubProvider, false).
 		WillReturnResult(sqlmock.NewResult(0, 1)) // 1 affected row.
 	f := c.Files[0]
 	sqlmock.ExpectExec("INSERT INTO commit_file.*").
-		WithArgs(*c.SHA, *f.Filename, *f.Status, *f.Additions, *f.Deletions, *f.Patch).
+		WithArgs(*c.SHA, *f.Filename, *f.Status, *f.Additions, *f.Deletions, *f.Patch, "").
 		WillReturnResult(sqlmock.NewResult(0, 1)) // 1 affected row.
 	sqlmock.ExpectCommit()
-	if err := CreateCommit(u, c); err != nil {
+	sqlmock.ExpectQuery("SELECT DISTINCT gid FROM group_webhook.*").
+		WithArgs(u.UID).
+		WillReturnRows(sqlmock.NewRows([]string{"gid"}))
+	if err := CreateCommit(GitHubAccount(u), GitHubSourceCommit(c)); err != nil {
 		t.Error(err)
 	}
 	if err := mdb.Close(); err != nil {
@@ -227,3 +235,28 @@ func TestGetCommitFailure(t *testing.T) {
 	t.SkipNow()
 	t.Log(GetCommit("JLFKDJSKLJFLDSK"))
 }
+
+var (
+	createTableRegexp = regexp.MustCompile(`CREATE TABLE IF NOT EXISTS "?(\w+)"?`)
+	tableRefRegexp    = regexp.MustCompile(`(?:REFERENCES|ALTER TABLE) "?(\w+)"?`)
+)
+
+// TestSchemaOrder checks that every schema comes after the schemas
+// that create the tables it references or alters, so that they can
+// be executed in order on an empty database.
+func TestSchemaOrder(t *testing.T) {
+	created := make(map[string]bool)
+	for i, s := range schemas {
+		for _, m := range createTableRegexp.FindAllStringSubmatch(s, -1) {
+			created[m[1]] = true
+		}
+		for _, m := range tableRefRegexp.FindAllStringSubmatch(s, -1) {
+			if !created[m[1]] {
+				t.Errorf("schema %d uses %s before it is created:%s", i, m[1], s)
+			}
+		}
+	}
+	if len(created) == 0 {
+		t.Error("no tables created")
+	}
+}
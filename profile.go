@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ajstarks/svgo"
+	"github.com/flosch/pongo2"
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/zenazn/goji/web"
+)
+
+// HeatmapDay is the number of commits on a day.
+type HeatmapDay struct {
+	Day     time.Time
+	Commits int
+}
+
+// Heatmap is a year of commits, one column per week, with weeks
+// starting on Sunday.
+type Heatmap struct {
+	// Weeks are oldest first. The last week ends today, so it may
+	// be short.
+	Weeks [][]HeatmapDay
+	// Total is the number of commits in the heatmap.
+	Total int
+	// Max is the most commits on one day.
+	Max int
+}
+
+// heatmapWeeks is how many weeks a heatmap shows.
+const heatmapWeeks = 53
+
+// NewHeatmap returns the heatmap of commits for the year up to now,
+// with days in loc.
+func NewHeatmap(commits []Commit, loc *time.Location, now time.Time) Heatmap {
+	counts := make(map[time.Time]int)
+	for _, dcg := range DayCommitGroups(append([]Commit(nil), commits...), loc) {
+		counts[dcg.Day] = len(dcg.Commits)
+	}
+	today := BeginningOfDay(now.In(loc))
+	day := time.Date(today.Year(), today.Month(), today.Day()-int(today.Weekday())-7*(heatmapWeeks-1), 0, 0, 0, 0, loc)
+	var h Heatmap
+	for !day.After(today) {
+		if day.Weekday() == time.Sunday {
+			h.Weeks = append(h.Weeks, nil)
+		}
+		n := counts[day]
+		h.Weeks[len(h.Weeks)-1] = append(h.Weeks[len(h.Weeks)-1], HeatmapDay{Day: day, Commits: n})
+		h.Total += n
+		if n > h.Max {
+			h.Max = n
+		}
+		day = nextDay(day)
+	}
+	return h
+}
+
+// Level returns the color level of a day with n commits, from 0 for
+// no commits to 4 for the busiest days.
+func (h Heatmap) Level(n int) int {
+	if n <= 0 || h.Max == 0 {
+		return 0
+	}
+	return (4*n + h.Max - 1) / h.Max
+}
+
+// WriteSVG writes h to w as an SVG.
+func (h Heatmap) WriteSVG(w io.Writer) {
+	canvas := svg.New(w)
+	canvas.Start(13*len(h.Weeks)+13, 13*7+13)
+	for x, week := range h.Weeks {
+		for _, d := range week {
+			canvas.Rect((x*13)+14, (int(d.Day.Weekday())*13)+14, 11, 11,
+				fmt.Sprintf(`style="fill:%s"`, svgColors[h.Level(d.Commits)]),
+				fmt.Sprintf(`data-count="%d"`, d.Commits),
+				fmt.Sprintf(`data-date="%s"`, d.Day.Format("2006-01-02")))
+		}
+	}
+	canvas.End()
+}
+
+// userProfilePath returns the path of page on u's profile. Logins
+// are only unique within a host, so users of other hosts are looked
+// up by provider too.
+func userProfilePath(u User, page string) string {
+	p := "/user/" + url.QueryEscape(u.Login) + page
+	if u.Provider != "" && u.Provider != GitHubProvider {
+		p += "?provider=" + url.QueryEscape(u.Provider)
+	}
+	return p
+}
+
+// UserURL returns the URL of u's profile.
+func UserURL(u User) string {
+	return userProfilePath(u, "")
+}
+
+// UserHeatmapURL returns the URL of u's heatmap for the last year.
+func UserHeatmapURL(u User) string {
+	return userProfilePath(u, "/heatmap.svg")
+}
+
+// SetProfilePrivate sets whether u's profile is hidden from people
+// who aren't in any of u's groups.
+func SetProfilePrivate(u User, private bool) error {
+	b := &db.Binder{}
+	query := `UPDATE "user" SET profile_private = ` + b.Bind(private) + ` WHERE uid = ` + b.Bind(u.UID)
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// GetSharedGroups returns the groups that both u and viewer are in.
+func GetSharedGroups(u, viewer User) ([]Group, error) {
+	b := &db.Binder{}
+	query := `
+SELECT * FROM "group"
+  WHERE gid IN (SELECT gid FROM user_group WHERE uid = ` + b.Bind(u.UID) + `)
+    AND gid IN (SELECT gid FROM user_group WHERE uid = ` + b.Bind(viewer.UID) + `)
+ORDER BY gid ASC`
+	var gs []Group
+	if err := db.DB.Select(&gs, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	return gs, nil
+}
+
+// ProfileGroups returns the groups on u's profile that viewer can
+// see: all of them for u, and the ones they share otherwise. viewer
+// is nil if nobody is logged in.
+func ProfileGroups(u User, viewer *User) ([]Group, error) {
+	if viewer == nil {
+		return nil, nil
+	}
+	if viewer.UID == u.UID {
+		return GetGroups(u)
+	}
+	return GetSharedGroups(u, *viewer)
+}
+
+// ProfileVisible returns whether viewer can see u's profile, given
+// the groups they share. Private profiles are only visible to u and
+// the people in u's groups.
+func ProfileVisible(u User, viewer *User, shared []Group) bool {
+	if !u.ProfilePrivate {
+		return true
+	}
+	return viewer != nil && (viewer.UID == u.UID || len(shared) != 0)
+}
+
+// Profile is a user's activity across groups.
+type Profile struct {
+	User    User
+	Groups  []Group
+	Heatmap Heatmap
+	Streaks Streaks
+	// TopRepos and Languages are for the last year.
+	TopRepos     []RepoSummary
+	Languages    []LanguageStat
+	Achievements []UserAchievement
+}
+
+// profileTopRepos is how many repos a profile lists.
+const profileTopRepos = 10
+
+// GetProfile returns u's profile as of now, with the given groups.
+func GetProfile(u User, groups []Group, now time.Time) (Profile, error) {
+	p := Profile{User: u, Groups: groups}
+	loc, err := userLocation(u)
+	if err != nil {
+		return Profile{}, wrapError(err)
+	}
+	cs, err := GetUserCommits(u, time.Time{})
+	if err != nil {
+		return Profile{}, wrapError(err)
+	}
+	p.Heatmap = NewHeatmap(cs, loc, now)
+	p.Streaks = ComputeStreaks(cs, loc, now)
+	yearAgo := now.AddDate(-1, 0, 0)
+	if p.TopRepos, err = GetUserTopRepos(u, yearAgo, profileTopRepos); err != nil {
+		return Profile{}, wrapError(err)
+	}
+	if p.Languages, err = GetUserLanguageStats(u, yearAgo); err != nil {
+		return Profile{}, wrapError(err)
+	}
+	if p.Achievements, err = GetUserAchievements(u); err != nil {
+		return Profile{}, wrapError(err)
+	}
+	return p, nil
+}
+
+// profileUser returns the user whose profile is requested, and the
+// groups on it that a can see. Private profiles are not found for
+// people who can't see them, so that they don't give away that the
+// user exists.
+func profileUser(a App, c web.C, r *http.Request) (User, []Group, error) {
+	spec := UserSpec{Login: c.URLParams["login"], Provider: r.URL.Query().Get("provider")}
+	u, err := GetUser(spec)
+	if err != nil {
+		if strings.Contains(err.Error(), sqlNotFound) {
+			return User{}, nil, &HTTPError{Err: errors.New("no such user"), Code: http.StatusNotFound}
+		}
+		return User{}, nil, wrapError(err)
+	}
+	gs, err := ProfileGroups(u, a.User)
+	if err != nil {
+		return User{}, nil, wrapError(err)
+	}
+	if !ProfileVisible(u, a.User, gs) {
+		if a.User == nil {
+			return User{}, nil, a.Authed(r)
+		}
+		return User{}, nil, &HTTPError{Err: errors.New("no such user"), Code: http.StatusNotFound}
+	}
+	return u, gs, nil
+}
+
+var profileTemplate = pongo2.Must(pongo2.FromFile("templates/profile.html"))
+
+type profileTemplateVars struct {
+	Login   string
+	Profile Profile
+	// Own is whether the viewer is looking at their own profile.
+	Own bool
+}
+
+func serveProfile(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	u, gs, err := profileUser(a, c, r)
+	if err != nil {
+		return err
+	}
+	p, err := GetProfile(u, gs, time.Now())
+	if err != nil {
+		return wrapError(err)
+	}
+	v := profileTemplateVars{Profile: p}
+	if a.User != nil {
+		v.Login = a.User.Login
+		v.Own = a.User.UID == u.UID
+	}
+	return RenderTemplate(profileTemplate, w, v)
+}
+
+func serveProfileHeatmap(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	u, _, err := profileUser(a, c, r)
+	if err != nil {
+		return err
+	}
+	loc, err := userLocation(u)
+	if err != nil {
+		return wrapError(err)
+	}
+	now := time.Now()
+	cs, err := GetUserCommits(u, now.AddDate(0, 0, -7*heatmapWeeks))
+	if err != nil {
+		return wrapError(err)
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	NewHeatmap(cs, loc, now).WriteSVG(w)
+	return nil
+}
+
+type profilePrivacyForm struct {
+	Private bool `schema:"private"`
+}
+
+func serveSaveProfilePrivacy(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form profilePrivacyForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	if err := SetProfilePrivate(*a.User, form.Private); err != nil {
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: "/settings", Code: http.StatusSeeOther}
+}
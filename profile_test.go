@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewHeatmap(t *testing.T) {
+	// Wednesday.
+	now := time.Date(2015, 8, 19, 12, 0, 0, 0, time.UTC)
+	commits := []Commit{
+		{SHA: "a", AuthorDate: time.Date(2015, 8, 19, 9, 0, 0, 0, time.UTC)},
+		{SHA: "b", AuthorDate: time.Date(2015, 8, 18, 9, 0, 0, 0, time.UTC)},
+		{SHA: "c", AuthorDate: time.Date(2015, 8, 18, 10, 0, 0, 0, time.UTC)},
+		{SHA: "d", AuthorDate: time.Date(2015, 8, 18, 11, 0, 0, 0, time.UTC)},
+		{SHA: "e", AuthorDate: time.Date(2015, 8, 18, 12, 0, 0, 0, time.UTC)},
+		// Too old to show.
+		{SHA: "f", AuthorDate: time.Date(2014, 8, 1, 9, 0, 0, 0, time.UTC)},
+	}
+	h := NewHeatmap(commits, time.UTC, now)
+	if len(h.Weeks) != heatmapWeeks {
+		t.Fatalf("got %d weeks, expected %d", len(h.Weeks), heatmapWeeks)
+	}
+	first := h.Weeks[0][0].Day
+	if expected := time.Date(2014, 8, 17, 0, 0, 0, 0, time.UTC); !first.Equal(expected) {
+		t.Errorf("first day is %s, expected %s", first, expected)
+	}
+	for i, w := range h.Weeks[:len(h.Weeks)-1] {
+		if len(w) != 7 {
+			t.Errorf("week %d has %d days, expected 7", i, len(w))
+		}
+	}
+	last := h.Weeks[len(h.Weeks)-1]
+	if len(last) != 4 {
+		t.Fatalf("last week has %d days, expected 4", len(last))
+	}
+	if last[2].Commits != 4 || last[3].Commits != 1 {
+		t.Errorf("got %d and %d commits on Aug 18 and 19, expected 4 and 1", last[2].Commits, last[3].Commits)
+	}
+	if h.Total != 5 || h.Max != 4 {
+		t.Errorf("got total %d and max %d, expected 5 and 4", h.Total, h.Max)
+	}
+	for n, expected := range []int{0, 1, 2, 3, 4} {
+		if l := h.Level(n); l != expected {
+			t.Errorf("level of %d commits is %d, expected %d", n, l, expected)
+		}
+	}
+}
+
+func TestProfileVisible(t *testing.T) {
+	public := User{UID: 1}
+	private := User{UID: 1, ProfilePrivate: true}
+	other := &User{UID: 2}
+	shared := []Group{{GID: 3}}
+	tests := []struct {
+		u        User
+		viewer   *User
+		shared   []Group
+		expected bool
+	}{
+		{public, nil, nil, true},
+		{public, other, nil, true},
+		{private, nil, nil, false},
+		{private, other, nil, false},
+		{private, other, shared, true},
+		{private, &User{UID: 1}, nil, true},
+	}
+	for i, test := range tests {
+		if v := ProfileVisible(test.u, test.viewer, test.shared); v != test.expected {
+			t.Errorf("%d: got %t, expected %t", i, v, test.expected)
+		}
+	}
+}
+
+func TestUserURL(t *testing.T) {
+	if u := UserURL(User{Login: "samertm", Provider: GitHubProvider}); u != "/user/samertm" {
+		t.Errorf("got %s", u)
+	}
+	if u := UserHeatmapURL(User{Login: "samertm", Provider: GitLabProvider}); u != "/user/samertm/heatmap.svg?provider="+GitLabProvider {
+		t.Errorf("got %s", u)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ajstarks/svgo"
+	"github.com/go-errors/errors"
+	"github.com/zenazn/goji/web"
+)
+
+// Punchcard counts commits by the day of the week and hour of the day
+// they were authored, like GitHub's old punchcard graph.
+type Punchcard struct {
+	// Timezone is the name of the location the hours are in.
+	Timezone string
+	// Counts is indexed by time.Weekday, then hour.
+	Counts [7][24]int
+	// Max is the largest count.
+	Max   int
+	Total int
+}
+
+// NewPunchcard counts commits by their author date in loc.
+func NewPunchcard(commits []Commit, loc *time.Location) Punchcard {
+	p := Punchcard{Timezone: loc.String()}
+	for _, c := range commits {
+		t := c.AuthorDate.In(loc)
+		p.Counts[t.Weekday()][t.Hour()]++
+		if n := p.Counts[t.Weekday()][t.Hour()]; n > p.Max {
+			p.Max = n
+		}
+		p.Total++
+	}
+	return p
+}
+
+// GetUserPunchcard returns the punchcard of all of u's commits, in
+// loc.
+func GetUserPunchcard(u User, loc *time.Location) (Punchcard, error) {
+	cs, err := GetUserCommits(u, time.Time{})
+	if err != nil {
+		return Punchcard{}, wrapError(err)
+	}
+	return NewPunchcard(cs, loc), nil
+}
+
+// GetGroupPunchcard returns the punchcard of the commits made by g's
+// users since g was created, in loc.
+func GetGroupPunchcard(g Group, loc *time.Location) (Punchcard, error) {
+	cs, err := GetGroupAllCommits(g)
+	if err != nil {
+		return Punchcard{}, wrapError(err)
+	}
+	return NewPunchcard(cs, loc), nil
+}
+
+// Punchcard SVG layout, in pixels.
+const (
+	punchcardCell   = 20
+	punchcardLeft   = 40
+	punchcardTop    = 20
+	punchcardRadius = punchcardCell/2 - 1
+)
+
+// radius returns the radius of the circle for count. The area of the
+// circle is proportional to count.
+func (p Punchcard) radius(count int) int {
+	if count == 0 || p.Max == 0 {
+		return 0
+	}
+	r := int(math.Sqrt(float64(count)/float64(p.Max)) * punchcardRadius)
+	if r < 2 {
+		// Keep small counts visible.
+		return 2
+	}
+	return r
+}
+
+// WriteSVG draws p as an SVG, with a row per day starting on Sunday
+// and a column per hour.
+func (p Punchcard) WriteSVG(w io.Writer) {
+	canvas := svg.New(w)
+	canvas.Start(punchcardLeft+24*punchcardCell, punchcardTop+7*punchcardCell)
+	canvas.Gstyle("font-family:sans-serif;font-size:10px;fill:#767676")
+	for h := 0; h < 24; h += 3 {
+		canvas.Text(punchcardLeft+h*punchcardCell+punchcardCell/2, punchcardTop-6,
+			fmt.Sprintf("%02d", h), `text-anchor="middle"`)
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		canvas.Text(0, punchcardTop+int(d)*punchcardCell+punchcardCell/2+4, d.String()[:3])
+	}
+	canvas.Gend()
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		for h := 0; h < 24; h++ {
+			count := p.Counts[d][h]
+			r := p.radius(count)
+			if r == 0 {
+				continue
+			}
+			canvas.Circle(punchcardLeft+h*punchcardCell+punchcardCell/2,
+				punchcardTop+int(d)*punchcardCell+punchcardCell/2, r,
+				`style="fill:#44a340"`,
+				fmt.Sprintf(`data-count="%d"`, count),
+				fmt.Sprintf(`data-day="%s"`, d),
+				fmt.Sprintf(`data-hour="%d"`, h))
+		}
+	}
+	canvas.End()
+}
+
+type punchcardQuery struct {
+	// Timezone overrides the group's timezone, e.g.
+	// "America/New_York".
+	Timezone string `schema:"tz"`
+}
+
+// getPunchcard returns the punchcard for the request's group, or for
+// one of its users if the URL has a user_id. viewer must be in the
+// group.
+func getPunchcard(viewer User, c web.C, r *http.Request) (Punchcard, error) {
+	g, err := memberGroup(viewer, c)
+	if err != nil {
+		return Punchcard{}, err
+	}
+	var q punchcardQuery
+	if err := SchemaDecoder.Decode(&q, r.URL.Query()); err != nil {
+		return Punchcard{}, wrapError(err)
+	}
+	var loc *time.Location
+	if q.Timezone != "" {
+		if loc, err = time.LoadLocation(q.Timezone); err != nil {
+			return Punchcard{}, &HTTPError{Err: wrapError(err), Code: http.StatusBadRequest}
+		}
+	} else if loc, err = GetGroupLocation(g); err != nil {
+		return Punchcard{}, wrapError(err)
+	}
+	if _, ok := c.URLParams["user_id"]; !ok {
+		return GetGroupPunchcard(g, loc)
+	}
+	uid, err := getParamInt(c, "user_id")
+	if err != nil {
+		return Punchcard{}, wrapError(err)
+	}
+	u, err := GetUser(UserSpec{UID: uid})
+	if err != nil {
+		return Punchcard{}, wrapError(err)
+	}
+	ok, err := UserInGroup(u, g)
+	if err != nil {
+		return Punchcard{}, wrapError(err)
+	}
+	if !ok {
+		return Punchcard{}, &HTTPError{Err: errors.Errorf("user %d isn't in group %d", u.UID, g.GID), Code: http.StatusNotFound}
+	}
+	return GetUserPunchcard(u, loc)
+}
+
+func servePunchcardSVG(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	p, err := getPunchcard(*a.User, c, r)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	p.WriteSVG(w)
+	return nil
+}
+
+func servePunchcardJSON(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	p, err := getPunchcard(*a.User, c, r)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(p)
+}
+
+// GroupPunchcardURL returns the url of g's punchcard SVG. The JSON
+// is at the same url with a .json extension.
+func GroupPunchcardURL(g Group) string {
+	return GroupURL(g) + "/punchcard.svg"
+}
+
+// GroupUserPunchcardURL returns the url of u's punchcard SVG, in g's
+// timezone.
+func GroupUserPunchcardURL(g Group, u User) string {
+	return GroupURL(g) + "/user/" + strconv.Itoa(u.UID) + "/punchcard.svg"
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewPunchcard(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	// Saturday 02:30 UTC is Friday 22:30 in New York.
+	sat := time.Date(2015, 8, 8, 2, 30, 0, 0, time.UTC)
+	cs := []Commit{{AuthorDate: sat}, {AuthorDate: sat.Add(10 * time.Minute)}, {AuthorDate: sat.Add(2 * time.Hour)}}
+	p := NewPunchcard(cs, ny)
+	if p.Timezone != "America/New_York" {
+		t.Errorf("Got timezone %q", p.Timezone)
+	}
+	if got := p.Counts[time.Friday][22]; got != 2 {
+		t.Errorf("Got %d commits on Friday at 22:00, wanted 2", got)
+	}
+	if got := p.Counts[time.Saturday][0]; got != 1 {
+		t.Errorf("Got %d commits on Saturday at 00:00, wanted 1", got)
+	}
+	if p.Max != 2 || p.Total != 3 {
+		t.Errorf("Got max %d and total %d, wanted 2 and 3", p.Max, p.Total)
+	}
+	if r := p.radius(p.Max); r != punchcardRadius {
+		t.Errorf("Got radius %d for the max count, wanted %d", r, punchcardRadius)
+	}
+	if r := p.radius(0); r != 0 {
+		t.Errorf("Got radius %d for no commits, wanted 0", r)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samertm/githubstreaks/conf"
+	"github.com/samertm/githubstreaks/debug"
+)
+
+// RateLimit is the last known GitHub rate limit for a token.
+type RateLimit struct {
+	// Key identifies the token, see AppRateLimitKey and
+	// TokenRateLimitKey.
+	Key string
+	// Limit, Remaining and Reset are read from the X-RateLimit
+	// headers. Limit is 0 until a response has been seen.
+	Limit     int
+	Remaining int
+	Reset     time.Time
+	// BlockedUntil is set when GitHub asks us to back off, with a
+	// Retry-After header or a secondary rate limit.
+	BlockedUntil time.Time
+	// Backoffs is the number of secondary rate limits in a row
+	// without a Retry-After header. The backoff doubles each time.
+	Backoffs  int
+	UpdatedOn time.Time
+}
+
+// readyAt returns when a request may be made while keeping reserve
+// requests in the budget. It returns the zero time if a request may
+// be made now.
+func (r RateLimit) readyAt(reserve int, now time.Time) time.Time {
+	var t time.Time
+	if r.BlockedUntil.After(now) {
+		t = r.BlockedUntil
+	}
+	if r.Limit > 0 && r.Remaining <= reserve && r.Reset.After(now) && r.Reset.After(t) {
+		t = r.Reset
+	}
+	return t
+}
+
+type rateLimits struct {
+	mu sync.Mutex
+	m  map[string]*RateLimit
+}
+
+// gitHubRateLimits holds the rate limits for every token that has
+// made a request since the server started.
+var gitHubRateLimits = &rateLimits{m: make(map[string]*RateLimit)}
+
+func (rl *rateLimits) get(key string) RateLimit {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if r, ok := rl.m[key]; ok {
+		return *r
+	}
+	return RateLimit{Key: key}
+}
+
+func (rl *rateLimits) update(key string, f func(r *RateLimit)) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	r, ok := rl.m[key]
+	if !ok {
+		r = &RateLimit{Key: key}
+		rl.m[key] = r
+	}
+	f(r)
+	r.UpdatedOn = time.Now()
+}
+
+type sortableRateLimits []RateLimit
+
+func (s sortableRateLimits) Len() int           { return len(s) }
+func (s sortableRateLimits) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sortableRateLimits) Less(i, j int) bool { return s[i].Key < s[j].Key }
+
+// GitHubRateLimits returns the known rate limits, sorted by key.
+func GitHubRateLimits() []RateLimit {
+	gitHubRateLimits.mu.Lock()
+	defer gitHubRateLimits.mu.Unlock()
+	rs := make([]RateLimit, 0, len(gitHubRateLimits.m))
+	for _, r := range gitHubRateLimits.m {
+		rs = append(rs, *r)
+	}
+	sort.Sort(sortableRateLimits(rs))
+	return rs
+}
+
+// AppRateLimitKey returns the rate limit key for requests made with
+// h's OAuth application.
+func AppRateLimitKey(h *GitHubHost) string {
+	return h.Provider + ":app"
+}
+
+// TokenRateLimitKey returns the rate limit key for requests made with
+// a user's token on h. The token is hashed so that it isn't shown on
+// the admin page.
+func TokenRateLimitKey(h *GitHubHost, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return h.Provider + ":token:" + hex.EncodeToString(sum[:])[:12]
+}
+
+// RateLimitError is returned by RateLimitTransport when a request
+// would have to wait longer than MaxWait for the rate limit.
+type RateLimitError struct {
+	Key   string
+	Until time.Time
+}
+
+// errRateLimited is in the message of every RateLimitError. Errors
+// are wrapped with their messages rewritten, so look for it with
+// RateLimitedUntil.
+const errRateLimited = "github rate limited until "
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s: %s%s", e.Key, errRateLimited, e.Until.UTC().Format(time.RFC3339))
+}
+
+// RateLimitedUntil returns the time that the rate limit in err
+// resets, and false if err isn't caused by a RateLimitError.
+func RateLimitedUntil(err error) (time.Time, bool) {
+	if err == nil {
+		return time.Time{}, false
+	}
+	s := err.Error()
+	i := strings.Index(s, errRateLimited)
+	if i == -1 {
+		return time.Time{}, false
+	}
+	s = s[i+len(errRateLimited):]
+	// Times formatted with RFC3339 in UTC are 20 characters long.
+	if len(s) > 20 {
+		s = s[:20]
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+const (
+	// defaultRateLimitMaxWait is used when
+	// GitHubRateLimitMaxWait is not configured.
+	defaultRateLimitMaxWait = time.Minute
+	// secondaryRateLimitBackoff is how long to back off from the
+	// first secondary rate limit without a Retry-After header.
+	secondaryRateLimitBackoff = time.Minute
+	// maxRateLimitRetries is the number of times a request is
+	// retried after being rate limited.
+	maxRateLimitRetries = 3
+)
+
+// RateLimitTransport tracks the GitHub rate limit for a token, and
+// pauses requests when the limit is exhausted or GitHub asks us to
+// back off. If the pause would be longer than MaxWait, the request
+// fails with a RateLimitError so that the caller can defer its work.
+type RateLimitTransport struct {
+	// Key identifies the token that requests are made with.
+	Key string
+	// Reserve is the number of requests to leave in the budget.
+	// Background work sets it so that users signing in and
+	// refreshing their groups aren't starved.
+	Reserve int
+	// MaxWait is the longest a request waits for the rate limit.
+	// If it is 0, GitHubRateLimitMaxWait is used.
+	MaxWait time.Duration
+	// Transport makes the requests. If it is nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	// sleep is time.Sleep, except in tests.
+	sleep func(time.Duration)
+}
+
+func (t *RateLimitTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+func (t *RateLimitTransport) maxWait() time.Duration {
+	if t.MaxWait != 0 {
+		return t.MaxWait
+	}
+	if s := conf.Config.GitHubRateLimitMaxWait; s != 0 {
+		return time.Duration(s) * time.Second
+	}
+	return defaultRateLimitMaxWait
+}
+
+// wait pauses until a request can be made, or returns a
+// RateLimitError if that would take longer than MaxWait.
+func (t *RateLimitTransport) wait() error {
+	now := time.Now()
+	ready := gitHubRateLimits.get(t.Key).readyAt(t.Reserve, now)
+	if ready.IsZero() {
+		return nil
+	}
+	d := ready.Sub(now)
+	if d > t.maxWait() {
+		return &RateLimitError{Key: t.Key, Until: ready}
+	}
+	debug.Printf("Waiting %s for the GitHub rate limit for %s", d, t.Key)
+	if t.sleep != nil {
+		t.sleep(d)
+	} else {
+		time.Sleep(d)
+	}
+	return nil
+}
+
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.wait(); err != nil {
+			return nil, err
+		}
+		resp, err := t.transport().RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		limited, err := t.observe(resp)
+		if err != nil {
+			return nil, err
+		}
+		// Requests with bodies can't be replayed.
+		if !limited || req.Body != nil || attempt >= maxRateLimitRetries {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
+
+// observe records the rate limit in resp. It returns true if the
+// request was rejected because of a rate limit.
+func (t *RateLimitTransport) observe(resp *http.Response) (bool, error) {
+	limit, errLimit := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit"))
+	remaining, errRemaining := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	reset, errReset := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	haveLimit := errLimit == nil && errRemaining == nil && errReset == nil
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		gitHubRateLimits.update(t.Key, func(r *RateLimit) {
+			if haveLimit {
+				r.Limit, r.Remaining, r.Reset = limit, remaining, time.Unix(reset, 0)
+			}
+			r.Backoffs = 0
+		})
+		return false, nil
+	}
+	// A 403 is also used for permission errors, so look at the
+	// body to tell secondary rate limits apart.
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, wrapError(err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	retryAfter, errRetryAfter := strconv.Atoi(resp.Header.Get("Retry-After"))
+	secondary := bytes.Contains(bytes.ToLower(body), []byte("secondary rate limit")) ||
+		bytes.Contains(bytes.ToLower(body), []byte("abuse"))
+	primary := haveLimit && remaining == 0
+	if errRetryAfter != nil && !secondary && !primary {
+		return false, nil
+	}
+	now := time.Now()
+	gitHubRateLimits.update(t.Key, func(r *RateLimit) {
+		if haveLimit {
+			r.Limit, r.Remaining, r.Reset = limit, remaining, time.Unix(reset, 0)
+		}
+		switch {
+		case errRetryAfter == nil:
+			r.BlockedUntil = now.Add(time.Duration(retryAfter) * time.Second)
+		case secondary:
+			r.BlockedUntil = now.Add(secondaryRateLimitBackoff << uint(r.Backoffs))
+			r.Backoffs++
+		}
+	})
+	return true, nil
+}
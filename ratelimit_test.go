@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rateLimitServer serves the responses in order, one per request,
+// and counts the requests.
+type rateLimitServer struct {
+	*httptest.Server
+	requests int
+}
+
+type rateLimitResponse struct {
+	code   int
+	header map[string]string
+	body   string
+}
+
+func newRateLimitServer(t *testing.T, rs ...rateLimitResponse) *rateLimitServer {
+	s := &rateLimitServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.requests >= len(rs) {
+			t.Errorf("Unexpected request %d", s.requests+1)
+			http.NotFound(w, r)
+			return
+		}
+		resp := rs[s.requests]
+		s.requests++
+		for k, v := range resp.header {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(resp.code)
+		fmt.Fprint(w, resp.body)
+	}))
+	return s
+}
+
+func rateLimitHeader(limit, remaining int, reset time.Time) map[string]string {
+	return map[string]string{
+		"X-RateLimit-Limit":     strconv.Itoa(limit),
+		"X-RateLimit-Remaining": strconv.Itoa(remaining),
+		"X-RateLimit-Reset":     strconv.FormatInt(reset.Unix(), 10),
+	}
+}
+
+func TestRateLimitTransportExhausted(t *testing.T) {
+	reset := time.Now().Add(time.Hour)
+	srv := newRateLimitServer(t,
+		rateLimitResponse{code: http.StatusOK, header: rateLimitHeader(60, 0, reset)})
+	defer srv.Close()
+	client := &http.Client{Transport: &RateLimitTransport{Key: "test:exhausted", MaxWait: time.Second}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// The budget is spent, so the next request is deferred without
+	// reaching the server.
+	_, err = client.Get(srv.URL)
+	until, ok := RateLimitedUntil(err)
+	if !ok {
+		t.Fatalf("Got error %v, wanted a rate limit error", err)
+	}
+	if until.Unix() != reset.Unix() {
+		t.Errorf("Got rate limited until %s, wanted %s", until, reset)
+	}
+	if srv.requests != 1 {
+		t.Errorf("Got %d requests, wanted 1", srv.requests)
+	}
+}
+
+func TestRateLimitTransportReserve(t *testing.T) {
+	reset := time.Now().Add(time.Hour)
+	srv := newRateLimitServer(t,
+		rateLimitResponse{code: http.StatusOK, header: rateLimitHeader(5000, 10, reset)},
+		rateLimitResponse{code: http.StatusOK, header: rateLimitHeader(5000, 9, reset)})
+	defer srv.Close()
+	background := &http.Client{Transport: &RateLimitTransport{Key: "test:reserve", Reserve: 10, MaxWait: time.Second}}
+	user := &http.Client{Transport: &RateLimitTransport{Key: "test:reserve"}}
+	resp, err := background.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, err := background.Get(srv.URL); err == nil {
+		t.Error("Background request spent the reserve")
+	}
+	resp, err = user.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestRateLimitTransportRetryAfter(t *testing.T) {
+	srv := newRateLimitServer(t,
+		rateLimitResponse{
+			code:   http.StatusForbidden,
+			header: map[string]string{"Retry-After": "30"},
+			body:   `{"message": "You have exceeded a secondary rate limit."}`,
+		},
+		rateLimitResponse{code: http.StatusOK, body: "ok"})
+	defer srv.Close()
+	var slept time.Duration
+	tr := &RateLimitTransport{
+		Key:     "test:retry-after",
+		MaxWait: time.Minute,
+		sleep:   func(d time.Duration) { slept += d },
+	}
+	resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status %d, wanted the retry to succeed", resp.StatusCode)
+	}
+	if slept < 29*time.Second || slept > 30*time.Second {
+		t.Errorf("Slept for %s, wanted 30s", slept)
+	}
+}
+
+func TestRateLimitTransportSecondaryBackoff(t *testing.T) {
+	srv := newRateLimitServer(t,
+		rateLimitResponse{
+			code: http.StatusForbidden,
+			body: `{"message": "You have triggered an abuse detection mechanism."}`,
+		})
+	defer srv.Close()
+	tr := &RateLimitTransport{Key: "test:secondary", MaxWait: time.Second}
+	_, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if _, ok := RateLimitedUntil(err); !ok {
+		t.Fatalf("Got error %v, wanted a rate limit error", err)
+	}
+	if rl := gitHubRateLimits.get("test:secondary"); rl.Backoffs != 1 {
+		t.Errorf("Got %d backoffs, wanted 1", rl.Backoffs)
+	}
+}
+
+func TestRateLimitTransportForbidden(t *testing.T) {
+	srv := newRateLimitServer(t,
+		rateLimitResponse{code: http.StatusForbidden, body: `{"message": "Resource not accessible"}`})
+	defer srv.Close()
+	tr := &RateLimitTransport{Key: "test:forbidden"}
+	resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Got status %d, wanted %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
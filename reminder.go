@@ -0,0 +1,431 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/samertm/githubstreaks/debug"
+	"github.com/zenazn/goji/web"
+)
+
+// ReminderJob is the kind of job that reminds a user that their streak
+// is at risk. Each reminder job queues the next day's before it runs.
+const ReminderJob = "reminder"
+
+func init() {
+	jobHandlers[ReminderJob] = runReminderJob
+}
+
+// ReminderSetting is when and how a user is reminded that they haven't
+// committed today.
+type ReminderSetting struct {
+	UID     int  `db:"uid"`
+	Enabled bool `db:"enabled"`
+	// GID is the group whose rules decide what counts as today:
+	// the reminder goes out at LocalTime in the group's timezone,
+	// and only if there are no commits since the beginning of the
+	// group's day.
+	GID int `db:"gid"`
+	// LocalTime is in the form "15:04".
+	LocalTime string `db:"local_time"`
+	// Email sends reminders to the user's email, if it is verified.
+	Email bool `db:"email"`
+	// WebhookURL, if set, gets a JSON POST for each reminder.
+	WebhookURL string `db:"webhook_url"`
+}
+
+var reminderSettingSchema = `
+CREATE TABLE IF NOT EXISTS reminder_setting (
+  uid integer PRIMARY KEY REFERENCES "user" (uid),
+  enabled boolean NOT NULL,
+  gid integer REFERENCES "group" (gid) NOT NULL,
+  local_time text NOT NULL,
+  email boolean NOT NULL,
+  webhook_url text NOT NULL
+)`
+
+// Reminder is a reminder that was sent.
+type Reminder struct {
+	UID int `db:"uid"`
+	// Day is the group's day that the reminder was for, in the
+	// form "2006-01-02". Users get at most one reminder a day.
+	Day string `db:"day"`
+	GID int    `db:"gid"`
+	// Channels are the channels the reminder was sent to,
+	// separated by commas.
+	Channels string `db:"channels"`
+	// Streak is the streak that was at risk.
+	Streak int `db:"streak"`
+	// Error is why sending failed, if it did.
+	Error  string    `db:"error"`
+	SentOn time.Time `db:"sent_on"`
+}
+
+var reminderSchema = `
+CREATE TABLE IF NOT EXISTS reminder (
+  uid integer REFERENCES "user" (uid) NOT NULL,
+  day text NOT NULL,
+  gid integer REFERENCES "group" (gid) NOT NULL,
+  channels text NOT NULL,
+  streak integer NOT NULL,
+  error text NOT NULL DEFAULT '',
+  sent_on timestamp NOT NULL,
+  PRIMARY KEY (uid, day)
+)`
+
+// defaultReminderTime is the reminder time for users who haven't
+// chosen one.
+const defaultReminderTime = "20:00"
+
+// GetReminderSetting returns the reminder setting for the user with
+// uid. Users who haven't set one get reminders turned off.
+func GetReminderSetting(uid int) (ReminderSetting, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM reminder_setting WHERE uid = ` + b.Bind(uid)
+	var s ReminderSetting
+	if err := db.DB.Get(&s, query, b.Items...); err != nil {
+		if strings.Contains(err.Error(), sqlNotFound) {
+			return ReminderSetting{UID: uid, LocalTime: defaultReminderTime, Email: true}, nil
+		}
+		return ReminderSetting{}, wrapError(err)
+	}
+	return s, nil
+}
+
+// Validate returns an error if s can't be saved for u.
+func (s ReminderSetting) Validate(u User) error {
+	if _, err := time.Parse("15:04", s.LocalTime); err != nil {
+		return errors.Errorf("%q is not a time like 20:00", s.LocalTime)
+	}
+	if s.WebhookURL != "" {
+		if err := ValidWebhookURL(s.WebhookURL); err != nil {
+			return err
+		}
+	}
+	if !s.Enabled {
+		return nil
+	}
+	if !s.Email && s.WebhookURL == "" {
+		return errors.New("choose email or a webhook for reminders")
+	}
+	gs, err := GetGroups(u)
+	if err != nil {
+		return wrapError(err)
+	}
+	for _, g := range gs {
+		if g.GID == s.GID {
+			return nil
+		}
+	}
+	return errors.Errorf("you aren't in group %d", s.GID)
+}
+
+// SetReminderSetting saves s for u and reschedules u's reminders.
+func SetReminderSetting(u User, s ReminderSetting) error {
+	s.UID = u.UID
+	b := &db.Binder{}
+	query := `
+INSERT INTO reminder_setting(uid, enabled, gid, local_time, email, webhook_url)
+  VALUES (` + b.Bind(s.UID, s.Enabled, s.GID, s.LocalTime, s.Email, s.WebhookURL) + `)
+ON CONFLICT (uid) DO UPDATE SET
+  enabled = excluded.enabled, gid = excluded.gid, local_time = excluded.local_time,
+  email = excluded.email, webhook_url = excluded.webhook_url`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error saving reminder setting for user %d", u.UID)
+	}
+	if err := CancelQueuedJobs(u, ReminderJob); err != nil {
+		return wrapError(err)
+	}
+	if !s.Enabled {
+		return nil
+	}
+	return scheduleReminder(u, s, time.Now())
+}
+
+// NextReminderTime returns the first time after now that is clock,
+// in the form "15:04", in loc.
+func NextReminderTime(clock string, loc *time.Location, now time.Time) (time.Time, error) {
+	c, err := time.Parse("15:04", clock)
+	if err != nil {
+		return time.Time{}, wrapError(err)
+	}
+	n := now.In(loc)
+	next := time.Date(n.Year(), n.Month(), n.Day(), c.Hour(), c.Minute(), 0, 0, loc)
+	if !next.After(n) {
+		next = time.Date(n.Year(), n.Month(), n.Day()+1, c.Hour(), c.Minute(), 0, 0, loc)
+	}
+	return next, nil
+}
+
+// ReminderArgs are the arguments for a reminder job.
+type ReminderArgs struct {
+	// Day is the group's day the reminder is for, in the form
+	// "2006-01-02". Reminders that run late, after Day is over,
+	// are skipped.
+	Day string
+}
+
+// scheduleReminder queues u's next reminder after now, unless one is
+// already queued.
+func scheduleReminder(u User, s ReminderSetting, now time.Time) error {
+	queued, err := HasQueuedJob(u, ReminderJob)
+	if err != nil {
+		return wrapError(err)
+	}
+	if queued {
+		return nil
+	}
+	g, err := GetGroup(s.GID)
+	if err != nil {
+		return wrapError(err)
+	}
+	loc, err := GetGroupLocation(g)
+	if err != nil {
+		return wrapError(err)
+	}
+	next, err := NextReminderTime(s.LocalTime, loc, now)
+	if err != nil {
+		return wrapError(err)
+	}
+	if _, err := EnqueueJobAt(u, ReminderJob, ReminderArgs{Day: next.Format("2006-01-02")}, next); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// ScheduleReminders queues the next reminder for every user with
+// reminders turned on who doesn't have one queued, in case a chain of
+// reminder jobs was broken.
+func ScheduleReminders() error {
+	var ss []ReminderSetting
+	if err := db.DB.Select(&ss, `SELECT * FROM reminder_setting WHERE enabled`); err != nil {
+		return wrapError(err)
+	}
+	for _, s := range ss {
+		u, err := GetUser(UserSpec{UID: s.UID})
+		if err != nil {
+			return wrapError(err)
+		}
+		if err := scheduleReminder(u, s, time.Now()); err != nil {
+			return wrapError(err)
+		}
+	}
+	return nil
+}
+
+func runReminderJob(j *Job) error {
+	var args ReminderArgs
+	if err := j.DecodeArgs(&args); err != nil {
+		return wrapError(err)
+	}
+	u, err := GetUser(UserSpec{UID: j.UID})
+	if err != nil {
+		return wrapError(err)
+	}
+	s, err := GetReminderSetting(u.UID)
+	if err != nil {
+		return wrapError(err)
+	}
+	if !s.Enabled {
+		return nil
+	}
+	now := time.Now()
+	// Queue tomorrow's reminder first, so that the chain goes on
+	// even if this one fails.
+	if err := scheduleReminder(u, s, now); err != nil {
+		return wrapError(err)
+	}
+	g, err := GetGroup(s.GID)
+	if err != nil {
+		return wrapError(err)
+	}
+	loc, err := GetGroupLocation(g)
+	if err != nil {
+		return wrapError(err)
+	}
+	if today := now.In(loc).Format("2006-01-02"); today != args.Day {
+		debug.Printf("Skipping reminder for user %d on %s, it is already %s", u.UID, args.Day, today)
+		return nil
+	}
+	// Make sure we've seen today's commits. Rate limits defer the
+	// job, which is then retried.
+	if err := UpdateUserCommits(u); err != nil {
+		return wrapError(err)
+	}
+	cs, err := GetUserCommits(u, BeginningOfDay(now.In(loc)))
+	if err != nil {
+		return wrapError(err)
+	}
+	if len(cs) > 0 {
+		return nil
+	}
+	streaks, err := GetUserStreaks(u, loc, now)
+	if err != nil {
+		return wrapError(err)
+	}
+	return SendReminder(u, g, s, args.Day, streaks)
+}
+
+// claimReminder records that u is being reminded on day. It returns
+// false if u was already reminded that day.
+func claimReminder(r Reminder) (bool, error) {
+	b := &db.Binder{}
+	query := `
+INSERT INTO reminder(uid, day, gid, channels, streak, sent_on)
+  VALUES (` + b.Bind(r.UID, r.Day, r.GID, r.Channels, r.Streak) + `, current_timestamp)
+ON CONFLICT (uid, day) DO NOTHING`
+	res, err := db.DB.Exec(query, b.Items...)
+	if err != nil {
+		return false, wrapError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, wrapError(err)
+	}
+	return n > 0, nil
+}
+
+// ReminderPayload is the JSON posted to reminder webhooks.
+type ReminderPayload struct {
+	Type    string `json:"type"`
+	Login   string `json:"login"`
+	GroupID int    `json:"group_id"`
+	Day     string `json:"day"`
+	Streak  int    `json:"streak"`
+	Message string `json:"message"`
+}
+
+// reminderMessage is the text of a reminder.
+func reminderMessage(u User, streaks Streaks) string {
+	if streaks.Current > 0 {
+		return fmt.Sprintf("%s, your %d day streak is at risk! Make a commit today to keep it going.",
+			u.Login, streaks.Current)
+	}
+	return fmt.Sprintf("%s, you haven't committed today. Make a commit to start a new streak!", u.Login)
+}
+
+// SendReminder reminds u that they haven't committed on day, through
+// the channels in s. It does nothing if u was already reminded on
+// day. The reminder is recorded along with any errors.
+func SendReminder(u User, g Group, s ReminderSetting, day string, streaks Streaks) error {
+	var channels []string
+	if s.Email && u.Email.Valid && u.Email.String != "" && u.EmailVerified {
+		channels = append(channels, "email")
+	}
+	if s.WebhookURL != "" {
+		channels = append(channels, "webhook")
+	}
+	if len(channels) == 0 {
+		return nil
+	}
+	r := Reminder{UID: u.UID, Day: day, GID: g.GID, Channels: strings.Join(channels, ","), Streak: streaks.Current}
+	claimed, err := claimReminder(r)
+	if err != nil {
+		return wrapError(err)
+	}
+	if !claimed {
+		return nil
+	}
+	msg := reminderMessage(u, streaks)
+	var errs []string
+	for _, c := range channels {
+		var err error
+		switch c {
+		case "email":
+			err = SendMail(Mail{
+				To:      u.Email.String,
+				Subject: "Your GitHub Streaks streak is at risk",
+				Text: msg + "\n\nSee your group: " + AbsoluteURL(GroupURL(g)) + "\n\n" +
+					"Change your reminders: " + AbsoluteURL("/") + "\n",
+			})
+		case "webhook":
+			err = postJSON(webhookClient, s.WebhookURL, nil, ReminderPayload{
+				Type:    "streak_at_risk",
+				Login:   u.Login,
+				GroupID: g.GID,
+				Day:     day,
+				Streak:  streaks.Current,
+				Message: msg,
+			})
+		}
+		if err != nil {
+			errs = append(errs, c+": "+err.Error())
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	sendErr := errors.Errorf("error sending reminder to user %d: %s", u.UID, strings.Join(errs, "; "))
+	b := &db.Binder{}
+	query := `UPDATE reminder SET error = ` + b.Bind(sendErr.Error()) +
+		` WHERE uid = ` + b.Bind(u.UID) + ` AND day = ` + b.Bind(day)
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapError(err)
+	}
+	return sendErr
+}
+
+// GetUserReminders returns the last limit reminders sent to u, newest
+// first.
+func GetUserReminders(u User, limit int) ([]Reminder, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM reminder WHERE uid = ` + b.Bind(u.UID) +
+		` ORDER BY sent_on DESC LIMIT ` + b.Bind(limit)
+	var rs []Reminder
+	if err := db.DB.Select(&rs, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	return rs, nil
+}
+
+type reminderForm struct {
+	Enabled    bool   `schema:"enabled"`
+	GID        int    `schema:"gid"`
+	LocalTime  string `schema:"local_time"`
+	Email      bool   `schema:"email"`
+	WebhookURL string `schema:"webhook_url"`
+}
+
+func serveSaveReminder(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form reminderForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	s := ReminderSetting{
+		UID:        a.User.UID,
+		Enabled:    form.Enabled,
+		GID:        form.GID,
+		LocalTime:  form.LocalTime,
+		Email:      form.Email,
+		WebhookURL: strings.TrimSpace(form.WebhookURL),
+	}
+	if err := s.Validate(*a.User); err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	if !s.Enabled && s.GID == 0 {
+		// The setting needs a group even when it's off.
+		gs, err := GetGroups(*a.User)
+		if err != nil {
+			return wrapError(err)
+		}
+		if len(gs) == 0 {
+			return &HTTPError{Err: errors.New("join a group to get reminders"), Code: http.StatusBadRequest}
+		}
+		s.GID = gs[0].GID
+	}
+	if err := SetReminderSetting(*a.User, s); err != nil {
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: "/settings", Code: http.StatusSeeOther}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextReminderTime(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, tt := range []struct {
+		now  time.Time
+		want time.Time
+	}{
+		// Later today.
+		{time.Date(2015, 8, 20, 18, 0, 0, 0, la), time.Date(2015, 8, 20, 20, 0, 0, 0, la)},
+		// Already past, so tomorrow.
+		{time.Date(2015, 8, 20, 20, 0, 0, 0, la), time.Date(2015, 8, 21, 20, 0, 0, 0, la)},
+		// 03:30 UTC is still the evening before in Los Angeles.
+		{time.Date(2015, 8, 21, 2, 30, 0, 0, time.UTC), time.Date(2015, 8, 20, 20, 0, 0, 0, la)},
+		// Across the end of daylight saving time.
+		{time.Date(2015, 10, 31, 21, 0, 0, 0, la), time.Date(2015, 11, 1, 20, 0, 0, 0, la)},
+	} {
+		got, err := NextReminderTime("20:00", la, tt.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("NextReminderTime(%s) = %s, want %s", tt.now, got, tt.want)
+		}
+	}
+	if _, err := NextReminderTime("8pm", la, time.Now()); err == nil {
+		t.Error("NextReminderTime accepted 8pm")
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/zenazn/goji/web"
+)
+
+// groupCommitCond returns a condition on commit that matches the
+// commits owned or co-authored by g's users, leaving out commits
+// excluded by their repo filters. Its parameters are bound in b.
+func groupCommitCond(b *db.Binder, g Group) string {
+	gid := b.Bind(g.GID)
+	return `(commit.uid IN (SELECT uid FROM user_group WHERE gid = ` + gid + `) AND NOT commit.excluded) OR
+  commit.sha IN (SELECT sha FROM commit_author JOIN user_group USING (uid)
+                 WHERE gid = ` + gid + ` AND NOT commit_author.excluded)`
+}
+
+// userCommitCond returns a condition on commit that matches the
+// commits owned or co-authored by u, leaving out commits excluded by
+// u's repo filter. Its parameters are bound in b.
+func userCommitCond(b *db.Binder, u User) string {
+	uid := b.Bind(u.UID)
+	return `(commit.uid = ` + uid + ` AND NOT commit.excluded) OR
+  commit.sha IN (SELECT sha FROM commit_author WHERE uid = ` + uid + ` AND NOT excluded)`
+}
+
+// RepoSummary is the total activity in a repo.
+type RepoSummary struct {
+	RepoName  string `db:"repo_name"`
+	Provider  string `db:"provider"`
+	Commits   int    `db:"commits"`
+	Additions int    `db:"additions"`
+	Deletions int    `db:"deletions"`
+}
+
+// RepoID returns the RepoID of the repo's commits.
+func (r RepoSummary) RepoID() string {
+	return Commit{RepoName: r.RepoName, Provider: r.Provider}.RepoID()
+}
+
+// GetGroupTopRepos returns the limit repos with the most commits by
+// g's users since since.
+func GetGroupTopRepos(g Group, since time.Time, limit int) ([]RepoSummary, error) {
+	b := &db.Binder{}
+	query := `
+SELECT repo_name, provider, count(*) AS commits,
+  sum(additions) AS additions, sum(deletions) AS deletions
+FROM commit
+WHERE (` + groupCommitCond(b, g) + `) AND author_date > ` + b.Bind(since) + `
+GROUP BY provider, repo_name
+ORDER BY count(*) DESC, sum(additions + deletions) DESC
+LIMIT ` + b.Bind(limit)
+	var rs []RepoSummary
+	if err := db.DB.Select(&rs, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	return rs, nil
+}
+
+// GetUserTopRepos returns the limit repos with the most commits by u
+// since since.
+func GetUserTopRepos(u User, since time.Time, limit int) ([]RepoSummary, error) {
+	b := &db.Binder{}
+	query := `
+SELECT repo_name, provider, count(*) AS commits,
+  sum(additions) AS additions, sum(deletions) AS deletions
+FROM commit
+WHERE (` + userCommitCond(b, u) + `) AND author_date > ` + b.Bind(since) + `
+GROUP BY provider, repo_name
+ORDER BY count(*) DESC, sum(additions + deletions) DESC
+LIMIT ` + b.Bind(limit)
+	var rs []RepoSummary
+	if err := db.DB.Select(&rs, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	return rs, nil
+}
+
+// RepoContributor is a user's activity in a repo. Co-authored commits
+// count toward every author.
+type RepoContributor struct {
+	UID       int    `db:"uid" json:"-"`
+	Login     string `db:"login"`
+	Commits   int    `db:"commits"`
+	Additions int    `db:"additions"`
+	Deletions int    `db:"deletions"`
+}
+
+// RepoFile is the activity in one of a repo's files.
+type RepoFile struct {
+	Filename  string `db:"filename"`
+	Commits   int    `db:"commits"`
+	Additions int    `db:"additions"`
+	Deletions int    `db:"deletions"`
+}
+
+// RepoDay is the activity in a repo on a day.
+type RepoDay struct {
+	// Day is formatted as "2006-01-02".
+	Day       string
+	Commits   int
+	Additions int
+	Deletions int
+}
+
+// RepoStats is a group's activity in a repo.
+type RepoStats struct {
+	RepoName     string
+	Provider     string
+	Commits      int
+	Additions    int
+	Deletions    int
+	Contributors []RepoContributor
+	// Days are the days with commits, most recent first.
+	Days []RepoDay
+	// TopFiles are the most touched files.
+	TopFiles []RepoFile
+}
+
+// RepoID returns the RepoID of the repo's commits.
+func (r RepoStats) RepoID() string {
+	return Commit{RepoName: r.RepoName, Provider: r.Provider}.RepoID()
+}
+
+// repoTopFilesLimit is the number of files in RepoStats.TopFiles.
+const repoTopFilesLimit = 10
+
+// GetGroupRepoStats returns g's activity in repoName on provider
+// since g was created. Days are in loc.
+func GetGroupRepoStats(g Group, provider, repoName string, loc *time.Location) (RepoStats, error) {
+	rs := RepoStats{RepoName: repoName, Provider: provider}
+	since := BeginningOfDay(g.CreatedOn)
+	cs, err := GetGroupAllCommits(g)
+	if err != nil {
+		return RepoStats{}, wrapError(err)
+	}
+	var repoCommits []Commit
+	for _, c := range cs {
+		if c.RepoName == repoName && c.Provider == provider {
+			repoCommits = append(repoCommits, c)
+			rs.Commits++
+			rs.Additions += c.Additions
+			rs.Deletions += c.Deletions
+		}
+	}
+	for _, dcg := range DayCommitGroups(repoCommits, loc) {
+		rs.Days = append(rs.Days, RepoDay{
+			Day:       dcg.Day.Format("2006-01-02"),
+			Commits:   len(dcg.Commits),
+			Additions: dcg.Additions,
+			Deletions: dcg.Deletions,
+		})
+	}
+
+	b := &db.Binder{}
+	repo := `commit.provider = ` + b.Bind(provider) + ` AND commit.repo_name = ` + b.Bind(repoName) +
+		` AND commit.author_date > ` + b.Bind(since)
+	gid := b.Bind(g.GID)
+	query := `
+SELECT "user".uid, "user".login, count(*) AS commits,
+  sum(a.additions) AS additions, sum(a.deletions) AS deletions
+FROM (
+  SELECT commit.uid, commit.additions, commit.deletions FROM commit
+  WHERE ` + repo + ` AND NOT commit.excluded
+  UNION ALL
+  SELECT commit_author.uid, commit.additions, commit.deletions
+  FROM commit JOIN commit_author USING (sha) WHERE ` + repo + ` AND NOT commit_author.excluded
+) a JOIN "user" ON "user".uid = a.uid
+WHERE a.uid IN (SELECT uid FROM user_group WHERE gid = ` + gid + `)
+GROUP BY "user".uid, "user".login
+ORDER BY count(*) DESC, "user".login ASC`
+	if err := db.DB.Select(&rs.Contributors, query, b.Items...); err != nil {
+		return RepoStats{}, wrapError(err)
+	}
+
+	b = &db.Binder{}
+	query = `
+SELECT commit_file.filename, count(DISTINCT commit.sha) AS commits,
+  sum(commit_file.additions) AS additions, sum(commit_file.deletions) AS deletions
+FROM commit_file JOIN commit ON commit.sha = commit_file.commit_sha
+WHERE commit.provider = ` + b.Bind(provider) + ` AND commit.repo_name = ` + b.Bind(repoName) + `
+  AND commit.author_date > ` + b.Bind(since) + ` AND (` + groupCommitCond(b, g) + `)
+GROUP BY commit_file.filename
+ORDER BY count(DISTINCT commit.sha) DESC, sum(commit_file.additions + commit_file.deletions) DESC
+LIMIT ` + b.Bind(repoTopFilesLimit)
+	if err := db.DB.Select(&rs.TopFiles, query, b.Items...); err != nil {
+		return RepoStats{}, wrapError(err)
+	}
+	return rs, nil
+}
+
+// GroupRepoURL returns the url for g's page for repoName on provider.
+// Repos whose names aren't owner/name have no page, so it returns
+// g's url for them.
+func GroupRepoURL(g Group, provider, repoName string) string {
+	if !ValidRepoName(repoName) {
+		return GroupURL(g)
+	}
+	owner, name := SplitRepoName(repoName)
+	u := GroupURL(g) + "/repo/" + url.QueryEscape(owner) + "/" + url.QueryEscape(name)
+	if provider != "" && provider != GitHubProvider {
+		u += "?provider=" + url.QueryEscape(provider)
+	}
+	return u
+}
+
+var repoTemplate = pongo2.Must(pongo2.FromFile("templates/repo.html"))
+
+type repoTemplateVars struct {
+	Login string
+	Group Group
+	Repo  RepoStats
+}
+
+// getGroupRepoStats returns the RepoStats for the request's group and
+// repo, as given in the URL. viewer must be in the group.
+func getGroupRepoStats(viewer User, c web.C, r *http.Request) (Group, RepoStats, error) {
+	g, err := memberGroup(viewer, c)
+	if err != nil {
+		return Group{}, RepoStats{}, err
+	}
+	loc, err := GetGroupLocation(g)
+	if err != nil {
+		return Group{}, RepoStats{}, wrapError(err)
+	}
+	provider := r.URL.Query().Get("provider")
+	if provider == "" {
+		provider = GitHubProvider
+	}
+	repoName := c.URLParams["owner"] + "/" + c.URLParams["name"]
+	rs, err := GetGroupRepoStats(g, provider, repoName, loc)
+	if err != nil {
+		return Group{}, RepoStats{}, wrapError(err)
+	}
+	if rs.Commits == 0 {
+		return Group{}, RepoStats{}, &HTTPError{
+			Err:  errors.Errorf("group %d has no commits in %s", g.GID, repoName),
+			Code: http.StatusNotFound,
+		}
+	}
+	return g, rs, nil
+}
+
+func serveGroupRepo(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	g, rs, err := getGroupRepoStats(*a.User, c, r)
+	if err != nil {
+		return err
+	}
+	return RenderTemplate(repoTemplate, w, repoTemplateVars{
+		Login: a.User.Login,
+		Group: g,
+		Repo:  rs,
+	})
+}
+
+func serveGroupRepoStats(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	_, rs, err := getGroupRepoStats(*a.User, c, r)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(rs)
+}
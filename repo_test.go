@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestGroupRepoURL(t *testing.T) {
+	g := Group{GID: 4}
+	for _, tt := range []struct {
+		provider, repoName, want string
+	}{
+		{GitHubProvider, "samertm/githubstreaks", "/group/4/repo/samertm/githubstreaks"},
+		{"", "samertm/githubstreaks", "/group/4/repo/samertm/githubstreaks"},
+		{GitLabProvider, "team/app", "/group/4/repo/team/app?provider=gitlab"},
+		{GitHubProvider, "foo", "/group/4"},
+		{GitHubProvider, "foo/", "/group/4"},
+	} {
+		if got := GroupRepoURL(g, tt.provider, tt.repoName); got != tt.want {
+			t.Errorf("GroupRepoURL(%q, %q) = %q, want %q", tt.provider, tt.repoName, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/samertm/githubstreaks/db"
+	"github.com/zenazn/goji/web"
+)
+
+// RepoFilter decides which of a user's repos count toward their
+// streaks. Commits in filtered repos are still stored, but are marked
+// excluded, so changing the filter is reversible.
+type RepoFilter struct {
+	UID int `db:"uid"`
+	// Include and Exclude are newline separated globs on
+	// "owner/repo", as matched by path.Match. If Include is not
+	// empty, only repos that match one of its globs count.
+	Include string `db:"include"`
+	Exclude string `db:"exclude"`
+	// ExcludeForks and ExcludeArchived exclude forks and archived
+	// repos.
+	ExcludeForks    bool `db:"exclude_forks"`
+	ExcludeArchived bool `db:"exclude_archived"`
+}
+
+var repoFilterSchema = `
+CREATE TABLE IF NOT EXISTS repo_filter (
+  uid integer PRIMARY KEY REFERENCES "user" (uid),
+  include text NOT NULL,
+  exclude text NOT NULL,
+  exclude_forks boolean NOT NULL,
+  exclude_archived boolean NOT NULL
+)`
+
+// repoInfoSchema caches whether repos are forks or archived.
+var repoInfoSchema = `
+CREATE TABLE IF NOT EXISTS repo_info (
+  provider text NOT NULL,
+  repo_name text NOT NULL,
+  fork boolean NOT NULL,
+  archived boolean NOT NULL,
+  updated_on timestamp NOT NULL,
+  PRIMARY KEY (provider, repo_name)
+)`
+
+// excludedSchema marks commits that are filtered out for their owner
+// and co-authors.
+var excludedSchema = `
+ALTER TABLE "commit" ADD COLUMN IF NOT EXISTS excluded boolean NOT NULL DEFAULT false;
+ALTER TABLE commit_author ADD COLUMN IF NOT EXISTS excluded boolean NOT NULL DEFAULT false`
+
+// patterns returns the globs in s, one per line.
+func patterns(s string) []string {
+	var ps []string
+	for _, p := range strings.Split(s, "\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// matchAny returns true if repoName matches any of the globs. Repo
+// names are case-insensitive.
+func matchAny(globs []string, repoName string) bool {
+	for _, g := range globs {
+		if ok, _ := path.Match(strings.ToLower(g), strings.ToLower(repoName)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsRepoInfo returns true if f needs to know whether repos are
+// forks or archived.
+func (f RepoFilter) NeedsRepoInfo() bool {
+	return f.ExcludeForks || f.ExcludeArchived
+}
+
+// Excludes returns true if commits in repoName should not count. info
+// is only used if f.NeedsRepoInfo.
+func (f RepoFilter) Excludes(repoName string, info RepoInfo) bool {
+	if include := patterns(f.Include); len(include) > 0 && !matchAny(include, repoName) {
+		return true
+	}
+	if matchAny(patterns(f.Exclude), repoName) {
+		return true
+	}
+	return (f.ExcludeForks && info.Fork) || (f.ExcludeArchived && info.Archived)
+}
+
+// Validate returns an error if one of f's globs is malformed.
+func (f RepoFilter) Validate() error {
+	for _, p := range append(patterns(f.Include), patterns(f.Exclude)...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return wrapErrorf(err, "bad pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// GetRepoFilter returns the filter for the user with uid. Users
+// without a filter get the zero RepoFilter, which excludes nothing.
+func GetRepoFilter(uid int) (RepoFilter, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM repo_filter WHERE uid = ` + b.Bind(uid)
+	var fs []RepoFilter
+	if err := db.DB.Select(&fs, query, b.Items...); err != nil {
+		return RepoFilter{}, wrapError(err)
+	}
+	if len(fs) == 0 {
+		return RepoFilter{UID: uid}, nil
+	}
+	return fs[0], nil
+}
+
+// SetRepoFilter saves f.
+func SetRepoFilter(f RepoFilter) error {
+	b := &db.Binder{}
+	query := `
+INSERT INTO repo_filter(uid, include, exclude, exclude_forks, exclude_archived)
+  VALUES (` + b.Bind(f.UID, f.Include, f.Exclude, f.ExcludeForks, f.ExcludeArchived) + `)
+ON CONFLICT (uid) DO UPDATE SET
+  include = excluded.include, exclude = excluded.exclude,
+  exclude_forks = excluded.exclude_forks, exclude_archived = excluded.exclude_archived`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error saving repo filter for user %d", f.UID)
+	}
+	return nil
+}
+
+// RepoInfo is what RepoFilter needs to know about a repo.
+type RepoInfo struct {
+	Fork     bool `db:"fork"`
+	Archived bool `db:"archived"`
+}
+
+// RepoInfoSource is a CommitSource that can describe repos.
+type RepoInfoSource interface {
+	GetRepoInfo(repoName string) (RepoInfo, error)
+}
+
+// repoInfoTTL is how long repo info is cached for.
+var repoInfoTTL = 7 * 24 * time.Hour
+
+// GetRepoInfo returns the info for repoName on provider, from the
+// cache if it is fresh. Repos on sources that can't describe repos
+// are neither forks nor archived.
+func GetRepoInfo(provider, repoName string) (RepoInfo, error) {
+	b := &db.Binder{}
+	query := `SELECT fork, archived FROM repo_info WHERE provider = ` + b.Bind(provider) +
+		` AND repo_name = ` + b.Bind(repoName) + ` AND updated_on > ` + b.Bind(time.Now().Add(-repoInfoTTL))
+	var is []RepoInfo
+	if err := db.DB.Select(&is, query, b.Items...); err != nil {
+		return RepoInfo{}, wrapError(err)
+	}
+	if len(is) > 0 {
+		return is[0], nil
+	}
+	src, err := AccountSource(Account{Provider: provider})
+	if err != nil {
+		// The provider is gone, so we can't know.
+		return RepoInfo{}, nil
+	}
+	ris, ok := src.(RepoInfoSource)
+	if !ok {
+		return RepoInfo{}, nil
+	}
+	info, err := ris.GetRepoInfo(repoName)
+	if err != nil {
+		return RepoInfo{}, wrapError(err)
+	}
+	b = &db.Binder{}
+	query = `
+INSERT INTO repo_info(provider, repo_name, fork, archived, updated_on)
+  VALUES (` + b.Bind(provider, repoName, info.Fork, info.Archived) + `, current_timestamp)
+ON CONFLICT (provider, repo_name) DO UPDATE SET
+  fork = excluded.fork, archived = excluded.archived, updated_on = excluded.updated_on`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return RepoInfo{}, wrapError(err)
+	}
+	return info, nil
+}
+
+// RepoExcluded returns true if the user with uid filters out commits
+// in repoName on provider.
+func RepoExcluded(uid int, provider, repoName string) (bool, error) {
+	f, err := GetRepoFilter(uid)
+	if err != nil {
+		return false, wrapError(err)
+	}
+	var info RepoInfo
+	if f.NeedsRepoInfo() {
+		if info, err = GetRepoInfo(provider, repoName); err != nil {
+			return false, wrapError(err)
+		}
+	}
+	return f.Excludes(repoName, info), nil
+}
+
+// commitAuthor is a co-author of a commit, as stored in
+// commit_author.
+type commitAuthor struct {
+	UID      int
+	Excluded bool
+}
+
+// markExcluded sets c.Excluded according to its owner's repo filter,
+// and returns coauthors with their own filters applied.
+func markExcluded(c *Commit, coauthors []int) ([]commitAuthor, error) {
+	excluded, err := RepoExcluded(c.UID, c.Provider, c.RepoName)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	c.Excluded = excluded
+	var cas []commitAuthor
+	for _, uid := range coauthors {
+		excluded, err := RepoExcluded(uid, c.Provider, c.RepoName)
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		cas = append(cas, commitAuthor{UID: uid, Excluded: excluded})
+	}
+	return cas, nil
+}
+
+// repoExclusion is whether a user's commits in Repo count.
+type repoExclusion struct {
+	Repo     RepoSummary
+	Excluded bool
+}
+
+// ApplyRepoFilter marks u's commits, and the commits u co-authored,
+// as excluded or not according to u's current repo filter. It may
+// fetch repo info, so handlers should queue a RepoFilterJob instead.
+func ApplyRepoFilter(u User) error {
+	f, err := GetRepoFilter(u.UID)
+	if err != nil {
+		return wrapError(err)
+	}
+	b := &db.Binder{}
+	uid := b.Bind(u.UID)
+	query := `
+SELECT DISTINCT provider, repo_name FROM commit
+WHERE uid = ` + uid + ` OR sha IN (SELECT sha FROM commit_author WHERE uid = ` + uid + `)`
+	var repos []RepoSummary
+	if err := db.DB.Select(&repos, query, b.Items...); err != nil {
+		return wrapError(err)
+	}
+	// Look up repo info before starting the transaction, since it
+	// may go over the network.
+	var res []repoExclusion
+	for _, r := range repos {
+		var info RepoInfo
+		if f.NeedsRepoInfo() {
+			if info, err = GetRepoInfo(r.Provider, r.RepoName); err != nil {
+				return wrapError(err)
+			}
+		}
+		res = append(res, repoExclusion{Repo: r, Excluded: f.Excludes(r.RepoName, info)})
+	}
+	return saveRepoExclusions(u.UID, res)
+}
+
+// saveRepoExclusions marks the commits of the user with uid in each
+// of res's repos, and the commits they co-authored there, as excluded
+// or not. It runs in a single transaction.
+func saveRepoExclusions(uid int, res []repoExclusion) error {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return wrapError(err)
+	}
+	for _, re := range res {
+		r := re.Repo
+		query := `
+UPDATE commit SET excluded = $1 WHERE uid = $2 AND provider = $3 AND repo_name = $4`
+		if _, err := tx.Exec(query, re.Excluded, uid, r.Provider, r.RepoName); err != nil {
+			tx.Rollback()
+			return wrapErrorf(err, "error applying repo filter to %s for user %d", r.RepoName, uid)
+		}
+		query = `
+UPDATE commit_author SET excluded = $1 WHERE uid = $2
+  AND sha IN (SELECT sha FROM commit WHERE provider = $3 AND repo_name = $4)`
+		if _, err := tx.Exec(query, re.Excluded, uid, r.Provider, r.RepoName); err != nil {
+			tx.Rollback()
+			return wrapErrorf(err, "error applying repo filter to %s for user %d", r.RepoName, uid)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// RepoFilterJob applies a user's repo filter to their commits in the
+// background, since it may need to fetch info for each of their
+// repos.
+const RepoFilterJob = "repo_filter"
+
+func init() {
+	jobHandlers[RepoFilterJob] = runRepoFilterJob
+}
+
+func runRepoFilterJob(j *Job) error {
+	u, err := GetUser(UserSpec{UID: j.UID})
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := j.Checkpoint("", "Applying your repo filter"); err != nil {
+		return wrapError(err)
+	}
+	if err := ApplyRepoFilter(u); err != nil {
+		return wrapError(err)
+	}
+	evaluateAchievements(u)
+	return nil
+}
+
+// EnqueueRepoFilter queues a RepoFilterJob for u, unless one is
+// already waiting to run. A running job may have read the old
+// filter, so it doesn't count.
+func EnqueueRepoFilter(u User) error {
+	queued, err := HasQueuedJob(u, RepoFilterJob)
+	if err != nil {
+		return wrapError(err)
+	}
+	if queued {
+		return nil
+	}
+	if _, err := EnqueueJob(u, RepoFilterJob, nil); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+type repoFilterForm struct {
+	Include         string `schema:"include"`
+	Exclude         string `schema:"exclude"`
+	ExcludeForks    bool   `schema:"exclude_forks"`
+	ExcludeArchived bool   `schema:"exclude_archived"`
+}
+
+func serveSaveRepoFilter(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form repoFilterForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	f := RepoFilter{
+		UID:             a.User.UID,
+		Include:         form.Include,
+		Exclude:         form.Exclude,
+		ExcludeForks:    form.ExcludeForks,
+		ExcludeArchived: form.ExcludeArchived,
+	}
+	if err := f.Validate(); err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	if err := SetRepoFilter(f); err != nil {
+		return wrapError(err)
+	}
+	if err := EnqueueRepoFilter(*a.User); err != nil {
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: "/settings", Code: http.StatusSeeOther}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/samertm/githubstreaks/db"
+)
+
+func TestRepoFilterExcludes(t *testing.T) {
+	for _, tt := range []struct {
+		filter   RepoFilter
+		repoName string
+		info     RepoInfo
+		want     bool
+	}{
+		{RepoFilter{}, "samertm/githubstreaks", RepoInfo{Fork: true, Archived: true}, false},
+		{RepoFilter{Include: "samertm/*"}, "samertm/githubstreaks", RepoInfo{}, false},
+		{RepoFilter{Include: "samertm/*"}, "other/repo", RepoInfo{}, true},
+		{RepoFilter{Include: "\n  other/*\nSamertm/*\n"}, "samertm/githubstreaks", RepoInfo{}, false},
+		{RepoFilter{Exclude: "*/dotfiles"}, "samertm/dotfiles", RepoInfo{}, true},
+		{RepoFilter{Include: "samertm/*", Exclude: "samertm/dotfiles"}, "samertm/dotfiles", RepoInfo{}, true},
+		{RepoFilter{ExcludeForks: true}, "samertm/go", RepoInfo{Fork: true}, true},
+		{RepoFilter{ExcludeForks: true}, "samertm/go", RepoInfo{Archived: true}, false},
+		{RepoFilter{ExcludeArchived: true}, "samertm/old", RepoInfo{Archived: true}, true},
+	} {
+		if got := tt.filter.Excludes(tt.repoName, tt.info); got != tt.want {
+			t.Errorf("%+v.Excludes(%q, %+v) = %t, want %t", tt.filter, tt.repoName, tt.info, got, tt.want)
+		}
+	}
+}
+
+func TestRepoFilterValidate(t *testing.T) {
+	if err := (RepoFilter{Include: "samertm/*\n*/[a-z]*"}).Validate(); err != nil {
+		t.Errorf("Validate() = %s, want nil", err)
+	}
+	if err := (RepoFilter{Exclude: "samertm/[a-"}).Validate(); err == nil {
+		t.Error("Validate() = nil for a malformed pattern")
+	}
+}
+
+// TestSaveRepoExclusions checks that each repo's commits and credits
+// are updated by separate statements in one transaction, since pq
+// can't prepare several statements at once.
+func TestSaveRepoExclusions(t *testing.T) {
+	mdb := db.GetSetMock()
+	uid := 1
+	res := []repoExclusion{
+		{Repo: RepoSummary{Provider: GitHubProvider, RepoName: "samertm/githubstreaks"}, Excluded: false},
+		{Repo: RepoSummary{Provider: GitLabProvider, RepoName: "samertm/fork"}, Excluded: true},
+	}
+	sqlmock.ExpectBegin()
+	for _, re := range res {
+		sqlmock.ExpectExec(`UPDATE commit SET excluded = \$1 WHERE uid = \$2 AND provider = \$3 AND repo_name = \$4`).
+			WithArgs(re.Excluded, uid, re.Repo.Provider, re.Repo.RepoName).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlmock.ExpectExec(`UPDATE commit_author SET excluded = \$1 WHERE uid = \$2`).
+			WithArgs(re.Excluded, uid, re.Repo.Provider, re.Repo.RepoName).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	sqlmock.ExpectCommit()
+	if err := saveRepoExclusions(uid, res); err != nil {
+		t.Error(err)
+	}
+	if err := mdb.Close(); err != nil {
+		t.Error(err)
+	}
+}
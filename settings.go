@@ -0,0 +1,280 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/samertm/githubstreaks/debug"
+	"github.com/zenazn/goji/web"
+)
+
+// ParseTimezone returns the IANA timezone name tz, trimmed, or an
+// error if it isn't a known timezone. An empty tz unsets the
+// timezone.
+func ParseTimezone(tz string) (string, error) {
+	tz = strings.TrimSpace(tz)
+	if tz == "" {
+		return "", nil
+	}
+	// LoadLocation treats "Local" as the server's timezone, which
+	// means nothing to the user.
+	if tz == "Local" {
+		return "", errors.Errorf("unknown timezone %q", tz)
+	}
+	if _, err := time.LoadLocation(tz); err != nil {
+		return "", errors.Errorf("unknown timezone %q", tz)
+	}
+	return tz, nil
+}
+
+// SetUserTimezone sets u's timezone to tz, which must be valid
+// according to ParseTimezone.
+func SetUserTimezone(u User, tz string) error {
+	b := &db.Binder{}
+	query := `UPDATE "user" SET timezone = ` + b.Bind(tz) + ` WHERE uid = ` + b.Bind(u.UID)
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// Account deletion modes. Deleting removes the user's commits;
+// anonymizing keeps them, without messages, file names or repo names,
+// under a placeholder user who is in no groups.
+const (
+	DeleteCommits    = "delete"
+	AnonymizeCommits = "anonymize"
+)
+
+// deletedProvider is the provider of the placeholder users left by
+// anonymized accounts. No host has it, so nobody can log in as them.
+const deletedProvider = "deleted"
+
+// deletedRepoName replaces the repo names of anonymized commits.
+const deletedRepoName = deletedProvider + "/repo"
+
+// accountDeletionQueries returns the queries that delete the account
+// of the user with uid $1, in order. mode is DeleteCommits or
+// AnonymizeCommits.
+func accountDeletionQueries(mode string) []string {
+	qs := []string{
+		`DELETE FROM user_group WHERE uid = $1`,
+		`DELETE FROM digest_subscription WHERE uid = $1`,
+		`DELETE FROM reminder_setting WHERE uid = $1`,
+		`DELETE FROM reminder WHERE uid = $1`,
+		`DELETE FROM repo_filter WHERE uid = $1`,
+		`DELETE FROM user_email WHERE uid = $1`,
+		`DELETE FROM user_achievement WHERE uid = $1`,
+		`DELETE FROM feed_token WHERE uid = $1`,
+		`DELETE FROM account WHERE uid = $1`,
+		`DELETE FROM job WHERE uid = $1`,
+		`DELETE FROM data_export WHERE uid = $1`,
+		// Co-authoring credits on other people's commits.
+		`DELETE FROM commit_author WHERE uid = $1`,
+	}
+	if mode == AnonymizeCommits {
+		return append(qs,
+			`UPDATE commit_file SET filename = '', patch = ''
+  WHERE commit_sha IN (SELECT sha FROM commit WHERE uid = $1)`,
+			`UPDATE commit SET message = '', repo_name = '`+deletedRepoName+`' WHERE uid = $1`,
+			`UPDATE "user" SET login = 'deleted-' || uid, provider = '`+deletedProvider+`',
+  email = NULL, email_verified = false, etag = NULL, commits_last_updated_on = NULL,
+  profile_private = true, timezone = ''
+  WHERE uid = $1`,
+		)
+	}
+	return append(qs,
+		`DELETE FROM commit_file WHERE commit_sha IN (SELECT sha FROM commit WHERE uid = $1)`,
+		`DELETE FROM commit_author WHERE sha IN (SELECT sha FROM commit WHERE uid = $1)`,
+		`DELETE FROM commit WHERE uid = $1`,
+		`DELETE FROM "user" WHERE uid = $1`,
+	)
+}
+
+// DeleteAccount removes u from all of their groups and deletes their
+// settings and their commits, or anonymizes the commits, depending on
+// mode. It runs in a single transaction, after telling u's groups
+// that u left.
+func DeleteAccount(u User, mode string) error {
+	if mode != DeleteCommits && mode != AnonymizeCommits {
+		return errors.Errorf("unknown account deletion mode %q", mode)
+	}
+	gs, err := GetGroups(u)
+	if err != nil {
+		return wrapError(err)
+	}
+	for _, g := range gs {
+		if err := PublishGroupEvent(GroupEvent{Kind: EventMemberLeft, Group: g, User: u}); err != nil {
+			// The account is still deleted.
+			debug.Println(err)
+		}
+	}
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return wrapError(err)
+	}
+	for _, query := range accountDeletionQueries(mode) {
+		if _, err := tx.Exec(query, u.UID); err != nil {
+			tx.Rollback()
+			return wrapErrorf(err, "error deleting account %d", u.UID)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// groupDigest is a user's digest subscription for one of their
+// groups.
+type groupDigest struct {
+	Group  Group
+	Digest DigestSubscription
+}
+
+var settingsTemplate = pongo2.Must(pongo2.FromFile("templates/settings.html"))
+
+type settingsTemplateVars struct {
+	Login string
+	User  User
+	// AuthorEmails are the user's registered author emails.
+	AuthorEmails []UserEmail
+	Groups       []Group
+	// Digests are the user's digest subscriptions, one per group.
+	Digests []groupDigest
+	// Reminder is the user's reminder setting, and Reminders are
+	// the last reminders they were sent.
+	Reminder   ReminderSetting
+	Reminders  []Reminder
+	RepoFilter RepoFilter
+	// FilteringRepos is whether the repo filter is being applied.
+	FilteringRepos bool
+	// Export is the user's latest export, if any, and Exporting is
+	// whether a new one is being built.
+	Export    *DataExport
+	Exporting bool
+}
+
+func serveSettings(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	u := *a.User
+	v := settingsTemplateVars{Login: u.Login, User: u}
+	var err error
+	if v.AuthorEmails, err = GetUserEmails(u); err != nil {
+		return wrapError(err)
+	}
+	if v.Groups, err = GetGroups(u); err != nil {
+		return wrapError(err)
+	}
+	for _, g := range v.Groups {
+		ds, err := GetDigestSubscription(u.UID, g.GID)
+		if err != nil {
+			return wrapError(err)
+		}
+		v.Digests = append(v.Digests, groupDigest{Group: g, Digest: ds})
+	}
+	if v.Reminder, err = GetReminderSetting(u.UID); err != nil {
+		return wrapError(err)
+	}
+	if v.Reminders, err = GetUserReminders(u, 5); err != nil {
+		return wrapError(err)
+	}
+	if v.RepoFilter, err = GetRepoFilter(u.UID); err != nil {
+		return wrapError(err)
+	}
+	if v.FilteringRepos, err = HasActiveJob(u, RepoFilterJob); err != nil {
+		return wrapError(err)
+	}
+	if v.Export, err = GetDataExport(u); err != nil {
+		return wrapError(err)
+	}
+	if v.Exporting, err = HasActiveJob(u, ExportJob); err != nil {
+		return wrapError(err)
+	}
+	return RenderTemplate(settingsTemplate, w, v)
+}
+
+type timezoneForm struct {
+	Timezone string `schema:"timezone"`
+}
+
+func serveSaveTimezone(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form timezoneForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	tz, err := ParseTimezone(form.Timezone)
+	if err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	if err := SetUserTimezone(*a.User, tz); err != nil {
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: "/settings", Code: http.StatusSeeOther}
+}
+
+var deleteAccountTemplate = pongo2.Must(pongo2.FromFile("templates/delete_account.html"))
+
+type deleteAccountTemplateVars struct {
+	Login string
+}
+
+// serveDeleteAccountConfirm asks the user to confirm that they want
+// to delete their account.
+func serveDeleteAccountConfirm(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	return RenderTemplate(deleteAccountTemplate, w, deleteAccountTemplateVars{Login: a.User.Login})
+}
+
+type deleteAccountForm struct {
+	Mode string `schema:"mode"`
+	// Confirm must be the user's login.
+	Confirm string `schema:"confirm"`
+}
+
+func serveDeleteAccount(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form deleteAccountForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	if strings.TrimSpace(form.Confirm) != a.User.Login {
+		return &HTTPError{Err: errors.New("type your login to confirm"), Code: http.StatusBadRequest}
+	}
+	if form.Mode != DeleteCommits && form.Mode != AnonymizeCommits {
+		return &HTTPError{Err: errors.Errorf("unknown mode %q", form.Mode), Code: http.StatusBadRequest}
+	}
+	if err := DeleteAccount(*a.User, form.Mode); err != nil {
+		return wrapError(err)
+	}
+	delete(a.Session.Values, UIDSessionKey)
+	if err := a.Session.Save(r, w); err != nil {
+		return wrapErrorf(err, "error saving session")
+	}
+	return RenderTemplate(messageTemplate, w, messageTemplateVars{
+		Message: "Your account was deleted.",
+	})
+}
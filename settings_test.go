@@ -0,0 +1,65 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseTimezone(t *testing.T) {
+	tests := []struct {
+		tz       string
+		expected string
+		err      bool
+	}{
+		{"", "", false},
+		{" America/New_York ", "America/New_York", false},
+		{"UTC", "UTC", false},
+		{"Local", "", true},
+		{"Mars/Olympus_Mons", "", true},
+	}
+	for _, test := range tests {
+		tz, err := ParseTimezone(test.tz)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v, expected error: %t", test.tz, err, test.err)
+		}
+		if tz != test.expected {
+			t.Errorf("%q: got %q, expected %q", test.tz, tz, test.expected)
+		}
+	}
+}
+
+var (
+	userTableRegexp = regexp.MustCompile(`CREATE TABLE IF NOT EXISTS "?(\w+)"? \(([^;]*)\)`)
+	userRefRegexp   = regexp.MustCompile(`uid integer[^,]* REFERENCES "user"`)
+)
+
+// TestAccountDeletionQueries checks that deleting an account clears
+// every table that references users, so that new tables aren't
+// forgotten.
+func TestAccountDeletionQueries(t *testing.T) {
+	for _, mode := range []string{DeleteCommits, AnonymizeCommits} {
+		qs := strings.Join(accountDeletionQueries(mode), "\n")
+		for _, s := range schemas {
+			for _, m := range userTableRegexp.FindAllStringSubmatch(s, -1) {
+				if !userRefRegexp.MatchString(m[2]) || m[1] == "commit" {
+					continue
+				}
+				if !strings.Contains(qs, "DELETE FROM "+m[1]+" WHERE uid = $1") {
+					t.Errorf("%s: %s isn't cleared", mode, m[1])
+				}
+			}
+		}
+	}
+	del := accountDeletionQueries(DeleteCommits)
+	if last := del[len(del)-1]; last != `DELETE FROM "user" WHERE uid = $1` {
+		t.Errorf("delete: last query is %s, expected the user to be deleted last", last)
+	}
+	anon := strings.Join(accountDeletionQueries(AnonymizeCommits), "\n")
+	if strings.Contains(anon, "DELETE FROM commit WHERE") || strings.Contains(anon, `DELETE FROM "user"`) {
+		t.Errorf("anonymize deletes commits or the user:\n%s", anon)
+	}
+	if !strings.Contains(anon, "repo_name = '"+deletedRepoName+"'") {
+		t.Errorf("anonymize keeps repo names:\n%s", anon)
+	}
+}
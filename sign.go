@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/conf"
+)
+
+// signature returns the HMAC of v, keyed by the session key. The
+// "sig" value is not signed.
+func signature(v url.Values) string {
+	unsigned := url.Values{}
+	for k, vs := range v {
+		if k != "sig" {
+			unsigned[k] = vs
+		}
+	}
+	m := hmac.New(sha256.New, []byte(conf.Config.SessionKey))
+	// Encode sorts by key, so the message is stable.
+	m.Write([]byte(unsigned.Encode()))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Purposes of signed queries. A query signed for one purpose isn't
+// accepted for another, even if it has the same values.
+const (
+	SignAccountEmailVerify = "account_email_verify"
+	SignUserEmailVerify    = "user_email_verify"
+	SignDigestUnsubscribe  = "digest_unsubscribe"
+	SignExportDownload     = "export_download"
+)
+
+// SignQuery returns the encoded query for v with purpose, an expiry
+// time and a signature added. Use it to build links that must not be
+// forged, like email verification links.
+func SignQuery(purpose string, v url.Values, expires time.Time) string {
+	signed := url.Values{}
+	for k, vs := range v {
+		signed[k] = vs
+	}
+	signed.Set("purpose", purpose)
+	signed.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	signed.Set("sig", signature(signed))
+	return signed.Encode()
+}
+
+// VerifySignedQuery returns nil if v was created by SignQuery for
+// purpose and has not expired by now.
+func VerifySignedQuery(purpose string, v url.Values, now time.Time) error {
+	if !hmac.Equal([]byte(v.Get("sig")), []byte(signature(v))) {
+		return errors.New("invalid signature")
+	}
+	if v.Get("purpose") != purpose {
+		return errors.New("link is for something else")
+	}
+	expires, err := strconv.ParseInt(v.Get("expires"), 10, 64)
+	if err != nil {
+		return errors.New("invalid expiry time")
+	}
+	if now.After(time.Unix(expires, 0)) {
+		return errors.New("link has expired")
+	}
+	return nil
+}
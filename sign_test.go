@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignQuery(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	v := url.Values{}
+	v.Set("uid", "3")
+	v.Set("email", "me@example.com")
+	signed, err := url.ParseQuery(SignQuery(SignUserEmailVerify, v, now.Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySignedQuery(SignUserEmailVerify, signed, now); err != nil {
+		t.Errorf("VerifySignedQuery: %s", err)
+	}
+	if err := VerifySignedQuery(SignUserEmailVerify, signed, now.Add(2*time.Hour)); err == nil {
+		t.Error("VerifySignedQuery accepted an expired query")
+	}
+	if err := VerifySignedQuery(SignAccountEmailVerify, signed, now); err == nil {
+		t.Error("VerifySignedQuery accepted a query signed for another purpose")
+	}
+	purpose := url.Values{}
+	for k, vs := range signed {
+		purpose[k] = vs
+	}
+	purpose.Set("purpose", SignAccountEmailVerify)
+	if err := VerifySignedQuery(SignAccountEmailVerify, purpose, now); err == nil {
+		t.Error("VerifySignedQuery accepted a query with a changed purpose")
+	}
+	signed.Set("email", "someone@example.com")
+	if err := VerifySignedQuery(SignUserEmailVerify, signed, now); err == nil {
+		t.Error("VerifySignedQuery accepted a tampered query")
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/samertm/githubstreaks/conf"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/zenazn/goji/web"
+)
+
+// Provider names for the supported commit sources. They are stored
+// in the provider column of commits and accounts.
+const (
+	GitHubProvider = "github"
+	GitLabProvider = "gitlab"
+	GiteaProvider  = "gitea"
+	LocalProvider  = "local"
+)
+
+// CommitSource is a service that hosts git repositories, like
+// GitHub, GitLab or Gitea.
+type CommitSource interface {
+	// Provider returns the name of the source. It is stored with
+	// every commit fetched from the source.
+	Provider() string
+	// Identify returns the login of the user that token belongs
+	// to.
+	Identify(token string) (string, error)
+	// ListRecentPushes lists the commits that login recently
+	// pushed, newest first.
+	ListRecentPushes(login string) ([]PushedCommit, error)
+	// GetCommit fetches the commit sha in repoName, including its
+	// stats and files.
+	GetCommit(repoName, sha string) (SourceCommit, error)
+}
+
+// HistorySource is a CommitSource that can list commits older than
+// its recent pushes. It is used to backfill a user's history.
+type HistorySource interface {
+	CommitSource
+	// ListRepos lists the names of the repos that login owns or
+	// contributes to.
+	ListRepos(login string) ([]string, error)
+	// ListAuthoredCommits lists the SHAs of the commits in
+	// repoName authored by login between since and until.
+	ListAuthoredCommits(repoName, login string, since, until time.Time) ([]string, error)
+}
+
+// PushedCommit is a commit that was pushed to a repo.
+type PushedCommit struct {
+	RepoName string
+	SHA      string
+	// Pusher is the login of the user that pushed the commit.
+	Pusher string
+}
+
+// SourceCommit is a commit fetched from a CommitSource. UID and
+// Provider are filled in by CreateCommit.
+type SourceCommit struct {
+	Commit
+	// AuthorLogin is the login of the commit's author on the
+	// source. It is empty if the source does not know who the
+	// author is.
+	AuthorLogin string
+	AuthorName  string
+	AuthorEmail string
+	// ParentCount is the number of parents the commit has. Merge
+	// commits have more than one.
+	ParentCount int
+	Files       []CommitFile
+}
+
+// Account is a user's identity on a CommitSource. Every user has an
+// implicit GitHub account with their login; accounts for other
+// providers are linked by the user.
+type Account struct {
+	UID      int    `db:"uid"`
+	Provider string `db:"provider"`
+	Login    string `db:"login"`
+}
+
+var accountSchema = `
+CREATE TABLE IF NOT EXISTS account (
+  uid integer REFERENCES "user" (uid) NOT NULL,
+  provider text NOT NULL,
+  login text NOT NULL,
+  CONSTRAINT provider_login UNIQUE(provider, login)
+)`
+
+// GitHubAccount returns u's implicit account on the GitHub host they
+// logged in with.
+func GitHubAccount(u User) Account {
+	provider := u.Provider
+	if provider == "" {
+		provider = GitHubProvider
+	}
+	return Account{UID: u.UID, Provider: provider, Login: u.Login}
+}
+
+// GetUserAccounts returns all of u's accounts, starting with their
+// GitHub account.
+func GetUserAccounts(u User) ([]Account, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM account WHERE uid = ` + b.Bind(u.UID) + ` ORDER BY provider ASC`
+	var as []Account
+	if err := db.DB.Select(&as, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	return append([]Account{GitHubAccount(u)}, as...), nil
+}
+
+// FindAccountUID returns the uid of the user with login on provider,
+// either as the login they signed in with or as a linked account. It
+// returns 0 if there is no such user.
+func FindAccountUID(provider, login string) (int, error) {
+	b := &db.Binder{}
+	query := `
+SELECT uid FROM "user" WHERE provider = ` + b.Bind(provider) + ` AND login = ` + b.Bind(login) + `
+UNION
+SELECT uid FROM account WHERE provider = $1 AND login = $2`
+	var uids []int
+	if err := db.DB.Select(&uids, query, b.Items...); err != nil {
+		return 0, wrapError(err)
+	}
+	if len(uids) == 0 {
+		return 0, nil
+	}
+	return uids[0], nil
+}
+
+// LinkAccount links the account for login on provider to u.
+func LinkAccount(u User, provider, login string) error {
+	b := &db.Binder{}
+	query := `INSERT INTO account(uid, provider, login) VALUES (` +
+		b.Bind(u.UID, provider, login) + `)`
+	if _, err := db.DB.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error linking %s account %s to user %d", provider, login, u.UID)
+	}
+	return nil
+}
+
+// commitSources holds the configured sources, keyed by provider.
+// GitHub hosts are not in commitSources because they need a
+// per-request rate limit reserve; see AccountSource.
+var commitSources = make(map[string]CommitSource)
+
+func init() {
+	if conf.Config.GitLabURL != "" {
+		commitSources[GitLabProvider] = &GitLabSource{
+			BaseURL: conf.Config.GitLabURL,
+			Token:   conf.Config.GitLabToken,
+			Client:  &http.Client{Transport: CachedTransport()},
+		}
+	}
+	if conf.Config.GiteaURL != "" {
+		commitSources[GiteaProvider] = &GiteaSource{
+			BaseURL: conf.Config.GiteaURL,
+			Token:   conf.Config.GiteaToken,
+			Client:  &http.Client{Transport: CachedTransport()},
+		}
+	}
+}
+
+// AccountSource returns the CommitSource for a.
+func AccountSource(a Account) (CommitSource, error) {
+	if h, ok := githubHosts[a.Provider]; ok {
+		return &GitHubSource{Host: h, Transport: CachedTransport()}, nil
+	}
+	src, ok := commitSources[a.Provider]
+	if !ok {
+		return nil, errors.Errorf("provider %q is not configured", a.Provider)
+	}
+	return src, nil
+}
+
+// getJSON makes a GET request to url with header and decodes the
+// JSON response into v.
+func getJSON(client *http.Client, url string, header http.Header, v interface{}) error {
+	body, err := getBody(client, url, header)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return wrapErrorf(err, "error decoding response from %s", url)
+	}
+	return nil
+}
+
+// getBody makes a GET request to url with header and returns the
+// response body, which must be closed by the caller. Responses that
+// aren't 200 OK are returned as errors.
+func getBody(client *http.Client, url string, header http.Header) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, errors.Errorf("GET %s: %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+// diffLineStats counts the added and removed lines in the hunks of a
+// unified diff. File headers ("--- a/x", "+++ b/x") are not counted.
+func diffLineStats(diff string) (additions, deletions int) {
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++ "), strings.HasPrefix(line, "--- "):
+		case strings.HasPrefix(line, "+"):
+			additions++
+		case strings.HasPrefix(line, "-"):
+			deletions++
+		}
+	}
+	return additions, deletions
+}
+
+// splitGitDiff splits the output of "git diff" into the diff for each
+// file, keyed by the file's new name.
+func splitGitDiff(diff string) map[string]string {
+	files := make(map[string]string)
+	var name string
+	var current []string
+	flush := func() {
+		if name != "" {
+			files[name] = strings.Join(current, "\n")
+		}
+	}
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, "diff --git ") {
+			flush()
+			current = nil
+			// "diff --git a/old b/new"
+			if i := strings.LastIndex(line, " b/"); i != -1 {
+				name = line[i+len(" b/"):]
+			} else {
+				name = ""
+			}
+			continue
+		}
+		current = append(current, line)
+	}
+	flush()
+	return files
+}
+
+type linkAccountForm struct {
+	Provider string `schema:"provider"`
+	Token    string `schema:"token"`
+}
+
+// serveLinkAccount links an account on another provider to the
+// logged in user. The user proves that they own the account with an
+// access token, which is only used to look up their login.
+func serveLinkAccount(c web.C, w http.ResponseWriter, r *http.Request) error {
+	a := NewApp(c)
+	if redirect := a.Authed(r); redirect != nil {
+		return redirect
+	}
+	if err := r.ParseForm(); err != nil {
+		return wrapErrorf(err, "error parsing form")
+	}
+	var form linkAccountForm
+	if err := SchemaDecoder.Decode(&form, r.PostForm); err != nil {
+		return wrapErrorf(err, "error decoding form")
+	}
+	src, err := AccountSource(Account{Provider: form.Provider})
+	if err != nil {
+		return &HTTPError{Err: err, Code: http.StatusBadRequest}
+	}
+	login, err := src.Identify(form.Token)
+	if err != nil {
+		return &HTTPError{Err: wrapErrorf(err, "error identifying %s user", form.Provider), Code: http.StatusBadRequest}
+	}
+	if err := LinkAccount(*a.User, src.Provider(), login); err != nil {
+		return wrapError(err)
+	}
+	return &HTTPRedirect{To: "/", Code: http.StatusSeeOther}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GiteaSource is the CommitSource for a Gitea instance.
+type GiteaSource struct {
+	// BaseURL is the URL of the Gitea instance, e.g.
+	// "https://gitea.example.com".
+	BaseURL string
+	// Token is an access token used to read activity feeds and
+	// commits. It may be empty for public data.
+	Token string
+	// Client is used to make requests. If it is nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+}
+
+func (s *GiteaSource) Provider() string {
+	return GiteaProvider
+}
+
+func (s *GiteaSource) httpClient() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+func (s *GiteaSource) url(path string) string {
+	return strings.TrimSuffix(s.BaseURL, "/") + "/api/v1" + path
+}
+
+func (s *GiteaSource) header(token string) http.Header {
+	h := make(http.Header)
+	if token != "" {
+		h.Set("Authorization", "token "+token)
+	}
+	return h
+}
+
+func (s *GiteaSource) get(path string, token string, v interface{}) error {
+	return getJSON(s.httpClient(), s.url(path), s.header(token), v)
+}
+
+func (s *GiteaSource) Identify(token string) (string, error) {
+	var u struct {
+		Login string `json:"login"`
+	}
+	if err := s.get("/user", token, &u); err != nil {
+		return "", err
+	}
+	return u.Login, nil
+}
+
+type giteaActivity struct {
+	OpType  string `json:"op_type"`
+	ActUser struct {
+		Login string `json:"login"`
+	} `json:"act_user"`
+	Repo struct {
+		FullName string `json:"full_name"`
+	} `json:"repo"`
+	// Content is a JSON document. For "commit_repo" activities it
+	// holds the pushed commits.
+	Content string `json:"content"`
+}
+
+func (s *GiteaSource) ListRecentPushes(login string) ([]PushedCommit, error) {
+	var as []giteaActivity
+	path := "/users/" + url.QueryEscape(login) + "/activities/feeds?only-performed-by=true"
+	if err := s.get(path, s.Token, &as); err != nil {
+		return nil, err
+	}
+	var ps []PushedCommit
+	for _, a := range as {
+		if a.OpType != "commit_repo" || a.Content == "" {
+			continue
+		}
+		var content struct {
+			Commits []struct {
+				Sha1 string
+			}
+		}
+		if err := json.Unmarshal([]byte(a.Content), &content); err != nil {
+			return nil, wrapErrorf(err, "error decoding push to %s", a.Repo.FullName)
+		}
+		for _, c := range content.Commits {
+			ps = append(ps, PushedCommit{
+				RepoName: a.Repo.FullName,
+				SHA:      c.Sha1,
+				Pusher:   a.ActUser.Login,
+			})
+		}
+	}
+	return ps, nil
+}
+
+type giteaCommit struct {
+	SHA    string `json:"sha"`
+	Author *struct {
+		Login string `json:"login"`
+	} `json:"author"`
+	Commit struct {
+		Message string `json:"message"`
+		Author  struct {
+			Name  string    `json:"name"`
+			Email string    `json:"email"`
+			Date  time.Time `json:"date"`
+		} `json:"author"`
+	} `json:"commit"`
+	Parents []struct {
+		SHA string `json:"sha"`
+	} `json:"parents"`
+	Stats struct {
+		Additions int `json:"additions"`
+		Deletions int `json:"deletions"`
+	} `json:"stats"`
+	Files []struct {
+		Filename string `json:"filename"`
+		Status   string `json:"status"`
+	} `json:"files"`
+}
+
+func (s *GiteaSource) GetCommit(repoName, sha string) (SourceCommit, error) {
+	owner, repo := SplitRepoName(repoName)
+	base := "/repos/" + url.QueryEscape(owner) + "/" + url.QueryEscape(repo) +
+		"/git/commits/" + url.QueryEscape(sha)
+	var c giteaCommit
+	if err := s.get(base, s.Token, &c); err != nil {
+		return SourceCommit{}, err
+	}
+	// The commit API only lists file names, so get per-file
+	// stats from the diff.
+	body, err := getBody(s.httpClient(), s.url(base+".diff"), s.header(s.Token))
+	if err != nil {
+		return SourceCommit{}, err
+	}
+	diff, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return SourceCommit{}, wrapError(err)
+	}
+	diffs := splitGitDiff(string(diff))
+	sc := SourceCommit{
+		Commit: Commit{
+			SHA:        c.SHA,
+			AuthorDate: c.Commit.Author.Date.UTC(),
+			RepoName:   repoName,
+			Message:    c.Commit.Message,
+			Additions:  c.Stats.Additions,
+			Deletions:  c.Stats.Deletions,
+			Provider:   GiteaProvider,
+		},
+		AuthorName:  c.Commit.Author.Name,
+		AuthorEmail: c.Commit.Author.Email,
+		ParentCount: len(c.Parents),
+	}
+	if c.Author != nil {
+		sc.AuthorLogin = c.Author.Login
+	}
+	for _, f := range c.Files {
+		cf := CommitFile{
+			CommitSHA: c.SHA,
+			Filename:  f.Filename,
+			Status:    f.Status,
+			Patch:     diffs[f.Filename],
+		}
+		cf.Additions, cf.Deletions = diffLineStats(cf.Patch)
+		sc.Files = append(sc.Files, cf)
+	}
+	return sc, nil
+}
+
+func (s *GiteaSource) GetRepoInfo(repoName string) (RepoInfo, error) {
+	owner, repo := SplitRepoName(repoName)
+	var r struct {
+		Fork     bool `json:"fork"`
+		Archived bool `json:"archived"`
+	}
+	if err := s.get("/repos/"+url.QueryEscape(owner)+"/"+url.QueryEscape(repo), s.Token, &r); err != nil {
+		return RepoInfo{}, err
+	}
+	return RepoInfo{Fork: r.Fork, Archived: r.Archived}, nil
+}
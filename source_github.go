@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+// GitHubSource is the CommitSource for a GitHub host.
+type GitHubSource struct {
+	Host *GitHubHost
+	// Transport is used for unauthenticated requests. If it is
+	// nil, the default transport is used. AccountSource uses a
+	// CachingTransport so that unchanged responses don't count
+	// against the rate limit.
+	Transport http.RoundTripper
+	// Reserve is the number of requests to leave in the rate
+	// limit budget for other work. Background jobs set it.
+	Reserve int
+}
+
+func (s *GitHubSource) Provider() string {
+	return s.Host.Provider
+}
+
+func (s *GitHubSource) client() *github.Client {
+	return UnauthedGitHubClient(s.Host, s.Transport, s.Reserve)
+}
+
+func (s *GitHubSource) Identify(token string) (string, error) {
+	client := s.Host.TokenClient(&oauth2.Token{AccessToken: token})
+	u, _, err := client.Users.Get("")
+	if err != nil {
+		return "", wrapError(err)
+	}
+	return *u.Login, nil
+}
+
+func (s *GitHubSource) ListRecentPushes(login string) ([]PushedCommit, error) {
+	client := s.client()
+	// Unchanged events are replayed from the cache, so commits we
+	// already have are skipped by FetchRecentCommits.
+	es, _, err := client.Activity.ListEventsPerformedByUser(login, true, nil)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	var ps []PushedCommit
+	for _, e := range es {
+		if *e.Type != "PushEvent" {
+			continue
+		}
+		for _, pec := range e.Payload().(*github.PushEvent).Commits {
+			ps = append(ps, PushedCommit{
+				RepoName: *e.Repo.Name,
+				SHA:      *pec.SHA,
+				Pusher:   login,
+			})
+		}
+	}
+	return ps, nil
+}
+
+func (s *GitHubSource) GetCommit(repoName, sha string) (SourceCommit, error) {
+	repoUser, repo := SplitRepoName(repoName)
+	c, _, err := s.client().Repositories.GetCommit(repoUser, repo, sha)
+	if err != nil {
+		return SourceCommit{}, wrapError(err)
+	}
+	sc := GitHubSourceCommit(GitHubCommitRepo{RepositoryCommit: *c, RepoName: repoName})
+	sc.Provider = s.Host.Provider
+	return sc, nil
+}
+
+// GitHubCommitRepo associates a RepositoryCommit with a RepoName.
+type GitHubCommitRepo struct {
+	github.RepositoryCommit
+	RepoName string
+}
+
+// GitHubSourceCommit converts c to a SourceCommit.
+func GitHubSourceCommit(c GitHubCommitRepo) SourceCommit {
+	sc := SourceCommit{
+		Commit: Commit{
+			SHA:      *c.SHA,
+			RepoName: c.RepoName,
+			Provider: GitHubProvider,
+		},
+	}
+	if c.Author != nil && c.Author.Login != nil {
+		sc.AuthorLogin = *c.Author.Login
+	}
+	if c.Commit != nil {
+		if c.Commit.Message != nil {
+			sc.Message = *c.Commit.Message
+		}
+		if a := c.Commit.Author; a != nil {
+			if a.Date != nil {
+				sc.AuthorDate = *a.Date
+			}
+			if a.Name != nil {
+				sc.AuthorName = *a.Name
+			}
+			if a.Email != nil {
+				sc.AuthorEmail = *a.Email
+			}
+		}
+	}
+	sc.ParentCount = len(c.Parents)
+	if c.Stats != nil {
+		sc.Additions = *c.Stats.Additions
+		sc.Deletions = *c.Stats.Deletions
+	}
+	for _, f := range c.Files {
+		// For empty files, Patch is nil.
+		if f.Patch == nil {
+			f.Patch = github.String("")
+		}
+		sc.Files = append(sc.Files, CommitFile{
+			CommitSHA: *c.SHA,
+			Filename:  *f.Filename,
+			Status:    *f.Status,
+			Additions: *f.Additions,
+			Deletions: *f.Deletions,
+			Patch:     *f.Patch,
+		})
+	}
+	return sc
+}
+
+// githubPerPage is the page size for listing repos and commits. It
+// is the largest that GitHub allows.
+const githubPerPage = 100
+
+// ListRepos lists login's public repos, including forks and repos
+// owned by organizations login belongs to.
+func (s *GitHubSource) ListRepos(login string) ([]string, error) {
+	opt := &github.RepositoryListOptions{
+		Type:        "all",
+		ListOptions: github.ListOptions{PerPage: githubPerPage},
+	}
+	var names []string
+	for {
+		rs, resp, err := s.client().Repositories.List(login, opt)
+		if err != nil {
+			return nil, wrapErrorf(err, "error listing repos for %s", login)
+		}
+		for _, r := range rs {
+			names = append(names, *r.FullName)
+		}
+		if resp.NextPage == 0 {
+			return names, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (s *GitHubSource) ListAuthoredCommits(repoName, login string, since, until time.Time) ([]string, error) {
+	owner, repo := SplitRepoName(repoName)
+	opt := &github.CommitsListOptions{
+		Author:      login,
+		Since:       since,
+		Until:       until,
+		ListOptions: github.ListOptions{PerPage: githubPerPage},
+	}
+	var shas []string
+	for {
+		cs, resp, err := s.client().Repositories.ListCommits(owner, repo, opt)
+		if err != nil {
+			// Empty repos return 409 Conflict.
+			if resp != nil && resp.StatusCode == http.StatusConflict {
+				return nil, nil
+			}
+			return nil, wrapErrorf(err, "error listing commits in %s", repoName)
+		}
+		for _, c := range cs {
+			shas = append(shas, *c.SHA)
+		}
+		if resp.NextPage == 0 {
+			return shas, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// GetRepoInfo asks GitHub whether repoName is a fork or archived. The
+// repo is fetched directly because our version of go-github predates
+// archived repos.
+func (s *GitHubSource) GetRepoInfo(repoName string) (RepoInfo, error) {
+	owner, repo := SplitRepoName(repoName)
+	client := s.client()
+	req, err := client.NewRequest("GET", "repos/"+url.QueryEscape(owner)+"/"+url.QueryEscape(repo), nil)
+	if err != nil {
+		return RepoInfo{}, wrapError(err)
+	}
+	var r struct {
+		Fork     bool `json:"fork"`
+		Archived bool `json:"archived"`
+	}
+	if _, err := client.Do(req, &r); err != nil {
+		return RepoInfo{}, wrapErrorf(err, "error getting repo %s", repoName)
+	}
+	return RepoInfo{Fork: r.Fork, Archived: r.Archived}, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GitLabSource is the CommitSource for a GitLab instance. It uses
+// version 4 of the GitLab API.
+type GitLabSource struct {
+	// BaseURL is the URL of the GitLab instance, e.g.
+	// "https://gitlab.com".
+	BaseURL string
+	// Token is a personal access token used to read events and
+	// commits. It may be empty for public data.
+	Token string
+	// Client is used to make requests. If it is nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+}
+
+func (s *GitLabSource) Provider() string {
+	return GitLabProvider
+}
+
+func (s *GitLabSource) get(path string, token string, v interface{}) error {
+	return getJSON(s.httpClient(), s.url(path), s.header(token), v)
+}
+
+func (s *GitLabSource) httpClient() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+func (s *GitLabSource) url(path string) string {
+	return strings.TrimSuffix(s.BaseURL, "/") + "/api/v4" + path
+}
+
+func (s *GitLabSource) header(token string) http.Header {
+	h := make(http.Header)
+	if token != "" {
+		h.Set("PRIVATE-TOKEN", token)
+	}
+	return h
+}
+
+func (s *GitLabSource) Identify(token string) (string, error) {
+	var u struct {
+		Username string `json:"username"`
+	}
+	if err := s.get("/user", token, &u); err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
+
+type gitLabPushEvent struct {
+	ProjectID      int    `json:"project_id"`
+	AuthorUsername string `json:"author_username"`
+	PushData       struct {
+		CommitCount int    `json:"commit_count"`
+		CommitTo    string `json:"commit_to"`
+	} `json:"push_data"`
+}
+
+func (s *GitLabSource) ListRecentPushes(login string) ([]PushedCommit, error) {
+	var es []gitLabPushEvent
+	if err := s.get("/users/"+url.QueryEscape(login)+"/events?action=pushed", s.Token, &es); err != nil {
+		return nil, err
+	}
+	// Cache project names, pushes usually go to the same few
+	// projects.
+	projects := make(map[int]string)
+	var ps []PushedCommit
+	for _, e := range es {
+		// Branch deletions and tag pushes have no commits.
+		if e.PushData.CommitCount == 0 || e.PushData.CommitTo == "" {
+			continue
+		}
+		name, ok := projects[e.ProjectID]
+		if !ok {
+			var p struct {
+				PathWithNamespace string `json:"path_with_namespace"`
+			}
+			if err := s.get("/projects/"+strconv.Itoa(e.ProjectID), s.Token, &p); err != nil {
+				return nil, err
+			}
+			name = p.PathWithNamespace
+			projects[e.ProjectID] = name
+		}
+		// Push events only carry the head commit, so list the
+		// commits leading up to it.
+		count := e.PushData.CommitCount
+		if count > 100 {
+			count = 100
+		}
+		var cs []struct {
+			ID string `json:"id"`
+		}
+		path := "/projects/" + strconv.Itoa(e.ProjectID) + "/repository/commits?ref_name=" +
+			url.QueryEscape(e.PushData.CommitTo) + "&per_page=" + strconv.Itoa(count)
+		if err := s.get(path, s.Token, &cs); err != nil {
+			return nil, err
+		}
+		for _, c := range cs {
+			ps = append(ps, PushedCommit{RepoName: name, SHA: c.ID, Pusher: e.AuthorUsername})
+		}
+	}
+	return ps, nil
+}
+
+type gitLabCommit struct {
+	ID           string    `json:"id"`
+	Message      string    `json:"message"`
+	AuthorName   string    `json:"author_name"`
+	AuthorEmail  string    `json:"author_email"`
+	AuthoredDate time.Time `json:"authored_date"`
+	ParentIDs    []string  `json:"parent_ids"`
+	Stats        struct {
+		Additions int `json:"additions"`
+		Deletions int `json:"deletions"`
+	} `json:"stats"`
+}
+
+type gitLabDiff struct {
+	OldPath     string `json:"old_path"`
+	NewPath     string `json:"new_path"`
+	NewFile     bool   `json:"new_file"`
+	RenamedFile bool   `json:"renamed_file"`
+	DeletedFile bool   `json:"deleted_file"`
+	Diff        string `json:"diff"`
+}
+
+// GetCommit fetches a commit from GitLab. GitLab does not link
+// commits to accounts, so AuthorLogin is always empty.
+func (s *GitLabSource) GetCommit(repoName, sha string) (SourceCommit, error) {
+	base := "/projects/" + url.QueryEscape(repoName) + "/repository/commits/" + url.QueryEscape(sha)
+	var c gitLabCommit
+	if err := s.get(base, s.Token, &c); err != nil {
+		return SourceCommit{}, err
+	}
+	var ds []gitLabDiff
+	if err := s.get(base+"/diff", s.Token, &ds); err != nil {
+		return SourceCommit{}, err
+	}
+	sc := SourceCommit{
+		Commit: Commit{
+			SHA:        c.ID,
+			AuthorDate: c.AuthoredDate.UTC(),
+			RepoName:   repoName,
+			Message:    c.Message,
+			Additions:  c.Stats.Additions,
+			Deletions:  c.Stats.Deletions,
+			Provider:   GitLabProvider,
+		},
+		AuthorName:  c.AuthorName,
+		AuthorEmail: c.AuthorEmail,
+		ParentCount: len(c.ParentIDs),
+	}
+	for _, d := range ds {
+		f := CommitFile{
+			CommitSHA: c.ID,
+			Filename:  d.NewPath,
+			Status:    "modified",
+			Patch:     d.Diff,
+		}
+		switch {
+		case d.NewFile:
+			f.Status = "added"
+		case d.DeletedFile:
+			f.Status = "removed"
+		case d.RenamedFile:
+			f.Status = "renamed"
+		}
+		f.Additions, f.Deletions = diffLineStats(d.Diff)
+		sc.Files = append(sc.Files, f)
+	}
+	return sc, nil
+}
+
+func (s *GitLabSource) GetRepoInfo(repoName string) (RepoInfo, error) {
+	var p struct {
+		Archived          bool `json:"archived"`
+		ForkedFromProject *struct {
+			ID int `json:"id"`
+		} `json:"forked_from_project"`
+	}
+	if err := s.get("/projects/"+url.QueryEscape(repoName), s.Token, &p); err != nil {
+		return RepoInfo{}, err
+	}
+	return RepoInfo{Fork: p.ForkedFromProject != nil, Archived: p.Archived}, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/samertm/githubstreaks/conf"
+)
+
+// fakeSourceServer serves the canned responses in routes, keyed by
+// request URI. It fails the test for any other request.
+func fakeSourceServer(t *testing.T, routes map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := routes[r.URL.RequestURI()]
+		if !ok {
+			t.Errorf("Unexpected request %s", r.URL.RequestURI())
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+}
+
+const testSHA = "ffffffffffffffffffffffffffffffffffffffff"
+
+func TestGitHubSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/someone/events/public":
+			fmt.Fprint(w, `[{"type": "WatchEvent", "repo": {"name": "o/r"}},
+{"type": "PushEvent", "repo": {"name": "o/r"}, "payload": {"commits": [{"sha": "`+testSHA+`"}]}}]`)
+		case "/repos/o/r/commits/" + testSHA:
+			fmt.Fprint(w, `{"sha": "`+testSHA+`", "author": {"login": "someone"},
+"commit": {"message": "Fix it", "author": {"name": "Some One", "email": "some@one.com", "date": "2015-06-01T12:00:00Z"}},
+"stats": {"additions": 2, "deletions": 1},
+"files": [{"filename": "main.go", "status": "modified", "additions": 2, "deletions": 1, "patch": "@@"}]}`)
+		default:
+			t.Errorf("Unexpected request %s", r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	host, err := newGitHubHost("ghe", conf.GitHubHost{WebURL: srv.URL, APIURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &GitHubSource{Host: host}
+	ps, err := src.ListRecentPushes("someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].RepoName != "o/r" || ps[0].SHA != testSHA {
+		t.Fatalf("Got pushes %+v, wanted one push to o/r", ps)
+	}
+	c, err := src.GetCommit(ps[0].RepoName, ps[0].SHA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AuthorLogin != "someone" || c.AuthorEmail != "some@one.com" {
+		t.Errorf("Got author %s <%s>, wanted someone <some@one.com>", c.AuthorLogin, c.AuthorEmail)
+	}
+	if c.Additions != 2 || c.Deletions != 1 || len(c.Files) != 1 {
+		t.Errorf("Got +%d/-%d in %d files, wanted +2/-1 in 1 file", c.Additions, c.Deletions, len(c.Files))
+	}
+	if c.Provider != "ghe" {
+		t.Errorf("Got provider %s, wanted ghe", c.Provider)
+	}
+}
+
+func TestGitLabSource(t *testing.T) {
+	srv := fakeSourceServer(t, map[string]string{
+		"/api/v4/user": `{"username": "someone"}`,
+		"/api/v4/users/someone/events?action=pushed": `[
+{"project_id": 7, "author_username": "someone", "push_data": {"commit_count": 1, "commit_to": "` + testSHA + `"}},
+{"project_id": 7, "author_username": "someone", "push_data": {"commit_count": 0, "commit_to": null}}]`,
+		"/api/v4/projects/7": `{"path_with_namespace": "group/project"}`,
+		"/api/v4/projects/7/repository/commits?ref_name=" + testSHA + "&per_page=1": `[{"id": "` + testSHA + `"}]`,
+		"/api/v4/projects/group%2Fproject/repository/commits/" + testSHA: `{"id": "` + testSHA + `",
+"message": "Fix it", "author_name": "Some One", "author_email": "some@one.com",
+"authored_date": "2015-06-01T05:00:00-07:00", "stats": {"additions": 2, "deletions": 1}}`,
+		"/api/v4/projects/group%2Fproject/repository/commits/" + testSHA + "/diff": `[
+{"old_path": "a.go", "new_path": "a.go", "diff": "@@ -1 +1,2 @@\n-old\n+new\n+newer\n"}]`,
+	})
+	defer srv.Close()
+	src := &GitLabSource{BaseURL: srv.URL}
+	login, err := src.Identify("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login != "someone" {
+		t.Errorf("Got login %s, wanted someone", login)
+	}
+	ps, err := src.ListRecentPushes("someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].RepoName != "group/project" || ps[0].Pusher != "someone" {
+		t.Fatalf("Got pushes %+v, wanted one push to group/project by someone", ps)
+	}
+	c, err := src.GetCommit(ps[0].RepoName, ps[0].SHA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2015-06-01 12:00:00 +0000 UTC"; c.AuthorDate.String() != want {
+		t.Errorf("Got author date %s, wanted %s", c.AuthorDate, want)
+	}
+	if len(c.Files) != 1 || c.Files[0].Additions != 2 || c.Files[0].Deletions != 1 {
+		t.Errorf("Got files %+v, wanted a.go with +2/-1", c.Files)
+	}
+	if c.AuthorLogin != "" || c.Provider != GitLabProvider {
+		t.Errorf("Got author login %q on %s, wanted no login on %s", c.AuthorLogin, c.Provider, GitLabProvider)
+	}
+}
+
+func TestGiteaSource(t *testing.T) {
+	srv := fakeSourceServer(t, map[string]string{
+		"/api/v1/user": `{"login": "someone"}`,
+		"/api/v1/users/someone/activities/feeds?only-performed-by=true": `[
+{"op_type": "star_repo", "act_user": {"login": "someone"}, "repo": {"full_name": "o/r"}},
+{"op_type": "commit_repo", "act_user": {"login": "someone"}, "repo": {"full_name": "o/r"},
+ "content": "{\"Commits\": [{\"Sha1\": \"` + testSHA + `\"}]}"}]`,
+		"/api/v1/repos/o/r/git/commits/" + testSHA: `{"sha": "` + testSHA + `",
+"author": {"login": "someone"},
+"commit": {"message": "Fix it", "author": {"name": "Some One", "email": "some@one.com", "date": "2015-06-01T12:00:00Z"}},
+"stats": {"additions": 3, "deletions": 1},
+"files": [{"filename": "a.go", "status": "modified"}, {"filename": "b.go", "status": "added"}]}`,
+		"/api/v1/repos/o/r/git/commits/" + testSHA + ".diff": "diff --git a/a.go b/a.go\n" +
+			"--- a/a.go\n+++ b/a.go\n@@ -1 +1 @@\n-old\n+new\n" +
+			"diff --git a/b.go b/b.go\nnew file mode 100644\n--- /dev/null\n+++ b/b.go\n@@ -0,0 +1,2 @@\n+one\n+two\n",
+	})
+	defer srv.Close()
+	src := &GiteaSource{BaseURL: srv.URL}
+	login, err := src.Identify("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login != "someone" {
+		t.Errorf("Got login %s, wanted someone", login)
+	}
+	ps, err := src.ListRecentPushes("someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].RepoName != "o/r" || ps[0].SHA != testSHA {
+		t.Fatalf("Got pushes %+v, wanted one push to o/r", ps)
+	}
+	c, err := src.GetCommit(ps[0].RepoName, ps[0].SHA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AuthorLogin != "someone" || c.Provider != GiteaProvider {
+		t.Errorf("Got author login %q on %s, wanted someone on %s", c.AuthorLogin, c.Provider, GiteaProvider)
+	}
+	want := map[string][2]int{"a.go": {1, 1}, "b.go": {2, 0}}
+	for _, f := range c.Files {
+		if got := [2]int{f.Additions, f.Deletions}; got != want[f.Filename] {
+			t.Errorf("Got +%d/-%d for %s, wanted +%d/-%d", got[0], got[1], f.Filename, want[f.Filename][0], want[f.Filename][1])
+		}
+	}
+}
+
+func TestCommitRepoID(t *testing.T) {
+	cs := []Commit{
+		{SHA: "1", RepoName: "o/r", Provider: GitHubProvider},
+		{SHA: "2", RepoName: "o/r", Provider: GitLabProvider},
+		{SHA: "3", RepoName: "o/r", Provider: GitHubProvider},
+	}
+	cgs := CommitGroups(cs)
+	if want := 2; len(cgs) != want {
+		t.Fatalf("Got %d commit groups, wanted %d", len(cgs), want)
+	}
+	for _, cg := range cgs {
+		if want := map[string]string{GitHubProvider: "o/r", GitLabProvider: "gitlab:o/r"}[cg.Provider]; cg.RepoID != want {
+			t.Errorf("Got repo id %s, wanted %s", cg.RepoID, want)
+		}
+	}
+}
+
+// TestCommitOwnerWithoutLogin checks that commits from sources that
+// don't link commits to accounts aren't credited to the pusher unless
+// the foreign commit policy says so.
+func TestCommitOwnerWithoutLogin(t *testing.T) {
+	policy := conf.Config.ForeignCommitPolicy
+	defer func() { conf.Config.ForeignCommitPolicy = policy }()
+	a := Account{UID: 1, Provider: GitLabProvider, Login: "someone"}
+	tests := []struct {
+		policy   string
+		c        SourceCommit
+		expected int
+	}{
+		{ForeignCommitsSkip, SourceCommit{AuthorLogin: "someone"}, 1},
+		{ForeignCommitsSkip, SourceCommit{}, 0},
+		{ForeignCommitsAuthor, SourceCommit{}, 0},
+		{ForeignCommitsPusher, SourceCommit{}, 1},
+	}
+	for _, test := range tests {
+		conf.Config.ForeignCommitPolicy = test.policy
+		uid, err := CommitOwner(a, test.c)
+		if err != nil {
+			t.Error(err)
+		}
+		if uid != test.expected {
+			t.Errorf("%s, author %q: got uid %d, expected %d", test.policy, test.c.AuthorLogin, uid, test.expected)
+		}
+	}
+}
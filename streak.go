@@ -0,0 +1,76 @@
+package main
+
+import "time"
+
+// Streaks summarizes a user's runs of consecutive days with commits.
+type Streaks struct {
+	// Current is the length of the streak that ends today, or
+	// yesterday if there are no commits today yet. It is 0 if the
+	// streak is broken.
+	Current int
+	// Longest is the length of the longest streak ever.
+	Longest int
+	// LastCommitDay is the most recent day with commits, or the
+	// zero time if there are no commits.
+	LastCommitDay time.Time
+}
+
+// nextDay returns the beginning of the day after day, which must be
+// the beginning of a day. Days are not always 24 hours long.
+func nextDay(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, day.Location())
+}
+
+// ComputeStreaks computes the streaks in commits, with days in loc,
+// as of now.
+func ComputeStreaks(commits []Commit, loc *time.Location, now time.Time) Streaks {
+	dcgs := DayCommitGroups(commits, loc)
+	if len(dcgs) == 0 {
+		return Streaks{}
+	}
+	s := Streaks{LastCommitDay: dcgs[0].Day, Longest: 1}
+	// first is the length of the streak that ends on the last
+	// commit day.
+	first, run := 1, 1
+	for i := 1; i < len(dcgs); i++ {
+		if nextDay(dcgs[i].Day).Equal(dcgs[i-1].Day) {
+			run++
+			if run == i+1 {
+				first = run
+			}
+		} else {
+			run = 1
+		}
+		if run > s.Longest {
+			s.Longest = run
+		}
+	}
+	today := BeginningOfDay(now.In(loc))
+	if s.LastCommitDay.Equal(today) || nextDay(s.LastCommitDay).Equal(today) {
+		s.Current = first
+	}
+	return s
+}
+
+// StreakOn returns the length of the streak in commits that ends on
+// day, with days in loc. It is 0 if there are no commits on day.
+func StreakOn(commits []Commit, loc *time.Location, day time.Time) int {
+	days := make(map[time.Time]bool)
+	for _, dcg := range DayCommitGroups(commits, loc) {
+		days[dcg.Day] = true
+	}
+	n := 0
+	for d := BeginningOfDay(day.In(loc)); days[d]; d = d.AddDate(0, 0, -1) {
+		n++
+	}
+	return n
+}
+
+// GetUserStreaks returns u's streaks as of now, with days in loc.
+func GetUserStreaks(u User, loc *time.Location, now time.Time) (Streaks, error) {
+	cs, err := GetUserCommits(u, time.Time{})
+	if err != nil {
+		return Streaks{}, wrapError(err)
+	}
+	return ComputeStreaks(cs, loc, now), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeStreaks(t *testing.T) {
+	day := func(d, h int) Commit {
+		return Commit{AuthorDate: time.Date(2015, 8, d, h, 0, 0, 0, time.UTC)}
+	}
+	now := time.Date(2015, 8, 20, 9, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		commits []Commit
+		want    Streaks
+	}{
+		{nil, Streaks{}},
+		// A three day streak ending today, after a longer one.
+		{
+			[]Commit{day(20, 8), day(19, 1), day(19, 2), day(18, 5),
+				day(10, 1), day(11, 1), day(12, 1), day(13, 1)},
+			Streaks{Current: 3, Longest: 4, LastCommitDay: time.Date(2015, 8, 20, 0, 0, 0, 0, time.UTC)},
+		},
+		// No commits today yet, so the streak is still going.
+		{
+			[]Commit{day(19, 1), day(18, 1)},
+			Streaks{Current: 2, Longest: 2, LastCommitDay: time.Date(2015, 8, 19, 0, 0, 0, 0, time.UTC)},
+		},
+		// Broken streak.
+		{
+			[]Commit{day(17, 1), day(16, 1)},
+			Streaks{Current: 0, Longest: 2, LastCommitDay: time.Date(2015, 8, 17, 0, 0, 0, 0, time.UTC)},
+		},
+	} {
+		got := ComputeStreaks(tt.commits, time.UTC, now)
+		if got.Current != tt.want.Current || got.Longest != tt.want.Longest ||
+			!got.LastCommitDay.Equal(tt.want.LastCommitDay) {
+			t.Errorf("ComputeStreaks(%v) = %+v, want %+v", tt.commits, got, tt.want)
+		}
+	}
+}
+
+func TestStreakOn(t *testing.T) {
+	day := func(d int) Commit {
+		return Commit{AuthorDate: time.Date(2015, 8, d, 23, 0, 0, 0, time.UTC)}
+	}
+	cs := []Commit{day(20), day(19), day(18), day(16)}
+	for _, tt := range []struct {
+		day  int
+		want int
+	}{{20, 3}, {19, 2}, {17, 0}, {16, 1}, {21, 0}} {
+		if got := StreakOn(cs, time.UTC, time.Date(2015, 8, tt.day, 0, 0, 0, 0, time.UTC)); got != tt.want {
+			t.Errorf("StreakOn(Aug %d) = %d, want %d", tt.day, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jmoiron/sqlx"
+	"github.com/samertm/githubstreaks/db"
+	"github.com/samertm/githubstreaks/debug"
+)
+
+// webhookClient makes requests to webhooks. They are someone else's
+// servers, so requests time out, and they may not be on internal
+// networks; see dialWebhook.
+var webhookClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: &http.Transport{DialContext: dialWebhook},
+}
+
+// lookupIP resolves webhook hosts. Tests replace it.
+var lookupIP = net.LookupIP
+
+// internalNets are the networks that webhooks may not point into:
+// loopback, private, link-local (including cloud metadata services),
+// shared, unspecified, multicast and broadcast addresses.
+var internalNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"255.255.255.255/32",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseCIDRs(ss ...string) []*net.IPNet {
+	var ns []*net.IPNet
+	for _, s := range ss {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		ns = append(ns, n)
+	}
+	return ns
+}
+
+// internalIP returns true if ip is in one of internalNets.
+func internalIP(ip net.IP) bool {
+	for _, n := range internalNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicIPs resolves host and returns its addresses, or an error if
+// any of them is internal.
+func publicIPs(host string) ([]net.IP, error) {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = lookupIP(host); err != nil {
+			return nil, errors.Errorf("can't resolve webhook host %q", host)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.Errorf("webhook host %q has no addresses", host)
+	}
+	for _, ip := range ips {
+		if internalIP(ip) {
+			return nil, errors.Errorf("webhook host %q is on an internal network", host)
+		}
+	}
+	return ips, nil
+}
+
+// dialWebhook dials addr after checking that its host is public. It
+// dials the checked address, so the host can't resolve to an internal
+// address in between.
+func dialWebhook(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := publicIPs(host)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+}
+
+// postJSON posts v as JSON to url with header. Responses that aren't
+// 2xx are returned as errors. Response bodies are not read, since
+// errors are shown to users.
+func postJSON(client *http.Client, url string, header http.Header, v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return wrapError(err)
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(bs))
+	if err != nil {
+		return wrapError(err)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return wrapError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("POST %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// ValidWebhookURL returns an error if s can't be used as a webhook:
+// it must be an http or https URL whose host resolves only to public
+// addresses. Webhooks are checked again when they are dialed.
+func ValidWebhookURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.Errorf("webhook URL %q must be an http:// or https:// URL", s)
+	}
+	if _, err := publicIPs(u.Hostname()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delivery states.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Delivery is a JSON payload queued for a webhook. Deliveries are
+// posted in the background by RunDeliveries, and retried with
+// backoff if they fail.
+type Delivery struct {
+	DID int `db:"did"`
+	// HookKind and HookID identify the hook the delivery is for,
+	// e.g. "chat" and a ChatHook's HID.
+	HookKind string `db:"hook_kind"`
+	HookID   int    `db:"hook_id"`
+	URL      string `db:"url"`
+	// Body is the JSON payload.
+	Body     string `db:"body"`
+	State    string `db:"state"`
+	Attempts int    `db:"attempts"`
+	// NextAttemptOn is when a pending delivery is tried next.
+	NextAttemptOn time.Time `db:"next_attempt_on"`
+	// Error is why the last attempt failed.
+	Error     string    `db:"error"`
+	CreatedOn time.Time `db:"created_on"`
+	UpdatedOn time.Time `db:"updated_on"`
+}
+
+var deliverySchema = `
+CREATE TABLE IF NOT EXISTS delivery (
+  did serial PRIMARY KEY,
+  hook_kind text NOT NULL,
+  hook_id integer NOT NULL,
+  url text NOT NULL,
+  body text NOT NULL,
+  state text NOT NULL DEFAULT 'pending',
+  attempts integer NOT NULL DEFAULT 0,
+  next_attempt_on timestamp NOT NULL,
+  error text NOT NULL DEFAULT '',
+  created_on timestamp NOT NULL,
+  updated_on timestamp NOT NULL
+)`
+
+// maxDeliveryAttempts is the number of times a delivery is tried
+// before it fails for good.
+const maxDeliveryAttempts = 5
+
+// deliveryBackoff returns how long to wait after a delivery's
+// attempts'th failed attempt.
+func deliveryBackoff(attempts int) time.Duration {
+	return time.Minute << uint(attempts-1)
+}
+
+// EnqueueDelivery queues payload, encoded as JSON, for the webhook at
+// url. ex is db.DB, or a transaction to queue the delivery in.
+func EnqueueDelivery(ex sqlx.Execer, hookKind string, hookID int, url string, payload interface{}) error {
+	bs, err := json.Marshal(payload)
+	if err != nil {
+		return wrapError(err)
+	}
+	b := &db.Binder{}
+	query := `
+INSERT INTO delivery(hook_kind, hook_id, url, body, next_attempt_on, created_on, updated_on)
+  VALUES (` + b.Bind(hookKind, hookID, url, string(bs)) + `, current_timestamp, current_timestamp, current_timestamp)`
+	if _, err := ex.Exec(query, b.Items...); err != nil {
+		return wrapErrorf(err, "error queueing delivery to %s hook %d", hookKind, hookID)
+	}
+	return nil
+}
+
+// claimDelivery returns the oldest pending delivery that is due, and
+// pushes its next attempt back so that other workers leave it alone
+// while it is posted. It returns nil if no delivery is due.
+func claimDelivery() (*Delivery, error) {
+	query := `
+UPDATE delivery SET next_attempt_on = current_timestamp + interval '5 minutes'
+WHERE did = (
+  SELECT did FROM delivery
+  WHERE state = 'pending' AND next_attempt_on <= current_timestamp
+  ORDER BY did ASC LIMIT 1 FOR UPDATE SKIP LOCKED
+) RETURNING *`
+	var d Delivery
+	if err := db.DB.Get(&d, query); err != nil {
+		if strings.Contains(err.Error(), sqlNotFound) {
+			return nil, nil
+		}
+		return nil, wrapError(err)
+	}
+	return &d, nil
+}
+
+// DeliveryAttempt is a logged attempt to post a delivery.
+type DeliveryAttempt struct {
+	DID     int `db:"did"`
+	Attempt int `db:"attempt"`
+	// Error is why the attempt failed, or empty if it succeeded.
+	Error       string    `db:"error"`
+	AttemptedOn time.Time `db:"attempted_on"`
+}
+
+var deliveryAttemptSchema = `
+CREATE TABLE IF NOT EXISTS delivery_attempt (
+  did integer NOT NULL REFERENCES delivery (did) ON DELETE CASCADE,
+  attempt integer NOT NULL,
+  error text NOT NULL,
+  attempted_on timestamp NOT NULL,
+  PRIMARY KEY (did, attempt)
+)`
+
+// deliveryKind customizes how deliveries of a hook kind are posted.
+// Both funcs may be nil.
+type deliveryKind struct {
+	// Header returns the extra headers to post d with. If it
+	// returns an error, d fails for good without being posted.
+	Header func(d Delivery) (http.Header, error)
+	// Finished is called once d is delivered or fails for good.
+	Finished func(d Delivery) error
+}
+
+// deliveryKinds are the customized hook kinds, by Delivery.HookKind.
+var deliveryKinds = make(map[string]deliveryKind)
+
+// postDelivery posts d's body to its URL with header.
+func postDelivery(d Delivery, header http.Header) error {
+	body := json.RawMessage(d.Body)
+	return postJSON(webhookClient, d.URL, header, &body)
+}
+
+// finishAttempt records the result of an attempt to post d, and
+// returns d as updated. If retry is false, a failed attempt fails d
+// for good.
+func finishAttempt(d Delivery, postErr error, retry bool) (Delivery, error) {
+	d.Attempts++
+	d.State, d.Error, d.NextAttemptOn = DeliveryDelivered, "", time.Now()
+	if postErr != nil {
+		d.Error = postErr.Error()
+		if !retry || d.Attempts >= maxDeliveryAttempts {
+			d.State = DeliveryFailed
+		} else {
+			d.State, d.NextAttemptOn = DeliveryPending, d.NextAttemptOn.Add(deliveryBackoff(d.Attempts))
+		}
+	}
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return d, wrapError(err)
+	}
+	b := &db.Binder{}
+	query := `UPDATE delivery SET state = ` + b.Bind(d.State) + `, attempts = ` + b.Bind(d.Attempts) +
+		`, error = ` + b.Bind(d.Error) + `, next_attempt_on = ` + b.Bind(d.NextAttemptOn.UTC()) +
+		`, updated_on = current_timestamp WHERE did = ` + b.Bind(d.DID)
+	if _, err := tx.Exec(query, b.Items...); err != nil {
+		tx.Rollback()
+		return d, wrapErrorf(err, "error saving attempt for delivery %d", d.DID)
+	}
+	b = &db.Binder{}
+	query = `INSERT INTO delivery_attempt(did, attempt, error, attempted_on) VALUES (` +
+		b.Bind(d.DID, d.Attempts, d.Error) + `, current_timestamp)`
+	if _, err := tx.Exec(query, b.Items...); err != nil {
+		tx.Rollback()
+		return d, wrapErrorf(err, "error logging attempt for delivery %d", d.DID)
+	}
+	if err := tx.Commit(); err != nil {
+		return d, wrapError(err)
+	}
+	return d, nil
+}
+
+// attemptDelivery posts d once and records the result.
+func attemptDelivery(d Delivery) error {
+	kind := deliveryKinds[d.HookKind]
+	var header http.Header
+	var err error
+	retry := true
+	if kind.Header != nil {
+		header, err = kind.Header(d)
+		retry = err == nil
+	}
+	if err == nil {
+		err = postDelivery(d, header)
+	}
+	if err != nil {
+		debug.Printf("Delivery %d to %s hook %d failed: %s", d.DID, d.HookKind, d.HookID, err)
+	}
+	if d, err = finishAttempt(d, err, retry); err != nil {
+		return wrapError(err)
+	}
+	if d.State != DeliveryPending && kind.Finished != nil {
+		return kind.Finished(d)
+	}
+	return nil
+}
+
+// RunDeliveries posts due deliveries, checking for new ones every
+// poll. It never returns.
+func RunDeliveries(poll time.Duration) {
+	for {
+		d, err := claimDelivery()
+		if err != nil {
+			debug.Println(err)
+		}
+		if d == nil {
+			time.Sleep(poll)
+			continue
+		}
+		if err := attemptDelivery(*d); err != nil {
+			debug.Println(err)
+		}
+	}
+}
+
+// DeliveryLog is a delivery with its attempts, oldest first.
+type DeliveryLog struct {
+	Delivery
+	Attempts []DeliveryAttempt
+}
+
+// GetDeliveryLogs returns the last limit deliveries to a hook, newest
+// first.
+func GetDeliveryLogs(hookKind string, hookID int, limit int) ([]DeliveryLog, error) {
+	b := &db.Binder{}
+	query := `SELECT * FROM delivery WHERE hook_kind = ` + b.Bind(hookKind) + ` AND hook_id = ` + b.Bind(hookID) +
+		` ORDER BY did DESC LIMIT ` + b.Bind(limit)
+	var ds []Delivery
+	if err := db.DB.Select(&ds, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	if len(ds) == 0 {
+		return nil, nil
+	}
+	b = &db.Binder{}
+	query = `SELECT * FROM delivery_attempt WHERE did >= ` + b.Bind(ds[len(ds)-1].DID) +
+		` AND did IN (SELECT did FROM delivery WHERE hook_kind = ` + b.Bind(hookKind) +
+		` AND hook_id = ` + b.Bind(hookID) + `) ORDER BY did, attempt`
+	var as []DeliveryAttempt
+	if err := db.DB.Select(&as, query, b.Items...); err != nil {
+		return nil, wrapError(err)
+	}
+	byDID := make(map[int][]DeliveryAttempt)
+	for _, a := range as {
+		byDID[a.DID] = append(byDID[a.DID], a)
+	}
+	ls := make([]DeliveryLog, 0, len(ds))
+	for _, d := range ds {
+		ls = append(ls, DeliveryLog{Delivery: d, Attempts: byDID[d.DID]})
+	}
+	return ls, nil
+}
+
+// Redeliver queues a copy of the delivery to a hook with did, and
+// returns the copy's DID. The original is left as it is.
+func Redeliver(hookKind string, hookID int, did int) (int, error) {
+	b := &db.Binder{}
+	query := `
+INSERT INTO delivery(hook_kind, hook_id, url, body, next_attempt_on, created_on, updated_on)
+  SELECT hook_kind, hook_id, url, body, current_timestamp, current_timestamp, current_timestamp
+  FROM delivery WHERE did = ` + b.Bind(did) + ` AND hook_kind = ` + b.Bind(hookKind) +
+		` AND hook_id = ` + b.Bind(hookID) + `
+RETURNING did`
+	var newDID int
+	if err := db.DB.Get(&newDID, query, b.Items...); err != nil {
+		if strings.Contains(err.Error(), sqlNotFound) {
+			return 0, errors.Errorf("no delivery %d to %s hook %d", did, hookKind, hookID)
+		}
+		return 0, wrapError(err)
+	}
+	return newDID, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// allowLoopbackWebhooks lets webhooks reach test servers on loopback
+// until the returned function is called.
+func allowLoopbackWebhooks() func() {
+	c := webhookClient
+	webhookClient = &http.Client{Timeout: c.Timeout}
+	return func() { webhookClient = c }
+}
+
+// fakeLookupIP resolves the hosts in ips, and no others, until the
+// returned function is called.
+func fakeLookupIP(ips map[string]string) func() {
+	lookup := lookupIP
+	lookupIP = func(host string) ([]net.IP, error) {
+		ip, ok := ips[host]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host}
+		}
+		return []net.IP{net.ParseIP(ip)}, nil
+	}
+	return func() { lookupIP = lookup }
+}
+
+func TestPostJSON(t *testing.T) {
+	defer allowLoopbackWebhooks()()
+	var got ReminderPayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Got Content-Type %q", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		if got.Login == "fail" {
+			http.Error(w, "nope", http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	want := ReminderPayload{Type: "streak_at_risk", Login: "samertm", GroupID: 3, Day: "2015-08-20", Streak: 4}
+	if err := postJSON(webhookClient, ts.URL, nil, want); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Got payload %+v, want %+v", got, want)
+	}
+	if err := postJSON(webhookClient, ts.URL, nil, ReminderPayload{Login: "fail"}); err == nil {
+		t.Error("Got no error for a 500 response")
+	}
+}
+
+func TestValidWebhookURL(t *testing.T) {
+	defer fakeLookupIP(map[string]string{
+		"hooks.slack.com": "34.1.2.3",
+		"example.com":     "93.184.216.34",
+		"localhost":       "127.0.0.1",
+		"internal.corp":   "10.1.2.3",
+		"metadata":        "169.254.169.254",
+		"v6.internal":     "fd00::1",
+	})()
+	for _, u := range []string{"https://hooks.slack.com/services/x", "http://example.com:8080/hook", "http://93.184.216.34/hook"} {
+		if err := ValidWebhookURL(u); err != nil {
+			t.Errorf("ValidWebhookURL(%q) = %s", u, err)
+		}
+	}
+	for _, u := range []string{
+		"", "ftp://example.com", "https://", "example.com/hook", "http://unknown.example/hook",
+		"http://localhost:8080/hook", "http://127.0.0.1/hook", "http://internal.corp/hook",
+		"http://metadata/latest/meta-data/", "http://[::1]/hook", "http://v6.internal/hook",
+		"http://0.0.0.0/hook", "http://[::ffff:127.0.0.1]/hook",
+	} {
+		if err := ValidWebhookURL(u); err == nil {
+			t.Errorf("ValidWebhookURL(%q) = nil", u)
+		}
+	}
+}
+
+// TestWebhookClientInternal checks that webhooks can't reach internal
+// addresses even if their URLs were saved when they were public, and
+// that response bodies aren't returned.
+func TestWebhookClientInternal(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "secret", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	err := postJSON(webhookClient, ts.URL, nil, ReminderPayload{})
+	if err == nil {
+		t.Fatal("Got no error posting to loopback")
+	}
+	defer allowLoopbackWebhooks()()
+	err = postJSON(webhookClient, ts.URL, nil, ReminderPayload{})
+	if err == nil {
+		t.Fatal("Got no error for a 500 response")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("Got response body in error %q", err)
+	}
+}
+
+func TestDeliveryBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute} {
+		if got := deliveryBackoff(attempts); got != want {
+			t.Errorf("deliveryBackoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}